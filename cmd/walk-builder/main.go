@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log/slog"
 	"os"
@@ -12,51 +13,79 @@ import (
 	"github.com/maxdollinger/walk.io/internal/vm"
 	"github.com/maxdollinger/walk.io/pkg/fs"
 	"github.com/maxdollinger/walk.io/pkg/oci"
+	"github.com/maxdollinger/walk.io/pkg/utils"
 )
 
 const (
 	WALKIO_BASE = "/var/walkio/"
 	APP_DIR     = WALKIO_BASE + "app"
 	STATE_DIR   = WALKIO_BASE + "state"
+	CACHE_DIR   = WALKIO_BASE + "cache/layers"
+
+	LAYER_CACHE_SIZE = 10 * utils.GB
 )
 
 func main() {
+	clean := flag.Bool("clean", false, "remove the app and state devices built by this run on exit")
+	flag.Parse()
+
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	if err := run(logger, *clean); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func run(logger *slog.Logger, clean bool) error {
 	ctx := context.TODO()
 
 	appID, err := uuid.NewV7()
 	if err != nil {
-		fmt.Println("could not create apID: " + err.Error())
-		os.Exit(1)
+		return fmt.Errorf("could not create apID: %w", err)
 	}
 	logger = logger.With("appID", appID.String())
 
 	imageSource, err := oci.NewRegistryProvider("hello-world:latest")
 	if err != nil {
-		fmt.Printf("Error: %s\n", err)
-		os.Exit(1)
+		return fmt.Errorf("creating image source: %w", err)
 	}
 	logger = logger.With("imageSource", imageSource.Info())
 
+	var built []*builder.BuildResult
+	if clean {
+		defer func() {
+			if err := builder.RemoveBuildArtifacts(built...); err != nil {
+				logger.Error("failed cleanup", "err", err)
+			}
+		}()
+	}
+
+	layerCache, err := oci.NewLayerCache(CACHE_DIR, int64(LAYER_CACHE_SIZE))
+	if err != nil {
+		return err
+	}
+
 	ext4Builder := fs.NewExt4Builder()
 	appResult, err := builder.BuildAppDevice(ctx, imageSource, ext4Builder, &builder.AppFSopts{
-		OutputDir: APP_DIR,
+		OutputDir:  APP_DIR,
+		Progress:   printProgress,
+		LayerCache: layerCache,
 	})
 	if err != nil {
-		fmt.Printf("Building AppFS: %s\n", err)
-		os.Exit(1)
+		return fmt.Errorf("Building AppFS: %w", err)
 	}
+	built = append(built, appResult)
 	logger = logger.With("appDevice", appResult)
 
 	stateResult, err := builder.BuildStateDevice(ctx, ext4Builder, &builder.StateFsOpts{
 		AppID:     appID.String(),
 		OutputDir: STATE_DIR,
-		SizeBytes: 0,
+		Size:      0,
 	})
 	if err != nil {
-		fmt.Printf("Building StateFS: %s\n", err)
-		os.Exit(1)
+		return fmt.Errorf("Building StateFS: %w", err)
 	}
+	built = append(built, stateResult)
 	logger = logger.With("stateDevice", stateResult)
 
 	vmConfig := vm.VMConfig{
@@ -64,16 +93,15 @@ func main() {
 		AppFsPath:   appResult.BlockDevicePath,
 		BaseVersion: "v0.1.1",
 		VCPU:        2,
-		Memory:      256,
+		Memory:      256 * utils.MB,
 		Timeout:     30 * time.Second,
 	}
 
-	machine, err := vm.NewFirecrackerMachine(stateResult.BlockDevicePath, &vmConfig)
-	defer machine.Clean()
+	machine, err := vm.NewMachine(stateResult.BlockDevicePath, &vmConfig)
 	if err != nil {
-		fmt.Printf("Failed to start VM: %s\n", err)
-		os.Exit(1)
+		return fmt.Errorf("Failed to start VM: %w", err)
 	}
+	defer machine.Clean()
 
 	startTime := time.Now()
 	if err := machine.Start(); err != nil {
@@ -95,4 +123,18 @@ func main() {
 	}
 
 	logger.Info("Finished execution", "exec_time", time.Since(startTime).Seconds())
+	return nil
+}
+
+// printProgress keeps a line per layer on stderr, rewritten while the layer is pulled
+func printProgress(event fs.ProgressEvent) {
+	line := fmt.Sprintf("\rlayer %d/%d %s: %dM", event.Layer+1, event.Layers, event.Digest.Encoded()[:12], utils.Bytes(event.Read).MB())
+	if event.Size > 0 {
+		line += fmt.Sprintf(" of %dM", utils.Bytes(event.Size).MB())
+	}
+	if event.Done {
+		line += " done\n"
+	}
+
+	fmt.Fprint(os.Stderr, line)
 }
@@ -6,9 +6,17 @@ import (
 	"os"
 
 	"github.com/maxdollinger/walk.io/internal/db"
+	"github.com/maxdollinger/walk.io/internal/doctor"
 )
 
+// baseVersion is the base bundle the doctor command checks
+const baseVersion = "v0.1.1"
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		os.Exit(runDoctor())
+	}
+
 	walkDB, err := db.NewDB("/var/lib/walkio/walk.db")
 	if err != nil {
 		fmt.Println(err)
@@ -16,8 +24,22 @@ func main() {
 	}
 
 	ctx := context.Background()
-	if err = db.InitSchema(ctx, walkDB); err != nil {
+	if err = db.Migrate(ctx, walkDB); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 }
+
+// runDoctor prints the environment check and returns the exit code
+func runDoctor() int {
+	report := doctor.EnvironmentCheck(baseVersion)
+	if err := report.Print(os.Stdout); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if !report.OK() {
+		return 1
+	}
+
+	return 0
+}
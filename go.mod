@@ -3,16 +3,16 @@ module github.com/maxdollinger/walk.io
 go 1.25.5
 
 require (
+	github.com/coreos/go-iptables v0.8.0
 	github.com/google/uuid v1.6.0
+	github.com/klauspost/compress v1.18.1
 	github.com/mattn/go-sqlite3 v1.14.33
 	github.com/opencontainers/go-digest v1.0.0
+	github.com/vishvananda/netlink v1.2.1-beta.2
+	golang.org/x/sys v0.38.0
 )
 
-require (
-	github.com/coreos/go-iptables v0.8.0 // indirect
-	github.com/vishvananda/netlink v1.2.1-beta.2 // indirect
-	github.com/vishvananda/netns v0.0.0-20200728191858-db3c7e526aae // indirect
-)
+require github.com/vishvananda/netns v0.0.0-20200728191858-db3c7e526aae // indirect
 
 require (
 	github.com/containerd/stargz-snapshotter/estargz v0.18.1 // indirect
@@ -20,11 +20,9 @@ require (
 	github.com/docker/distribution v2.8.3+incompatible // indirect
 	github.com/docker/docker-credential-helpers v0.9.3 // indirect
 	github.com/google/go-containerregistry v0.20.7
-	github.com/klauspost/compress v1.18.1 // indirect
 	github.com/mitchellh/go-homedir v1.1.0 // indirect
 	github.com/opencontainers/image-spec v1.1.1 // indirect
 	github.com/sirupsen/logrus v1.9.3 // indirect
 	github.com/vbatts/tar-split v0.12.2 // indirect
 	golang.org/x/sync v0.18.0 // indirect
-	golang.org/x/sys v0.38.0 // indirect
 )
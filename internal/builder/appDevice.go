@@ -5,27 +5,165 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
+	"maps"
 	"os"
 	"path"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
+	models "github.com/maxdollinger/walk.io/internal/db/models"
 	"github.com/maxdollinger/walk.io/pkg/fs"
+	"github.com/maxdollinger/walk.io/pkg/lock"
 	"github.com/maxdollinger/walk.io/pkg/oci"
+	"github.com/maxdollinger/walk.io/pkg/utils"
+	"github.com/opencontainers/go-digest"
 )
 
 type AppFSopts struct {
-	OutputDir string
+	OutputDir          string
+	ExtractConcurrency int             // layers downloaded in parallel while unpacking (default 1)
+	EnvFile            string          // dotenv file merged over the image env (optional)
+	Env                []string        // per-app env (KEY=VALUE), overrides image and EnvFile env
+	Argv               []string        // per-app argv, replaces ENTRYPOINT and CMD of the image (optional)
+	Locker             lock.Locker     // serializes builds of the same image (default no locking)
+	Publisher          Publisher       // replicates fresh builds before the local publish (default LocalPublisher)
+	Scratch            bool            // allow images without layers, the device then only holds the walkio config
+	Progress           fs.ProgressFunc // reports how far each layer was read (optional)
+	Clock              utils.Clock     // stamps BuildTime, the wanted file and the publish meta (default utils.SystemClock)
+	LayerCache         *oci.LayerCache // serves layers shared with earlier builds from disk (optional)
+	Format             fs.Format       // builds the device with the builder of this format instead of the passed one (default ext4)
 }
 
+// ForApp returns a copy of the options building the AppFS of app: its env is
+// merged over Env and its args, if set, replace Argv
+func (o AppFSopts) ForApp(app *models.App) *AppFSopts {
+	appEnv := make([]string, 0, len(app.Env))
+	for _, key := range slices.Sorted(maps.Keys(app.Env)) {
+		appEnv = append(appEnv, key+"="+app.Env[key])
+	}
+	o.Env = fs.MergeEnv(o.Env, appEnv)
+
+	if len(app.Args) > 0 {
+		o.Argv = app.Args
+	}
+	return &o
+}
+
+// BuildKey returns the key BuildAppDevice caches the AppFS of the image with
+// imageDigest under, e.g. to tell if the env or args of an app changed
+func (o *AppFSopts) BuildKey(imageDigest string) (string, error) {
+	parsed, err := digest.Parse(imageDigest)
+	if err != nil {
+		return "", fmt.Errorf("build key: %w", err)
+	}
+
+	var injectedEnv []string
+	if len(o.EnvFile) > 0 {
+		injectedEnv, err = fs.ReadDotEnvFile(o.EnvFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read env file: %w", err)
+		}
+	}
+
+	return buildKeyOf(parsed.Hex(), fs.MergeEnv(injectedEnv, o.Env), o.Argv), nil
+}
+
+// buildKeyOf returns the digest of the image, the device content depends on the
+// injected env and argv, so a digest of them is appended if set
+func buildKeyOf(digestHex string, injectedEnv, argv []string) string {
+	overrides := strings.Join(injectedEnv, "\n")
+	if len(argv) > 0 {
+		overrides += "\x00" + strings.Join(argv, "\x00")
+	}
+	if len(overrides) == 0 {
+		return digestHex
+	}
+
+	return digestHex + "-" + digest.FromString(overrides).Hex()[:16]
+}
+
+// AppDeviceBuilder builds the AppFS of apps with BuildAppDevice and the options
+// of each app, see AppFSopts.ForApp
+type AppDeviceBuilder struct {
+	Opts          AppFSopts
+	DeviceBuilder fs.BlockDeviceBuilder
+	// ImageSource returns the source of the image of app.Digest
+	ImageSource func(app *models.App) (oci.OciImageSource, error)
+}
+
+// BuildApp returns the AppFS of app, building it if missing
+func (b *AppDeviceBuilder) BuildApp(ctx context.Context, app *models.App) (*BuildResult, error) {
+	imageSource, err := b.ImageSource(app)
+	if err != nil {
+		return nil, fmt.Errorf("image of app %s: %w", app.ID, err)
+	}
+
+	return BuildAppDevice(ctx, imageSource, b.DeviceBuilder, b.Opts.ForApp(app))
+}
+
+// BuildKey returns the key of the AppFS BuildApp builds for app
+func (b *AppDeviceBuilder) BuildKey(app *models.App) (string, error) {
+	return b.Opts.ForApp(app).BuildKey(app.Digest)
+}
+
+// ErrEmptyImage is returned for an image without layers that is not marked as scratch,
+// usually the registry resolved a manifest for the wrong platform
+var ErrEmptyImage = errors.New("image has no layers")
+
+// ErrSuperseded is returned by a build that finished after a newer build of the
+// same AppFS started, the newer build publishes the device. Callers can treat it
+// as success and take the device of the newer build.
+var ErrSuperseded = errors.New("superseded by a newer build")
+
 type BuildResult struct {
-	BlockDevicePath string        // full path to .ext4 file
+	BlockDevicePath string        // full path to the device file, e.g. .ext4
 	BuildTime       time.Duration // time taken to build
+	Size            utils.Bytes   // size of the block device
 	Cached          bool          // true if existing block device was reused
+	RemoteRef       string        // reference returned by the Publisher, empty for cached results
+	ImageDigest     string        // digest of the source image
+	ExposedPorts    []string      // ports the image exposes in OCI format, see vm.ParseExposedPorts
+}
+
+// String describes the result in one line for logs, e.g. "/app/abc.ext4 (512M, cached)"
+func (r *BuildResult) String() string {
+	state := "built in " + r.BuildTime.Round(time.Millisecond).String()
+	if r.Cached {
+		state = "cached"
+	}
+
+	return fmt.Sprintf("%s (%s, %s)", r.BlockDevicePath, r.Size, state)
+}
+
+// LogValue logs the result as a group, empty digest and remote ref are left out
+func (r *BuildResult) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("path", r.BlockDevicePath),
+		slog.String("size", r.Size.String()),
+		slog.Bool("cached", r.Cached),
+		slog.Duration("buildTime", r.BuildTime),
+	}
+	if len(r.ImageDigest) > 0 {
+		attrs = append(attrs, slog.String("digest", r.ImageDigest))
+	}
+	if len(r.RemoteRef) > 0 {
+		attrs = append(attrs, slog.String("remoteRef", r.RemoteRef))
+	}
+
+	return slog.GroupValue(attrs...)
 }
 
 func BuildAppDevice(ctx context.Context, imageSource oci.OciImageSource, deviceBuilder fs.BlockDeviceBuilder, opts *AppFSopts) (*BuildResult, error) {
-	startTime := time.Now()
+	format, deviceBuilder, err := deviceBuilderFor(opts.Format, deviceBuilder)
+	if err != nil {
+		return nil, fmt.Errorf("appfs: %w", err)
+	}
+
+	clock := clockOrSystem(opts.Clock)
+	startTime := clock.Now()
 	buildTimeStamp := startTime.Unix()
 
 	if err := os.MkdirAll(opts.OutputDir, 0o755); err != nil {
@@ -36,57 +174,125 @@ func BuildAppDevice(ctx context.Context, imageSource oci.OciImageSource, deviceB
 	if err != nil {
 		return nil, fmt.Errorf("failed to provide image: %w", err)
 	}
+	if len(image.Layers) == 0 && !image.Scratch && !opts.Scratch {
+		return nil, fmt.Errorf("appfs from image %s: %w, check the platform or build with Scratch", image.Digest, ErrEmptyImage)
+	}
+
+	// image env < env file < per-app env
+	var injectedEnv []string
+	if len(opts.EnvFile) > 0 {
+		injectedEnv, err = fs.ReadDotEnvFile(opts.EnvFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read env file: %w", err)
+		}
+	}
+	injectedEnv = fs.MergeEnv(injectedEnv, opts.Env)
+
+	imageConfig := *image.Config
+	imageConfig.Env = fs.MergeEnv(image.Config.Env, injectedEnv)
+	if len(opts.Argv) > 0 {
+		if err := fs.ValidateArgv(opts.Argv); err != nil {
+			return nil, fmt.Errorf("appfs: %w", err)
+		}
+		imageConfig.Entrypoint, imageConfig.Cmd = opts.Argv, nil
+	}
 
 	digestHex := image.Digest.Hex()
-	outputFilePath := path.Join(opts.OutputDir, digestHex+".ext4")
-	// if a build for exactly this image is present skip
-	if _, err := os.Stat(outputFilePath); err == nil {
+	buildKey := buildKeyOf(digestHex, injectedEnv, opts.Argv)
+	outputFilePath := path.Join(opts.OutputDir, buildKey+format.Extension())
+
+	locker := opts.Locker
+	if locker == nil {
+		locker = lock.NewNoOpLocker()
+	}
+	buildLock, err := locker.AcquireLock(ctx, buildKey)
+	if err != nil {
+		return nil, fmt.Errorf("appfs from image %s: %w", digestHex, err)
+	}
+	defer buildLock.Release()
+
+	// if a build for exactly this image is present skip, a concurrent build may just have published it
+	if info, err := os.Stat(outputFilePath); err == nil {
 		return &BuildResult{
 			BlockDevicePath: outputFilePath,
-			BuildTime:       time.Since(startTime),
+			BuildTime:       clock.Now().Sub(startTime),
+			Size:            utils.Bytes(info.Size()),
 			Cached:          true,
+			ImageDigest:     image.Digest.String(),
+			ExposedPorts:    imageConfig.ExposedPorts,
 		}, nil
 	}
 
 	// build is fresh invoked so set the wanted to this build
-	wantedFile := path.Join(opts.OutputDir, digestHex+".wanted")
+	wantedFile := path.Join(opts.OutputDir, buildKey+".wanted")
 	err = fs.WriteFileAtomic(wantedFile, []byte(strconv.FormatInt(buildTimeStamp, 10)), 0o644)
 	if err != nil {
 		return nil, fmt.Errorf("error writing wanted file: %w", err)
 	}
 
-	tmpDevicePath := path.Join(opts.OutputDir, digestHex+"_tmp.ext4")
-	appDevice, err := deviceBuilder.NewDevice(ctx, fs.BlockDeviceOptions{
-		OutputFilePath: tmpDevicePath,
-		SizeBytes:      image.Manifest.Size * 3,
-		Label:          "APP_FS",
-	})
+	// the rootfs is assembled in a staging dir and copied into the device by mkfs, no mount needed
+	rootfsDir, err := os.MkdirTemp(opts.OutputDir, buildKey+"_tmp_rootfs_*")
 	if err != nil {
 		return nil, fmt.Errorf("appfs from image %s: %w", digestHex, err)
 	}
+	defer os.RemoveAll(rootfsDir)
 
-	mountDir, err := appDevice.Mount()
+	flattener := fs.NewLayerFlattener(fs.WithConcurrency(opts.ExtractConcurrency), fs.WithProgress(opts.Progress))
+	layers := image.Layers
+	if opts.LayerCache != nil {
+		layers = opts.LayerCache.WrapLayers(layers)
+	}
+	err = flattener.Flatten(ctx, layers, rootfsDir)
 	if err != nil {
 		return nil, fmt.Errorf("appfs from image %s: %w", digestHex, err)
 	}
-	defer appDevice.Unmount()
 
-	err = fs.UnpackImage(ctx, image.Layers, mountDir)
+	err = fs.WriteContainerConfig(ctx, &imageConfig, rootfsDir)
 	if err != nil {
 		return nil, fmt.Errorf("appfs from image %s: %w", digestHex, err)
 	}
 
-	err = fs.WriteContainerConfig(ctx, image.Config, mountDir)
+	tmpDevicePath := path.Join(opts.OutputDir, buildKey+"_tmp"+format.Extension())
+	// leftover of a failed or cancelled build, gone after a successful publish
+	defer os.Remove(tmpDevicePath)
+	device, err := deviceBuilder.NewDevice(ctx, fs.BlockDeviceOptions{
+		OutputFilePath: tmpDevicePath,
+		SourceDirPath:  rootfsDir,
+		Label:          fs.AppFSLabel,
+		ReadOnly:       true,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("appfs from image %s: %w", digestHex, err)
 	}
 
-	if !isNewstBuild(wantedFile, buildTimeStamp) {
-		return nil, errors.New("newer build detected not publishing")
+	if !isNewestBuild(wantedFile, buildTimeStamp) {
+		return nil, fmt.Errorf("appfs from image %s: %w, not publishing", digestHex, ErrSuperseded)
+	}
+
+	// the lease may have expired during a long build and another holder builds the
+	// same key now, refreshing notices a takeover since the last heartbeat
+	if err := buildLock.Refresh(); err != nil {
+		return nil, fmt.Errorf("appfs from image %s: %w, not publishing", digestHex, err)
+	}
+
+	// replicate before the local publish, a present device counts as published
+	// and is never handed to the publisher again
+	publisher := opts.Publisher
+	if publisher == nil {
+		publisher = NewLocalPublisher()
+	}
+	remoteRef, err := publisher.Publish(ctx, tmpDevicePath, PublishMeta{
+		BuildKey:    buildKey,
+		FileName:    path.Base(outputFilePath),
+		ImageDigest: image.Digest.String(),
+		Size:        device.Size(),
+		BuiltAt:     startTime,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("appfs from image %s: %w", digestHex, err)
 	}
 
 	// atomic publish of newest build
-	appDevice.Unmount()
 	err = os.Rename(tmpDevicePath, outputFilePath)
 	if err != nil {
 		return nil, fmt.Errorf("appf from image %s: %w", digestHex, err)
@@ -94,12 +300,39 @@ func BuildAppDevice(ctx context.Context, imageSource oci.OciImageSource, deviceB
 
 	return &BuildResult{
 		BlockDevicePath: outputFilePath,
-		BuildTime:       time.Since(startTime),
+		BuildTime:       clock.Now().Sub(startTime),
+		Size:            device.Size(),
 		Cached:          false,
+		RemoteRef:       remoteRef,
+		ImageDigest:     image.Digest.String(),
+		ExposedPorts:    imageConfig.ExposedPorts,
 	}, nil
 }
 
-func isNewstBuild(filePath string, timestamp int64) bool {
+// deviceBuilderFor returns the builder of format, or deviceBuilder for the default ext4 format
+func deviceBuilderFor(format fs.Format, deviceBuilder fs.BlockDeviceBuilder) (fs.Format, fs.BlockDeviceBuilder, error) {
+	if len(format) == 0 {
+		return fs.FormatExt4, deviceBuilder, nil
+	}
+
+	formatBuilder, err := fs.NewBuilderForFormat(format)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return format, formatBuilder, nil
+}
+
+func clockOrSystem(clock utils.Clock) utils.Clock {
+	if clock == nil {
+		return utils.SystemClock
+	}
+	return clock
+}
+
+// isNewestBuild reports whether no build started after timestamp, going by the
+// .wanted file at filePath. An unreadable file doesn't hold the build back.
+func isNewestBuild(filePath string, timestamp int64) bool {
 	data, err := os.ReadFile(filePath)
 	if err != nil {
 		return true
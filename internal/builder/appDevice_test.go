@@ -0,0 +1,400 @@
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	models "github.com/maxdollinger/walk.io/internal/db/models"
+	"github.com/maxdollinger/walk.io/pkg/fs"
+	"github.com/maxdollinger/walk.io/pkg/lock"
+	"github.com/maxdollinger/walk.io/pkg/oci"
+	"github.com/maxdollinger/walk.io/pkg/utils"
+)
+
+func TestBuildAppDeviceCachesResult(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+
+	ctx := context.Background()
+	opts := &AppFSopts{OutputDir: t.TempDir()}
+
+	first, err := BuildAppDevice(ctx, oci.NewNoOpImageProvider(), fs.NewExt4Builder(), opts)
+	if err != nil {
+		t.Fatalf("BuildAppDevice failed: %v", err)
+	}
+	if first.Cached {
+		t.Error("first build reported as cached")
+	}
+	if _, err := os.Stat(first.BlockDevicePath); err != nil {
+		t.Fatalf("block device not published: %v", err)
+	}
+
+	second, err := BuildAppDevice(ctx, oci.NewNoOpImageProvider(), fs.NewExt4Builder(), opts)
+	if err != nil {
+		t.Fatalf("second BuildAppDevice failed: %v", err)
+	}
+	if !second.Cached || second.BlockDevicePath != first.BlockDevicePath {
+		t.Errorf("second build = %+v, want cached %s", second, first.BlockDevicePath)
+	}
+
+	opts.Env = []string{"MODE=test"}
+	withEnv, err := BuildAppDevice(ctx, oci.NewNoOpImageProvider(), fs.NewExt4Builder(), opts)
+	if err != nil {
+		t.Fatalf("BuildAppDevice with env failed: %v", err)
+	}
+	if withEnv.Cached || withEnv.BlockDevicePath == first.BlockDevicePath {
+		t.Errorf("build with injected env reused %s", withEnv.BlockDevicePath)
+	}
+}
+
+func TestBuildAppDeviceConcurrentBuildsShareResult(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+
+	dir := t.TempDir()
+	opts := &AppFSopts{
+		OutputDir: filepath.Join(dir, "app"),
+		Locker:    lock.NewFileLocker(filepath.Join(dir, "locks")),
+	}
+
+	results := make([]*BuildResult, 4)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := BuildAppDevice(context.Background(), oci.NewNoOpImageProvider(), fs.NewExt4Builder(), opts)
+			if err != nil {
+				t.Errorf("BuildAppDevice failed: %v", err)
+				return
+			}
+			results[i] = result
+		}()
+	}
+	wg.Wait()
+
+	fresh := 0
+	for _, result := range results {
+		if result != nil && !result.Cached {
+			fresh++
+		}
+	}
+	if fresh != 1 {
+		t.Errorf("%d fresh builds, want exactly 1", fresh)
+	}
+}
+
+// overtakingBuilder runs overtake before the first device it builds, e.g. a
+// newer build of the same AppFS
+type overtakingBuilder struct {
+	fs.BlockDeviceBuilder
+	overtake func()
+}
+
+func (b *overtakingBuilder) NewDevice(ctx context.Context, opts fs.BlockDeviceOptions) (fs.BlockDevice, error) {
+	if overtake := b.overtake; overtake != nil {
+		b.overtake = nil
+		overtake()
+	}
+	return b.BlockDeviceBuilder.NewDevice(ctx, opts)
+}
+
+func TestBuildAppDeviceSuperseded(t *testing.T) {
+	ctx := context.Background()
+	outputDir := t.TempDir()
+	older := &AppFSopts{OutputDir: outputDir, Clock: utils.FixedClock{T: time.Unix(100, 0)}}
+	newer := &AppFSopts{OutputDir: outputDir, Clock: utils.FixedClock{T: time.Unix(200, 0)}}
+
+	// the newer build starts and publishes while the older one builds its device
+	var winner *BuildResult
+	deviceBuilder := &overtakingBuilder{BlockDeviceBuilder: fs.NewRawTarBuilder()}
+	deviceBuilder.overtake = func() {
+		var err error
+		winner, err = BuildAppDevice(ctx, oci.NewNoOpImageProvider(), deviceBuilder, newer)
+		if err != nil {
+			t.Errorf("newer BuildAppDevice failed: %v", err)
+		}
+	}
+
+	if _, err := BuildAppDevice(ctx, oci.NewNoOpImageProvider(), deviceBuilder, older); !errors.Is(err, ErrSuperseded) {
+		t.Fatalf("older BuildAppDevice error = %v, want %v", err, ErrSuperseded)
+	}
+	if winner == nil || winner.Cached {
+		t.Fatalf("newer build = %+v, want a fresh build", winner)
+	}
+	if _, err := os.Stat(winner.BlockDevicePath); err != nil {
+		t.Errorf("device of the newer build not published: %v", err)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(outputDir, "*_tmp*")); len(leftovers) > 0 {
+		t.Errorf("superseded build left %v behind", leftovers)
+	}
+}
+
+func TestBuildAppDeviceLeaseLost(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	lockDir := filepath.Join(dir, "locks")
+	opts := &AppFSopts{OutputDir: filepath.Join(dir, "app"), Locker: lock.NewFileLocker(lockDir)}
+
+	// the build hangs past its lease and another builder takes the lock over
+	var thief lock.Lock
+	deviceBuilder := &overtakingBuilder{BlockDeviceBuilder: fs.NewRawTarBuilder()}
+	deviceBuilder.overtake = func() {
+		lockFiles, _ := filepath.Glob(filepath.Join(lockDir, "*.lock"))
+		if len(lockFiles) != 1 {
+			t.Fatalf("lock files %v, want the one of the build", lockFiles)
+		}
+		expired := fmt.Sprintf("%d\n%d\n", os.Getpid(), time.Now().Add(-time.Second).UnixNano())
+		if err := os.WriteFile(lockFiles[0], []byte(expired), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		key := strings.TrimSuffix(filepath.Base(lockFiles[0]), ".lock")
+		acquireCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		var err error
+		thief, err = lock.NewFileLocker(lockDir).AcquireLock(acquireCtx, key)
+		if err != nil {
+			t.Fatalf("second locker did not take the expired lease over: %v", err)
+		}
+	}
+
+	if _, err := BuildAppDevice(ctx, oci.NewNoOpImageProvider(), deviceBuilder, opts); !errors.Is(err, lock.ErrLeaseLost) {
+		t.Fatalf("BuildAppDevice error = %v, want %v", err, lock.ErrLeaseLost)
+	}
+	if thief != nil {
+		defer thief.Release()
+	}
+	if published, _ := filepath.Glob(filepath.Join(opts.OutputDir, "*"+fs.FormatExt4.Extension())); len(published) > 0 {
+		t.Errorf("build without lease published %v", published)
+	}
+}
+
+// emptyImageSource serves the NoOp image as a real image, without the scratch marker
+type emptyImageSource struct {
+	oci.NoOpImageProvider
+}
+
+func (s *emptyImageSource) GetImage(ctx context.Context) (*oci.Image, error) {
+	image, err := s.NoOpImageProvider.GetImage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	image.Scratch = false
+	return image, nil
+}
+
+func TestBuildAppDeviceRejectsEmptyImage(t *testing.T) {
+	opts := &AppFSopts{OutputDir: t.TempDir()}
+
+	_, err := BuildAppDevice(context.Background(), &emptyImageSource{}, fs.NewExt4Builder(), opts)
+	if !errors.Is(err, ErrEmptyImage) {
+		t.Fatalf("BuildAppDevice error = %v, want %v", err, ErrEmptyImage)
+	}
+
+	entries, err := os.ReadDir(opts.OutputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("rejected build left %d files in the output dir", len(entries))
+	}
+}
+
+func TestBuildAppDeviceScratchAllowsEmptyImage(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+
+	opts := &AppFSopts{OutputDir: t.TempDir(), Scratch: true}
+
+	result, err := BuildAppDevice(context.Background(), &emptyImageSource{}, fs.NewExt4Builder(), opts)
+	if err != nil {
+		t.Fatalf("BuildAppDevice with Scratch failed: %v", err)
+	}
+	if _, err := os.Stat(result.BlockDevicePath); err != nil {
+		t.Errorf("block device not published: %v", err)
+	}
+}
+
+func TestBuildResultString(t *testing.T) {
+	result := &BuildResult{
+		BlockDevicePath: "/var/walkio/app/abc.ext4",
+		Size:            64 * utils.MB,
+		Cached:          true,
+		ImageDigest:     "sha256:abc",
+	}
+
+	if got, want := result.String(), "/var/walkio/app/abc.ext4 (64M, cached)"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	var out bytes.Buffer
+	slog.New(slog.NewTextHandler(&out, nil)).Info("built", "appDevice", result)
+	for _, want := range []string{"appDevice.path=/var/walkio/app/abc.ext4", "appDevice.digest=sha256:abc", "appDevice.cached=true"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("log %q is missing %q", out.String(), want)
+		}
+	}
+	if strings.Contains(out.String(), "remoteRef") {
+		t.Errorf("log %q contains the empty remote ref", out.String())
+	}
+}
+
+func TestBuildAppDeviceFormat(t *testing.T) {
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("tar not available")
+	}
+
+	// the passed builder is replaced by the one of the format
+	opts := &AppFSopts{OutputDir: t.TempDir(), Format: fs.FormatRawTar}
+	result, err := BuildAppDevice(context.Background(), oci.NewNoOpImageProvider(), nil, opts)
+	if err != nil {
+		t.Fatalf("BuildAppDevice failed: %v", err)
+	}
+	if filepath.Ext(result.BlockDevicePath) != ".tar" {
+		t.Errorf("BlockDevicePath = %s, want a .tar device", result.BlockDevicePath)
+	}
+
+	report, err := InspectCache(opts.OutputDir)
+	if err != nil {
+		t.Fatalf("InspectCache failed: %v", err)
+	}
+	if report.Devices != 1 || len(report.CorruptDevices) != 0 {
+		t.Errorf("InspectCache = %+v, want one healthy device", report)
+	}
+}
+
+func TestBuildAppDeviceAppOverrides(t *testing.T) {
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("tar not available")
+	}
+
+	app := &models.App{
+		Env:  map[string]string{"DATABASE_URL": "postgres://db", "MODE": "app"},
+		Args: []string{"/bin/app", "--serve"},
+	}
+	base := AppFSopts{OutputDir: t.TempDir(), Format: fs.FormatRawTar, Env: []string{"MODE=base", "LOG=debug"}}
+	opts := base.ForApp(app)
+
+	result, err := BuildAppDevice(context.Background(), oci.NewNoOpImageProvider(), nil, opts)
+	if err != nil {
+		t.Fatalf("BuildAppDevice failed: %v", err)
+	}
+
+	files := readTarFiles(t, result.BlockDevicePath)
+	if want := "/bin/app\n--serve\n"; files["walkio/argv"] != want {
+		t.Errorf("argv = %q, want %q", files["walkio/argv"], want)
+	}
+	for _, line := range []string{"DATABASE_URL=postgres://db", "MODE=app", "LOG=debug"} {
+		if !strings.Contains(files["walkio/env"], line+"\n") {
+			t.Errorf("env = %q, want %s", files["walkio/env"], line)
+		}
+	}
+
+	// another argv is another device
+	opts.Argv = []string{"/bin/app", "--migrate"}
+	migrate, err := BuildAppDevice(context.Background(), oci.NewNoOpImageProvider(), nil, opts)
+	if err != nil {
+		t.Fatalf("BuildAppDevice failed: %v", err)
+	}
+	if migrate.Cached || migrate.BlockDevicePath == result.BlockDevicePath {
+		t.Errorf("build with another argv reused %s", migrate.BlockDevicePath)
+	}
+
+	opts.Argv = []string{"/bin/app", " "}
+	if _, err := BuildAppDevice(context.Background(), oci.NewNoOpImageProvider(), nil, opts); !errors.Is(err, fs.ErrInvalidArgv) {
+		t.Errorf("BuildAppDevice error = %v, want %v", err, fs.ErrInvalidArgv)
+	}
+}
+
+func TestAppDeviceBuilder(t *testing.T) {
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("tar not available")
+	}
+
+	imageSource := oci.NewNoOpImageProvider()
+	image, err := imageSource.GetImage(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	appBuilder := &AppDeviceBuilder{
+		Opts:        AppFSopts{OutputDir: t.TempDir(), Format: fs.FormatRawTar},
+		ImageSource: func(*models.App) (oci.OciImageSource, error) { return imageSource, nil },
+	}
+	app := &models.App{ID: "app-1", Digest: image.Digest.String(), Env: map[string]string{"MODE": "prod"}}
+
+	result, err := appBuilder.BuildApp(context.Background(), app)
+	if err != nil {
+		t.Fatalf("BuildApp failed: %v", err)
+	}
+	if files := readTarFiles(t, result.BlockDevicePath); !strings.Contains(files["walkio/env"], "MODE=prod\n") {
+		t.Errorf("env = %q, want the env of the app", files["walkio/env"])
+	}
+
+	buildKey, err := appBuilder.BuildKey(app)
+	if err != nil {
+		t.Fatalf("BuildKey failed: %v", err)
+	}
+	if want := buildKey + fs.FormatRawTar.Extension(); filepath.Base(result.BlockDevicePath) != want {
+		t.Errorf("device %s, want it cached under the build key %s", result.BlockDevicePath, want)
+	}
+
+	app.Env["MODE"] = "dev"
+	if changed, _ := appBuilder.BuildKey(app); changed == buildKey {
+		t.Error("build key unchanged after the env of the app changed")
+	}
+}
+
+// readTarFiles returns the regular files of a tar archive by path
+func readTarFiles(t *testing.T, tarPath string) map[string]string {
+	t.Helper()
+
+	file, err := os.Open(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	files := make(map[string]string)
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatalf("read %s: %v", tarPath, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[strings.TrimPrefix(header.Name, "./")] = string(data)
+	}
+}
+
+func TestBuildAppDeviceUnsupportedFormat(t *testing.T) {
+	opts := &AppFSopts{OutputDir: t.TempDir(), Format: "btrfs"}
+	_, err := BuildAppDevice(context.Background(), oci.NewNoOpImageProvider(), fs.NewExt4Builder(), opts)
+	if !errors.Is(err, fs.ErrUnsupportedFormat) {
+		t.Errorf("BuildAppDevice error = %v, want %v", err, fs.ErrUnsupportedFormat)
+	}
+}
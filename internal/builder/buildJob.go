@@ -0,0 +1,118 @@
+package builder
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	models "github.com/maxdollinger/walk.io/internal/db/models"
+)
+
+var ErrBuildCancelled = errors.New("build job cancelled")
+
+// cancelPollInterval is how often a running job checks its cancel_requested flag
+var cancelPollInterval = time.Second
+
+// BuildFunc runs the actual build, it has to stop and clean up when ctx is cancelled
+type BuildFunc func(ctx context.Context) (*BuildResult, error)
+
+// workerPollInterval is how long an idle worker waits before looking for a queued job again
+var workerPollInterval = 2 * time.Second
+
+// RunBuildJob runs build for the queued job jobID and records the outcome.
+// While the build runs the job row is polled, a cancel request cancels the
+// build context and the job ends up cancelled with ErrBuildCancelled returned.
+// A build interrupted by cancelling ctx is queued again instead of failed.
+func RunBuildJob(ctx context.Context, walkDB *sql.DB, jobID string, build BuildFunc) (*BuildResult, error) {
+	if err := models.StartBuildJob(ctx, walkDB, jobID); err != nil {
+		return nil, fmt.Errorf("start build job %s: %w", jobID, err)
+	}
+
+	return runStartedJob(ctx, walkDB, jobID, build)
+}
+
+// RunBuildWorker consumes the build queue until ctx is cancelled. Jobs are
+// claimed one at a time, newBuild returns the build for a claimed job. A failed
+// build only fails its job, the worker moves on to the next one. The job in
+// flight when ctx is cancelled is queued again for the next worker.
+func RunBuildWorker(ctx context.Context, walkDB *sql.DB, newBuild func(job *models.BuildJob) BuildFunc) error {
+	for {
+		job, err := models.NextQueuedJob(ctx, walkDB)
+		switch {
+		case err == nil:
+			// the outcome is recorded on the job
+			_, _ = runStartedJob(ctx, walkDB, job.ID, newBuild(job))
+			continue
+		case !errors.Is(err, models.ErrNoQueuedJob) && ctx.Err() == nil:
+			return fmt.Errorf("claim build job: %w", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(workerPollInterval):
+		}
+	}
+}
+
+// runStartedJob builds a job that is already running and records the outcome
+func runStartedJob(ctx context.Context, walkDB *sql.DB, jobID string, build BuildFunc) (*BuildResult, error) {
+	buildCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	pollDone := make(chan struct{})
+	go func() {
+		defer close(pollDone)
+		pollCancelRequest(buildCtx, walkDB, jobID, cancel)
+	}()
+
+	result, buildErr := build(buildCtx)
+	cancel(nil)
+	<-pollDone
+
+	// the job outcome is recorded even if the caller context is gone
+	recordCtx := context.WithoutCancel(ctx)
+	var err error
+	switch {
+	case buildErr == nil:
+		err = models.CompleteBuildJob(recordCtx, walkDB, jobID, result.ImageDigest, result.BlockDevicePath)
+	case errors.Is(context.Cause(buildCtx), ErrBuildCancelled):
+		buildErr = fmt.Errorf("%w: %w", ErrBuildCancelled, buildErr)
+		err = models.FinishBuildJob(recordCtx, walkDB, jobID, models.BuildJobCancelled, nil, nil)
+	case ctx.Err() != nil && errors.Is(buildErr, ctx.Err()):
+		// the build was interrupted by a shutdown, not by its own failure
+		err = models.RequeueBuildJob(recordCtx, walkDB, jobID)
+	default:
+		err = models.FailBuildJob(recordCtx, walkDB, jobID, buildErr.Error())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("finish build job %s: %w", jobID, err)
+	}
+
+	if buildErr != nil {
+		return nil, fmt.Errorf("build job %s: %w", jobID, buildErr)
+	}
+
+	return result, nil
+}
+
+func pollCancelRequest(ctx context.Context, walkDB *sql.DB, jobID string, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(cancelPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			requested, err := models.IsBuildJobCancelRequested(ctx, walkDB, jobID)
+			// a failed poll is retried on the next tick
+			if err == nil && requested {
+				cancel(ErrBuildCancelled)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package builder
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/maxdollinger/walk.io/internal/db/dbtest"
+	models "github.com/maxdollinger/walk.io/internal/db/models"
+)
+
+func newBuildJobTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	// build jobs reference their app
+	walkDB := dbtest.NewDB(t)
+	app := &models.App{ID: "app-1", Digest: "sha256:abc", BaseVersion: "v0.1.1"}
+	if err := models.UpsertApp(context.Background(), walkDB, app); err != nil {
+		t.Fatalf("UpsertApp failed: %v", err)
+	}
+
+	return walkDB
+}
+
+func fastCancelPoll(t *testing.T) {
+	t.Helper()
+
+	original := cancelPollInterval
+	cancelPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { cancelPollInterval = original })
+}
+
+func TestRunBuildJobCancelsRunningBuild(t *testing.T) {
+	fastCancelPoll(t)
+	ctx := context.Background()
+	walkDB := newBuildJobTestDB(t)
+
+	job, err := models.InsertBuildJob(ctx, walkDB, "app-1", "nginx:latest")
+	if err != nil {
+		t.Fatalf("InsertBuildJob failed: %v", err)
+	}
+
+	cleanedUp := false
+	started := make(chan struct{})
+	build := func(ctx context.Context) (*BuildResult, error) {
+		close(started)
+		select {
+		case <-ctx.Done():
+			cleanedUp = true
+			return nil, ctx.Err()
+		case <-time.After(5 * time.Second):
+			return &BuildResult{BlockDevicePath: "/never.ext4"}, nil
+		}
+	}
+
+	go func() {
+		<-started
+		if err := models.RequestBuildJobCancel(ctx, walkDB, job.ID); err != nil {
+			t.Errorf("RequestBuildJobCancel failed: %v", err)
+		}
+	}()
+
+	_, err = RunBuildJob(ctx, walkDB, job.ID, build)
+	if !errors.Is(err, ErrBuildCancelled) {
+		t.Fatalf("RunBuildJob error = %v, want %v", err, ErrBuildCancelled)
+	}
+	if !cleanedUp {
+		t.Error("build was not aborted")
+	}
+
+	got, err := models.GetBuildJobByID(ctx, walkDB, job.ID)
+	if err != nil {
+		t.Fatalf("GetBuildJobByID failed: %v", err)
+	}
+	if got.Status != models.BuildJobCancelled || got.CompletedAt == nil {
+		t.Errorf("job = %+v, want cancelled and completed", got)
+	}
+}
+
+func TestRunBuildJobRecordsOutcome(t *testing.T) {
+	fastCancelPoll(t)
+	ctx := context.Background()
+	walkDB := newBuildJobTestDB(t)
+
+	tests := []struct {
+		name       string
+		build      BuildFunc
+		wantStatus string
+		wantErr    bool
+	}{
+		{
+			name: "succeeded",
+			build: func(ctx context.Context) (*BuildResult, error) {
+				return &BuildResult{BlockDevicePath: "/app.ext4", ImageDigest: "sha256:abc"}, nil
+			},
+			wantStatus: models.BuildJobSucceeded,
+		},
+		{
+			name: "failed",
+			build: func(ctx context.Context) (*BuildResult, error) {
+				return nil, errors.New("pull failed")
+			},
+			wantStatus: models.BuildJobFailed,
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job, err := models.InsertBuildJob(ctx, walkDB, "app-1", "nginx:latest")
+			if err != nil {
+				t.Fatalf("InsertBuildJob failed: %v", err)
+			}
+
+			_, err = RunBuildJob(ctx, walkDB, job.ID, tt.build)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RunBuildJob error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			got, err := models.GetBuildJobByID(ctx, walkDB, job.ID)
+			if err != nil {
+				t.Fatalf("GetBuildJobByID failed: %v", err)
+			}
+			if got.Status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", got.Status, tt.wantStatus)
+			}
+			if tt.wantStatus == models.BuildJobSucceeded && (got.Digest == nil || *got.Digest != "sha256:abc") {
+				t.Errorf("digest = %v, want sha256:abc", got.Digest)
+			}
+		})
+	}
+}
+
+func TestRequestBuildJobCancelQueued(t *testing.T) {
+	ctx := context.Background()
+	walkDB := newBuildJobTestDB(t)
+
+	job, err := models.InsertBuildJob(ctx, walkDB, "app-1", "nginx:latest")
+	if err != nil {
+		t.Fatalf("InsertBuildJob failed: %v", err)
+	}
+	if err := models.RequestBuildJobCancel(ctx, walkDB, job.ID); err != nil {
+		t.Fatalf("RequestBuildJobCancel failed: %v", err)
+	}
+
+	queued, err := models.GetQueuedJobs(ctx, walkDB)
+	if err != nil {
+		t.Fatalf("GetQueuedJobs failed: %v", err)
+	}
+	if len(queued) != 0 {
+		t.Errorf("queued jobs = %+v, want none", queued)
+	}
+
+	_, err = RunBuildJob(ctx, walkDB, job.ID, func(ctx context.Context) (*BuildResult, error) {
+		t.Error("cancelled job was built")
+		return nil, nil
+	})
+	if !errors.Is(err, models.ErrBuildJobNotQueued) {
+		t.Errorf("RunBuildJob error = %v, want %v", err, models.ErrBuildJobNotQueued)
+	}
+}
+
+func TestRunBuildWorkerConsumesQueue(t *testing.T) {
+	fastCancelPoll(t)
+	original := workerPollInterval
+	workerPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { workerPollInterval = original })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	walkDB := newBuildJobTestDB(t)
+
+	okJob, err := models.InsertBuildJob(ctx, walkDB, "app-1", "nginx:latest")
+	if err != nil {
+		t.Fatalf("InsertBuildJob failed: %v", err)
+	}
+	badJob, err := models.InsertBuildJob(ctx, walkDB, "app-1", "broken:latest")
+	if err != nil {
+		t.Fatalf("InsertBuildJob failed: %v", err)
+	}
+
+	built := make(chan string, 2)
+	newBuild := func(job *models.BuildJob) BuildFunc {
+		return func(ctx context.Context) (*BuildResult, error) {
+			defer func() { built <- job.ID }()
+			if job.ImageName == "broken:latest" {
+				return nil, errors.New("pull failed")
+			}
+			return &BuildResult{BlockDevicePath: "/app.ext4", ImageDigest: "sha256:abc"}, nil
+		}
+	}
+
+	workerErr := make(chan error, 1)
+	go func() { workerErr <- RunBuildWorker(ctx, walkDB, newBuild) }()
+
+	for range 2 {
+		select {
+		case <-built:
+		case <-time.After(5 * time.Second):
+			t.Fatal("worker did not build the queued jobs")
+		}
+	}
+	cancel()
+	if err := <-workerErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("RunBuildWorker error = %v, want %v", err, context.Canceled)
+	}
+
+	for id, want := range map[string]string{okJob.ID: models.BuildJobSucceeded, badJob.ID: models.BuildJobFailed} {
+		got, err := models.GetBuildJobByID(context.Background(), walkDB, id)
+		if err != nil {
+			t.Fatalf("GetBuildJobByID failed: %v", err)
+		}
+		if got.Status != want {
+			t.Errorf("job %s status = %s, want %s", got.ImageName, got.Status, want)
+		}
+	}
+}
+
+func TestRunBuildWorkerRequeuesOnShutdown(t *testing.T) {
+	fastCancelPoll(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	walkDB := newBuildJobTestDB(t)
+
+	job, err := models.InsertBuildJob(ctx, walkDB, "app-1", "nginx:latest")
+	if err != nil {
+		t.Fatalf("InsertBuildJob failed: %v", err)
+	}
+
+	started := make(chan struct{})
+	newBuild := func(job *models.BuildJob) BuildFunc {
+		return func(ctx context.Context) (*BuildResult, error) {
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+	}
+
+	workerErr := make(chan error, 1)
+	go func() { workerErr <- RunBuildWorker(ctx, walkDB, newBuild) }()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker did not start the queued job")
+	}
+	cancel()
+	if err := <-workerErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("RunBuildWorker error = %v, want %v", err, context.Canceled)
+	}
+
+	got, err := models.GetBuildJobByID(context.Background(), walkDB, job.ID)
+	if err != nil {
+		t.Fatalf("GetBuildJobByID failed: %v", err)
+	}
+	if got.Status != models.BuildJobQueued || got.Error != nil {
+		t.Errorf("job = %+v, want queued again", got)
+	}
+}
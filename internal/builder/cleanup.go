@@ -0,0 +1,132 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/maxdollinger/walk.io/pkg/lock"
+)
+
+const (
+	// orphanGracePeriod protects files of builds that are still running
+	orphanGracePeriod = 10 * time.Minute
+	// wantedMarkerTTL is how long a .wanted marker is kept for concurrent builds to compare against
+	wantedMarkerTTL = 24 * time.Hour
+)
+
+// RemoveBuildArtifacts removes the devices produced by the given builds together
+// with their .wanted markers. Cached results are kept, they were not produced by
+// the build that returned them. Nil results are skipped.
+func RemoveBuildArtifacts(results ...*BuildResult) error {
+	var errs []error
+	for _, result := range results {
+		if result == nil || result.Cached || len(result.BlockDevicePath) == 0 {
+			continue
+		}
+
+		wantedFile := strings.TrimSuffix(result.BlockDevicePath, path.Ext(result.BlockDevicePath)) + ".wanted"
+		for _, filePath := range []string{result.BlockDevicePath, wantedFile} {
+			if err := os.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, fmt.Errorf("removing build artifact: %w", err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// CleanupOrphans removes leftovers of crashed builds from an app output dir:
+// temporary devices and rootfs staging dirs not touched for orphanGracePeriod,
+// whether or not their build got published, and .wanted markers older than wantedMarkerTTL.
+// A leftover is only removed while holding the build lock of its build key
+// (the locker of AppFSopts), builds that still hold it are skipped however old
+// their files are, so it is safe to call at any time. A nil locker relies on the
+// file age alone.
+func CleanupOrphans(ctx context.Context, outputDir string, locker lock.Locker) error {
+	return cleanupOrphans(ctx, outputDir, locker, time.Now())
+}
+
+func cleanupOrphans(ctx context.Context, outputDir string, locker lock.Locker, now time.Time) error {
+	if locker == nil {
+		locker = lock.NewNoOpLocker()
+	}
+
+	entries, err := os.ReadDir(outputDir)
+	if err != nil {
+		return fmt.Errorf("cleanup orphans: %w", err)
+	}
+
+	var errs []error
+	for _, entry := range entries {
+		name := entry.Name()
+
+		if !isBuildLeftover(name) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !isOrphan(name, info.ModTime(), now) {
+			continue
+		}
+
+		if err := removeOrphan(ctx, locker, outputDir, name); err != nil {
+			errs = append(errs, fmt.Errorf("cleanup orphans: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// orphanLockTimeout is how long CleanupOrphans waits for the lock of a build before skipping it
+var orphanLockTimeout = 100 * time.Millisecond
+
+// removeOrphan removes the leftover name unless its build still holds the build lock
+func removeOrphan(ctx context.Context, locker lock.Locker, outputDir, name string) error {
+	lockCtx, cancel := context.WithTimeout(ctx, orphanLockTimeout)
+	defer cancel()
+
+	buildLock, err := locker.AcquireLock(lockCtx, leftoverBuildKey(name))
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		// a build is running for the key
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer buildLock.Release()
+
+	return os.RemoveAll(path.Join(outputDir, name))
+}
+
+// leftoverBuildKey returns the build key (the lock key of BuildAppDevice) of a build leftover
+func leftoverBuildKey(name string) string {
+	buildKey, _, _ := strings.Cut(name, "_tmp")
+	return strings.TrimSuffix(buildKey, ".wanted")
+}
+
+// isBuildLeftover reports whether name is a temporary file or marker of a build
+func isBuildLeftover(name string) bool {
+	return strings.Contains(name, "_tmp.") || strings.Contains(name, "_tmp_rootfs_") || strings.HasSuffix(name, ".wanted")
+}
+
+// isOrphan reports whether the build leftover name is old enough to be removed
+func isOrphan(name string, modTime, now time.Time) bool {
+	maxAge := orphanGracePeriod
+	if strings.HasSuffix(name, ".wanted") {
+		maxAge = wantedMarkerTTL
+	}
+
+	return now.Sub(modTime) >= maxAge
+}
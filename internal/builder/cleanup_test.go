@@ -0,0 +1,124 @@
+package builder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maxdollinger/walk.io/pkg/lock"
+)
+
+func TestRemoveBuildArtifacts(t *testing.T) {
+	dir := t.TempDir()
+	touch := func(name string) string {
+		t.Helper()
+		filePath := filepath.Join(dir, name)
+		if err := os.WriteFile(filePath, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return filePath
+	}
+
+	appDevice := touch("abc.ext4")
+	appWanted := touch("abc.wanted")
+	stateDevice := touch("app_123.ext4")
+	cachedDevice := touch("cached.ext4")
+	cachedWanted := touch("cached.wanted")
+
+	err := RemoveBuildArtifacts(
+		&BuildResult{BlockDevicePath: appDevice},
+		&BuildResult{BlockDevicePath: stateDevice},
+		&BuildResult{BlockDevicePath: cachedDevice, Cached: true},
+		&BuildResult{BlockDevicePath: filepath.Join(dir, "missing.ext4")},
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("RemoveBuildArtifacts failed: %v", err)
+	}
+
+	for _, removed := range []string{appDevice, appWanted, stateDevice} {
+		if _, err := os.Stat(removed); !os.IsNotExist(err) {
+			t.Errorf("%s still exists", removed)
+		}
+	}
+	for _, kept := range []string{cachedDevice, cachedWanted} {
+		if _, err := os.Stat(kept); err != nil {
+			t.Errorf("cached artifact %s removed: %v", kept, err)
+		}
+	}
+}
+
+func TestCleanupOrphans(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	files := []struct {
+		name    string
+		age     time.Duration
+		removed bool
+	}{
+		{name: "abc_tmp.ext4", age: time.Hour, removed: true},
+		{name: "abc.ext4", age: 48 * time.Hour},
+		{name: "abc.wanted", age: 48 * time.Hour, removed: true},
+		{name: "def_tmp.ext4", age: time.Minute},
+		{name: "def.wanted", age: time.Hour},
+		{name: "def_tmp_rootfs_123", age: time.Hour, removed: true},
+		{name: "app_state.ext4", age: 48 * time.Hour},
+	}
+	for _, f := range files {
+		filePath := filepath.Join(dir, f.name)
+		if err := os.WriteFile(filePath, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		modTime := now.Add(-f.age)
+		if err := os.Chtimes(filePath, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := cleanupOrphans(context.Background(), dir, nil, now); err != nil {
+		t.Fatalf("cleanupOrphans failed: %v", err)
+	}
+
+	for _, f := range files {
+		_, err := os.Stat(filepath.Join(dir, f.name))
+		if removed := os.IsNotExist(err); removed != f.removed {
+			t.Errorf("%s removed = %v, want %v", f.name, removed, f.removed)
+		}
+	}
+}
+
+func TestCleanupOrphansSkipsLockedBuilds(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"running_tmp.ext4", "running_tmp_rootfs_1", "crashed_tmp.ext4"} {
+		filePath := filepath.Join(dir, name)
+		if err := os.WriteFile(filePath, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filePath, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a long running build holds its lock while its files age
+	locker := lock.NewFileLocker(t.TempDir())
+	buildLock, err := locker.AcquireLock(context.Background(), "running")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buildLock.Release()
+
+	if err := CleanupOrphans(context.Background(), dir, locker); err != nil {
+		t.Fatalf("CleanupOrphans failed: %v", err)
+	}
+
+	for name, wantRemoved := range map[string]bool{"running_tmp.ext4": false, "running_tmp_rootfs_1": false, "crashed_tmp.ext4": true} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if removed := os.IsNotExist(err); removed != wantRemoved {
+			t.Errorf("%s removed = %v, want %v", name, removed, wantRemoved)
+		}
+	}
+}
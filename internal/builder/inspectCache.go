@@ -0,0 +1,81 @@
+package builder
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/maxdollinger/walk.io/pkg/fs"
+)
+
+// CacheReport summarizes the health of an AppFS output dir
+type CacheReport struct {
+	Devices        int      // published app devices
+	CorruptDevices []string // published devices without a valid APP_FS superblock
+	OrphanedFiles  int      // build leftovers CleanupOrphans would remove
+	TotalBytes     int64    // disk space allocated by the files in the dir
+}
+
+// InspectCache scans an AppFS output dir and validates the superblock of every published device
+func InspectCache(dir string) (*CacheReport, error) {
+	return inspectCache(dir, time.Now())
+}
+
+func inspectCache(dir string, now time.Time) (*CacheReport, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("inspect cache: %w", err)
+	}
+
+	report := &CacheReport{}
+	for _, entry := range entries {
+		name := entry.Name()
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("inspect cache: %w", err)
+		}
+
+		if !info.IsDir() {
+			report.TotalBytes += allocatedBytes(info)
+		}
+
+		switch {
+		case isBuildLeftover(name):
+			if isOrphan(name, info.ModTime(), now) {
+				report.OrphanedFiles++
+			}
+
+		case isDevice(name) && info.Mode().IsRegular():
+			report.Devices++
+			// squashfs carries no label and raw-tar devices no filesystem
+			if format, _ := fs.FormatOf(name); format != fs.FormatExt4 && format != fs.FormatXFS {
+				continue
+			}
+			_, label, err := fs.ReadLabel(path.Join(dir, name))
+			if err != nil || label != fs.AppFSLabel {
+				report.CorruptDevices = append(report.CorruptDevices, name)
+			}
+		}
+	}
+
+	return report, nil
+}
+
+func isDevice(name string) bool {
+	_, ok := fs.FormatOf(name)
+	return ok
+}
+
+// allocatedBytes returns the disk space used by a (possibly sparse) file
+func allocatedBytes(info os.FileInfo) int64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Blocks * 512
+	}
+
+	return info.Size()
+}
@@ -0,0 +1,71 @@
+package builder
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/maxdollinger/walk.io/pkg/fs"
+)
+
+func TestInspectCache(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+
+	dir := t.TempDir()
+	now := time.Now()
+
+	newDevice := func(name, label string) {
+		t.Helper()
+		_, err := fs.NewExt4Builder().NewDevice(context.Background(), fs.BlockDeviceOptions{
+			OutputFilePath: filepath.Join(dir, name),
+			Label:          label,
+		})
+		if err != nil {
+			t.Fatalf("create device %s: %v", name, err)
+		}
+	}
+	writeFile := func(name string, size int, age time.Duration) {
+		t.Helper()
+		filePath := filepath.Join(dir, name)
+		if err := os.WriteFile(filePath, make([]byte, size), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		modTime := now.Add(-age)
+		if err := os.Chtimes(filePath, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	newDevice("valid.ext4", fs.AppFSLabel)
+	newDevice("mislabeled.ext4", "state-0123456789")
+	writeFile("truncated.ext4", 4096, 0)
+	writeFile("old_tmp.ext4", 4096, time.Hour)
+	writeFile("old.wanted", 10, 48*time.Hour)
+	writeFile("running_tmp.ext4", 4096, time.Minute)
+	writeFile("running.wanted", 10, time.Minute)
+
+	report, err := inspectCache(dir, now)
+	if err != nil {
+		t.Fatalf("inspectCache failed: %v", err)
+	}
+
+	if report.Devices != 3 {
+		t.Errorf("Devices = %d, want 3", report.Devices)
+	}
+	slices.Sort(report.CorruptDevices)
+	if want := []string{"mislabeled.ext4", "truncated.ext4"}; !slices.Equal(report.CorruptDevices, want) {
+		t.Errorf("CorruptDevices = %v, want %v", report.CorruptDevices, want)
+	}
+	if report.OrphanedFiles != 2 {
+		t.Errorf("OrphanedFiles = %d, want 2", report.OrphanedFiles)
+	}
+	if report.TotalBytes < 3*4096 {
+		t.Errorf("TotalBytes = %d, want at least the written files", report.TotalBytes)
+	}
+}
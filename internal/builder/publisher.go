@@ -0,0 +1,104 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/maxdollinger/walk.io/pkg/utils"
+)
+
+// PublishMeta describes a built device, remote publishers upload it as a JSON
+// sidecar ({device}.json) next to the device
+type PublishMeta struct {
+	BuildKey    string      `json:"buildKey"`    // file name of the device without .ext4
+	FileName    string      `json:"fileName"`    // name of the device in the output dir, default: base of localPath
+	ImageDigest string      `json:"imageDigest"` // digest of the source image
+	Size        utils.Bytes `json:"size"`
+	BuiltAt     time.Time   `json:"builtAt"`
+}
+
+// Publisher replicates a device before it is atomically published to the output dir,
+// so a failed publish leaves no local device behind and the next build retries it
+type Publisher interface {
+	// Publish makes the device staged at localPath available as meta.FileName
+	// and returns a reference to its copy
+	Publish(ctx context.Context, localPath string, meta PublishMeta) (string, error)
+}
+
+// fileName returns the name the device is published as
+func (m PublishMeta) fileName(localPath string) string {
+	if len(m.FileName) > 0 {
+		return m.FileName
+	}
+	return path.Base(localPath)
+}
+
+// LocalPublisher keeps the device in the output dir only, the default
+type LocalPublisher struct{}
+
+func NewLocalPublisher() *LocalPublisher {
+	return &LocalPublisher{}
+}
+
+// Publish checks the device exists and returns its path in the output dir as reference
+func (p *LocalPublisher) Publish(ctx context.Context, localPath string, meta PublishMeta) (string, error) {
+	if _, err := os.Stat(localPath); err != nil {
+		return "", fmt.Errorf("publish %s: %w", meta.BuildKey, err)
+	}
+
+	return path.Join(path.Dir(localPath), meta.fileName(localPath)), ctx.Err()
+}
+
+// ObjectStore is the subset of an S3-like object storage used by RemotePublisher
+type ObjectStore interface {
+	PutObject(ctx context.Context, key string, body io.Reader, size int64) error
+}
+
+// RemotePublisher uploads the device and its sidecar to an object store below prefix
+type RemotePublisher struct {
+	store  ObjectStore
+	prefix string
+}
+
+func NewRemotePublisher(store ObjectStore, prefix string) *RemotePublisher {
+	return &RemotePublisher{store: store, prefix: prefix}
+}
+
+// Publish uploads the device first and the sidecar last, so a present sidecar
+// marks a complete upload. Returns the object key of the device.
+func (p *RemotePublisher) Publish(ctx context.Context, localPath string, meta PublishMeta) (string, error) {
+	deviceKey := path.Join(p.prefix, meta.fileName(localPath))
+
+	device, err := os.Open(localPath)
+	if err != nil {
+		return "", fmt.Errorf("publish %s: %w", meta.BuildKey, err)
+	}
+	defer device.Close()
+
+	info, err := device.Stat()
+	if err != nil {
+		return "", fmt.Errorf("publish %s: %w", meta.BuildKey, err)
+	}
+
+	if err := p.store.PutObject(ctx, deviceKey, device, info.Size()); err != nil {
+		return "", fmt.Errorf("publish %s: upload device: %w", meta.BuildKey, err)
+	}
+
+	sidecar, err := json.Marshal(meta)
+	if err != nil {
+		return "", fmt.Errorf("publish %s: %w", meta.BuildKey, err)
+	}
+
+	err = p.store.PutObject(ctx, deviceKey+".json", bytes.NewReader(sidecar), int64(len(sidecar)))
+	if err != nil {
+		return "", fmt.Errorf("publish %s: upload sidecar: %w", meta.BuildKey, err)
+	}
+
+	return deviceKey, nil
+}
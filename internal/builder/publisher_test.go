@@ -0,0 +1,238 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maxdollinger/walk.io/pkg/fs"
+	"github.com/maxdollinger/walk.io/pkg/oci"
+	"github.com/maxdollinger/walk.io/pkg/utils"
+)
+
+// fakeObjectStore keeps uploaded objects in memory, failing uploads of failKey
+type fakeObjectStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	order   []string
+	failKey string
+}
+
+func newFakeObjectStore() *fakeObjectStore {
+	return &fakeObjectStore{objects: make(map[string][]byte)}
+}
+
+func (s *fakeObjectStore) PutObject(ctx context.Context, key string, body io.Reader, size int64) error {
+	if key == s.failKey {
+		return errors.New("upload failed")
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != size {
+		return errors.New("size mismatch")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = data
+	s.order = append(s.order, key)
+	return nil
+}
+
+func TestLocalPublisher(t *testing.T) {
+	devicePath := filepath.Join(t.TempDir(), "abc.ext4")
+	if err := os.WriteFile(devicePath, []byte("device"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err := NewLocalPublisher().Publish(context.Background(), devicePath, PublishMeta{BuildKey: "abc"})
+	if err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	if ref != devicePath {
+		t.Errorf("Publish() = %q, want %q", ref, devicePath)
+	}
+
+	// a staged device is referenced by the name it is published as
+	ref, err = NewLocalPublisher().Publish(context.Background(), devicePath, PublishMeta{BuildKey: "abc", FileName: "def.ext4"})
+	if want := filepath.Join(filepath.Dir(devicePath), "def.ext4"); err != nil || ref != want {
+		t.Errorf("Publish() = %q, %v, want %q", ref, err, want)
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing.ext4")
+	if _, err := NewLocalPublisher().Publish(context.Background(), missing, PublishMeta{BuildKey: "missing"}); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Publish of missing device error = %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestRemotePublisherUploadsDeviceAndSidecar(t *testing.T) {
+	devicePath := filepath.Join(t.TempDir(), "abc.ext4")
+	if err := os.WriteFile(devicePath, []byte("device content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	store := newFakeObjectStore()
+	meta := PublishMeta{
+		BuildKey:    "abc",
+		ImageDigest: "sha256:abc",
+		Size:        14,
+		BuiltAt:     time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+
+	ref, err := NewRemotePublisher(store, "walkio/app").Publish(context.Background(), devicePath, meta)
+	if err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	if ref != "walkio/app/abc.ext4" {
+		t.Errorf("Publish() = %q, want %q", ref, "walkio/app/abc.ext4")
+	}
+
+	// the sidecar marks a complete upload, so it goes last
+	wantOrder := []string{"walkio/app/abc.ext4", "walkio/app/abc.ext4.json"}
+	if !slices.Equal(store.order, wantOrder) {
+		t.Errorf("uploads = %v, want %v", store.order, wantOrder)
+	}
+	if !bytes.Equal(store.objects["walkio/app/abc.ext4"], []byte("device content")) {
+		t.Errorf("device object = %q", store.objects["walkio/app/abc.ext4"])
+	}
+
+	var sidecar PublishMeta
+	if err := json.Unmarshal(store.objects["walkio/app/abc.ext4.json"], &sidecar); err != nil {
+		t.Fatalf("sidecar is not valid JSON: %v", err)
+	}
+	if sidecar != meta {
+		t.Errorf("sidecar = %+v, want %+v", sidecar, meta)
+	}
+}
+
+func TestRemotePublisherDeviceUploadFails(t *testing.T) {
+	devicePath := filepath.Join(t.TempDir(), "abc.ext4")
+	if err := os.WriteFile(devicePath, []byte("device"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	store := newFakeObjectStore()
+	store.failKey = "abc.ext4"
+
+	if _, err := NewRemotePublisher(store, "").Publish(context.Background(), devicePath, PublishMeta{BuildKey: "abc"}); err == nil {
+		t.Fatal("Publish succeeded with a failing upload")
+	}
+	if _, ok := store.objects["abc.ext4.json"]; ok {
+		t.Error("sidecar uploaded for an incomplete device upload")
+	}
+}
+
+func TestBuildAppDevicePublishesFreshBuilds(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+
+	ctx := context.Background()
+	store := newFakeObjectStore()
+	opts := &AppFSopts{OutputDir: t.TempDir(), Publisher: NewRemotePublisher(store, "app")}
+
+	result, err := BuildAppDevice(ctx, oci.NewNoOpImageProvider(), fs.NewExt4Builder(), opts)
+	if err != nil {
+		t.Fatalf("BuildAppDevice failed: %v", err)
+	}
+
+	wantRef := "app/" + filepath.Base(result.BlockDevicePath)
+	if result.RemoteRef != wantRef {
+		t.Errorf("RemoteRef = %q, want %q", result.RemoteRef, wantRef)
+	}
+	if _, ok := store.objects[wantRef+".json"]; !ok {
+		t.Errorf("sidecar %s.json not uploaded, got %v", wantRef, store.order)
+	}
+
+	cached, err := BuildAppDevice(ctx, oci.NewNoOpImageProvider(), fs.NewExt4Builder(), opts)
+	if err != nil {
+		t.Fatalf("second BuildAppDevice failed: %v", err)
+	}
+	if !cached.Cached || len(store.order) != 2 {
+		t.Errorf("cached build re-published, uploads = %v", store.order)
+	}
+}
+
+// failFirstUpload fails the first upload, like a flaky object store
+type failFirstUpload struct {
+	*fakeObjectStore
+	failed bool
+}
+
+func (s *failFirstUpload) PutObject(ctx context.Context, key string, body io.Reader, size int64) error {
+	if !s.failed {
+		s.failed = true
+		return errors.New("upload failed")
+	}
+	return s.fakeObjectStore.PutObject(ctx, key, body, size)
+}
+
+func TestBuildAppDeviceRetriesFailedPublish(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+
+	ctx := context.Background()
+	store := newFakeObjectStore()
+	opts := &AppFSopts{OutputDir: t.TempDir(), Publisher: NewRemotePublisher(&failFirstUpload{fakeObjectStore: store}, "app")}
+
+	if _, err := BuildAppDevice(ctx, oci.NewNoOpImageProvider(), fs.NewExt4Builder(), opts); err == nil {
+		t.Fatal("BuildAppDevice succeeded with a failing publish")
+	}
+	if devices, _ := filepath.Glob(filepath.Join(opts.OutputDir, "*.ext4")); len(devices) > 0 {
+		t.Fatalf("devices %v left after the failed publish, the next build would skip publishing", devices)
+	}
+
+	result, err := BuildAppDevice(ctx, oci.NewNoOpImageProvider(), fs.NewExt4Builder(), opts)
+	if err != nil {
+		t.Fatalf("second BuildAppDevice failed: %v", err)
+	}
+	if result.Cached {
+		t.Error("second build was cached, the failed publish was not retried")
+	}
+	if _, ok := store.objects[result.RemoteRef+".json"]; !ok {
+		t.Errorf("sidecar %s.json not uploaded, got %v", result.RemoteRef, store.order)
+	}
+}
+
+func TestBuildAppDeviceFixedClock(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+
+	store := newFakeObjectStore()
+	epoch := time.Unix(0, 0).UTC()
+	opts := &AppFSopts{
+		OutputDir: t.TempDir(),
+		Publisher: NewRemotePublisher(store, ""),
+		Clock:     utils.FixedClock{T: epoch},
+	}
+
+	result, err := BuildAppDevice(context.Background(), oci.NewNoOpImageProvider(), fs.NewExt4Builder(), opts)
+	if err != nil {
+		t.Fatalf("BuildAppDevice failed: %v", err)
+	}
+	if result.BuildTime != 0 {
+		t.Errorf("BuildTime = %v with a fixed clock, want 0", result.BuildTime)
+	}
+
+	var meta PublishMeta
+	if err := json.Unmarshal(store.objects[result.RemoteRef+".json"], &meta); err != nil {
+		t.Fatalf("sidecar is not valid JSON: %v", err)
+	}
+	if !meta.BuiltAt.Equal(epoch) {
+		t.Errorf("BuiltAt = %v, want %v", meta.BuiltAt, epoch)
+	}
+}
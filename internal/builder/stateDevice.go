@@ -2,32 +2,68 @@ package builder
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"path"
-	"time"
+	"path/filepath"
+	"strings"
 
-	"github.com/google/uuid"
 	"github.com/maxdollinger/walk.io/pkg/fs"
+	"github.com/maxdollinger/walk.io/pkg/utils"
+)
+
+// ErrStateFSInUse is returned for state devices held by a running VM or a loop mount
+var ErrStateFSInUse = fs.ErrDeviceInUse
+
+const (
+	// DefaultStateFsSize is used if no size is requested (same as the apps table default)
+	DefaultStateFsSize = 1 * utils.GB
+	// MinStateFsSize is the smallest device mkfs.ext4 can fit a journal into
+	MinStateFsSize = 8 * utils.MB
 )
 
 type StateFsOpts struct {
 	AppID     string
-	SizeBytes int64
+	Size      utils.Bytes // 0 uses DefaultStateFsSize, smaller sizes are raised to MinStateFsSize
 	OutputDir string
+	Clock     utils.Clock // stamps BuildTime and the device ID (default utils.SystemClock)
+	Entropy   io.Reader   // random bits of the device ID (default crypto/rand)
+}
+
+// stateFsSize validates the requested size and applies default and minimum
+func stateFsSize(requested utils.Bytes) (utils.Bytes, error) {
+	switch {
+	case requested < 0:
+		return 0, fmt.Errorf("invalid statefs size %d", requested)
+	case requested == 0:
+		return DefaultStateFsSize, nil
+	default:
+		return max(requested, MinStateFsSize), nil
+	}
 }
 
 func BuildStateDevice(ctx context.Context, blockDeviceBuilder fs.BlockDeviceBuilder, opts *StateFsOpts) (*BuildResult, error) {
-	startTime := time.Now()
+	clock := clockOrSystem(opts.Clock)
+	startTime := clock.Now()
 
-	uuid, err := uuid.NewV7()
+	size, err := stateFsSize(opts.Size)
 	if err != nil {
 		return nil, fmt.Errorf("building statefs for %s: %w", opts.AppID, err)
 	}
 
-	devicePath := path.Join(opts.OutputDir, uuid.String()+".ext4")
-	_, err = blockDeviceBuilder.NewDevice(ctx, fs.BlockDeviceOptions{
-		SizeBytes:      opts.SizeBytes,
+	deviceID, err := utils.NewUUID7At(startTime, opts.Entropy)
+	if err != nil {
+		return nil, fmt.Errorf("building statefs for %s: %w", opts.AppID, err)
+	}
+
+	devicePath := path.Join(opts.OutputDir, opts.AppID+"_"+deviceID+".ext4")
+	device, err := blockDeviceBuilder.NewDevice(ctx, fs.BlockDeviceOptions{
+		Size:           size,
 		OutputFilePath: devicePath,
+		// ext4 labels are limited to 16 bytes, the uuid tail is its random part
+		Label: fs.StateFSLabelPrefix + deviceID[len(deviceID)-10:],
 	})
 	if err != nil {
 		return nil, fmt.Errorf("building statefs for %s: %w", opts.AppID, err)
@@ -35,7 +71,82 @@ func BuildStateDevice(ctx context.Context, blockDeviceBuilder fs.BlockDeviceBuil
 
 	return &BuildResult{
 		BlockDevicePath: devicePath,
-		BuildTime:       time.Since(startTime),
+		BuildTime:       clock.Now().Sub(startTime),
+		Size:            device.Size(),
 		Cached:          false,
 	}, nil
 }
+
+// DeleteStateFSForApp removes all state devices ({appID}_*.ext4) of an app in dir
+// and returns how many were removed. Nothing is removed if any device is still
+// opened by a process (e.g. the firecracker process of a running VM).
+func DeleteStateFSForApp(appID, dir string) (int, error) {
+	if len(appID) == 0 {
+		return 0, errors.New("deleting statefs: empty app id")
+	}
+
+	devicePaths, err := stateDevicePaths(appID, dir)
+	if err != nil {
+		return 0, fmt.Errorf("deleting statefs for %s: %w", appID, err)
+	}
+
+	openFiles, err := fs.OpenFileIDs()
+	if err != nil {
+		return 0, fmt.Errorf("deleting statefs for %s: %w", appID, err)
+	}
+
+	for _, devicePath := range devicePaths {
+		// a jailed VM opens the device through a hard link in its chroot
+		id, err := fs.StatFileID(devicePath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("deleting statefs for %s: %w", appID, err)
+		}
+		if openFiles[id] {
+			return 0, fmt.Errorf("deleting statefs for %s: %w: %s", appID, ErrStateFSInUse, devicePath)
+		}
+	}
+
+	removed := 0
+	for _, devicePath := range devicePaths {
+		if err := os.Remove(devicePath); err != nil && !os.IsNotExist(err) {
+			return removed, fmt.Errorf("deleting statefs for %s: %w", appID, err)
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+// stateDevicePaths returns the absolute paths of the state devices of appID in dir.
+// The name is matched exactly instead of globbed, app IDs may contain glob
+// metacharacters and device IDs never contain '_', so app "a" doesn't match
+// the devices of app "a_b".
+func stateDevicePaths(appID, dir string) ([]string, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(absDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var devicePaths []string
+	for _, entry := range entries {
+		deviceID, ok := strings.CutPrefix(entry.Name(), appID+"_")
+		if !ok {
+			continue
+		}
+		deviceID, ok = strings.CutSuffix(deviceID, ".ext4")
+		if !ok || len(deviceID) == 0 || strings.Contains(deviceID, "_") || !entry.Type().IsRegular() {
+			continue
+		}
+		devicePaths = append(devicePaths, filepath.Join(absDir, entry.Name()))
+	}
+
+	return devicePaths, nil
+}
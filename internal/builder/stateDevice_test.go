@@ -0,0 +1,193 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/maxdollinger/walk.io/pkg/fs"
+	"github.com/maxdollinger/walk.io/pkg/utils"
+)
+
+func createFiles(t *testing.T, dir string, names ...string) {
+	t.Helper()
+
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatalf("create %s: %v", name, err)
+		}
+	}
+}
+
+func TestDeleteStateFSForApp(t *testing.T) {
+	dir := t.TempDir()
+	createFiles(t, dir,
+		"app-a_0001.ext4",
+		"app-a_0002.ext4",
+		"app-b_0001.ext4",
+		"app-ab_0001.ext4",
+		"app-a_b_0001.ext4",
+		"app-a_0003.json",
+	)
+
+	removed, err := DeleteStateFSForApp("app-a", dir)
+	if err != nil {
+		t.Fatalf("DeleteStateFSForApp failed: %v", err)
+	}
+	if removed != 2 {
+		t.Errorf("removed = %d, want 2", removed)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	var remaining []string
+	for _, entry := range entries {
+		remaining = append(remaining, entry.Name())
+	}
+
+	want := []string{"app-a_0003.json", "app-a_b_0001.ext4", "app-ab_0001.ext4", "app-b_0001.ext4"}
+	if !slices.Equal(remaining, want) {
+		t.Errorf("remaining = %v, want %v", remaining, want)
+	}
+}
+
+func TestDeleteStateFSForAppGlobMetacharacters(t *testing.T) {
+	dir := t.TempDir()
+	createFiles(t, dir, "app-a_0001.ext4", "app-*_0001.ext4")
+
+	removed, err := DeleteStateFSForApp("app-*", dir)
+	if err != nil || removed != 1 {
+		t.Fatalf("DeleteStateFSForApp() = %d, %v, want 1 removed", removed, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "app-a_0001.ext4")); err != nil {
+		t.Errorf("device of app-a removed for app-*: %v", err)
+	}
+}
+
+func TestDeleteStateFSForAppInUse(t *testing.T) {
+	dir := t.TempDir()
+	createFiles(t, dir, "app-a_0001.ext4", "app-a_0002.ext4")
+
+	// an open handle stands in for a running VM
+	f, err := os.Open(filepath.Join(dir, "app-a_0002.ext4"))
+	if err != nil {
+		t.Fatalf("open device: %v", err)
+	}
+	defer f.Close()
+
+	removed, err := DeleteStateFSForApp("app-a", dir)
+	if !errors.Is(err, ErrStateFSInUse) {
+		t.Fatalf("DeleteStateFSForApp() error = %v, want ErrStateFSInUse", err)
+	}
+	if removed != 0 {
+		t.Errorf("removed = %d, want 0", removed)
+	}
+
+	for _, name := range []string{"app-a_0001.ext4", "app-a_0002.ext4"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s should not be removed: %v", name, err)
+		}
+	}
+}
+
+func TestBuildStateDeviceZeroSize(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+
+	result, err := BuildStateDevice(context.Background(), fs.NewExt4Builder(), &StateFsOpts{
+		AppID:     "app-a",
+		OutputDir: t.TempDir(),
+		Size:      0,
+	})
+	if err != nil {
+		t.Fatalf("BuildStateDevice failed: %v", err)
+	}
+
+	info, err := os.Stat(result.BlockDevicePath)
+	if err != nil {
+		t.Fatalf("state device not created: %v", err)
+	}
+	if utils.Bytes(info.Size()) != DefaultStateFsSize || result.Size != DefaultStateFsSize {
+		t.Errorf("state device size = %d (result %d), want %d", info.Size(), result.Size, DefaultStateFsSize)
+	}
+
+	// fsck verifies the device holds a valid ext4 filesystem
+	if out, err := exec.Command("e2fsck", "-n", result.BlockDevicePath).CombinedOutput(); err != nil {
+		t.Errorf("state device is not a valid ext4 filesystem: %v\n%s", err, out)
+	}
+}
+
+func TestStateFsSize(t *testing.T) {
+	tests := []struct {
+		requested utils.Bytes
+		want      utils.Bytes
+		wantErr   bool
+	}{
+		{requested: 0, want: DefaultStateFsSize},
+		{requested: utils.KB, want: MinStateFsSize},
+		{requested: 2 * DefaultStateFsSize, want: 2 * DefaultStateFsSize},
+		{requested: -1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := stateFsSize(tt.requested)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("stateFsSize(%d) error = %v, wantErr %v", tt.requested, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("stateFsSize(%d) = %d, want %d", tt.requested, got, tt.want)
+		}
+	}
+}
+
+// stepClock advances by step on every call
+type stepClock struct {
+	now  time.Time
+	step time.Duration
+}
+
+func (c *stepClock) Now() time.Time {
+	now := c.now
+	c.now = c.now.Add(c.step)
+	return now
+}
+
+func TestBuildStateDeviceDeterministic(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+
+	build := func() *BuildResult {
+		t.Helper()
+
+		result, err := BuildStateDevice(context.Background(), fs.NewExt4Builder(), &StateFsOpts{
+			AppID:     "app-a",
+			OutputDir: t.TempDir(),
+			Size:      MinStateFsSize,
+			Clock:     &stepClock{now: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC), step: 3 * time.Second},
+			Entropy:   bytes.NewReader(bytes.Repeat([]byte{0x42}, 16)),
+		})
+		if err != nil {
+			t.Fatalf("BuildStateDevice failed: %v", err)
+		}
+		return result
+	}
+
+	first, second := build(), build()
+	if first.BuildTime != 3*time.Second {
+		t.Errorf("BuildTime = %v, want the 3s clock step", first.BuildTime)
+	}
+	if filepath.Base(first.BlockDevicePath) != filepath.Base(second.BlockDevicePath) {
+		t.Errorf("device IDs differ: %s and %s", first.BlockDevicePath, second.BlockDevicePath)
+	}
+}
@@ -0,0 +1,126 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/maxdollinger/walk.io/pkg/fs"
+)
+
+// snapshotBlockSize is the unit in which restores skip zeroed ranges, the ext4 block size
+const snapshotBlockSize = 4096
+
+// SnapshotStateFS streams a zstd compressed raw image of the state device at
+// path to w. e2image copies only the blocks in use, unused blocks are written
+// as zeros, which compress to almost nothing. The device must not be in use,
+// neither opened by a process (e.g. a running VM) nor loop mounted.
+func SnapshotStateFS(ctx context.Context, path string, w io.Writer) error {
+	if err := fs.CheckDeviceIdle(path); err != nil {
+		return fmt.Errorf("snapshot %s: %w", path, err)
+	}
+
+	encoder, err := zstd.NewWriter(w)
+	if err != nil {
+		return fmt.Errorf("snapshot %s: %w", path, err)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "e2image", "-ra", path, "-")
+	cmd.Stdout = encoder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		_ = encoder.Close()
+		return fmt.Errorf("snapshot %s: e2image: %w: %s", path, err, strings.TrimSpace(stderr.String()))
+	}
+
+	if err := encoder.Close(); err != nil {
+		return fmt.Errorf("snapshot %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// RestoreStateFS writes the snapshot read from r to a state device at path.
+// The device is written next to path and renamed once complete, so an
+// existing device is only replaced by a full restore. Zeroed blocks are left
+// as holes. An existing device must not be in use.
+func RestoreStateFS(ctx context.Context, r io.Reader, path string) error {
+	if _, err := os.Stat(path); err == nil {
+		if err := fs.CheckDeviceIdle(path); err != nil {
+			return fmt.Errorf("restore %s: %w", path, err)
+		}
+	}
+
+	decoder, err := zstd.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("restore %s: %w", path, err)
+	}
+	defer decoder.Close()
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".restore-*")
+	if err != nil {
+		return fmt.Errorf("restore %s: %w", path, err)
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	if err := copySparse(ctx, tmpFile, decoder); err != nil {
+		return fmt.Errorf("restore %s: %w", path, err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return fmt.Errorf("restore %s: %w", path, err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("restore %s: %w", path, err)
+	}
+
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		return fmt.Errorf("restore %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// copySparse copies r to f block by block, seeking over zeroed blocks
+func copySparse(ctx context.Context, f *os.File, r io.Reader) error {
+	block := make([]byte, snapshotBlockSize)
+	zero := make([]byte, snapshotBlockSize)
+
+	var size int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n, err := io.ReadFull(r, block)
+		if n > 0 {
+			if bytes.Equal(block[:n], zero[:n]) {
+				_, seekErr := f.Seek(int64(n), io.SeekCurrent)
+				if seekErr != nil {
+					return seekErr
+				}
+			} else if _, writeErr := f.Write(block[:n]); writeErr != nil {
+				return writeErr
+			}
+			size += int64(n)
+		}
+
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// a trailing hole is only part of the file once the size is set
+	return f.Truncate(size)
+}
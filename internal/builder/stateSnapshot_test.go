@@ -0,0 +1,96 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/maxdollinger/walk.io/pkg/fs"
+	"github.com/maxdollinger/walk.io/pkg/utils"
+)
+
+func TestStateFSSnapshotRoundTrip(t *testing.T) {
+	for _, tool := range []string{"mkfs.ext4", "e2image", "debugfs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not available", tool)
+		}
+	}
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	sourceDir := filepath.Join(dir, "source")
+	if err := os.MkdirAll(filepath.Join(sourceDir, "data"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Repeat("state of the app\n", 1000)
+	if err := os.WriteFile(filepath.Join(sourceDir, "data", "db"), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	device, err := fs.NewExt4Builder().NewDevice(ctx, fs.BlockDeviceOptions{
+		Size:           32 * utils.MB,
+		OutputFilePath: filepath.Join(dir, "state.ext4"),
+		SourceDirPath:  sourceDir,
+		Label:          fs.StateFSLabelPrefix + "test",
+	})
+	if err != nil {
+		t.Fatalf("NewDevice failed: %v", err)
+	}
+
+	var snapshot bytes.Buffer
+	if err := SnapshotStateFS(ctx, device.Path(), &snapshot); err != nil {
+		t.Fatalf("SnapshotStateFS failed: %v", err)
+	}
+	if int64(snapshot.Len()) >= int64(device.Size())/8 {
+		t.Errorf("snapshot of %d bytes is barely compressed", snapshot.Len())
+	}
+
+	restoredPath := filepath.Join(dir, "restored.ext4")
+	if err := RestoreStateFS(ctx, &snapshot, restoredPath); err != nil {
+		t.Fatalf("RestoreStateFS failed: %v", err)
+	}
+
+	info, err := os.Stat(restoredPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(device.Size()) {
+		t.Errorf("restored device has %d bytes, want %d", info.Size(), device.Size())
+	}
+	out, err := exec.Command("debugfs", "-R", "cat /data/db", restoredPath).Output()
+	if err != nil {
+		t.Fatalf("debugfs failed: %v", err)
+	}
+	if string(out) != content {
+		t.Errorf("restored /data/db has %d bytes, want the %d bytes written", len(out), len(content))
+	}
+	if label, err := fs.ReadExt4Label(restoredPath); err != nil || label != fs.StateFSLabelPrefix+"test" {
+		t.Errorf("restored label = %q (err %v)", label, err)
+	}
+}
+
+func TestSnapshotStateFSInUse(t *testing.T) {
+	devicePath := filepath.Join(t.TempDir(), "state.ext4")
+	if err := os.WriteFile(devicePath, []byte("state"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// like a running VM holding the device
+	holder, err := os.Open(devicePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Close()
+
+	if err := SnapshotStateFS(context.Background(), devicePath, &bytes.Buffer{}); !errors.Is(err, ErrStateFSInUse) {
+		t.Errorf("SnapshotStateFS error = %v, want %v", err, ErrStateFSInUse)
+	}
+	if err := RestoreStateFS(context.Background(), &bytes.Buffer{}, devicePath); !errors.Is(err, ErrStateFSInUse) {
+		t.Errorf("RestoreStateFS error = %v, want %v", err, ErrStateFSInUse)
+	}
+}
@@ -0,0 +1,328 @@
+// Package controller converges the running system to the apps defined in the database
+package controller
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/maxdollinger/walk.io/internal/builder"
+	models "github.com/maxdollinger/walk.io/internal/db/models"
+	"github.com/maxdollinger/walk.io/internal/vm"
+	"github.com/maxdollinger/walk.io/pkg/utils"
+)
+
+const (
+	DefaultReconcileInterval = 10 * time.Second
+	DefaultBaseBackoff       = time.Second
+	DefaultMaxBackoff        = 5 * time.Minute
+)
+
+// AppBuilder builds the AppFS device of an app, implemented by *builder.AppDeviceBuilder
+type AppBuilder interface {
+	// BuildApp returns the AppFS of the app's current digest, env and args, building it if missing
+	BuildApp(ctx context.Context, app *models.App) (*builder.BuildResult, error)
+	// BuildKey identifies the AppFS BuildApp returns for app, it changes with the digest, env and args
+	BuildKey(app *models.App) (string, error)
+}
+
+var _ AppBuilder = (*builder.AppDeviceBuilder)(nil)
+
+// Launcher starts crutches, e.g. with vm.NewMachine
+type Launcher interface {
+	// Launch creates and starts a VM of app booting the AppFS at appFsPath
+	Launch(ctx context.Context, app *models.App, appFsPath string) (vm.VMRuntime, error)
+}
+
+// Controller keeps for every app in the database a current AppFS built and
+// App.DesiredCrutches crutches running. Each reconcile builds the AppFS when the
+// app digest, env or args changed, releases crutches that died, releases extra
+// ones, replaces the ones booting an older AppFS and starts missing ones. Apps
+// removed from the database lose all their crutches. An app whose reconcile
+// failed is retried with an exponential backoff, the other apps are not held up by it.
+//
+// Only crutches launched by the controller are managed. Crutches of a previous
+// process are not adopted, models.ReconcileCrutches marks them stopped.
+type Controller struct {
+	db       *sql.DB
+	builder  AppBuilder
+	launcher Launcher
+
+	interval    time.Duration
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	clock       utils.Clock
+	logger      *slog.Logger
+
+	mu   sync.Mutex
+	apps map[string]*appState
+}
+
+// appState is what the controller knows about an app
+type appState struct {
+	builtKey  string // build key of the AppFS, see AppBuilder.BuildKey
+	appFsPath string
+	crutches  []crutch // oldest first
+
+	failures    int
+	nextAttempt time.Time // the app is skipped until then after a failure
+}
+
+// crutch is a VM launched by the controller
+type crutch struct {
+	vm.VMRuntime
+	buildKey string // build key of the AppFS it boots
+}
+
+// Option configures optional settings of a Controller
+type Option func(*Controller)
+
+// WithInterval overrides DefaultReconcileInterval, non-positive values keep the default
+func WithInterval(interval time.Duration) Option {
+	return func(c *Controller) {
+		if interval > 0 {
+			c.interval = interval
+		}
+	}
+}
+
+// WithBackoff sets the wait after the first failed reconcile of an app, it
+// doubles with every further failure up to max. Non-positive values keep the defaults.
+func WithBackoff(base, max time.Duration) Option {
+	return func(c *Controller) {
+		if base > 0 {
+			c.baseBackoff = base
+		}
+		if max > 0 {
+			c.maxBackoff = max
+		}
+	}
+}
+
+// WithClock sets the clock backoffs are measured with, default utils.SystemClock
+func WithClock(clock utils.Clock) Option {
+	return func(c *Controller) {
+		if clock != nil {
+			c.clock = clock
+		}
+	}
+}
+
+// WithLogger sets the logger reconcile actions are reported to, default slog.Default()
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *Controller) {
+		if logger != nil {
+			c.logger = logger
+		}
+	}
+}
+
+func New(walkDB *sql.DB, appBuilder AppBuilder, launcher Launcher, opts ...Option) *Controller {
+	controller := &Controller{
+		db:          walkDB,
+		builder:     appBuilder,
+		launcher:    launcher,
+		interval:    DefaultReconcileInterval,
+		baseBackoff: DefaultBaseBackoff,
+		maxBackoff:  DefaultMaxBackoff,
+		clock:       utils.SystemClock,
+		logger:      slog.Default(),
+		apps:        make(map[string]*appState),
+	}
+	for _, opt := range opts {
+		opt(controller)
+	}
+
+	return controller
+}
+
+// Run reconciles right away and then every interval until ctx is cancelled.
+// Failed reconciles are logged and retried, Run only returns ctx.Err().
+func (c *Controller) Run(ctx context.Context) error {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.Reconcile(ctx); err != nil && ctx.Err() == nil {
+			c.logger.Error("reconcile failed", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Reconcile converges every app once, apps in backoff are skipped.
+// The errors of all failed apps are joined.
+func (c *Controller) Reconcile(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	apps, err := models.ListApps(ctx, c.db)
+	if err != nil {
+		return fmt.Errorf("list apps: %w", err)
+	}
+
+	var errs []error
+	desired := make(map[string]bool, len(apps))
+	for _, app := range apps {
+		desired[app.ID] = true
+
+		state, ok := c.apps[app.ID]
+		if !ok {
+			state = &appState{}
+			c.apps[app.ID] = state
+		}
+		if c.clock.Now().Before(state.nextAttempt) {
+			continue
+		}
+
+		if err := c.reconcileApp(ctx, app, state); err != nil {
+			state.failures++
+			state.nextAttempt = c.clock.Now().Add(c.backoff(state.failures))
+			errs = append(errs, fmt.Errorf("app %s: %w", app.ID, err))
+			continue
+		}
+		state.failures, state.nextAttempt = 0, time.Time{}
+	}
+
+	// apps removed from the database
+	for appID, state := range c.apps {
+		if desired[appID] {
+			continue
+		}
+		if err := c.scaleDown(ctx, appID, state, 0); err != nil {
+			errs = append(errs, fmt.Errorf("app %s: %w", appID, err))
+			continue
+		}
+		delete(c.apps, appID)
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *Controller) reconcileApp(ctx context.Context, app *models.App, state *appState) error {
+	c.pruneDead(ctx, app.ID, state)
+
+	buildKey, err := c.builder.BuildKey(app)
+	if err != nil {
+		return fmt.Errorf("build appfs: %w", err)
+	}
+	if state.builtKey != buildKey {
+		result, err := c.builder.BuildApp(ctx, app)
+		if err != nil {
+			return fmt.Errorf("build appfs: %w", err)
+		}
+		state.builtKey, state.appFsPath = buildKey, result.BlockDevicePath
+		c.logger.Info("appfs ready", "app", app.ID, "device", result)
+	}
+
+	if err := c.scaleDown(ctx, app.ID, state, app.DesiredCrutches); err != nil {
+		return err
+	}
+	if err := c.replaceOutdated(ctx, app, state); err != nil {
+		return err
+	}
+
+	for len(state.crutches) < app.DesiredCrutches {
+		if err := c.startCrutch(ctx, app, state); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// startCrutch launches a crutch booting the current AppFS of the app
+func (c *Controller) startCrutch(ctx context.Context, app *models.App, state *appState) error {
+	launched, err := c.launcher.Launch(ctx, app, state.appFsPath)
+	if err != nil {
+		return fmt.Errorf("start crutch: %w", err)
+	}
+	state.crutches = append(state.crutches, crutch{VMRuntime: launched, buildKey: state.builtKey})
+	c.logger.Info("started crutch", "app", app.ID, "crutch", launched.String())
+
+	return nil
+}
+
+// replaceOutdated rolls the crutches booting an older AppFS over to the current
+// one, oldest first. Each one is released before its replacement starts, so the
+// app never runs more than its desired crutches, e.g. with MaxRunningCrutches
+// at the desired count.
+func (c *Controller) replaceOutdated(ctx context.Context, app *models.App, state *appState) error {
+	for i := 0; i < len(state.crutches); {
+		outdated := state.crutches[i]
+		if outdated.buildKey == state.builtKey {
+			i++
+			continue
+		}
+
+		if err := outdated.Release(ctx); err != nil {
+			return fmt.Errorf("replace crutch %s: %w", outdated.String(), err)
+		}
+		state.crutches = slices.Delete(state.crutches, i, i+1)
+		c.logger.Info("stopped outdated crutch", "app", app.ID, "crutch", outdated.String())
+
+		// the replacement is appended as the newest crutch
+		if err := c.startCrutch(ctx, app, state); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pruneDead releases crutches whose VMM exited, they are replaced by the scale up
+func (c *Controller) pruneDead(ctx context.Context, appID string, state *appState) {
+	alive := state.crutches[:0]
+	for _, crutch := range state.crutches {
+		status, err := crutch.Status()
+		if err == nil && status == vm.VMStatusRunning {
+			alive = append(alive, crutch)
+			continue
+		}
+
+		c.logger.Warn("crutch died", "app", appID, "crutch", crutch.String(), "status", status, "err", err)
+		if err := crutch.Release(ctx); err != nil {
+			c.logger.Error("release dead crutch", "app", appID, "crutch", crutch.String(), "err", err)
+		}
+	}
+	clear(state.crutches[len(alive):])
+	state.crutches = alive
+}
+
+// scaleDown releases the newest crutches until want are left
+func (c *Controller) scaleDown(ctx context.Context, appID string, state *appState, want int) error {
+	for len(state.crutches) > want {
+		last := len(state.crutches) - 1
+		crutch := state.crutches[last]
+		if err := crutch.Release(ctx); err != nil {
+			return fmt.Errorf("stop crutch %s: %w", crutch.String(), err)
+		}
+		state.crutches = state.crutches[:last]
+		c.logger.Info("stopped crutch", "app", appID, "crutch", crutch.String())
+	}
+
+	return nil
+}
+
+// backoff returns the wait after the nth consecutive failure of an app
+func (c *Controller) backoff(failures int) time.Duration {
+	backoff := c.baseBackoff
+	for range failures - 1 {
+		backoff *= 2
+		if backoff >= c.maxBackoff {
+			return c.maxBackoff
+		}
+	}
+
+	return min(backoff, c.maxBackoff)
+}
@@ -0,0 +1,278 @@
+package controller
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/maxdollinger/walk.io/internal/builder"
+	"github.com/maxdollinger/walk.io/internal/db/dbtest"
+	models "github.com/maxdollinger/walk.io/internal/db/models"
+	"github.com/maxdollinger/walk.io/internal/vm"
+)
+
+func upsertApp(t *testing.T, walkDB *sql.DB, id, digest string, desired int) {
+	t.Helper()
+
+	app := &models.App{ID: id, Digest: digest, BaseVersion: "v0.1.1", DesiredCrutches: desired}
+	if err := models.UpsertApp(context.Background(), walkDB, app); err != nil {
+		t.Fatalf("UpsertApp failed: %v", err)
+	}
+}
+
+// fakeBuilder records the digests it built, failing while err is set
+type fakeBuilder struct {
+	built []string
+	err   error
+}
+
+func (b *fakeBuilder) BuildApp(ctx context.Context, app *models.App) (*builder.BuildResult, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	b.built = append(b.built, app.Digest)
+	buildKey, _ := b.BuildKey(app)
+	return &builder.BuildResult{BlockDevicePath: "/app/" + buildKey + ".ext4", ImageDigest: app.Digest}, nil
+}
+
+// BuildKey is the digest, followed by env and args if the app sets them
+func (b *fakeBuilder) BuildKey(app *models.App) (string, error) {
+	if len(app.Env) == 0 && len(app.Args) == 0 {
+		return app.Digest, nil
+	}
+	return fmt.Sprintf("%s-%v-%v", app.Digest, app.Env, app.Args), nil
+}
+
+// fakeCrutch is a VM that runs until it is released or crashes
+type fakeCrutch struct {
+	id       string
+	appFs    string
+	status   vm.VMStatus
+	released bool
+}
+
+func (c *fakeCrutch) Start() error                                       { return nil }
+func (c *fakeCrutch) Stop() error                                        { return nil }
+func (c *fakeCrutch) Status() (vm.VMStatus, error)                       { return c.status, nil }
+func (c *fakeCrutch) Clean() error                                       { return nil }
+func (c *fakeCrutch) TailConsole(ctx context.Context, w io.Writer) error { return nil }
+func (c *fakeCrutch) String() string                                     { return c.id }
+
+func (c *fakeCrutch) Release(ctx context.Context) error {
+	c.released, c.status = true, vm.VMStatusStopped
+	return nil
+}
+
+type fakeLauncher struct {
+	launched   []*fakeCrutch
+	maxRunning int // most crutches running at once
+}
+
+func (l *fakeLauncher) Launch(ctx context.Context, app *models.App, appFsPath string) (vm.VMRuntime, error) {
+	crutch := &fakeCrutch{id: fmt.Sprintf("%s-%d", app.ID, len(l.launched)), appFs: appFsPath, status: vm.VMStatusRunning}
+	l.launched = append(l.launched, crutch)
+	l.maxRunning = max(l.maxRunning, l.running())
+	return crutch, nil
+}
+
+func (l *fakeLauncher) running() int {
+	running := 0
+	for _, crutch := range l.launched {
+		if !crutch.released {
+			running++
+		}
+	}
+	return running
+}
+
+func newTestController(walkDB *sql.DB, appBuilder AppBuilder, launcher Launcher, opts ...Option) *Controller {
+	opts = append([]Option{WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))}, opts...)
+	return New(walkDB, appBuilder, launcher, opts...)
+}
+
+func TestReconcileBuildsAndStartsCrutches(t *testing.T) {
+	ctx := context.Background()
+	walkDB := dbtest.NewDB(t)
+	upsertApp(t, walkDB, "app-1", "sha256:abc", 2)
+
+	appBuilder, launcher := &fakeBuilder{}, &fakeLauncher{}
+	controller := newTestController(walkDB, appBuilder, launcher)
+
+	for range 2 {
+		if err := controller.Reconcile(ctx); err != nil {
+			t.Fatalf("Reconcile failed: %v", err)
+		}
+	}
+
+	// converged after the first pass, the second one changes nothing
+	if len(appBuilder.built) != 1 || appBuilder.built[0] != "sha256:abc" {
+		t.Errorf("built %v, want the missing appfs of sha256:abc once", appBuilder.built)
+	}
+	if len(launcher.launched) != 2 {
+		t.Fatalf("launched %d crutches, want 2", len(launcher.launched))
+	}
+	for _, crutch := range launcher.launched {
+		if crutch.appFs != "/app/sha256:abc.ext4" {
+			t.Errorf("crutch %s boots %s, want the built appfs", crutch.id, crutch.appFs)
+		}
+	}
+
+	// a crashed crutch is released and replaced
+	launcher.launched[0].status = vm.VMStatusError
+	if err := controller.Reconcile(ctx); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if !launcher.launched[0].released || launcher.running() != 2 {
+		t.Errorf("crashed crutch released %v, %d running, want it replaced", launcher.launched[0].released, launcher.running())
+	}
+}
+
+func TestReconcileRebuildsOnEnvChange(t *testing.T) {
+	ctx := context.Background()
+	walkDB := dbtest.NewDB(t)
+	upsertApp(t, walkDB, "app-1", "sha256:abc", 1)
+
+	appBuilder := &fakeBuilder{}
+	controller := newTestController(walkDB, appBuilder, &fakeLauncher{})
+	if err := controller.Reconcile(ctx); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+
+	// same digest, but the env is baked into the AppFS
+	app := &models.App{ID: "app-1", Digest: "sha256:abc", BaseVersion: "v0.1.1", DesiredCrutches: 1, Env: map[string]string{"MODE": "prod"}}
+	if err := models.UpsertApp(ctx, walkDB, app); err != nil {
+		t.Fatalf("UpsertApp failed: %v", err)
+	}
+	for range 2 {
+		if err := controller.Reconcile(ctx); err != nil {
+			t.Fatalf("Reconcile failed: %v", err)
+		}
+	}
+
+	if len(appBuilder.built) != 2 {
+		t.Errorf("built %v, want a rebuild for the changed env only", appBuilder.built)
+	}
+}
+
+func TestReconcileReplacesOutdatedCrutches(t *testing.T) {
+	ctx := context.Background()
+	walkDB := dbtest.NewDB(t)
+	upsertApp(t, walkDB, "app-1", "sha256:abc", 2)
+
+	launcher := &fakeLauncher{}
+	controller := newTestController(walkDB, &fakeBuilder{}, launcher)
+	if err := controller.Reconcile(ctx); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+
+	upsertApp(t, walkDB, "app-1", "sha256:def", 2)
+	for range 2 {
+		if err := controller.Reconcile(ctx); err != nil {
+			t.Fatalf("Reconcile failed: %v", err)
+		}
+	}
+
+	if len(launcher.launched) != 4 {
+		t.Fatalf("launched %d crutches, want the 2 outdated ones replaced once", len(launcher.launched))
+	}
+	for i, crutch := range launcher.launched {
+		outdated := i < 2
+		if crutch.released != outdated {
+			t.Errorf("crutch %s booting %s released %v, want %v", crutch.id, crutch.appFs, crutch.released, outdated)
+		}
+		if !outdated && crutch.appFs != "/app/sha256:def.ext4" {
+			t.Errorf("replacement %s boots %s, want the new appfs", crutch.id, crutch.appFs)
+		}
+	}
+	// rolled one by one, the app never ran more than its desired crutches
+	if launcher.maxRunning > 2 {
+		t.Errorf("%d crutches ran at once, want at most 2", launcher.maxRunning)
+	}
+}
+
+func TestReconcileStopsExtraCrutches(t *testing.T) {
+	ctx := context.Background()
+	walkDB := dbtest.NewDB(t)
+	upsertApp(t, walkDB, "app-1", "sha256:abc", 3)
+
+	launcher := &fakeLauncher{}
+	controller := newTestController(walkDB, &fakeBuilder{}, launcher)
+	if err := controller.Reconcile(ctx); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+
+	upsertApp(t, walkDB, "app-1", "sha256:abc", 1)
+	if err := controller.Reconcile(ctx); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if launcher.running() != 1 || launcher.launched[0].released {
+		t.Errorf("%d running (oldest released %v), want only the oldest left", launcher.running(), launcher.launched[0].released)
+	}
+
+	// removing the app stops the rest
+	if _, err := walkDB.Exec(`DELETE FROM apps WHERE id = 'app-1'`); err != nil {
+		t.Fatal(err)
+	}
+	if err := controller.Reconcile(ctx); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if launcher.running() != 0 {
+		t.Errorf("%d crutches of a removed app still running", launcher.running())
+	}
+}
+
+// stepClock is a clock the test moves forward
+type stepClock struct {
+	now time.Time
+}
+
+func (c *stepClock) Now() time.Time { return c.now }
+
+func TestReconcileBacksOffFailingApps(t *testing.T) {
+	ctx := context.Background()
+	walkDB := dbtest.NewDB(t)
+	upsertApp(t, walkDB, "app-1", "sha256:abc", 1)
+
+	buildErr := errors.New("registry down")
+	appBuilder, launcher := &fakeBuilder{err: buildErr}, &fakeLauncher{}
+	clock := &stepClock{now: time.Unix(0, 0)}
+	controller := newTestController(walkDB, appBuilder, launcher,
+		WithBackoff(time.Second, 3*time.Second), WithClock(clock))
+
+	if err := controller.Reconcile(ctx); !errors.Is(err, buildErr) {
+		t.Fatalf("Reconcile error = %v, want %v", err, buildErr)
+	}
+	appBuilder.err = nil
+
+	// still backing off
+	clock.now = clock.now.Add(500 * time.Millisecond)
+	if err := controller.Reconcile(ctx); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if len(appBuilder.built) != 0 || len(launcher.launched) != 0 {
+		t.Errorf("app reconciled during its backoff")
+	}
+
+	clock.now = clock.now.Add(time.Second)
+	if err := controller.Reconcile(ctx); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if len(appBuilder.built) != 1 || launcher.running() != 1 {
+		t.Errorf("built %v, %d running after the backoff, want the app converged", appBuilder.built, launcher.running())
+	}
+}
+
+func TestBackoffDoublesUpToMax(t *testing.T) {
+	controller := New(nil, nil, nil, WithBackoff(time.Second, 5*time.Second))
+
+	for failures, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 40: 5 * time.Second} {
+		if got := controller.backoff(failures); got != want {
+			t.Errorf("backoff(%d) = %v, want %v", failures, got, want)
+		}
+	}
+}
@@ -2,19 +2,40 @@ package db
 
 import (
 	"database/sql"
+	"strconv"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// BusyTimeoutMs is how long a statement waits for a lock held by another
+// connection or process before failing with "database is locked"
+const BusyTimeoutMs = 5000
+
+// NewDB opens the SQLite database at dbPath. The pragmas are DSN parameters, so
+// every connection of the pool gets them: WAL lets readers run alongside the
+// writer, busy_timeout makes writers queue instead of failing, and foreign keys
+// are enforced. A single connection serializes the writes of this process.
 func NewDB(dbPath string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+	db, err := sql.Open("sqlite3", dsn(dbPath))
 	if err != nil {
 		return nil, err
 	}
+	db.SetMaxOpenConns(1)
 
 	if err = db.Ping(); err != nil {
+		db.Close()
 		return nil, err
 	}
 
 	return db, nil
 }
+
+func dsn(dbPath string) string {
+	separator := "?"
+	if strings.Contains(dbPath, "?") {
+		separator = "&"
+	}
+
+	return dbPath + separator + "_journal_mode=WAL&_busy_timeout=" + strconv.Itoa(BusyTimeoutMs) + "&_foreign_keys=on"
+}
@@ -0,0 +1,30 @@
+package db_test
+
+import (
+	"testing"
+
+	"github.com/maxdollinger/walk.io/internal/db/dbtest"
+)
+
+func TestNewDBPragmas(t *testing.T) {
+	walkDB := dbtest.NewUnmigratedDB(t)
+
+	tests := []struct {
+		pragma string
+		want   string
+	}{
+		{pragma: "journal_mode", want: "wal"},
+		{pragma: "busy_timeout", want: "5000"},
+		{pragma: "foreign_keys", want: "1"},
+	}
+
+	for _, tt := range tests {
+		var got string
+		if err := walkDB.QueryRow("PRAGMA " + tt.pragma).Scan(&got); err != nil {
+			t.Fatalf("PRAGMA %s failed: %v", tt.pragma, err)
+		}
+		if got != tt.want {
+			t.Errorf("PRAGMA %s = %s, want %s", tt.pragma, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+// Package dbtest provides the walk database for tests
+package dbtest
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxdollinger/walk.io/internal/db"
+)
+
+// NewDB returns a migrated database in a temp dir of t, closed when t ends
+func NewDB(t testing.TB) *sql.DB {
+	t.Helper()
+
+	walkDB := NewUnmigratedDB(t)
+	if err := db.Migrate(context.Background(), walkDB); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+
+	return walkDB
+}
+
+// NewUnmigratedDB returns an empty database like NewDB, for tests of the migrations themselves
+func NewUnmigratedDB(t testing.TB) *sql.DB {
+	t.Helper()
+
+	walkDB, err := db.NewDB(filepath.Join(t.TempDir(), "walk.db"))
+	if err != nil {
+		t.Fatalf("NewDB failed: %v", err)
+	}
+	t.Cleanup(func() { walkDB.Close() })
+
+	return walkDB
+}
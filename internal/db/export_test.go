@@ -0,0 +1,8 @@
+package db
+
+// internals for the tests in package db_test, which is external so it can use dbtest
+var (
+	MigrationFiles = migrationFiles
+	MigrateFS      = migrate
+	ReadMigrations = readMigrations
+)
@@ -0,0 +1,8 @@
+-- Network allocations table: IP and host ports held by a VM (crutch)
+-- host_ports is a comma separated list, restored into the pools on startup
+CREATE TABLE network_allocations (
+    vm_id VARCHAR(255) PRIMARY KEY,
+    ip VARCHAR(45) NOT NULL UNIQUE,
+    host_ports TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,3 @@
+-- Port mappings (host:guest/protocol, comma separated) of a VM, so its DNAT
+-- rules can be re-installed after the host's iptables were reset
+ALTER TABLE network_allocations ADD COLUMN port_mappings TEXT NOT NULL DEFAULT '';
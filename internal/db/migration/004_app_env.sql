@@ -0,0 +1,2 @@
+-- Per-app env (JSON object KEY -> VALUE), written to /walkio/env of the app device
+ALTER TABLE apps ADD COLUMN env TEXT NOT NULL DEFAULT '{}';
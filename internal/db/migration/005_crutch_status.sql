@@ -0,0 +1,4 @@
+-- Lifecycle status of a crutch (queued, running, stopped, error).
+-- Crutches recorded before had a started firecracker process, so they count as running.
+ALTER TABLE crutches ADD COLUMN status VARCHAR(32) NOT NULL DEFAULT 'queued';
+UPDATE crutches SET status = 'running';
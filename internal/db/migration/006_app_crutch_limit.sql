@@ -0,0 +1,2 @@
+-- Maximum number of running crutches per app, 0 means unlimited.
+ALTER TABLE apps ADD COLUMN max_running_crutches INTEGER NOT NULL DEFAULT 0;
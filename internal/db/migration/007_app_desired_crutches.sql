@@ -0,0 +1,2 @@
+-- Number of crutches the controller keeps running per app.
+ALTER TABLE apps ADD COLUMN desired_crutches INTEGER NOT NULL DEFAULT 0;
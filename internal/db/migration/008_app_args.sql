@@ -0,0 +1,2 @@
+-- Per-app argv (JSON array) replacing ENTRYPOINT and CMD of the image, empty keeps them
+ALTER TABLE apps ADD COLUMN args TEXT NOT NULL DEFAULT '[]';
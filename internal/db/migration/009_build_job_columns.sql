@@ -0,0 +1,9 @@
+-- Columns of the BuildJob model missing from the initial build_jobs table.
+-- cancel_requested is polled by the worker running the job.
+ALTER TABLE build_jobs ADD COLUMN image_name VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE build_jobs ADD COLUMN cancel_requested BOOLEAN NOT NULL DEFAULT 0;
+ALTER TABLE build_jobs ADD COLUMN digest VARCHAR(255);
+ALTER TABLE build_jobs ADD COLUMN block_device_path VARCHAR(255);
+ALTER TABLE build_jobs ADD COLUMN error TEXT;
+ALTER TABLE build_jobs ADD COLUMN started_at TIMESTAMP;
+ALTER TABLE build_jobs ADD COLUMN completed_at TIMESTAMP;
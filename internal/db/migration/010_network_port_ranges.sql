@@ -0,0 +1,3 @@
+-- Port ranges (first-last/protocol, comma separated) forwarded to a VM by a
+-- single DNAT rule each, re-installed like port_mappings
+ALTER TABLE network_allocations ADD COLUMN port_ranges TEXT NOT NULL DEFAULT '';
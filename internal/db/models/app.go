@@ -3,24 +3,156 @@ package db
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
+
+	"github.com/maxdollinger/walk.io/pkg/fs"
+	"github.com/maxdollinger/walk.io/pkg/utils"
 )
 
+// defaultStateFsSize matches the column default of apps.state_fs_size_bytes
+const defaultStateFsSize = 1 * utils.GB
+
 type App struct {
-	ID               string // unique application identifier
-	Digest           string // OCI image digest (e.g., "sha256:abc123...")
-	BaseVersion      string // base bundle version (e.g., "v1.0", "v2.0") references /var/lib/walkio/base/[version]
-	StateFsSizeBytes int64  // size of StateFS in bytes (default 1GB)
-	CreatedAt        time.Time
-	UpdatedAt        time.Time
+	ID                 string            // unique application identifier
+	Digest             string            // OCI image digest (e.g., "sha256:abc123...")
+	BaseVersion        string            // base bundle version (e.g., "v1.0", "v2.0") references /var/lib/walkio/base/[version]
+	StateFsSize        utils.Bytes       // size of StateFS, stored in bytes (default 1G)
+	Env                map[string]string // per-app env written to /walkio/env, keys are shell identifiers
+	Args               []string          // per-app argv written to /walkio/argv instead of the image's, empty keeps it
+	MaxRunningCrutches int               // maximum number of running crutches, 0 is unlimited
+	DesiredCrutches    int               // crutches the controller keeps running (default 0)
+	CreatedAt          time.Time
+	UpdatedAt          time.Time
 }
 
+// UpsertApp inserts the app or updates the app with the same ID.
+// Env keys are trimmed and must be shell identifiers (fs.ValidateEnvKey), the
+// normalized env is set on app. Args must not be blank, see fs.ValidateArgv.
 func UpsertApp(ctx context.Context, walkDB *sql.DB, app *App) error {
-	// TODO
+	env, err := normalizeEnv(app.Env)
+	if err != nil {
+		return fmt.Errorf("app %s: %w", app.ID, err)
+	}
+	envJSON, err := json.Marshal(env)
+	if err != nil {
+		return fmt.Errorf("app %s: encode env: %w", app.ID, err)
+	}
+	if err := fs.ValidateArgv(app.Args); err != nil {
+		return fmt.Errorf("app %s: %w", app.ID, err)
+	}
+	args := app.Args
+	if args == nil {
+		args = []string{}
+	}
+	argsJSON, err := json.Marshal(args)
+	if err != nil {
+		return fmt.Errorf("app %s: encode args: %w", app.ID, err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	if app.CreatedAt.IsZero() {
+		app.CreatedAt = now
+	}
+	if app.StateFsSize == 0 {
+		app.StateFsSize = defaultStateFsSize
+	}
+	if app.MaxRunningCrutches < 0 {
+		return fmt.Errorf("app %s: negative crutch limit %d", app.ID, app.MaxRunningCrutches)
+	}
+	if app.DesiredCrutches < 0 {
+		return fmt.Errorf("app %s: negative desired crutches %d", app.ID, app.DesiredCrutches)
+	}
+
+	query := `
+		INSERT INTO apps (id, digest, base_version, state_fs_size_bytes, env, args, max_running_crutches, desired_crutches, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			digest = excluded.digest,
+			base_version = excluded.base_version,
+			state_fs_size_bytes = excluded.state_fs_size_bytes,
+			env = excluded.env,
+			args = excluded.args,
+			max_running_crutches = excluded.max_running_crutches,
+			desired_crutches = excluded.desired_crutches,
+			updated_at = excluded.updated_at
+	`
+	_, err = walkDB.ExecContext(ctx, query,
+		app.ID, app.Digest, app.BaseVersion, int64(app.StateFsSize), string(envJSON), string(argsJSON), app.MaxRunningCrutches, app.DesiredCrutches, app.CreatedAt, now)
+	if err != nil {
+		return err
+	}
+
+	app.Env = env
+	app.UpdatedAt = now
 	return nil
 }
 
+const appColumns = `id, digest, base_version, state_fs_size_bytes, env, args, max_running_crutches, desired_crutches, created_at, updated_at`
+
 func GetAppByID(ctx context.Context, walkDB *sql.DB, appID string) (*App, error) {
-	// TODO
-	return nil, nil
+	query := `SELECT ` + appColumns + ` FROM apps WHERE id = ?`
+	return scanApp(walkDB.QueryRowContext(ctx, query, appID))
+}
+
+// ListApps returns all apps ordered by ID
+func ListApps(ctx context.Context, walkDB *sql.DB) ([]*App, error) {
+	rows, err := walkDB.QueryContext(ctx, `SELECT `+appColumns+` FROM apps ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var apps []*App
+	for rows.Next() {
+		app, err := scanApp(rows)
+		if err != nil {
+			return nil, err
+		}
+		apps = append(apps, app)
+	}
+
+	return apps, rows.Err()
+}
+
+func scanApp(row rowScanner) (*App, error) {
+	var envJSON, argsJSON string
+	app := &App{}
+	err := row.Scan(&app.ID, &app.Digest, &app.BaseVersion, &app.StateFsSize, &envJSON, &argsJSON,
+		&app.MaxRunningCrutches, &app.DesiredCrutches, &app.CreatedAt, &app.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(envJSON), &app.Env); err != nil {
+		return nil, fmt.Errorf("app %s: decode env: %w", app.ID, err)
+	}
+	if err := json.Unmarshal([]byte(argsJSON), &app.Args); err != nil {
+		return nil, fmt.Errorf("app %s: decode args: %w", app.ID, err)
+	}
+	if len(app.Args) == 0 {
+		app.Args = nil
+	}
+
+	return app, nil
+}
+
+// normalizeEnv trims the keys and rejects keys that are no shell identifiers
+// or collide after trimming
+func normalizeEnv(env map[string]string) (map[string]string, error) {
+	normalized := make(map[string]string, len(env))
+	for key, value := range env {
+		trimmed := strings.TrimSpace(key)
+		if err := fs.ValidateEnvKey(trimmed); err != nil {
+			return nil, err
+		}
+		if _, ok := normalized[trimmed]; ok {
+			return nil, fmt.Errorf("%w: %q is set more than once", fs.ErrInvalidEnvKey, trimmed)
+		}
+		normalized[trimmed] = value
+	}
+
+	return normalized, nil
 }
@@ -0,0 +1,167 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/maxdollinger/walk.io/internal/db"
+	"github.com/maxdollinger/walk.io/internal/db/dbtest"
+	"github.com/maxdollinger/walk.io/pkg/fs"
+	"github.com/maxdollinger/walk.io/pkg/utils"
+)
+
+func TestUpsertApp(t *testing.T) {
+	ctx := context.Background()
+	walkDB := dbtest.NewDB(t)
+
+	app := &App{
+		ID:          "app-1",
+		Digest:      "sha256:abc",
+		BaseVersion: "v0.1.1",
+		Env:         map[string]string{" _FOO123 ": "bar", "MODE": "a=b"},
+	}
+	if err := UpsertApp(ctx, walkDB, app); err != nil {
+		t.Fatalf("UpsertApp failed: %v", err)
+	}
+
+	wantEnv := map[string]string{"_FOO123": "bar", "MODE": "a=b"}
+	if !maps.Equal(app.Env, wantEnv) {
+		t.Errorf("normalized env = %v, want %v", app.Env, wantEnv)
+	}
+
+	app.Digest = "sha256:def"
+	app.StateFsSize = 2 * utils.GB
+	app.Args = []string{"/bin/app", "--serve"}
+	if err := UpsertApp(ctx, walkDB, app); err != nil {
+		t.Fatalf("second UpsertApp failed: %v", err)
+	}
+
+	got, err := GetAppByID(ctx, walkDB, "app-1")
+	if err != nil {
+		t.Fatalf("GetAppByID failed: %v", err)
+	}
+	if got.Digest != "sha256:def" || got.StateFsSize != 2*utils.GB || !maps.Equal(got.Env, wantEnv) {
+		t.Errorf("GetAppByID() = %+v, want updated digest, 2G state and env %v", got, wantEnv)
+	}
+	if !slices.Equal(got.Args, app.Args) {
+		t.Errorf("Args = %q, want %q", got.Args, app.Args)
+	}
+
+	app.Args = []string{"/bin/app", " "}
+	if err := UpsertApp(ctx, walkDB, app); !errors.Is(err, fs.ErrInvalidArgv) {
+		t.Errorf("UpsertApp with a blank arg error = %v, want %v", err, fs.ErrInvalidArgv)
+	}
+}
+
+func TestListApps(t *testing.T) {
+	ctx := context.Background()
+	walkDB := dbtest.NewDB(t)
+
+	for i, id := range []string{"app-b", "app-a"} {
+		app := &App{ID: id, Digest: "sha256:" + id, BaseVersion: "v0.1.1", DesiredCrutches: i + 1}
+		if err := UpsertApp(ctx, walkDB, app); err != nil {
+			t.Fatalf("UpsertApp failed: %v", err)
+		}
+	}
+	if err := UpsertApp(ctx, walkDB, &App{ID: "app-c", DesiredCrutches: -1}); err == nil {
+		t.Error("UpsertApp accepted negative desired crutches")
+	}
+
+	apps, err := ListApps(ctx, walkDB)
+	if err != nil {
+		t.Fatalf("ListApps failed: %v", err)
+	}
+	if len(apps) != 2 || apps[0].ID != "app-a" || apps[0].DesiredCrutches != 2 || apps[1].DesiredCrutches != 1 {
+		t.Errorf("ListApps() = %+v, want app-a with 2 and app-b with 1 desired crutches", apps)
+	}
+}
+
+func TestUpsertAppInvalidEnv(t *testing.T) {
+	ctx := context.Background()
+	walkDB := dbtest.NewDB(t)
+
+	tests := []map[string]string{
+		{"": "empty"},
+		{"MY KEY": "space"},
+		{"FOO=BAR": "equals"},
+		{"1FOO": "leading digit"},
+		{"FOO": "a", " FOO": "collides after trimming"},
+	}
+
+	for _, env := range tests {
+		err := UpsertApp(ctx, walkDB, &App{ID: "app-1", Digest: "sha256:abc", BaseVersion: "v0.1.1", Env: env})
+		if !errors.Is(err, fs.ErrInvalidEnvKey) {
+			t.Errorf("UpsertApp with env %q error = %v, want %v", env, err, fs.ErrInvalidEnvKey)
+		}
+	}
+
+	if _, err := GetAppByID(ctx, walkDB, "app-1"); err == nil {
+		t.Error("app with invalid env was stored")
+	}
+}
+
+func TestCrutchStoreDeleteInstance(t *testing.T) {
+	ctx := context.Background()
+	walkDB := dbtest.NewDB(t)
+
+	if err := UpsertApp(ctx, walkDB, &App{ID: "app-1", Digest: "sha256:abc", BaseVersion: "v0.1.1"}); err != nil {
+		t.Fatalf("UpsertApp failed: %v", err)
+	}
+	if err := InsertCrutch(walkDB, &Crutch{ID: "vm-1", AppID: "app-1", Pid: 42, SocketPath: "/vm-1.sock"}); err != nil {
+		t.Fatalf("InsertCrutch failed: %v", err)
+	}
+
+	store := &CrutchStore{DB: walkDB}
+	for i := range 2 {
+		if err := store.DeleteInstance(ctx, "vm-1"); err != nil {
+			t.Fatalf("DeleteInstance %d failed: %v", i, err)
+		}
+	}
+	if _, err := GetCrutchByID(walkDB, "vm-1"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GetCrutchByID error = %v, want %v", err, sql.ErrNoRows)
+	}
+}
+
+func TestUpsertAppConcurrentWriters(t *testing.T) {
+	ctx := context.Background()
+	dbPath := filepath.Join(t.TempDir(), "walk.db")
+
+	// like the builder worker and the API handler, each with its own handle
+	handles := make([]*sql.DB, 2)
+	for i := range handles {
+		walkDB, err := db.NewDB(dbPath)
+		if err != nil {
+			t.Fatalf("NewDB failed: %v", err)
+		}
+		t.Cleanup(func() { walkDB.Close() })
+		handles[i] = walkDB
+	}
+	if err := db.Migrate(ctx, handles[0]); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i, walkDB := range handles {
+		wg.Go(func() {
+			for n := range 50 {
+				app := &App{
+					ID:          fmt.Sprintf("app-%d", i),
+					Digest:      fmt.Sprintf("sha256:%d-%d", i, n),
+					BaseVersion: "v0.1.1",
+				}
+				if err := UpsertApp(ctx, walkDB, app); err != nil {
+					t.Errorf("UpsertApp failed: %v", err)
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+}
@@ -3,7 +3,25 @@ package db
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"time"
+
+	"github.com/maxdollinger/walk.io/pkg/utils"
+)
+
+// Build job states, a job moves from queued to running to one of the final states
+const (
+	BuildJobQueued    = "queued"
+	BuildJobRunning   = "running"
+	BuildJobSucceeded = "succeeded"
+	BuildJobFailed    = "failed"
+	BuildJobCancelled = "cancelled"
+)
+
+var (
+	ErrBuildJobNotQueued  = errors.New("build job is not queued")
+	ErrBuildJobNotRunning = errors.New("build job is not running")
+	ErrNoQueuedJob        = errors.New("no queued build job")
 )
 
 type BuildJob struct {
@@ -11,6 +29,7 @@ type BuildJob struct {
 	AppID           string     `json:"app_id"`
 	ImageName       string     `json:"image_name"`
 	Status          string     `json:"status"`
+	CancelRequested bool       `json:"cancel_requested"`
 	Digest          *string    `json:"digest,omitempty"`
 	BlockDevicePath *string    `json:"block_device_path,omitempty"`
 	Error           *string    `json:"error,omitempty"`
@@ -19,12 +38,195 @@ type BuildJob struct {
 	CreatedAt       time.Time  `json:"created_at"`
 }
 
+const buildJobColumns = `id, app_id, image_name, status, cancel_requested, digest, block_device_path, error, started_at, completed_at, created_at`
+
 func InsertBuildJob(ctx context.Context, walkDB *sql.DB, appID, imageName string) (*BuildJob, error) {
-	// TODO
-	return nil, nil
+	id, err := utils.NewUUID7()
+	if err != nil {
+		return nil, err
+	}
+
+	job := &BuildJob{
+		ID:        id,
+		AppID:     appID,
+		ImageName: imageName,
+		Status:    BuildJobQueued,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+
+	query := `
+		INSERT INTO build_jobs (id, app_id, image_name, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`
+	_, err = walkDB.ExecContext(ctx, query,
+		job.ID, job.AppID, job.ImageName, job.Status, job.CreatedAt, job.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+func GetBuildJobByID(ctx context.Context, walkDB *sql.DB, id string) (*BuildJob, error) {
+	query := `SELECT ` + buildJobColumns + ` FROM build_jobs WHERE id = ?`
+	return scanBuildJob(walkDB.QueryRowContext(ctx, query, id))
 }
 
 func GetQueuedJobs(ctx context.Context, walkDB *sql.DB) ([]BuildJob, error) {
-	// TODO
-	return nil, nil
+	query := `SELECT ` + buildJobColumns + ` FROM build_jobs WHERE status = ? ORDER BY created_at`
+	rows, err := walkDB.QueryContext(ctx, query, BuildJobQueued)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []BuildJob
+	for rows.Next() {
+		job, err := scanBuildJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, *job)
+	}
+
+	return jobs, rows.Err()
+}
+
+// StartBuildJob moves a queued job to running. It returns ErrBuildJobNotQueued
+// if the job was cancelled or picked up by another worker in the meantime.
+func StartBuildJob(ctx context.Context, walkDB *sql.DB, id string) error {
+	query := `UPDATE build_jobs SET status = ?, started_at = ?, updated_at = ? WHERE id = ? AND status = ?`
+	now := time.Now().UTC()
+	result, err := walkDB.ExecContext(ctx, query, BuildJobRunning, now, now, id, BuildJobQueued)
+	if err != nil {
+		return err
+	}
+
+	return expectOneRow(result, ErrBuildJobNotQueued)
+}
+
+// NextQueuedJob claims the oldest queued job by moving it to running in a single
+// UPDATE, so two workers never get the same job. It returns ErrNoQueuedJob if
+// the queue is empty.
+func NextQueuedJob(ctx context.Context, walkDB *sql.DB) (*BuildJob, error) {
+	query := `
+		UPDATE build_jobs SET status = ?, started_at = ?, updated_at = ?
+		WHERE id = (SELECT id FROM build_jobs WHERE status = ? ORDER BY created_at, id LIMIT 1)
+		AND status = ?
+		RETURNING ` + buildJobColumns
+	now := time.Now().UTC()
+	job, err := scanBuildJob(walkDB.QueryRowContext(ctx, query,
+		BuildJobRunning, now, now, BuildJobQueued, BuildJobQueued))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNoQueuedJob
+	}
+
+	return job, err
+}
+
+// CompleteBuildJob moves a running job to succeeded and records the image
+// digest and the built device
+func CompleteBuildJob(ctx context.Context, walkDB *sql.DB, id, digest, devicePath string) error {
+	query := `
+		UPDATE build_jobs SET status = ?, digest = ?, block_device_path = ?, error = NULL, completed_at = ?, updated_at = ?
+		WHERE id = ? AND status = ?
+	`
+	now := time.Now().UTC()
+	result, err := walkDB.ExecContext(ctx, query, BuildJobSucceeded, digest, devicePath, now, now, id, BuildJobRunning)
+	if err != nil {
+		return err
+	}
+
+	return expectOneRow(result, ErrBuildJobNotRunning)
+}
+
+// FailBuildJob moves a running job to failed and records errMsg
+func FailBuildJob(ctx context.Context, walkDB *sql.DB, id, errMsg string) error {
+	query := `UPDATE build_jobs SET status = ?, error = ?, completed_at = ?, updated_at = ? WHERE id = ? AND status = ?`
+	now := time.Now().UTC()
+	result, err := walkDB.ExecContext(ctx, query, BuildJobFailed, errMsg, now, now, id, BuildJobRunning)
+	if err != nil {
+		return err
+	}
+
+	return expectOneRow(result, ErrBuildJobNotRunning)
+}
+
+// RequeueBuildJob moves a running job back to queued, e.g. when its worker shuts
+// down mid build, so the next worker claims it again
+func RequeueBuildJob(ctx context.Context, walkDB *sql.DB, id string) error {
+	query := `UPDATE build_jobs SET status = ?, started_at = NULL, updated_at = ? WHERE id = ? AND status = ?`
+	result, err := walkDB.ExecContext(ctx, query, BuildJobQueued, time.Now().UTC(), id, BuildJobRunning)
+	if err != nil {
+		return err
+	}
+
+	return expectOneRow(result, ErrBuildJobNotRunning)
+}
+
+// RequestBuildJobCancel flags a job for cancellation. A queued job is cancelled
+// right away, a running job is cancelled by its worker on the next poll.
+// Finished jobs are left untouched.
+func RequestBuildJobCancel(ctx context.Context, walkDB *sql.DB, id string) error {
+	now := time.Now().UTC()
+	_, err := walkDB.ExecContext(ctx,
+		`UPDATE build_jobs SET status = ?, cancel_requested = 1, completed_at = ?, updated_at = ? WHERE id = ? AND status = ?`,
+		BuildJobCancelled, now, now, id, BuildJobQueued)
+	if err != nil {
+		return err
+	}
+
+	_, err = walkDB.ExecContext(ctx,
+		`UPDATE build_jobs SET cancel_requested = 1, updated_at = ? WHERE id = ? AND status = ?`,
+		now, id, BuildJobRunning)
+	return err
+}
+
+func IsBuildJobCancelRequested(ctx context.Context, walkDB *sql.DB, id string) (bool, error) {
+	var requested bool
+	err := walkDB.QueryRowContext(ctx, `SELECT cancel_requested FROM build_jobs WHERE id = ?`, id).Scan(&requested)
+	return requested, err
+}
+
+// FinishBuildJob records the final state of a running job
+func FinishBuildJob(ctx context.Context, walkDB *sql.DB, id, status string, blockDevicePath, errMsg *string) error {
+	query := `UPDATE build_jobs SET status = ?, block_device_path = ?, error = ?, completed_at = ?, updated_at = ? WHERE id = ?`
+	now := time.Now().UTC()
+	_, err := walkDB.ExecContext(ctx, query, status, blockDevicePath, errMsg, now, now, id)
+	return err
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanBuildJob(row rowScanner) (*BuildJob, error) {
+	var startedAt, completedAt sql.NullTime
+	job := &BuildJob{}
+	err := row.Scan(&job.ID, &job.AppID, &job.ImageName, &job.Status, &job.CancelRequested,
+		&job.Digest, &job.BlockDevicePath, &job.Error, &startedAt, &completedAt, &job.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if startedAt.Valid {
+		job.StartedAt = &startedAt.Time
+	}
+	if completedAt.Valid {
+		job.CompletedAt = &completedAt.Time
+	}
+
+	return job, nil
+}
+
+func expectOneRow(result sql.Result, errNoRow error) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return errNoRow
+	}
+
+	return nil
 }
@@ -0,0 +1,131 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestBuildJobTransitions(t *testing.T) {
+	ctx := context.Background()
+	walkDB := newCrutchTestDB(t)
+
+	done, err := InsertBuildJob(ctx, walkDB, "app-1", "nginx:latest")
+	if err != nil {
+		t.Fatalf("InsertBuildJob failed: %v", err)
+	}
+	if err := CompleteBuildJob(ctx, walkDB, done.ID, "sha256:abc", "/abc.ext4"); !errors.Is(err, ErrBuildJobNotRunning) {
+		t.Errorf("CompleteBuildJob of a queued job error = %v, want %v", err, ErrBuildJobNotRunning)
+	}
+
+	if err := StartBuildJob(ctx, walkDB, done.ID); err != nil {
+		t.Fatalf("StartBuildJob failed: %v", err)
+	}
+	if err := CompleteBuildJob(ctx, walkDB, done.ID, "sha256:abc", "/abc.ext4"); err != nil {
+		t.Fatalf("CompleteBuildJob failed: %v", err)
+	}
+	got, err := GetBuildJobByID(ctx, walkDB, done.ID)
+	if err != nil {
+		t.Fatalf("GetBuildJobByID failed: %v", err)
+	}
+	if got.Status != BuildJobSucceeded || got.StartedAt == nil || got.CompletedAt == nil {
+		t.Errorf("completed job = %+v, want succeeded with timestamps", got)
+	}
+	if got.Digest == nil || *got.Digest != "sha256:abc" || got.BlockDevicePath == nil || *got.BlockDevicePath != "/abc.ext4" {
+		t.Errorf("completed job digest = %v, device = %v", got.Digest, got.BlockDevicePath)
+	}
+	if err := FailBuildJob(ctx, walkDB, done.ID, "too late"); !errors.Is(err, ErrBuildJobNotRunning) {
+		t.Errorf("FailBuildJob of a finished job error = %v, want %v", err, ErrBuildJobNotRunning)
+	}
+
+	failed, err := InsertBuildJob(ctx, walkDB, "app-1", "nginx:latest")
+	if err != nil {
+		t.Fatalf("InsertBuildJob failed: %v", err)
+	}
+	if err := StartBuildJob(ctx, walkDB, failed.ID); err != nil {
+		t.Fatalf("StartBuildJob failed: %v", err)
+	}
+	if err := FailBuildJob(ctx, walkDB, failed.ID, "pull failed"); err != nil {
+		t.Fatalf("FailBuildJob failed: %v", err)
+	}
+	got, err = GetBuildJobByID(ctx, walkDB, failed.ID)
+	if err != nil {
+		t.Fatalf("GetBuildJobByID failed: %v", err)
+	}
+	if got.Status != BuildJobFailed || got.Error == nil || *got.Error != "pull failed" || got.CompletedAt == nil {
+		t.Errorf("failed job = %+v, want failed with error", got)
+	}
+
+	requeued, err := InsertBuildJob(ctx, walkDB, "app-1", "nginx:latest")
+	if err != nil {
+		t.Fatalf("InsertBuildJob failed: %v", err)
+	}
+	if err := RequeueBuildJob(ctx, walkDB, requeued.ID); !errors.Is(err, ErrBuildJobNotRunning) {
+		t.Errorf("RequeueBuildJob of a queued job error = %v, want %v", err, ErrBuildJobNotRunning)
+	}
+	if err := StartBuildJob(ctx, walkDB, requeued.ID); err != nil {
+		t.Fatalf("StartBuildJob failed: %v", err)
+	}
+	if err := RequeueBuildJob(ctx, walkDB, requeued.ID); err != nil {
+		t.Fatalf("RequeueBuildJob failed: %v", err)
+	}
+	got, err = GetBuildJobByID(ctx, walkDB, requeued.ID)
+	if err != nil {
+		t.Fatalf("GetBuildJobByID failed: %v", err)
+	}
+	if got.Status != BuildJobQueued || got.StartedAt != nil {
+		t.Errorf("requeued job = %+v, want queued without start", got)
+	}
+}
+
+func TestNextQueuedJob(t *testing.T) {
+	ctx := context.Background()
+	walkDB := newCrutchTestDB(t)
+
+	if _, err := NextQueuedJob(ctx, walkDB); !errors.Is(err, ErrNoQueuedJob) {
+		t.Fatalf("NextQueuedJob on an empty queue error = %v, want %v", err, ErrNoQueuedJob)
+	}
+
+	const jobs = 8
+	for range jobs {
+		if _, err := InsertBuildJob(ctx, walkDB, "app-1", "nginx:latest"); err != nil {
+			t.Fatalf("InsertBuildJob failed: %v", err)
+		}
+	}
+
+	var mu sync.Mutex
+	claimed := make(map[string]int)
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Go(func() {
+			for {
+				job, err := NextQueuedJob(ctx, walkDB)
+				if errors.Is(err, ErrNoQueuedJob) {
+					return
+				}
+				if err != nil {
+					t.Errorf("NextQueuedJob failed: %v", err)
+					return
+				}
+				if job.Status != BuildJobRunning || job.StartedAt == nil {
+					t.Errorf("claimed job = %+v, want running", job)
+				}
+
+				mu.Lock()
+				claimed[job.ID]++
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+
+	if len(claimed) != jobs {
+		t.Errorf("claimed %d jobs, want %d", len(claimed), jobs)
+	}
+	for id, n := range claimed {
+		if n != 1 {
+			t.Errorf("job %s claimed %d times", id, n)
+		}
+	}
+}
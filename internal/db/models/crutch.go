@@ -1,21 +1,53 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"slices"
 	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Crutch states, a crutch moves from queued to running to stopped or error
+const (
+	CrutchQueued  = "queued"
+	CrutchRunning = "running"
+	CrutchStopped = "stopped"
+	CrutchError   = "error"
+)
+
+var (
+	ErrCrutchNotFound      = errors.New("crutch not found")
+	ErrInvalidCrutchStatus = errors.New("invalid crutch status")
 )
 
+// CrutchLimitError rejects starting a crutch of an app that already runs
+// App.MaxRunningCrutches crutches
+type CrutchLimitError struct {
+	AppID string
+	Limit int
+}
+
+func (e *CrutchLimitError) Error() string {
+	return fmt.Sprintf("app %s already runs its limit of %d crutches", e.AppID, e.Limit)
+}
+
 // Crutch represents a running instance of an App (a Firecracker VM instance).
 type Crutch struct {
 	ID         string // UUID of this VM instance
 	AppID      string // which app is running
 	Pid        int    // firecracker process PID
 	SocketPath string // firecracker control socket path
+	Status     string // one of the Crutch* states, InsertCrutch defaults to CrutchQueued
 	CreatedAt  time.Time
 	UpdatedAt  time.Time
 }
 
+const crutchColumns = `id, app_id, pid, socket_path, status, created_at, updated_at`
+
 // GetStateFsPath computes the state filesystem path from the VM instance ID.
 // This ensures state_fs_path always matches the VM instance UUID.
 // Returns: /var/lib/walkio/state/{id}.ext4
@@ -25,39 +57,143 @@ func (c *Crutch) GetStateFsPath() string {
 
 // InsertCrutch saves a new Crutch to the database.
 func InsertCrutch(db *sql.DB, crutch *Crutch) error {
+	if len(crutch.Status) == 0 {
+		crutch.Status = CrutchQueued
+	}
+	if err := validateCrutchStatus(crutch.Status); err != nil {
+		return err
+	}
+
 	query := `
-		INSERT INTO crutches (id, app_id, pid, socket_path, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?)
+		INSERT INTO crutches (id, app_id, pid, socket_path, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
 	`
-	now := time.Now().Unix()
+	now := time.Now().UTC()
 	_, err := db.Exec(query,
-		crutch.ID, crutch.AppID, crutch.Pid, crutch.SocketPath, now, now)
+		crutch.ID, crutch.AppID, crutch.Pid, crutch.SocketPath, crutch.Status, now, now)
 	return err
 }
 
 // GetCrutchByID retrieves a Crutch by ID from the database.
 func GetCrutchByID(db *sql.DB, id string) (*Crutch, error) {
-	query := `SELECT id, app_id, pid, socket_path, created_at, updated_at FROM crutches WHERE id = ?`
-	row := db.QueryRow(query, id)
+	query := `SELECT ` + crutchColumns + ` FROM crutches WHERE id = ?`
+	return scanCrutch(db.QueryRow(query, id))
+}
 
-	var createdAt, updatedAt int64
-	crutch := &Crutch{}
-	err := row.Scan(&crutch.ID, &crutch.AppID, &crutch.Pid, &crutch.SocketPath,
-		&createdAt, &updatedAt)
+// ListCrutchesByAppID retrieves all Crutches for an App from the database.
+func ListCrutchesByAppID(db *sql.DB, appID string) ([]*Crutch, error) {
+	query := `SELECT ` + crutchColumns + ` FROM crutches WHERE app_id = ? ORDER BY created_at DESC`
+	return queryCrutches(db, query, appID)
+}
 
+// ListRunningCrutches retrieves all Crutches in the running state.
+func ListRunningCrutches(db *sql.DB) ([]*Crutch, error) {
+	query := `SELECT ` + crutchColumns + ` FROM crutches WHERE status = ? ORDER BY created_at`
+	return queryCrutches(db, query, CrutchRunning)
+}
+
+// CountRunningCrutches returns the number of running Crutches of an App.
+func CountRunningCrutches(db *sql.DB, appID string) (int, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM crutches WHERE app_id = ? AND status = ?`, appID, CrutchRunning).Scan(&count)
+	return count, err
+}
+
+// StartCrutch records crutch as running, inserting it if it is new. The limit
+// of the app is checked in the same statement, so concurrent starts can't
+// overshoot it. Over the limit a *CrutchLimitError is returned.
+func StartCrutch(ctx context.Context, db *sql.DB, crutch *Crutch) error {
+	// the crutch itself is not counted, so restarting it never hits the limit
+	query := `
+		INSERT INTO crutches (id, app_id, pid, socket_path, status, created_at, updated_at)
+		SELECT ?, a.id, ?, ?, ?, ?, ? FROM apps a
+		WHERE a.id = ? AND (a.max_running_crutches = 0 OR a.max_running_crutches > (
+			SELECT COUNT(*) FROM crutches c WHERE c.app_id = a.id AND c.status = ? AND c.id != ?))
+		ON CONFLICT (id) DO UPDATE SET
+			pid = excluded.pid,
+			socket_path = excluded.socket_path,
+			status = excluded.status,
+			updated_at = excluded.updated_at
+	`
+	now := time.Now().UTC()
+	result, err := db.ExecContext(ctx, query,
+		crutch.ID, crutch.Pid, crutch.SocketPath, CrutchRunning, now, now,
+		crutch.AppID, CrutchRunning, crutch.ID)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("start crutch %s: %w", crutch.ID, err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("start crutch %s: %w", crutch.ID, err)
+	}
+	if n == 1 {
+		crutch.Status = CrutchRunning
+		return nil
 	}
 
-	crutch.CreatedAt = time.Unix(createdAt, 0)
-	crutch.UpdatedAt = time.Unix(updatedAt, 0)
-	return crutch, nil
+	// nothing was written, either the app is missing or at its limit
+	var limit int
+	err = db.QueryRowContext(ctx, `SELECT max_running_crutches FROM apps WHERE id = ?`, crutch.AppID).Scan(&limit)
+	if err != nil {
+		return fmt.Errorf("start crutch %s: app %s: %w", crutch.ID, crutch.AppID, err)
+	}
+
+	return &CrutchLimitError{AppID: crutch.AppID, Limit: limit}
 }
 
-// ListCrutchesByAppID retrieves all Crutches for an App from the database.
-func ListCrutchesByAppID(db *sql.DB, appID string) ([]*Crutch, error) {
-	query := `SELECT id, app_id, pid, socket_path, created_at, updated_at FROM crutches WHERE app_id = ? ORDER BY created_at DESC`
-	rows, err := db.Query(query, appID)
+// UpdateCrutchStatus moves a Crutch to status.
+func UpdateCrutchStatus(db *sql.DB, id, status string) error {
+	if err := validateCrutchStatus(status); err != nil {
+		return err
+	}
+
+	query := `UPDATE crutches SET status = ?, updated_at = ? WHERE id = ?`
+	result, err := db.Exec(query, status, time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+
+	return expectOneRow(result, ErrCrutchNotFound)
+}
+
+// processAlive reports if a process with pid exists, overridden in tests
+var processAlive = func(pid int) bool {
+	err := unix.Kill(pid, 0)
+	return err == nil || errors.Is(err, unix.EPERM)
+}
+
+// ReconcileCrutches marks running Crutches whose firecracker process is gone,
+// e.g. after a host reboot, as stopped. It returns the IDs of those crutches.
+func ReconcileCrutches(db *sql.DB) ([]string, error) {
+	running, err := ListRunningCrutches(db)
+	if err != nil {
+		return nil, fmt.Errorf("list running crutches: %w", err)
+	}
+
+	var stopped []string
+	for _, crutch := range running {
+		if crutch.Pid > 0 && processAlive(crutch.Pid) {
+			continue
+		}
+		if err := UpdateCrutchStatus(db, crutch.ID, CrutchStopped); err != nil {
+			return stopped, fmt.Errorf("stop crutch %s: %w", crutch.ID, err)
+		}
+		stopped = append(stopped, crutch.ID)
+	}
+
+	return stopped, nil
+}
+
+func validateCrutchStatus(status string) error {
+	if !slices.Contains([]string{CrutchQueued, CrutchRunning, CrutchStopped, CrutchError}, status) {
+		return fmt.Errorf("%w: %q", ErrInvalidCrutchStatus, status)
+	}
+
+	return nil
+}
+
+func queryCrutches(db *sql.DB, query string, args ...any) ([]*Crutch, error) {
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -65,23 +201,55 @@ func ListCrutchesByAppID(db *sql.DB, appID string) ([]*Crutch, error) {
 
 	var crutches []*Crutch
 	for rows.Next() {
-		var createdAt, updatedAt int64
-		crutch := &Crutch{}
-		if err := rows.Scan(&crutch.ID, &crutch.AppID, &crutch.Pid, &crutch.SocketPath,
-			&createdAt, &updatedAt); err != nil {
+		crutch, err := scanCrutch(rows)
+		if err != nil {
 			return nil, err
 		}
-		crutch.CreatedAt = time.Unix(createdAt, 0)
-		crutch.UpdatedAt = time.Unix(updatedAt, 0)
 		crutches = append(crutches, crutch)
 	}
 
 	return crutches, rows.Err()
 }
 
+func scanCrutch(row rowScanner) (*Crutch, error) {
+	crutch := &Crutch{}
+	err := row.Scan(&crutch.ID, &crutch.AppID, &crutch.Pid, &crutch.SocketPath, &crutch.Status,
+		&crutch.CreatedAt, &crutch.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return crutch, nil
+}
+
 // DeleteCrutch removes a Crutch from the database.
 func DeleteCrutch(db *sql.DB, id string) error {
 	query := `DELETE FROM crutches WHERE id = ?`
 	_, err := db.Exec(query, id)
 	return err
 }
+
+// CrutchStore keeps the crutch rows of VMs in sync with their VMM process
+type CrutchStore struct {
+	DB *sql.DB
+}
+
+// StartInstance records the VM as running, it fails with a *CrutchLimitError
+// if the app already runs its limit of crutches
+func (s *CrutchStore) StartInstance(ctx context.Context, appID, vmID string, pid int, socketPath string) error {
+	return StartCrutch(ctx, s.DB, &Crutch{ID: vmID, AppID: appID, Pid: pid, SocketPath: socketPath})
+}
+
+// StopInstance marks the crutch of the VM as stopped, so it no longer counts
+// against the limit of its app. A missing crutch is no error.
+func (s *CrutchStore) StopInstance(ctx context.Context, vmID string) error {
+	query := `UPDATE crutches SET status = ?, updated_at = ? WHERE id = ?`
+	_, err := s.DB.ExecContext(ctx, query, CrutchStopped, time.Now().UTC(), vmID)
+	return err
+}
+
+// DeleteInstance removes the crutch of the VM, deleting a missing crutch is no error
+func (s *CrutchStore) DeleteInstance(ctx context.Context, vmID string) error {
+	_, err := s.DB.ExecContext(ctx, `DELETE FROM crutches WHERE id = ?`, vmID)
+	return err
+}
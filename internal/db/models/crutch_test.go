@@ -0,0 +1,165 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/maxdollinger/walk.io/internal/db/dbtest"
+)
+
+func newCrutchTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	walkDB := dbtest.NewDB(t)
+	if err := UpsertApp(context.Background(), walkDB, &App{ID: "app-1", Digest: "sha256:abc", BaseVersion: "v0.1.1"}); err != nil {
+		t.Fatalf("UpsertApp failed: %v", err)
+	}
+
+	return walkDB
+}
+
+func TestCrutchStatus(t *testing.T) {
+	walkDB := newCrutchTestDB(t)
+
+	if err := InsertCrutch(walkDB, &Crutch{ID: "vm-1", AppID: "app-1", Pid: 42, SocketPath: "/vm-1.sock"}); err != nil {
+		t.Fatalf("InsertCrutch failed: %v", err)
+	}
+	crutch, err := GetCrutchByID(walkDB, "vm-1")
+	if err != nil {
+		t.Fatalf("GetCrutchByID failed: %v", err)
+	}
+	if crutch.Status != CrutchQueued {
+		t.Errorf("status of a new crutch = %q, want %q", crutch.Status, CrutchQueued)
+	}
+	if time.Since(crutch.CreatedAt) > time.Minute {
+		t.Errorf("CreatedAt = %v, want now", crutch.CreatedAt)
+	}
+
+	if err := UpdateCrutchStatus(walkDB, "vm-1", CrutchRunning); err != nil {
+		t.Fatalf("UpdateCrutchStatus failed: %v", err)
+	}
+	running, err := ListRunningCrutches(walkDB)
+	if err != nil {
+		t.Fatalf("ListRunningCrutches failed: %v", err)
+	}
+	if len(running) != 1 || running[0].ID != "vm-1" || running[0].Status != CrutchRunning {
+		t.Errorf("running crutches = %+v, want vm-1", running)
+	}
+
+	if err := UpdateCrutchStatus(walkDB, "vm-1", "paused"); !errors.Is(err, ErrInvalidCrutchStatus) {
+		t.Errorf("UpdateCrutchStatus(paused) error = %v, want %v", err, ErrInvalidCrutchStatus)
+	}
+	if err := UpdateCrutchStatus(walkDB, "vm-missing", CrutchStopped); !errors.Is(err, ErrCrutchNotFound) {
+		t.Errorf("UpdateCrutchStatus of missing crutch error = %v, want %v", err, ErrCrutchNotFound)
+	}
+}
+
+func TestReconcileCrutches(t *testing.T) {
+	walkDB := newCrutchTestDB(t)
+
+	original := processAlive
+	processAlive = func(pid int) bool { return pid == 100 }
+	t.Cleanup(func() { processAlive = original })
+
+	crutches := []*Crutch{
+		{ID: "vm-alive", Pid: 100, Status: CrutchRunning},
+		{ID: "vm-dead", Pid: 200, Status: CrutchRunning},
+		{ID: "vm-queued", Pid: 0, Status: CrutchQueued},
+		{ID: "vm-failed", Pid: 300, Status: CrutchError},
+	}
+	for _, crutch := range crutches {
+		crutch.AppID, crutch.SocketPath = "app-1", "/"+crutch.ID+".sock"
+		if err := InsertCrutch(walkDB, crutch); err != nil {
+			t.Fatalf("InsertCrutch failed: %v", err)
+		}
+	}
+
+	stopped, err := ReconcileCrutches(walkDB)
+	if err != nil {
+		t.Fatalf("ReconcileCrutches failed: %v", err)
+	}
+	if !slices.Equal(stopped, []string{"vm-dead"}) {
+		t.Errorf("stopped = %v, want [vm-dead]", stopped)
+	}
+
+	want := map[string]string{
+		"vm-alive":  CrutchRunning,
+		"vm-dead":   CrutchStopped,
+		"vm-queued": CrutchQueued,
+		"vm-failed": CrutchError,
+	}
+	for id, status := range want {
+		crutch, err := GetCrutchByID(walkDB, id)
+		if err != nil {
+			t.Fatalf("GetCrutchByID failed: %v", err)
+		}
+		if crutch.Status != status {
+			t.Errorf("status of %s = %q, want %q", id, crutch.Status, status)
+		}
+	}
+}
+
+func TestStartCrutchLimit(t *testing.T) {
+	ctx := context.Background()
+	walkDB := newCrutchTestDB(t)
+	if err := UpsertApp(ctx, walkDB, &App{ID: "app-1", Digest: "sha256:abc", BaseVersion: "v0.1.1", MaxRunningCrutches: 2}); err != nil {
+		t.Fatalf("UpsertApp failed: %v", err)
+	}
+
+	// below the limit
+	for _, id := range []string{"vm-1", "vm-2"} {
+		if err := StartCrutch(ctx, walkDB, &Crutch{ID: id, AppID: "app-1", Pid: 42}); err != nil {
+			t.Fatalf("StartCrutch(%s) below the limit failed: %v", id, err)
+		}
+	}
+	// a running crutch is not counted against itself
+	if err := StartCrutch(ctx, walkDB, &Crutch{ID: "vm-2", AppID: "app-1", Pid: 43}); err != nil {
+		t.Fatalf("restarting vm-2 failed: %v", err)
+	}
+
+	// at the limit
+	var limitErr *CrutchLimitError
+	err := StartCrutch(ctx, walkDB, &Crutch{ID: "vm-3", AppID: "app-1", Pid: 44})
+	if !errors.As(err, &limitErr) || limitErr.Limit != 2 || limitErr.AppID != "app-1" {
+		t.Fatalf("StartCrutch at the limit error = %v, want a CrutchLimitError of 2", err)
+	}
+	if _, err := GetCrutchByID(walkDB, "vm-3"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("rejected crutch was recorded, GetCrutchByID error = %v", err)
+	}
+	if count, err := CountRunningCrutches(walkDB, "app-1"); err != nil || count != 2 {
+		t.Errorf("CountRunningCrutches() = %d, %v, want 2", count, err)
+	}
+
+	// stopping one frees a slot
+	store := &CrutchStore{DB: walkDB}
+	if err := store.StopInstance(ctx, "vm-1"); err != nil {
+		t.Fatalf("StopInstance failed: %v", err)
+	}
+	if err := store.StartInstance(ctx, "app-1", "vm-3", 44, "/vm-3.sock"); err != nil {
+		t.Errorf("StartInstance after a stop failed: %v", err)
+	}
+}
+
+func TestStartCrutchUnlimited(t *testing.T) {
+	ctx := context.Background()
+	walkDB := newCrutchTestDB(t)
+
+	for i := range 5 {
+		crutch := &Crutch{ID: fmt.Sprintf("vm-%d", i), AppID: "app-1", Pid: 42}
+		if err := StartCrutch(ctx, walkDB, crutch); err != nil {
+			t.Fatalf("StartCrutch(%s) failed: %v", crutch.ID, err)
+		}
+		if crutch.Status != CrutchRunning {
+			t.Errorf("status = %q, want %q", crutch.Status, CrutchRunning)
+		}
+	}
+
+	if err := StartCrutch(ctx, walkDB, &Crutch{ID: "vm-x", AppID: "missing"}); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("StartCrutch of an unknown app error = %v, want %v", err, sql.ErrNoRows)
+	}
+}
@@ -5,20 +5,247 @@ import (
 	"database/sql"
 	"embed"
 	"fmt"
+	"io/fs"
+	"maps"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
 )
 
 //go:embed migration/*.sql
 var migrationFiles embed.FS
 
-func InitSchema(ctx context.Context, db *sql.DB) error {
-	schema, err := migrationFiles.ReadFile("migration/001_initial.sql")
+// migration is a numbered SQL step, files are named migration/{version}_{name}.sql
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// Migrate applies all migrations that have not run yet in version order and
+// records each in schema_migrations. Databases created before migrations were
+// tracked (by the former InitSchema) are adopted at version 1 if their schema
+// is the one of the initial migration.
+func Migrate(ctx context.Context, db *sql.DB) error {
+	return migrate(ctx, db, migrationFiles)
+}
+
+func migrate(ctx context.Context, db *sql.DB, fsys fs.FS) error {
+	migrations, err := readMigrations(fsys)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INT PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("create migrations table: %w", err)
+	}
+
+	if err := adoptUntrackedSchema(ctx, db, migrations); err != nil {
+		return err
+	}
+
+	applied, err := appliedVersions(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+		if err := applyMigration(ctx, db, m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readMigrations(fsys fs.FS) ([]migration, error) {
+	files, err := fs.Glob(fsys, "migration/*.sql")
+	if err != nil {
+		return nil, fmt.Errorf("list migrations: %w", err)
+	}
+
+	var migrations []migration
+	for _, file := range files {
+		name := strings.TrimSuffix(path.Base(file), ".sql")
+		versionPart, _, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(versionPart)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: file name must start with its version", file)
+		}
+
+		content, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration file: %w", err)
+		}
+
+		migrations = append(migrations, migration{version: version, name: name, sql: string(content)})
+	}
+
+	slices.SortFunc(migrations, func(a, b migration) int { return a.version - b.version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version == migrations[i-1].version {
+			return nil, fmt.Errorf("duplicate migration version %d", migrations[i].version)
+		}
+	}
+
+	return migrations, nil
+}
+
+// adoptUntrackedSchema marks the initial migration as applied if no migration
+// was recorded yet but its tables exist, e.g. in a database of the former
+// InitSchema. The tables have to have exactly the columns the migration creates,
+// a database with another schema fails instead of being skipped by the migrations.
+func adoptUntrackedSchema(ctx context.Context, db *sql.DB, migrations []migration) error {
+	if len(migrations) == 0 {
+		return nil
+	}
+
+	var recorded int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM schema_migrations`).Scan(&recorded); err != nil {
+		return fmt.Errorf("read migrations: %w", err)
+	}
+	if recorded > 0 {
+		return nil
+	}
+
+	initial := migrations[0]
+	want, err := migrationSchema(ctx, initial)
+	if err != nil {
+		return err
+	}
+	have, err := tableColumns(ctx, db, slices.Collect(maps.Keys(want)))
+	if err != nil {
+		return fmt.Errorf("inspect schema: %w", err)
+	}
+	if len(have) == 0 {
+		return nil
+	}
+	if !maps.EqualFunc(have, want, slices.Equal) {
+		return fmt.Errorf("adopt existing schema: tables %v do not match migration %s %v", have, initial.name, want)
+	}
+
+	_, err = db.ExecContext(ctx, `INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, initial.version, initial.name)
+	if err != nil {
+		return fmt.Errorf("adopt existing schema: %w", err)
+	}
+
+	return nil
+}
+
+// migrationSchema returns the columns of the tables m creates, by applying it to
+// an empty in-memory database
+func migrationSchema(ctx context.Context, m migration) (map[string][]string, error) {
+	scratch, err := sql.Open("sqlite3", ":memory:")
 	if err != nil {
-		return fmt.Errorf("failed to read migration file: %w", err)
+		return nil, fmt.Errorf("migration %s: %w", m.name, err)
 	}
+	defer scratch.Close()
+	// every connection gets its own in-memory database
+	scratch.SetMaxOpenConns(1)
 
-	_, err = db.ExecContext(ctx, string(schema))
+	if _, err := scratch.ExecContext(ctx, m.sql); err != nil {
+		return nil, fmt.Errorf("migration %s: %w", m.name, err)
+	}
+
+	rows, err := scratch.QueryContext(ctx, `SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'`)
+	if err != nil {
+		return nil, fmt.Errorf("migration %s: %w", m.name, err)
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("migration %s: %w", m.name, err)
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("migration %s: %w", m.name, err)
+	}
+
+	columns, err := tableColumns(ctx, scratch, tables)
 	if err != nil {
-		return fmt.Errorf("failed to execute schema: %w", err)
+		return nil, fmt.Errorf("migration %s: %w", m.name, err)
+	}
+	return columns, nil
+}
+
+// tableColumns returns the column names in order of those tables that exist in db
+func tableColumns(ctx context.Context, db *sql.DB, tables []string) (map[string][]string, error) {
+	columns := make(map[string][]string)
+	for _, table := range tables {
+		rows, err := db.QueryContext(ctx, `SELECT name FROM pragma_table_info(?) ORDER BY cid`, table)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var column string
+			if err := rows.Scan(&column); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			columns[table] = append(columns[table], column)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return columns, nil
+}
+
+func appliedVersions(ctx context.Context, db *sql.DB) (map[int]bool, error) {
+	rows, err := db.QueryContext(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("read migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]bool)
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, fmt.Errorf("read migrations: %w", err)
+		}
+		applied[version] = true
+	}
+
+	return applied, rows.Err()
+}
+
+// applyMigration runs a migration and records it in one transaction
+func applyMigration(ctx context.Context, db *sql.DB, m migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("migration %s: %w", m.name, err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, m.sql); err != nil {
+		return fmt.Errorf("migration %s: %w", m.name, err)
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, m.version, m.name)
+	if err != nil {
+		return fmt.Errorf("migration %s: record: %w", m.name, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("migration %s: %w", m.name, err)
 	}
 
 	return nil
@@ -0,0 +1,161 @@
+package db_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"testing/fstest"
+
+	"github.com/maxdollinger/walk.io/internal/db"
+	"github.com/maxdollinger/walk.io/internal/db/dbtest"
+)
+
+func migrationCount(t *testing.T, walkDB *sql.DB) int {
+	t.Helper()
+
+	var count int
+	if err := walkDB.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&count); err != nil {
+		t.Fatalf("count migrations: %v", err)
+	}
+	return count
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	ctx := context.Background()
+	walkDB := dbtest.NewUnmigratedDB(t)
+
+	for range 2 {
+		if err := db.Migrate(ctx, walkDB); err != nil {
+			t.Fatalf("Migrate failed: %v", err)
+		}
+	}
+
+	migrations, err := db.ReadMigrations(db.MigrationFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := migrationCount(t, walkDB); got != len(migrations) {
+		t.Errorf("recorded migrations = %d, want %d", got, len(migrations))
+	}
+}
+
+func TestMigrateAppliesInOrder(t *testing.T) {
+	ctx := context.Background()
+	walkDB := dbtest.NewUnmigratedDB(t)
+
+	fsys := fstest.MapFS{
+		"migration/001_initial.sql":  {Data: []byte(`CREATE TABLE apps (id VARCHAR(255) PRIMARY KEY);`)},
+		"migration/010_label.sql":    {Data: []byte(`ALTER TABLE apps ADD COLUMN label TEXT NOT NULL DEFAULT 'none';`)},
+		"migration/002_digest.sql":   {Data: []byte(`ALTER TABLE apps ADD COLUMN digest TEXT;`)},
+		"migration/README.md":        {Data: []byte(`not a migration`)},
+		"migration/003_seed_app.sql": {Data: []byte(`INSERT INTO apps (id, digest) VALUES ('app-1', 'sha256:abc');`)},
+	}
+	if err := db.MigrateFS(ctx, walkDB, fsys); err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+
+	var digest, label string
+	if err := walkDB.QueryRow(`SELECT digest, label FROM apps WHERE id = 'app-1'`).Scan(&digest, &label); err != nil {
+		t.Fatalf("query migrated table: %v", err)
+	}
+	if digest != "sha256:abc" || label != "none" {
+		t.Errorf("app = %s/%s, want sha256:abc/none", digest, label)
+	}
+	if got := migrationCount(t, walkDB); got != 4 {
+		t.Errorf("recorded migrations = %d, want 4", got)
+	}
+}
+
+// baselineSchema is the schema the former InitSchema created, kept verbatim so
+// the adoption is tested against real legacy databases, not the current 001
+const baselineSchema = `
+CREATE TABLE apps (
+    id VARCHAR(255) PRIMARY KEY,
+    digest VARCHAR(255) NOT NULL UNIQUE,
+    base_version VARCHAR(255) NOT NULL,
+    state_fs_size_bytes BIGINT NOT NULL DEFAULT 1073741824,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE crutches (
+    id VARCHAR(255) PRIMARY KEY,
+    app_id VARCHAR(255) NOT NULL,
+    pid INT NOT NULL,
+    socket_path VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (app_id) REFERENCES apps(id)
+);
+
+CREATE TABLE build_jobs (
+    id VARCHAR(255) PRIMARY KEY,
+    app_id VARCHAR(255) NOT NULL,
+    status VARCHAR(50) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (app_id) REFERENCES apps(id)
+);
+`
+
+func TestMigrateAdoptsUntrackedSchema(t *testing.T) {
+	ctx := context.Background()
+	walkDB := dbtest.NewUnmigratedDB(t)
+
+	if _, err := walkDB.Exec(baselineSchema); err != nil {
+		t.Fatalf("create legacy schema: %v", err)
+	}
+	if _, err := walkDB.Exec(`INSERT INTO apps (id, digest, base_version) VALUES ('app-1', 'sha256:abc', 'v1')`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Migrate(ctx, walkDB); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+
+	var count int
+	if err := walkDB.QueryRow(`SELECT COUNT(*) FROM apps`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("apps = %d after adoption, want 1", count)
+	}
+
+	var version int
+	if err := walkDB.QueryRow(`SELECT MIN(version) FROM schema_migrations`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 {
+		t.Errorf("adopted version = %d, want 1", version)
+	}
+
+	// the later migrations ran on the adopted schema
+	_, err := walkDB.Exec(`INSERT INTO build_jobs (id, app_id, image_name, status, cancel_requested) VALUES ('job-1', 'app-1', 'app:latest', 'queued', 1)`)
+	if err != nil {
+		t.Errorf("build_jobs not migrated: %v", err)
+	}
+}
+
+func TestMigrateRejectsUnknownUntrackedSchema(t *testing.T) {
+	walkDB := dbtest.NewUnmigratedDB(t)
+
+	if _, err := walkDB.Exec(`CREATE TABLE apps (id VARCHAR(255) PRIMARY KEY, name TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrate(context.Background(), walkDB); err == nil {
+		t.Error("Migrate adopted a schema the initial migration doesn't create")
+	}
+	if got := migrationCount(t, walkDB); got != 0 {
+		t.Errorf("recorded migrations = %d, want none", got)
+	}
+}
+
+func TestReadMigrationsRejectsDuplicates(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migration/001_a.sql": {Data: []byte(`SELECT 1;`)},
+		"migration/1_b.sql":   {Data: []byte(`SELECT 1;`)},
+	}
+	if _, err := db.ReadMigrations(fsys); err == nil {
+		t.Error("readMigrations accepted duplicate versions")
+	}
+}
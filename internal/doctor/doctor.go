@@ -0,0 +1,235 @@
+// Package doctor checks that the host can build and run walkio VMs, so a missing
+// requirement is reported up front instead of failing the first VM start.
+package doctor
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/maxdollinger/walk.io/internal/vm"
+)
+
+// Status of a single check
+type Status string
+
+const (
+	StatusPass Status = "pass"
+	StatusFail Status = "fail"
+)
+
+// capNetAdmin is the bit of CAP_NET_ADMIN in the capability sets of /proc/self/status
+const capNetAdmin = 12
+
+// requiredBinaries are the host tools the builder shells out to
+var requiredBinaries = []string{"mkfs.ext4", "e2fsck", "resize2fs"}
+
+type CheckResult struct {
+	Name        string
+	Status      Status
+	Detail      string // what was found
+	Remediation string // how to fix a failed check
+}
+
+type Report struct {
+	Checks []CheckResult
+}
+
+// OK reports whether all checks passed
+func (r *Report) OK() bool {
+	for _, check := range r.Checks {
+		if check.Status != StatusPass {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Print writes one line per check and the remediation of failed checks
+func (r *Report) Print(w io.Writer) error {
+	for _, check := range r.Checks {
+		if _, err := fmt.Fprintf(w, "[%s] %s: %s\n", check.Status, check.Name, check.Detail); err != nil {
+			return err
+		}
+		if check.Status == StatusFail && len(check.Remediation) > 0 {
+			if _, err := fmt.Fprintf(w, "       fix: %s\n", check.Remediation); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// probes are the host lookups of the checks, replaced in tests
+type probes struct {
+	openRW       func(path string) error
+	lookPath     func(file string) (string, error)
+	readFile     func(path string) ([]byte, error)
+	stat         func(path string) (os.FileInfo, error)
+	resolveVMM   func(config *vm.VMConfig) (string, error)
+	readContract func(path string) (*vm.GuestContract, error)
+}
+
+var hostProbes = probes{
+	openRW: func(path string) error {
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	},
+	lookPath:     exec.LookPath,
+	readFile:     os.ReadFile,
+	stat:         os.Stat,
+	resolveVMM:   vm.ResolveFirecrackerBinary,
+	readContract: vm.ReadGuestContract,
+}
+
+// EnvironmentCheck verifies KVM access, the required binaries, CAP_NET_ADMIN,
+// IP forwarding and the base bundle of baseVersion.
+func EnvironmentCheck(baseVersion string) *Report {
+	return environmentCheck(hostProbes, baseVersion)
+}
+
+func environmentCheck(p probes, baseVersion string) *Report {
+	report := &Report{}
+	report.Checks = append(report.Checks, checkKVM(p))
+	for _, binary := range requiredBinaries {
+		report.Checks = append(report.Checks, checkBinary(p, binary))
+	}
+	report.Checks = append(report.Checks,
+		checkNetAdmin(p),
+		checkIPForwarding(p),
+		checkBaseBundle(p, baseVersion),
+	)
+
+	return report
+}
+
+func checkKVM(p probes) CheckResult {
+	result := CheckResult{Name: "kvm", Status: StatusPass, Detail: "/dev/kvm is accessible"}
+	if err := p.openRW("/dev/kvm"); err != nil {
+		result.Status = StatusFail
+		result.Detail = err.Error()
+		result.Remediation = "enable hardware virtualization and make /dev/kvm read-writable for this user (e.g. add it to the kvm group)"
+	}
+
+	return result
+}
+
+func checkBinary(p probes, binary string) CheckResult {
+	result := CheckResult{Name: binary, Status: StatusPass}
+	path, err := p.lookPath(binary)
+	if err != nil {
+		result.Status = StatusFail
+		result.Detail = "not found in $PATH"
+		result.Remediation = "install e2fsprogs"
+		return result
+	}
+
+	result.Detail = path
+	return result
+}
+
+func checkNetAdmin(p probes) CheckResult {
+	result := CheckResult{Name: "CAP_NET_ADMIN", Status: StatusPass, Detail: "capability is effective"}
+	fail := func(detail string) CheckResult {
+		result.Status = StatusFail
+		result.Detail = detail
+		result.Remediation = "run as root or grant CAP_NET_ADMIN (e.g. setcap cap_net_admin+ep on the binary)"
+		return result
+	}
+
+	data, err := p.readFile("/proc/self/status")
+	if err != nil {
+		return fail(err.Error())
+	}
+
+	capEff, err := effectiveCapabilities(string(data))
+	if err != nil {
+		return fail(err.Error())
+	}
+	if capEff&(1<<capNetAdmin) == 0 {
+		return fail("capability is not effective")
+	}
+
+	return result
+}
+
+// effectiveCapabilities parses the CapEff line of /proc/self/status
+func effectiveCapabilities(status string) (uint64, error) {
+	for line := range strings.Lines(status) {
+		value, found := strings.CutPrefix(line, "CapEff:")
+		if !found {
+			continue
+		}
+
+		capEff, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		if err != nil {
+			return 0, fmt.Errorf("parse CapEff: %w", err)
+		}
+		return capEff, nil
+	}
+
+	return 0, fmt.Errorf("no CapEff in process status")
+}
+
+func checkIPForwarding(p probes) CheckResult {
+	result := CheckResult{Name: "ip_forward", Status: StatusPass, Detail: "IPv4 forwarding is enabled"}
+	data, err := p.readFile("/proc/sys/net/ipv4/ip_forward")
+	switch {
+	case err != nil:
+		result.Status = StatusFail
+		result.Detail = err.Error()
+	case strings.TrimSpace(string(data)) != "1":
+		result.Status = StatusFail
+		result.Detail = "IPv4 forwarding is disabled"
+	}
+	if result.Status == StatusFail {
+		result.Remediation = "sysctl -w net.ipv4.ip_forward=1"
+	}
+
+	return result
+}
+
+func checkBaseBundle(p probes, baseVersion string) CheckResult {
+	config := &vm.VMConfig{BaseVersion: baseVersion}
+	result := CheckResult{Name: "base bundle " + baseVersion, Status: StatusPass}
+	fail := func(detail string) CheckResult {
+		result.Status = StatusFail
+		result.Detail = detail
+		result.Remediation = "install the base bundle to " + path.Dir(config.GetKernelPath())
+		return result
+	}
+
+	for _, path := range []string{config.GetKernelPath(), config.GetRootFSPath()} {
+		if _, err := p.stat(path); err != nil {
+			return fail(err.Error())
+		}
+	}
+
+	contract, err := p.readContract(config.GetContractPath())
+	if err != nil {
+		return fail(err.Error())
+	}
+	if _, err := vm.NegotiateContract(contract); err != nil {
+		return fail(err.Error())
+	}
+
+	vmmBinary, err := p.resolveVMM(config)
+	if err != nil {
+		result.Status = StatusFail
+		result.Detail = err.Error()
+		result.Remediation = "add firecracker to the base bundle, set $" + vm.FirecrackerBinEnv + " or install it to $PATH"
+		return result
+	}
+
+	result.Detail = "kernel, rootfs and " + vmmBinary
+	return result
+}
@@ -0,0 +1,154 @@
+package doctor
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/maxdollinger/walk.io/internal/vm"
+)
+
+// healthyProbes describe a host passing all checks
+func healthyProbes() probes {
+	return probes{
+		openRW:   func(path string) error { return nil },
+		lookPath: func(file string) (string, error) { return "/usr/sbin/" + file, nil },
+		readFile: func(path string) ([]byte, error) {
+			switch path {
+			case "/proc/self/status":
+				return []byte("Name:\twalkcoord\nCapInh:\t0000000000000000\nCapEff:\t000001ffffffffff\n"), nil
+			case "/proc/sys/net/ipv4/ip_forward":
+				return []byte("1\n"), nil
+			}
+			return nil, os.ErrNotExist
+		},
+		stat:       func(path string) (os.FileInfo, error) { return nil, nil },
+		resolveVMM: func(config *vm.VMConfig) (string, error) { return config.GetFirecrackerPath(), nil },
+		readContract: func(path string) (*vm.GuestContract, error) {
+			return &vm.GuestContract{MinVersion: 1, MaxVersion: 2}, nil
+		},
+	}
+}
+
+func TestEnvironmentCheckHealthy(t *testing.T) {
+	report := environmentCheck(healthyProbes(), "v0.1.1")
+
+	if !report.OK() {
+		var out strings.Builder
+		_ = report.Print(&out)
+		t.Errorf("report of a healthy host is not ok:\n%s", out.String())
+	}
+	if len(report.Checks) != 4+len(requiredBinaries) {
+		t.Errorf("report has %d checks, want %d", len(report.Checks), 4+len(requiredBinaries))
+	}
+}
+
+func TestEnvironmentCheckFailures(t *testing.T) {
+	tests := []struct {
+		name      string
+		breakHost func(p *probes)
+		wantCheck string
+	}{
+		{
+			name:      "no kvm access",
+			breakHost: func(p *probes) { p.openRW = func(string) error { return os.ErrPermission } },
+			wantCheck: "kvm",
+		},
+		{
+			name: "missing resize2fs",
+			breakHost: func(p *probes) {
+				p.lookPath = func(file string) (string, error) {
+					if file == "resize2fs" {
+						return "", errors.New("not found")
+					}
+					return "/usr/sbin/" + file, nil
+				}
+			},
+			wantCheck: "resize2fs",
+		},
+		{
+			name: "no CAP_NET_ADMIN",
+			breakHost: func(p *probes) {
+				readFile := p.readFile
+				p.readFile = func(path string) ([]byte, error) {
+					if path == "/proc/self/status" {
+						return []byte("CapEff:\t0000000000000000\n"), nil
+					}
+					return readFile(path)
+				}
+			},
+			wantCheck: "CAP_NET_ADMIN",
+		},
+		{
+			name: "ip forwarding disabled",
+			breakHost: func(p *probes) {
+				readFile := p.readFile
+				p.readFile = func(path string) ([]byte, error) {
+					if path == "/proc/sys/net/ipv4/ip_forward" {
+						return []byte("0\n"), nil
+					}
+					return readFile(path)
+				}
+			},
+			wantCheck: "ip_forward",
+		},
+		{
+			name:      "missing kernel",
+			breakHost: func(p *probes) { p.stat = func(string) (os.FileInfo, error) { return nil, os.ErrNotExist } },
+			wantCheck: "base bundle v0.1.1",
+		},
+		{
+			name: "incompatible contract",
+			breakHost: func(p *probes) {
+				p.readContract = func(string) (*vm.GuestContract, error) {
+					return &vm.GuestContract{MinVersion: 99, MaxVersion: 99}, nil
+				}
+			},
+			wantCheck: "base bundle v0.1.1",
+		},
+		{
+			name: "missing firecracker",
+			breakHost: func(p *probes) {
+				p.resolveVMM = func(*vm.VMConfig) (string, error) { return "", vm.ErrFirecrackerNotFound }
+			},
+			wantCheck: "base bundle v0.1.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := healthyProbes()
+			tt.breakHost(&p)
+
+			report := environmentCheck(p, "v0.1.1")
+			if report.OK() {
+				t.Fatal("report is ok, want a failed check")
+			}
+
+			for _, check := range report.Checks {
+				wantStatus := StatusPass
+				if check.Name == tt.wantCheck {
+					wantStatus = StatusFail
+				}
+				if check.Status != wantStatus {
+					t.Errorf("check %s = %s (%s), want %s", check.Name, check.Status, check.Detail, wantStatus)
+				}
+				if check.Status == StatusFail && len(check.Remediation) == 0 {
+					t.Errorf("failed check %s has no remediation", check.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestEffectiveCapabilities(t *testing.T) {
+	capEff, err := effectiveCapabilities("CapPrm:\t0000000000003000\nCapEff:\t0000000000001000\n")
+	if err != nil || capEff != 1<<capNetAdmin {
+		t.Errorf("effectiveCapabilities() = %x, %v, want %x", capEff, err, 1<<capNetAdmin)
+	}
+
+	if _, err := effectiveCapabilities("CapPrm:\t0000000000003000\n"); err == nil {
+		t.Error("effectiveCapabilities() accepted a status without CapEff")
+	}
+}
@@ -0,0 +1,65 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// BalloonStats are the memory statistics the balloon driver of the guest reports
+type BalloonStats struct {
+	TargetMiB       int    `json:"target_mib"`       // size the balloon is inflated or deflated to
+	ActualMiB       int    `json:"actual_mib"`       // current size of the balloon
+	FreeMemory      uint64 `json:"free_memory"`      // bytes the guest doesn't use
+	TotalMemory     uint64 `json:"total_memory"`     // bytes of guest memory
+	AvailableMemory uint64 `json:"available_memory"` // bytes available to new processes without swapping
+	MajorFaults     uint64 `json:"major_faults"`
+	MinorFaults     uint64 `json:"minor_faults"`
+}
+
+// validateBalloonSize rejects balloon sizes that are negative or larger than the guest memory
+func validateBalloonSize(config *VMConfig, sizeMiB int) error {
+	if sizeMiB < 0 || int64(sizeMiB) > config.Memory.MB() {
+		return fmt.Errorf("balloon size %d MiB is outside the guest memory of %d MiB", sizeMiB, config.Memory.MB())
+	}
+	return nil
+}
+
+// UpdateBalloon inflates or deflates the balloon of the running VM to targetMiB,
+// inflating takes the memory from the guest and returns it to the host.
+func (m *FirecrackerMachine) UpdateBalloon(ctx context.Context, targetMiB int) error {
+	if !m.MachineConfig.hasBalloon() {
+		return fmt.Errorf("machine %s has no balloon device", m.ID)
+	}
+	if err := validateBalloonSize(m.MachineConfig, targetMiB); err != nil {
+		return err
+	}
+	if m.Cmd == nil {
+		return fmt.Errorf("machine %s is not running", m.ID)
+	}
+
+	api := newFirecrackerAPI(m.SocketPath)
+	if err := api.patch(ctx, "/balloon", map[string]int{"amount_mib": targetMiB}); err != nil {
+		return fmt.Errorf("update balloon of %s: %w", m.ID, err)
+	}
+
+	m.MachineConfig.BalloonSizeMiB = targetMiB
+	return nil
+}
+
+// BalloonStats returns the latest memory statistics of the running VM,
+// the guest reports them every VMConfig.BalloonStatsInterval
+func (m *FirecrackerMachine) BalloonStats(ctx context.Context) (*BalloonStats, error) {
+	if m.MachineConfig.BalloonStatsInterval <= 0 {
+		return nil, errors.New("balloon statistics are not enabled")
+	}
+	if m.Cmd == nil {
+		return nil, fmt.Errorf("machine %s is not running", m.ID)
+	}
+
+	var stats BalloonStats
+	if err := newFirecrackerAPI(m.SocketPath).get(ctx, "/balloon/statistics", &stats); err != nil {
+		return nil, fmt.Errorf("balloon statistics of %s: %w", m.ID, err)
+	}
+	return &stats, nil
+}
@@ -0,0 +1,82 @@
+package vm
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/maxdollinger/walk.io/pkg/utils"
+)
+
+func TestBuildFirecrackerConfigBalloon(t *testing.T) {
+	config := &VMConfig{BaseVersion: "v0.1.1", VCPU: 1, Memory: 512 * utils.MB}
+
+	if fcConfig := buildFirecrackerConfig(config, "/state.ext4", 2, "/logs/vm-1.log", ""); fcConfig["balloon"] != nil {
+		t.Errorf("config without balloon has balloon: %v", fcConfig["balloon"])
+	}
+
+	config.BalloonSizeMiB, config.DeflateOnOOM, config.BalloonStatsInterval = 128, true, 5*time.Second
+	balloon, ok := buildFirecrackerConfig(config, "/state.ext4", 2, "/logs/vm-1.log", "")["balloon"].(map[string]any)
+	if !ok {
+		t.Fatal("config has no balloon section")
+	}
+	if balloon["amount_mib"] != 128 || balloon["deflate_on_oom"] != true || balloon["stats_polling_interval_s"] != 5 {
+		t.Errorf("balloon = %v, want 128 MiB deflating on OOM with stats every 5s", balloon)
+	}
+
+	config.BalloonSizeMiB = 1024
+	if _, err := NewFirecrackerMachine("/state.ext4", config); err == nil {
+		t.Error("NewFirecrackerMachine accepted a balloon larger than the guest memory")
+	}
+}
+
+func TestUpdateBalloon(t *testing.T) {
+	socketPath, calls := stubFirecrackerAPI(t, "")
+	m := newRunningFirecrackerMachine(t, socketPath)
+	m.MachineConfig.Memory = 512 * utils.MB
+
+	if err := m.UpdateBalloon(context.Background(), 64); err == nil {
+		t.Fatal("UpdateBalloon succeeded without a balloon device")
+	}
+
+	m.MachineConfig.DeflateOnOOM = true
+	if err := m.UpdateBalloon(context.Background(), 600); err == nil {
+		t.Error("UpdateBalloon accepted a balloon larger than the guest memory")
+	}
+	if err := m.UpdateBalloon(context.Background(), 256); err != nil {
+		t.Fatalf("UpdateBalloon failed: %v", err)
+	}
+
+	got := calls()
+	if len(got) != 1 || got[0].method != http.MethodPatch || got[0].path != "/balloon" || got[0].raw != `{"amount_mib":256}` {
+		t.Errorf("calls = %v, want one PATCH /balloon to 256 MiB", got)
+	}
+	if m.MachineConfig.BalloonSizeMiB != 256 {
+		t.Errorf("BalloonSizeMiB = %d, want 256", m.MachineConfig.BalloonSizeMiB)
+	}
+}
+
+func TestBalloonStats(t *testing.T) {
+	socketPath := serveUnix(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/balloon/statistics" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(`{"target_pages":32768,"actual_pages":16384,"target_mib":128,"actual_mib":64,"free_memory":1024}`))
+	}))
+	m := newRunningFirecrackerMachine(t, socketPath)
+
+	if _, err := m.BalloonStats(context.Background()); err == nil {
+		t.Fatal("BalloonStats succeeded without statistics enabled")
+	}
+
+	m.MachineConfig.BalloonStatsInterval = time.Second
+	stats, err := m.BalloonStats(context.Background())
+	if err != nil {
+		t.Fatalf("BalloonStats failed: %v", err)
+	}
+	if *stats != (BalloonStats{TargetMiB: 128, ActualMiB: 64, FreeMemory: 1024}) {
+		t.Errorf("stats = %+v", stats)
+	}
+}
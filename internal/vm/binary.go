@@ -0,0 +1,109 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Environment variables overriding the VMM binary for base bundles without one
+const (
+	FirecrackerBinEnv     = "WALKIO_FIRECRACKER_BIN"
+	CloudHypervisorBinEnv = "WALKIO_CLOUD_HYPERVISOR_BIN"
+	JailerBinEnv          = "WALKIO_JAILER_BIN"
+)
+
+var (
+	ErrFirecrackerNotFound     = errors.New("firecracker binary not found")
+	ErrCloudHypervisorNotFound = errors.New("cloud-hypervisor binary not found")
+	ErrJailerNotFound          = errors.New("jailer binary not found")
+)
+
+// vmmBinary describes how the binary of a VMM is found and recognized
+type vmmBinary struct {
+	name          string // file name in the base bundle and $PATH
+	envVar        string
+	versionPrefix string // start of the --version output
+	errNotFound   error
+}
+
+var (
+	firecrackerBinary     = vmmBinary{"firecracker", FirecrackerBinEnv, "Firecracker v", ErrFirecrackerNotFound}
+	cloudHypervisorBinary = vmmBinary{"cloud-hypervisor", CloudHypervisorBinEnv, "cloud-hypervisor v", ErrCloudHypervisorNotFound}
+	jailerBinary          = vmmBinary{"jailer", JailerBinEnv, "Jailer v", ErrJailerNotFound}
+)
+
+const versionCheckTimeout = 5 * time.Second
+
+// ResolveFirecrackerBinary returns the firecracker binary for the base version of config.
+// The binary of the base bundle is preferred, then $WALKIO_FIRECRACKER_BIN, then firecracker in $PATH.
+// A binary that exists but is not executable or does not report a firecracker version is an error.
+func ResolveFirecrackerBinary(config *VMConfig) (string, error) {
+	return resolveVMMBinary(firecrackerBinary, config.GetFirecrackerPath(), os.Getenv(FirecrackerBinEnv))
+}
+
+// ResolveCloudHypervisorBinary works like ResolveFirecrackerBinary using $WALKIO_CLOUD_HYPERVISOR_BIN
+func ResolveCloudHypervisorBinary(config *VMConfig) (string, error) {
+	return resolveVMMBinary(cloudHypervisorBinary, config.GetCloudHypervisorPath(), os.Getenv(CloudHypervisorBinEnv))
+}
+
+// ResolveJailerBinary works like ResolveFirecrackerBinary using $WALKIO_JAILER_BIN
+func ResolveJailerBinary(config *VMConfig) (string, error) {
+	return resolveVMMBinary(jailerBinary, config.GetJailerPath(), os.Getenv(JailerBinEnv))
+}
+
+func resolveFirecrackerBinary(bundlePath, envPath string) (string, error) {
+	return resolveVMMBinary(firecrackerBinary, bundlePath, envPath)
+}
+
+func resolveVMMBinary(vmm vmmBinary, bundlePath, envPath string) (string, error) {
+	candidates := []string{bundlePath}
+	if len(envPath) > 0 {
+		candidates = append(candidates, envPath)
+	}
+	if pathBinary, err := exec.LookPath(vmm.name); err == nil {
+		candidates = append(candidates, pathBinary)
+	}
+
+	for _, candidate := range candidates {
+		info, err := os.Stat(candidate)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("%s binary %s: %w", vmm.name, candidate, err)
+		}
+
+		if !info.Mode().IsRegular() || info.Mode().Perm()&0o111 == 0 {
+			return "", fmt.Errorf("%s binary %s is not executable", vmm.name, candidate)
+		}
+		if err := checkVMMVersion(vmm, candidate); err != nil {
+			return "", err
+		}
+
+		return candidate, nil
+	}
+
+	return "", fmt.Errorf("%w: tried %s, $%s and $PATH", vmm.errNotFound, bundlePath, vmm.envVar)
+}
+
+// checkVMMVersion runs binary --version and expects the version prefix of the VMM
+func checkVMMVersion(vmm vmmBinary, binary string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), versionCheckTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, binary, "--version").Output()
+	if err != nil {
+		return fmt.Errorf("%s binary %s: version check: %w", vmm.name, binary, err)
+	}
+
+	if !strings.HasPrefix(strings.TrimSpace(string(out)), vmm.versionPrefix) {
+		return fmt.Errorf("%s binary %s: unexpected version output %q", vmm.name, binary, out)
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package vm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFakeBinary writes a shell script printing output for --version
+func writeFakeBinary(t *testing.T, dir, output string, perm os.FileMode) string {
+	t.Helper()
+
+	binary := filepath.Join(dir, "firecracker")
+	script := "#!/bin/sh\necho '" + output + "'\n"
+	if err := os.WriteFile(binary, []byte(script), perm); err != nil {
+		t.Fatal(err)
+	}
+	return binary
+}
+
+func TestResolveFirecrackerBinary(t *testing.T) {
+	const version = "Firecracker v1.7.0"
+
+	tests := []struct {
+		name string
+		// returns bundle path, env path and the expected binary
+		setup   func(t *testing.T) (string, string, string)
+		wantErr error
+	}{
+		{
+			name: "base bundle binary",
+			setup: func(t *testing.T) (string, string, string) {
+				bundle := writeFakeBinary(t, t.TempDir(), version, 0o755)
+				env := writeFakeBinary(t, t.TempDir(), version, 0o755)
+				return bundle, env, bundle
+			},
+		},
+		{
+			name: "env fallback",
+			setup: func(t *testing.T) (string, string, string) {
+				env := writeFakeBinary(t, t.TempDir(), version, 0o755)
+				return filepath.Join(t.TempDir(), "firecracker"), env, env
+			},
+		},
+		{
+			name: "PATH fallback",
+			setup: func(t *testing.T) (string, string, string) {
+				pathDir := t.TempDir()
+				onPath := writeFakeBinary(t, pathDir, version, 0o755)
+				t.Setenv("PATH", pathDir)
+				return filepath.Join(t.TempDir(), "firecracker"), "", onPath
+			},
+		},
+		{
+			name: "missing everywhere",
+			setup: func(t *testing.T) (string, string, string) {
+				t.Setenv("PATH", t.TempDir())
+				return filepath.Join(t.TempDir(), "firecracker"), filepath.Join(t.TempDir(), "firecracker"), ""
+			},
+			wantErr: ErrFirecrackerNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bundle, env, want := tt.setup(t)
+
+			got, err := resolveFirecrackerBinary(bundle, env)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("resolveFirecrackerBinary() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != want {
+				t.Errorf("resolveFirecrackerBinary() = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestResolveFirecrackerBinaryRejectsInvalid(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+
+	tests := []struct {
+		name   string
+		output string
+		perm   os.FileMode
+	}{
+		{name: "not executable", output: "Firecracker v1.7.0", perm: 0o644},
+		{name: "not firecracker", output: "cloud-hypervisor v40.0", perm: 0o755},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bundle := writeFakeBinary(t, t.TempDir(), tt.output, tt.perm)
+			env := writeFakeBinary(t, t.TempDir(), "Firecracker v1.7.0", 0o755)
+
+			if _, err := resolveFirecrackerBinary(bundle, env); err == nil {
+				t.Error("resolveFirecrackerBinary() accepted an invalid bundle binary")
+			}
+		})
+	}
+}
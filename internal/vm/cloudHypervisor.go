@@ -0,0 +1,105 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// ErrUnsupportedByVMM is returned for VMConfig fields the selected VMM can't honour
+var ErrUnsupportedByVMM = errors.New("not supported by the vmm")
+
+// CloudHypervisorMachine runs the VM with cloud-hypervisor, which is configured
+// by command line arguments instead of a config file.
+type CloudHypervisorMachine struct {
+	*machine
+	Args []string
+}
+
+func NewCloudHypervisorMachine(stateDevPath string, config *VMConfig) (*CloudHypervisorMachine, error) {
+	if err := validateCloudHypervisorConfig(config); err != nil {
+		return nil, err
+	}
+
+	base, err := newMachine(stateDevPath, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CloudHypervisorMachine{
+		machine: base,
+		Args:    buildCloudHypervisorArgs(config, stateDevPath, base.ContractVersion, base.LogFile.Name(), base.SocketPath, base.VsockPath),
+	}, nil
+}
+
+// validateCloudHypervisorConfig rejects the firecracker only fields of config,
+// silently dropping them would e.g. run an unjailed or unlimited VM
+func validateCloudHypervisorConfig(config *VMConfig) error {
+	unsupported := []struct {
+		field string
+		set   bool
+	}{
+		{"jailer", config.UseJailer},
+		{"mmds", config.MMDS != nil},
+		{"drive rate limit", config.DriveRateLimit != RateLimit{}},
+		{"net rate limit", config.NetRateLimit != RateLimit{}},
+		{"balloon", config.hasBalloon()},
+		{"smt", config.SMT},
+		{"cpu template", len(config.CPUTemplate) > 0},
+	}
+
+	var errs []error
+	for _, option := range unsupported {
+		if option.set {
+			errs = append(errs, fmt.Errorf("%s: %w", option.field, ErrUnsupportedByVMM))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("%s: %w", VMMCloudHypervisor, err)
+	}
+
+	return nil
+}
+
+func (m *CloudHypervisorMachine) Start() error {
+	cloudHypervisorBin, err := ResolveCloudHypervisorBinary(m.MachineConfig)
+	if err != nil {
+		return err
+	}
+
+	return m.startProcess(cloudHypervisorBin, m.Args...)
+}
+
+// buildCloudHypervisorArgs mirrors buildFirecrackerConfig. The drives keep the
+// firecracker order, so the guest sees rootfs, app and state as vda, vdb and vdc.
+func buildCloudHypervisorArgs(config *VMConfig, stateDevPath string, contractVersion int, logPath, socketPath, vsockPath string) []string {
+	args := []string{
+		"--api-socket", "path=" + socketPath,
+		"--log-file", logPath,
+		"--kernel", config.GetKernelPath(),
+		// firecracker derives the root device from is_root_device, cloud-hypervisor needs it spelled out
+		"--cmdline", guestBootArgs(config, contractVersion) + " root=/dev/vda ro",
+		"--cpus", "boot=" + strconv.Itoa(config.VCPU),
+		"--memory", fmt.Sprintf("size=%dM", config.Memory.MB()),
+		"--disk",
+		// Drive 1: RootFS - system initialization (root device, read-only, shared)
+		"path=" + config.GetRootFSPath() + ",readonly=on",
+		// Drive 2: AppFS - application code/data (secondary, read-only)
+		"path=" + config.AppFsPath + ",readonly=on",
+		// Drive 3: StateFS - runtime state (secondary, writable)
+		"path=" + stateDevPath,
+		// the guest serial console goes to stdout like with firecracker
+		"--serial", "tty",
+		"--console", "off",
+	}
+
+	if config.Network != nil {
+		args = append(args, "--net", "tap="+config.Network.TAPDevice+",mac="+config.Network.MACAddress)
+	}
+
+	if config.VsockCID > 0 {
+		args = append(args, "--vsock", fmt.Sprintf("cid=%d,socket=%s", config.VsockCID, vsockPath))
+	}
+
+	return args
+}
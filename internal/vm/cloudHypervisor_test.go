@@ -0,0 +1,133 @@
+package vm
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/maxdollinger/walk.io/pkg/network"
+	"github.com/maxdollinger/walk.io/pkg/utils"
+)
+
+// argValues returns the values following flag up to the next flag
+func argValues(args []string, flag string) []string {
+	i := slices.Index(args, flag)
+	if i < 0 {
+		return nil
+	}
+
+	var values []string
+	for _, arg := range args[i+1:] {
+		if strings.HasPrefix(arg, "--") {
+			break
+		}
+		values = append(values, arg)
+	}
+	return values
+}
+
+func TestBuildCloudHypervisorArgsLogger(t *testing.T) {
+	config := &VMConfig{BaseVersion: "v0.1.1", VCPU: 1, Memory: 128 * utils.MB}
+
+	args := buildCloudHypervisorArgs(config, "/state.ext4", ContractVersion, "/logs/vm-1.log", "/vm-1.sock", "")
+
+	if got := argValues(args, "--log-file"); !slices.Equal(got, []string{"/logs/vm-1.log"}) {
+		t.Errorf("--log-file = %v, want /logs/vm-1.log", got)
+	}
+	if got := argValues(args, "--api-socket"); !slices.Equal(got, []string{"path=/vm-1.sock"}) {
+		t.Errorf("--api-socket = %v, want path=/vm-1.sock", got)
+	}
+}
+
+func TestBuildCloudHypervisorArgsMachine(t *testing.T) {
+	config := &VMConfig{BaseVersion: "v0.1.1", AppFsPath: "/apps/abc.ext4", VCPU: 2, Memory: 256 * utils.MB}
+
+	args := buildCloudHypervisorArgs(config, "/state.ext4", 2, "/logs/vm-1.log", "/vm-1.sock", "")
+
+	tests := []struct {
+		flag string
+		want []string
+	}{
+		{flag: "--kernel", want: []string{config.GetKernelPath()}},
+		{flag: "--cpus", want: []string{"boot=2"}},
+		{flag: "--memory", want: []string{"size=256M"}},
+		{flag: "--serial", want: []string{"tty"}},
+		{flag: "--disk", want: []string{
+			"path=" + config.GetRootFSPath() + ",readonly=on",
+			"path=/apps/abc.ext4,readonly=on",
+			"path=/state.ext4",
+		}},
+	}
+	for _, tt := range tests {
+		if got := argValues(args, tt.flag); !slices.Equal(got, tt.want) {
+			t.Errorf("%s = %v, want %v", tt.flag, got, tt.want)
+		}
+	}
+
+	cmdline := argValues(args, "--cmdline")
+	if len(cmdline) != 1 || !strings.Contains(cmdline[0], "walkio.contract=2") || !strings.Contains(cmdline[0], "root=/dev/vda") {
+		t.Errorf("--cmdline = %v, want contract version and root device", cmdline)
+	}
+}
+
+func TestBuildCloudHypervisorArgsNetwork(t *testing.T) {
+	config := &VMConfig{BaseVersion: "v0.1.1", VCPU: 1, Memory: 128 * utils.MB}
+
+	args := buildCloudHypervisorArgs(config, "/state.ext4", 2, "/logs/vm-1.log", "/vm-1.sock", "")
+	if got := argValues(args, "--net"); got != nil {
+		t.Errorf("--net = %v, want none without network", got)
+	}
+
+	config.Network = &network.NetworkConfig{TAPDevice: "walkio-7d3f89ab", IPAddress: "172.16.0.2", MACAddress: "AA:FC:00:A1:B2:C3"}
+	args = buildCloudHypervisorArgs(config, "/state.ext4", 2, "/logs/vm-1.log", "/vm-1.sock", "")
+	if got := argValues(args, "--net"); !slices.Equal(got, []string{"tap=walkio-7d3f89ab,mac=AA:FC:00:A1:B2:C3"}) {
+		t.Errorf("--net = %v, want tap=walkio-7d3f89ab,mac=AA:FC:00:A1:B2:C3", got)
+	}
+}
+
+func TestBuildCloudHypervisorArgsVsock(t *testing.T) {
+	config := &VMConfig{BaseVersion: "v0.1.1", VCPU: 1, Memory: 128 * utils.MB, VsockCID: 42}
+
+	args := buildCloudHypervisorArgs(config, "/state.ext4", 2, "/logs/vm-1.log", "/vm-1.sock", "/vm-1.vsock")
+	if got := argValues(args, "--vsock"); !slices.Equal(got, []string{"cid=42,socket=/vm-1.vsock"}) {
+		t.Errorf("--vsock = %v, want cid=42,socket=/vm-1.vsock", got)
+	}
+}
+
+func TestNewMachineRejectsUnknownVMM(t *testing.T) {
+	if _, err := NewMachine("/state.ext4", &VMConfig{VMM: "qemu"}); err == nil {
+		t.Error("NewMachine accepted an unknown vmm")
+	}
+}
+
+func TestValidateCloudHypervisorConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config VMConfig
+	}{
+		{name: "jailer", config: VMConfig{UseJailer: true}},
+		{name: "mmds", config: VMConfig{MMDS: map[string]any{"app": "a"}}},
+		{name: "drive rate limit", config: VMConfig{DriveRateLimit: RateLimit{OpsPerSec: 100}}},
+		{name: "net rate limit", config: VMConfig{NetRateLimit: RateLimit{BytesPerSec: utils.MB}}},
+		{name: "balloon", config: VMConfig{DeflateOnOOM: true}},
+		{name: "smt", config: VMConfig{SMT: true}},
+		{name: "cpu template", config: VMConfig{CPUTemplate: "T2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateCloudHypervisorConfig(&tt.config)
+			if !errors.Is(err, ErrUnsupportedByVMM) || !strings.Contains(err.Error(), tt.name) {
+				t.Errorf("error = %v, want %s unsupported", err, tt.name)
+			}
+		})
+	}
+
+	if err := validateCloudHypervisorConfig(&VMConfig{VCPU: 2, Memory: 256 * utils.MB}); err != nil {
+		t.Errorf("plain config rejected: %v", err)
+	}
+	if _, err := NewCloudHypervisorMachine("/state.ext4", &VMConfig{UseJailer: true}); !errors.Is(err, ErrUnsupportedByVMM) {
+		t.Errorf("NewCloudHypervisorMachine error = %v, want %v", err, ErrUnsupportedByVMM)
+	}
+}
@@ -0,0 +1,67 @@
+package vm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Versions of the host/guest contract: the files under /walkio in the AppFS,
+// the drive layout and the boot args consumed by /walkio/init of the base rootfs.
+//
+// Version 2 escapes the values of /walkio/env and /walkio/argv, see
+// fs.DecodeConfigValue. AppFS devices are built without knowing the guest, so
+// the host only speaks version 2: a version 1 init would pass the escapes on,
+// e.g. a\\d for a\d. Base bundles without contract.json are version 1.
+const (
+	ContractVersion    = 2 // newest contract the host speaks
+	MinContractVersion = 2 // oldest contract the host can still speak
+)
+
+var ErrIncompatibleContract = errors.New("incompatible guest contract version")
+
+// GuestContract is the range of contract versions a base bundle supports.
+// It is read from base/{version}/contract.json, bundles without it only speak version 1.
+type GuestContract struct {
+	MinVersion int `json:"min_version"`
+	MaxVersion int `json:"max_version"`
+}
+
+// ReadGuestContract reads the contract declaration of a base bundle
+func ReadGuestContract(contractPath string) (*GuestContract, error) {
+	data, err := os.ReadFile(contractPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return &GuestContract{MinVersion: 1, MaxVersion: 1}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read guest contract: %w", err)
+	}
+
+	var contract GuestContract
+	if err := json.Unmarshal(data, &contract); err != nil {
+		return nil, fmt.Errorf("parse guest contract: %w", err)
+	}
+
+	if contract.MinVersion < 1 || contract.MaxVersion < contract.MinVersion {
+		return nil, fmt.Errorf("invalid guest contract range %d-%d", contract.MinVersion, contract.MaxVersion)
+	}
+
+	return &contract, nil
+}
+
+// NegotiateContract returns the newest contract version supported by host and guest.
+// The host downgrades to an older guest as long as it still speaks its version.
+func NegotiateContract(guest *GuestContract) (int, error) {
+	return negotiateContract(MinContractVersion, ContractVersion, guest)
+}
+
+func negotiateContract(hostMin, hostMax int, guest *GuestContract) (int, error) {
+	version := min(hostMax, guest.MaxVersion)
+	if version < max(hostMin, guest.MinVersion) {
+		return 0, fmt.Errorf("%w: host supports %d-%d, guest supports %d-%d",
+			ErrIncompatibleContract, hostMin, hostMax, guest.MinVersion, guest.MaxVersion)
+	}
+
+	return version, nil
+}
@@ -0,0 +1,106 @@
+package vm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNegotiateContract(t *testing.T) {
+	tests := []struct {
+		name    string
+		hostMin int
+		hostMax int
+		guest   GuestContract
+		want    int
+		wantErr bool
+	}{
+		{
+			name:    "matching versions",
+			hostMin: 1,
+			hostMax: 2,
+			guest:   GuestContract{MinVersion: 1, MaxVersion: 2},
+			want:    2,
+		},
+		{
+			name:    "host downgrades to older guest",
+			hostMin: 1,
+			hostMax: 3,
+			guest:   GuestContract{MinVersion: 1, MaxVersion: 2},
+			want:    2,
+		},
+		{
+			name:    "newer guest speaks host version",
+			hostMin: 1,
+			hostMax: 2,
+			guest:   GuestContract{MinVersion: 2, MaxVersion: 4},
+			want:    2,
+		},
+		{
+			name:    "guest too old",
+			hostMin: 2,
+			hostMax: 3,
+			guest:   GuestContract{MinVersion: 1, MaxVersion: 1},
+			wantErr: true,
+		},
+		{
+			name:    "guest too new",
+			hostMin: 1,
+			hostMax: 2,
+			guest:   GuestContract{MinVersion: 3, MaxVersion: 4},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := negotiateContract(tt.hostMin, tt.hostMax, &tt.guest)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("negotiateContract() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !errors.Is(err, ErrIncompatibleContract) {
+					t.Errorf("error = %v, want ErrIncompatibleContract", err)
+				}
+				return
+			}
+
+			if got != tt.want {
+				t.Errorf("negotiateContract() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadGuestContract(t *testing.T) {
+	dir := t.TempDir()
+
+	legacy, err := ReadGuestContract(filepath.Join(dir, "missing.json"))
+	if err != nil {
+		t.Fatalf("ReadGuestContract failed for missing file: %v", err)
+	}
+	if legacy.MinVersion != 1 || legacy.MaxVersion != 1 {
+		t.Errorf("legacy contract = %+v, want 1-1", legacy)
+	}
+
+	contractPath := filepath.Join(dir, "contract.json")
+	if err := os.WriteFile(contractPath, []byte(`{"min_version":1,"max_version":3}`), 0o644); err != nil {
+		t.Fatalf("write contract: %v", err)
+	}
+
+	contract, err := ReadGuestContract(contractPath)
+	if err != nil {
+		t.Fatalf("ReadGuestContract failed: %v", err)
+	}
+	if contract.MinVersion != 1 || contract.MaxVersion != 3 {
+		t.Errorf("contract = %+v, want 1-3", contract)
+	}
+
+	if err := os.WriteFile(contractPath, []byte(`{"min_version":3,"max_version":1}`), 0o644); err != nil {
+		t.Fatalf("write contract: %v", err)
+	}
+	if _, err := ReadGuestContract(contractPath); err == nil {
+		t.Error("expected error for inverted contract range")
+	}
+}
@@ -1,149 +1,223 @@
 package vm
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
 	"os"
-	"os/exec"
-	"path"
 	"path/filepath"
+	"slices"
+	"time"
 
 	"github.com/maxdollinger/walk.io/pkg/network"
-	"github.com/maxdollinger/walk.io/pkg/utils"
 )
 
-const (
-	LOG_DIR = "/var/walkio/machines/logs"
-	VM_DIR  = "/var/walkio/machines/"
-)
+// MMDSAddress is the link-local address the guest fetches VMConfig.MMDS from
+const MMDSAddress = "169.254.169.254"
+
+// CPUTemplates are the static CPU templates of firecracker: C3, T2, T2S and T2CL
+// for Intel, T2A for AMD and V1N1 for ARM hosts
+var CPUTemplates = []string{"C3", "T2", "T2S", "T2CL", "T2A", "V1N1"}
+
+// guestIfaceID is the firecracker id of the guest NIC, MMDS is bound to it
+const guestIfaceID = "eth0"
+
+// mmdsTimeout bounds waiting for the API socket and the upload of the metadata
+// after boot if VMConfig.Timeout is not set
+var mmdsTimeout = 5 * time.Second
 
 type FirecrackerMachine struct {
-	ID            string
-	Cmd           *exec.Cmd
-	LogFile       *os.File
-	SocketPath    string
-	ConfigPath    string
-	MachineConfig *VMConfig
-	NetworkConfig *network.NetworkConfig
+	*machine
+	ConfigPath string
+	jail       *jail // nil if firecracker is launched directly
+}
+
+// validateCPUConfig checks the CPU settings of the machine-config up front,
+// firecracker only rejects them when the VM is started
+func validateCPUConfig(config *VMConfig) error {
+	if len(config.CPUTemplate) > 0 && !slices.Contains(CPUTemplates, config.CPUTemplate) {
+		return fmt.Errorf("unknown cpu template %q, want one of %v", config.CPUTemplate, CPUTemplates)
+	}
+	// each core runs two threads with SMT on
+	if config.SMT && config.VCPU > 1 && config.VCPU%2 != 0 {
+		return fmt.Errorf("%d vcpus with smt, want 1 or an even count", config.VCPU)
+	}
+
+	return nil
 }
 
 func NewFirecrackerMachine(stateDevPath string, config *VMConfig) (*FirecrackerMachine, error) {
-	id, err := utils.NewUUID7()
+	if config.MMDS != nil && config.Network == nil {
+		return nil, errors.New("mmds needs a network interface")
+	}
+	if err := validateCPUConfig(config); err != nil {
+		return nil, err
+	}
+	if err := validateBalloonSize(config, config.BalloonSizeMiB); err != nil {
+		return nil, err
+	}
+
+	base, err := newMachine(stateDevPath, config)
 	if err != nil {
-		return nil, fmt.Errorf("generate vm id: %w", err)
+		return nil, err
 	}
 
-	machineDir := path.Join(VM_DIR, id)
-	if err := os.MkdirAll(machineDir, 0o755); err != nil {
-		return nil, fmt.Errorf("could not create machineDir: %w", err)
+	fcConfig := buildFirecrackerConfig(config, stateDevPath, base.ContractVersion, base.LogFile.Name(), base.VsockPath)
+	configPath := filepath.Join(base.dir(), base.ID+".json")
+
+	var vmJail *jail
+	if config.UseJailer {
+		vmJail, err = jailMachine(base, fcConfig)
+		if err != nil {
+			return nil, err
+		}
+		configPath = vmJail.hostPath(jailConfigFile)
 	}
 
-	fcConfig := buildFirecrackerConfig(config, stateDevPath)
 	data, err := json.Marshal(fcConfig)
 	if err != nil {
 		return nil, fmt.Errorf("marshal config: %w", err)
 	}
 
-	configPath := filepath.Join(machineDir, id+".json")
 	if err := os.WriteFile(configPath, data, 0o644); err != nil {
 		return nil, fmt.Errorf("write config file: %w", err)
 	}
 
-	socketPath := filepath.Join(machineDir, id+".sock")
-	logPath := filepath.Join(LOG_DIR, id+".log")
-	logFile, err := os.Create(logPath)
+	return newFirecrackerMachine(base, configPath, vmJail), nil
+}
+
+// newFirecrackerMachine wraps base, whose Clean also removes the chroot of vmJail
+func newFirecrackerMachine(base *machine, configPath string, vmJail *jail) *FirecrackerMachine {
+	m := &FirecrackerMachine{
+		machine:    base,
+		ConfigPath: configPath,
+		jail:       vmJail,
+	}
+	base.cleanVMM = m.cleanJail
+
+	return m
+}
+
+// jailMachine moves the files of fcConfig into the chroot of the VM and points
+// the sockets of base to their paths inside it
+func jailMachine(base *machine, fcConfig map[string]any) (*jail, error) {
+	firecrackerBin, err := ResolveFirecrackerBinary(base.MachineConfig)
 	if err != nil {
-		err = errors.Join(err, os.RemoveAll(machineDir))
-		return nil, fmt.Errorf("could not create log file: %w", err)
+		return nil, err
+	}
+
+	vmJail, err := newJail(base.MachineConfig, base.ID, firecrackerBin)
+	if err != nil {
+		return nil, err
+	}
+	if err := vmJail.adopt(fcConfig); err != nil {
+		return nil, errors.Join(fmt.Errorf("jail %s: %w", base.ID, err), vmJail.remove())
 	}
 
-	instance := FirecrackerMachine{
-		ID:            id,
-		Cmd:           nil,
-		SocketPath:    socketPath,
-		LogFile:       logFile,
-		ConfigPath:    configPath,
-		MachineConfig: config,
+	base.SocketPath = vmJail.hostPath(jailAPISocket)
+	if len(base.VsockPath) > 0 {
+		base.VsockPath = vmJail.hostPath(jailVsock)
 	}
 
-	return &instance, nil
+	return vmJail, nil
 }
 
 func (m *FirecrackerMachine) Start() error {
-	_ = os.Remove(m.SocketPath)
+	binary, args, err := m.command()
+	if err != nil {
+		return err
+	}
+
+	// firecracker writes the guest serial console to stdout, its own logs go to the logger file
+	if err := m.startProcess(binary, args...); err != nil {
+		return err
+	}
 
-	cmd := exec.Command(m.MachineConfig.GetFirecrackerPath(), "--api-sock", m.SocketPath, "--config-file", m.ConfigPath)
-	cmd.Stdout = m.LogFile
-	cmd.Stderr = m.LogFile
-	if err := cmd.Start(); err != nil {
-		err = errors.Join(err, m.Clean())
-		return fmt.Errorf("start firecracker process: %w", err)
+	// the guest init waits for its metadata, so a VM without it is of no use
+	if err := m.putMetadata(); err != nil {
+		return errors.Join(fmt.Errorf("mmds of %s: %w", m.ID, err), m.Stop())
 	}
 
 	return nil
 }
 
-func (m *FirecrackerMachine) Status() (VMStatus, error) {
-	if m.Cmd == nil {
-		return VMStatusStopped, nil
+// command returns the binary and args launching firecracker, through the jailer
+// with the paths inside the chroot for a jailed VM
+func (m *FirecrackerMachine) command() (string, []string, error) {
+	if m.jail != nil {
+		jailerBin, err := ResolveJailerBinary(m.MachineConfig)
+		if err != nil {
+			return "", nil, err
+		}
+		return jailerBin, m.jail.args("--api-sock", jailAPISocket, "--config-file", jailConfigFile), nil
 	}
 
-	// Try to send signal 0 to check if process is alive
-	if err := m.Cmd.Process.Signal(os.Signal(nil)); err != nil {
-		return VMStatusStopped, nil
+	firecrackerBin, err := ResolveFirecrackerBinary(m.MachineConfig)
+	if err != nil {
+		return "", nil, err
 	}
-
-	return VMStatusRunning, nil
+	return firecrackerBin, []string{"--api-sock", m.SocketPath, "--config-file", m.ConfigPath}, nil
 }
 
-func (m *FirecrackerMachine) Stop() error {
-	if m.Cmd == nil {
+// putMetadata uploads VMConfig.MMDS to the data store of the booted VM
+func (m *FirecrackerMachine) putMetadata() error {
+	if m.MachineConfig.MMDS == nil {
 		return nil
 	}
 
-	_ = m.Cmd.Process.Kill()
-	err := m.Cmd.Wait()
-	if err != nil {
-		return err
+	timeout := m.MachineConfig.Timeout
+	if timeout <= 0 {
+		timeout = mmdsTimeout
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	err = os.Remove(m.SocketPath)
-	if err != nil {
-		return err
-	}
-	m.Cmd = nil
-	return nil
-}
-
-func (m *FirecrackerMachine) Clean() error {
-	if m.Cmd != nil {
-		return fmt.Errorf("machine %s is still running", m.ID)
+	// the guest finds its network next to the app metadata unless the caller set it
+	payload := maps.Clone(m.MachineConfig.MMDS)
+	if _, ok := payload[network.MMDSKey]; !ok && m.NetworkConfig != nil {
+		data, err := m.NetworkConfig.MarshalMMDS()
+		if err != nil {
+			return err
+		}
+		payload[network.MMDSKey] = json.RawMessage(data)
 	}
 
-	err := os.RemoveAll(path.Join(VM_DIR, m.ID))
-	if err != nil {
-		return fmt.Errorf("could not clean vm %s: %w", m.ID, err)
+	api := newFirecrackerAPI(m.SocketPath)
+	if err := api.waitReady(ctx); err != nil {
+		return err
 	}
 
-	_ = m.LogFile.Close()
+	return api.put(ctx, "/mmds", payload)
+}
 
+// cleanJail removes the chroot of a jailed VM, it runs as the cleanVMM of the machine
+func (m *FirecrackerMachine) cleanJail() error {
+	if m.jail != nil {
+		if err := m.jail.remove(); err != nil {
+			return err
+		}
+	}
 	m.ConfigPath = ""
-	m.SocketPath = ""
 
 	return nil
 }
 
-func buildFirecrackerConfig(config *VMConfig, stateDevPath string) map[string]any {
-	return map[string]any{
+func buildFirecrackerConfig(config *VMConfig, stateDevPath string, contractVersion int, logPath, vsockPath string) map[string]any {
+	fcConfig := map[string]any{
+		"logger": map[string]any{
+			"log_path": logPath,
+			"level":    "Info",
+		},
 		"boot-source": map[string]any{
 			"kernel_image_path": config.GetKernelPath(),
-			"boot_args":         "console=ttyS0 reboot=k panic=1 init=/walkio/init",
+			"boot_args":         guestBootArgs(config, contractVersion),
 		},
 		"machine-config": map[string]any{
 			"vcpu_count":   config.VCPU,
-			"mem_size_mib": config.Memory,
-			"smt":          false,
+			"mem_size_mib": config.Memory.MB(),
+			"smt":          config.SMT,
 		},
 		"drives": []map[string]any{
 			// Drive 1: RootFS - system initialization (root device, read-only, shared)
@@ -169,4 +243,85 @@ func buildFirecrackerConfig(config *VMConfig, stateDevPath string) map[string]an
 			},
 		},
 	}
+
+	if len(config.CPUTemplate) > 0 {
+		fcConfig["machine-config"].(map[string]any)["cpu_template"] = config.CPUTemplate
+	}
+
+	if config.hasBalloon() {
+		balloon := map[string]any{
+			"amount_mib":     config.BalloonSizeMiB,
+			"deflate_on_oom": config.DeflateOnOOM,
+		}
+		if config.BalloonStatsInterval > 0 {
+			balloon["stats_polling_interval_s"] = max(1, int(config.BalloonStatsInterval/time.Second))
+		}
+		fcConfig["balloon"] = balloon
+	}
+
+	if limiter := rateLimiter(config.DriveRateLimit); limiter != nil {
+		for _, drive := range fcConfig["drives"].([]map[string]any) {
+			drive["rate_limiter"] = limiter
+		}
+	}
+
+	if config.Network != nil {
+		iface := map[string]any{
+			"iface_id":      guestIfaceID,
+			"guest_mac":     config.Network.MACAddress,
+			"host_dev_name": config.Network.TAPDevice,
+		}
+		if limiter := rateLimiter(config.NetRateLimit); limiter != nil {
+			iface["rx_rate_limiter"] = limiter
+			iface["tx_rate_limiter"] = limiter
+		}
+		fcConfig["network-interfaces"] = []map[string]any{iface}
+
+		// the data store is filled by putMetadata after boot
+		if config.MMDS != nil {
+			fcConfig["mmds-config"] = map[string]any{
+				"version":            "V2",
+				"ipv4_address":       MMDSAddress,
+				"network_interfaces": []string{guestIfaceID},
+			}
+		}
+	}
+
+	if config.VsockCID > 0 {
+		fcConfig["vsock"] = map[string]any{
+			"guest_cid": config.VsockCID,
+			"uds_path":  vsockPath,
+		}
+	}
+
+	return fcConfig
+}
+
+// rateLimitRefillMs is the refill interval of the token buckets, the rates are per second
+const rateLimitRefillMs = 1000
+
+// rateLimiter returns the rate_limiter object of limit, nil if it is unlimited
+func rateLimiter(limit RateLimit) map[string]any {
+	limiter := map[string]any{}
+	if limit.BytesPerSec > 0 {
+		bandwidth := map[string]any{
+			"size":        int64(limit.BytesPerSec),
+			"refill_time": rateLimitRefillMs,
+		}
+		if limit.Burst > 0 {
+			bandwidth["one_time_burst"] = int64(limit.Burst)
+		}
+		limiter["bandwidth"] = bandwidth
+	}
+	if limit.OpsPerSec > 0 {
+		limiter["ops"] = map[string]any{
+			"size":        limit.OpsPerSec,
+			"refill_time": rateLimitRefillMs,
+		}
+	}
+
+	if len(limiter) == 0 {
+		return nil
+	}
+	return limiter
 }
@@ -0,0 +1,211 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// firecrackerAPI talks to the API socket of a running firecracker process
+type firecrackerAPI struct {
+	client *http.Client
+	dial   func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func newFirecrackerAPI(socketPath string) *firecrackerAPI {
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "unix", socketPath)
+	}
+
+	return &firecrackerAPI{
+		client: &http.Client{Transport: &http.Transport{DialContext: dial}},
+		dial:   dial,
+	}
+}
+
+// apiPollInterval is how often waitReady tries to connect to the API socket
+const apiPollInterval = 20 * time.Millisecond
+
+// waitReady blocks until the API socket accepts connections, firecracker
+// creates it shortly after the process started
+func (a *firecrackerAPI) waitReady(ctx context.Context) error {
+	for {
+		conn, err := a.dial(ctx, "", "")
+		if err == nil {
+			return conn.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("api socket not ready: %w", errors.Join(ctx.Err(), err))
+		case <-time.After(apiPollInterval):
+		}
+	}
+}
+
+func (a *firecrackerAPI) patch(ctx context.Context, path string, body any) error {
+	return a.send(ctx, http.MethodPatch, path, body)
+}
+
+func (a *firecrackerAPI) put(ctx context.Context, path string, body any) error {
+	return a.send(ctx, http.MethodPut, path, body)
+}
+
+// get decodes the JSON answer of a GET of path into out
+func (a *firecrackerAPI) get(ctx context.Context, path string, out any) error {
+	resp, err := a.do(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode %s: %w", path, err)
+	}
+	return nil
+}
+
+// send sends body as JSON, firecracker answers 204 on success and a fault_message otherwise
+func (a *firecrackerAPI) send(ctx context.Context, method, path string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", path, err)
+	}
+
+	resp, err := a.do(ctx, method, path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// do sends a request to the API, answers other than 2xx are returned as error with their fault_message
+func (a *firecrackerAPI) do(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	// the host is ignored, requests go to the unix socket
+	req, err := http.NewRequestWithContext(ctx, method, "http://localhost"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", method, path, err)
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var fault struct {
+			FaultMessage string `json:"fault_message"`
+		}
+		respBody, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(respBody, &fault) != nil || len(fault.FaultMessage) == 0 {
+			fault.FaultMessage = string(respBody)
+		}
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, fault.FaultMessage)
+	}
+
+	return resp, nil
+}
+
+func (a *firecrackerAPI) setState(ctx context.Context, state string) error {
+	return a.patch(ctx, "/vm", map[string]string{"state": state})
+}
+
+// driveIDs are the drives of every VM, see buildFirecrackerConfig
+var driveIDs = []string{"rootfs", "app", "state"}
+
+// UpdateAppDrive swaps the backing file of the app drive of the running VM for
+// newAppFsPath, e.g. to deploy a new app version without recreating the VM.
+func (m *FirecrackerMachine) UpdateAppDrive(ctx context.Context, newAppFsPath string) error {
+	return m.UpdateDrive(ctx, "app", newAppFsPath)
+}
+
+// UpdateDrive swaps the backing file of the drive driveID (rootfs, app or state)
+// of the running VM for newPath. The VM is paused while the drive is patched and
+// resumed afterwards, also if the patch failed. Before resuming, the drive is
+// checked to be backed by newPath. The app and state devices have to carry the
+// label of their role.
+func (m *FirecrackerMachine) UpdateDrive(ctx context.Context, driveID, newPath string) error {
+	if !slices.Contains(driveIDs, driveID) {
+		return fmt.Errorf("unknown drive %q, want one of %v", driveID, driveIDs)
+	}
+	if err := verifyDriveLabel(driveID, newPath); err != nil {
+		return err
+	}
+
+	if m.Cmd == nil {
+		return fmt.Errorf("machine %s is not running", m.ID)
+	}
+
+	// a jailed firecracker only sees files inside its chroot
+	apiPath := newPath
+	if m.jail != nil {
+		var err error
+		apiPath, err = m.jail.link(newPath, "/"+driveID+filepath.Ext(newPath), driveID == "state")
+		if err != nil {
+			return fmt.Errorf("update %s drive of %s: %w", driveID, m.ID, err)
+		}
+	}
+
+	api := newFirecrackerAPI(m.SocketPath)
+	if err := api.setState(ctx, "Paused"); err != nil {
+		return fmt.Errorf("pause %s: %w", m.ID, err)
+	}
+
+	patchErr := api.patch(ctx, "/drives/"+driveID, map[string]string{
+		"drive_id":     driveID,
+		"path_on_host": apiPath,
+	})
+	if patchErr == nil {
+		patchErr = api.checkDrive(ctx, driveID, apiPath)
+	}
+	if err := api.setState(ctx, "Resumed"); err != nil {
+		return errors.Join(patchErr, fmt.Errorf("resume %s: %w", m.ID, err))
+	}
+	if patchErr != nil {
+		return fmt.Errorf("update %s drive of %s: %w", driveID, m.ID, patchErr)
+	}
+
+	switch driveID {
+	case "app":
+		m.MachineConfig.AppFsPath = newPath
+	case "state":
+		m.StateDevPath = newPath
+	}
+	return nil
+}
+
+// checkDrive verifies that firecracker backs the drive driveID by path
+func (a *firecrackerAPI) checkDrive(ctx context.Context, driveID, path string) error {
+	var vmConfig struct {
+		Drives []struct {
+			DriveID    string `json:"drive_id"`
+			PathOnHost string `json:"path_on_host"`
+		} `json:"drives"`
+	}
+	if err := a.get(ctx, "/vm/config", &vmConfig); err != nil {
+		return err
+	}
+
+	for _, drive := range vmConfig.Drives {
+		if drive.DriveID == driveID {
+			if drive.PathOnHost != path {
+				return fmt.Errorf("drive %s is backed by %s after the update, want %s", driveID, drive.PathOnHost, path)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("drive %s not found", driveID)
+}
@@ -0,0 +1,309 @@
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maxdollinger/walk.io/pkg/fs"
+	"github.com/maxdollinger/walk.io/pkg/network"
+)
+
+type apiCall struct {
+	method string
+	path   string
+	body   map[string]string
+	raw    string
+}
+
+// stubFirecrackerAPI serves the firecracker API on a unix socket and records the calls.
+// PATCHes of failPath are answered with a fault. GET /vm/config reports the patched
+// drives, with failPath /vm/config the patches are accepted but not applied.
+func stubFirecrackerAPI(t *testing.T, failPath string) (string, func() []apiCall) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var calls []apiCall
+	drives := map[string]string{} // drive id -> path_on_host
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		var body map[string]string
+		_ = json.Unmarshal(data, &body)
+
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, apiCall{method: r.Method, path: r.URL.Path, body: body, raw: string(data)})
+
+		if r.URL.Path == failPath && r.Method == http.MethodPatch {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"fault_message":"drive not found"}`))
+			return
+		}
+		if r.Method == http.MethodGet && r.URL.Path == "/vm/config" {
+			var vmConfig struct {
+				Drives []map[string]string `json:"drives"`
+			}
+			for _, id := range driveIDs {
+				vmConfig.Drives = append(vmConfig.Drives, map[string]string{"drive_id": id, "path_on_host": drives[id]})
+			}
+			_ = json.NewEncoder(w).Encode(vmConfig)
+			return
+		}
+		if id, ok := strings.CutPrefix(r.URL.Path, "/drives/"); ok && failPath != "/vm/config" {
+			drives[id] = body["path_on_host"]
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return serveUnix(t, handler), func() []apiCall {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(calls)
+	}
+}
+
+// serveUnix serves handler on a unix socket and returns its path
+func serveUnix(t *testing.T, handler http.Handler) string {
+	t.Helper()
+
+	server := httptest.NewUnstartedServer(handler)
+	socketPath := filepath.Join(t.TempDir(), "fc.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+
+	return socketPath
+}
+
+func newRunningFirecrackerMachine(t *testing.T, socketPath string) *FirecrackerMachine {
+	t.Helper()
+
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start process: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	return &FirecrackerMachine{machine: &machine{
+		ID:            "vm-1",
+		Cmd:           cmd,
+		SocketPath:    socketPath,
+		MachineConfig: &VMConfig{AppFsPath: "/apps/old.ext4"},
+	}}
+}
+
+func TestUpdateAppDrive(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+
+	socketPath, calls := stubFirecrackerAPI(t, "")
+	m := newRunningFirecrackerMachine(t, socketPath)
+	newAppDev := newLabeledDevice(t, fs.AppFSLabel)
+
+	if err := m.UpdateAppDrive(context.Background(), newAppDev); err != nil {
+		t.Fatalf("UpdateAppDrive failed: %v", err)
+	}
+
+	want := []apiCall{
+		{method: http.MethodPatch, path: "/vm", body: map[string]string{"state": "Paused"}},
+		{method: http.MethodPatch, path: "/drives/app", body: map[string]string{"drive_id": "app", "path_on_host": newAppDev}},
+		{method: http.MethodGet, path: "/vm/config"},
+		{method: http.MethodPatch, path: "/vm", body: map[string]string{"state": "Resumed"}},
+	}
+	got := calls()
+	if len(got) != len(want) {
+		t.Fatalf("calls = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i].method != want[i].method || got[i].path != want[i].path || !maps.Equal(got[i].body, want[i].body) {
+			t.Errorf("call %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+	if m.MachineConfig.AppFsPath != newAppDev {
+		t.Errorf("AppFsPath = %s, want %s", m.MachineConfig.AppFsPath, newAppDev)
+	}
+}
+
+func TestUpdateAppDriveResumesOnFailedPatch(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+
+	socketPath, calls := stubFirecrackerAPI(t, "/drives/app")
+	m := newRunningFirecrackerMachine(t, socketPath)
+
+	err := m.UpdateAppDrive(context.Background(), newLabeledDevice(t, fs.AppFSLabel))
+	if err == nil || !strings.Contains(err.Error(), "drive not found") {
+		t.Fatalf("UpdateAppDrive error = %v, want the fault message", err)
+	}
+
+	got := calls()
+	if len(got) != 3 || got[2].body["state"] != "Resumed" {
+		t.Errorf("calls = %v, want the VM resumed after the failed patch", got)
+	}
+	if m.MachineConfig.AppFsPath != "/apps/old.ext4" {
+		t.Errorf("AppFsPath = %s, want the old drive kept", m.MachineConfig.AppFsPath)
+	}
+}
+
+func TestUpdateAppDriveRejectsWrongLabel(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+
+	socketPath, calls := stubFirecrackerAPI(t, "")
+	m := newRunningFirecrackerMachine(t, socketPath)
+
+	if err := m.UpdateAppDrive(context.Background(), newLabeledDevice(t, fs.StateFSLabelPrefix+"0123456789")); err == nil {
+		t.Fatal("UpdateAppDrive accepted a state device")
+	}
+	if got := calls(); len(got) != 0 {
+		t.Errorf("calls = %v, want none for an invalid device", got)
+	}
+}
+
+func TestUpdateDrive(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+
+	socketPath, calls := stubFirecrackerAPI(t, "")
+	m := newRunningFirecrackerMachine(t, socketPath)
+	newStateDev := newLabeledDevice(t, fs.StateFSLabelPrefix+"0123456789")
+
+	if err := m.UpdateDrive(context.Background(), "state", newStateDev); err != nil {
+		t.Fatalf("UpdateDrive failed: %v", err)
+	}
+	if m.StateDevPath != newStateDev {
+		t.Errorf("StateDevPath = %s, want %s", m.StateDevPath, newStateDev)
+	}
+
+	invalid := []struct{ driveID, path string }{
+		{"scratch", newStateDev},
+		{"rootfs", filepath.Join(t.TempDir(), "missing.ext4")},
+		{"app", newStateDev},
+	}
+	for _, tt := range invalid {
+		if err := m.UpdateDrive(context.Background(), tt.driveID, tt.path); err == nil {
+			t.Errorf("UpdateDrive(%s, %s) succeeded", tt.driveID, tt.path)
+		}
+	}
+	if got := calls(); len(got) != 4 {
+		t.Errorf("calls = %v, want only the pause, patch, check and resume of the state drive", got)
+	}
+}
+
+func TestUpdateDriveNotApplied(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+
+	socketPath, calls := stubFirecrackerAPI(t, "/vm/config")
+	m := newRunningFirecrackerMachine(t, socketPath)
+
+	err := m.UpdateDrive(context.Background(), "app", newLabeledDevice(t, fs.AppFSLabel))
+	if err == nil || !strings.Contains(err.Error(), "after the update") {
+		t.Fatalf("UpdateDrive error = %v, want the unchanged drive reported", err)
+	}
+
+	got := calls()
+	if len(got) != 4 || got[3].body["state"] != "Resumed" {
+		t.Errorf("calls = %v, want the VM resumed after the failed check", got)
+	}
+	if m.MachineConfig.AppFsPath != "/apps/old.ext4" {
+		t.Errorf("AppFsPath = %s, want the old drive kept", m.MachineConfig.AppFsPath)
+	}
+}
+
+func TestPutMetadata(t *testing.T) {
+	socketPath, calls := stubFirecrackerAPI(t, "")
+	m := newRunningFirecrackerMachine(t, socketPath)
+	m.MachineConfig.MMDS = map[string]any{
+		"env":  map[string]string{"PORT": "8080"},
+		"argv": []string{"/app", "--serve"},
+	}
+
+	if err := m.putMetadata(); err != nil {
+		t.Fatalf("putMetadata failed: %v", err)
+	}
+
+	got := calls()
+	if len(got) != 1 || got[0].method != http.MethodPut || got[0].path != "/mmds" {
+		t.Fatalf("calls = %v, want one PUT /mmds", got)
+	}
+	var payload struct {
+		Env  map[string]string `json:"env"`
+		Argv []string          `json:"argv"`
+	}
+	if err := json.Unmarshal([]byte(got[0].raw), &payload); err != nil {
+		t.Fatalf("payload is not valid JSON: %v", err)
+	}
+	if payload.Env["PORT"] != "8080" || !slices.Equal(payload.Argv, []string{"/app", "--serve"}) {
+		t.Errorf("payload = %s", got[0].raw)
+	}
+}
+
+func TestPutMetadataSocketNotReady(t *testing.T) {
+	originalTimeout := mmdsTimeout
+	mmdsTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { mmdsTimeout = originalTimeout })
+
+	m := newRunningFirecrackerMachine(t, filepath.Join(t.TempDir(), "missing.sock"))
+	m.MachineConfig.MMDS = map[string]any{}
+
+	if err := m.putMetadata(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("putMetadata error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestPutMetadataAddsNetwork(t *testing.T) {
+	socketPath, calls := stubFirecrackerAPI(t, "")
+	m := newRunningFirecrackerMachine(t, socketPath)
+	m.MachineConfig.MMDS = map[string]any{"argv": []string{"/app"}}
+	m.NetworkConfig = &network.NetworkConfig{
+		TAPDevice:  "walkio-7d3f89ab",
+		IPAddress:  "172.16.0.2",
+		MACAddress: "AA:FC:00:A1:B2:C3",
+		Gateway:    network.DefaultGateway,
+		DNS:        network.DefaultDNS,
+	}
+
+	if err := m.putMetadata(); err != nil {
+		t.Fatalf("putMetadata failed: %v", err)
+	}
+
+	var payload map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(calls()[0].raw), &payload); err != nil {
+		t.Fatalf("payload is not valid JSON: %v", err)
+	}
+	guestNet, err := network.UnmarshalMMDS(payload[network.MMDSKey])
+	if err != nil {
+		t.Fatalf("network metadata: %v", err)
+	}
+	if guestNet.IPAddress != "172.16.0.2" || guestNet.MACAddress != "AA:FC:00:A1:B2:C3" {
+		t.Errorf("network metadata = %+v", guestNet)
+	}
+	if _, ok := m.MachineConfig.MMDS[network.MMDSKey]; ok {
+		t.Error("putMetadata modified VMConfig.MMDS")
+	}
+}
@@ -0,0 +1,262 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/maxdollinger/walk.io/pkg/network"
+	"github.com/maxdollinger/walk.io/pkg/utils"
+)
+
+func TestBuildFirecrackerConfigLogger(t *testing.T) {
+	config := &VMConfig{BaseVersion: "v0.1.1", VCPU: 1, Memory: 128 * utils.MB}
+
+	fcConfig := buildFirecrackerConfig(config, "/state.ext4", ContractVersion, "/logs/vm-1.log", "")
+
+	logger, ok := fcConfig["logger"].(map[string]any)
+	if !ok {
+		t.Fatal("config has no logger section")
+	}
+	if logger["log_path"] != "/logs/vm-1.log" {
+		t.Errorf("log_path = %v, want /logs/vm-1.log", logger["log_path"])
+	}
+}
+
+func TestBuildFirecrackerConfigMachine(t *testing.T) {
+	config := &VMConfig{BaseVersion: "v0.1.1", AppFsPath: "/apps/abc.ext4", VCPU: 2, Memory: 256 * utils.MB}
+
+	fcConfig := buildFirecrackerConfig(config, "/state.ext4", 2, "/logs/vm-1.log", "")
+
+	machineConfig := fcConfig["machine-config"].(map[string]any)
+	if machineConfig["vcpu_count"] != 2 || machineConfig["mem_size_mib"] != int64(256) {
+		t.Errorf("machine-config = %v, want 2 vcpus and 256 MiB", machineConfig)
+	}
+
+	bootSource := fcConfig["boot-source"].(map[string]any)
+	if !strings.Contains(bootSource["boot_args"].(string), "walkio.contract=2") {
+		t.Errorf("boot_args = %v, want contract version 2", bootSource["boot_args"])
+	}
+
+	drives := fcConfig["drives"].([]map[string]any)
+	wantPaths := []string{config.GetRootFSPath(), "/apps/abc.ext4", "/state.ext4"}
+	wantReadOnly := []bool{true, true, false}
+	for i, drive := range drives {
+		if drive["path_on_host"] != wantPaths[i] || drive["is_read_only"] != wantReadOnly[i] {
+			t.Errorf("drive %d = %v, want %s read-only=%v", i, drive, wantPaths[i], wantReadOnly[i])
+		}
+	}
+}
+
+func TestBuildFirecrackerConfigCPU(t *testing.T) {
+	config := &VMConfig{BaseVersion: "v0.1.1", VCPU: 2, Memory: 128 * utils.MB}
+
+	machineConfig := buildFirecrackerConfig(config, "/state.ext4", 2, "/logs/vm-1.log", "")["machine-config"].(map[string]any)
+	if _, ok := machineConfig["cpu_template"]; ok || machineConfig["smt"] != false {
+		t.Errorf("machine-config = %v, want smt off and no cpu template by default", machineConfig)
+	}
+
+	config.SMT, config.CPUTemplate = true, "T2"
+	machineConfig = buildFirecrackerConfig(config, "/state.ext4", 2, "/logs/vm-1.log", "")["machine-config"].(map[string]any)
+	if machineConfig["smt"] != true || machineConfig["cpu_template"] != "T2" {
+		t.Errorf("machine-config = %v, want smt on with template T2", machineConfig)
+	}
+
+	config.CPUTemplate = "t2"
+	if _, err := NewFirecrackerMachine("/state.ext4", config); err == nil || !strings.Contains(err.Error(), "cpu template") {
+		t.Errorf("NewFirecrackerMachine error = %v, want unknown cpu template rejected", err)
+	}
+
+	config.CPUTemplate = "T2"
+	for vcpus, valid := range map[int]bool{1: true, 2: true, 3: false, 4: true, 5: false} {
+		config.VCPU = vcpus
+		if err := validateCPUConfig(config); (err == nil) != valid {
+			t.Errorf("validateCPUConfig with %d vcpus and smt = %v, want valid %v", vcpus, err, valid)
+		}
+	}
+	config.SMT, config.VCPU = false, 3
+	if err := validateCPUConfig(config); err != nil {
+		t.Errorf("validateCPUConfig with 3 vcpus without smt = %v", err)
+	}
+}
+
+func TestBuildFirecrackerConfigNetwork(t *testing.T) {
+	config := &VMConfig{BaseVersion: "v0.1.1", VCPU: 1, Memory: 128 * utils.MB}
+
+	fcConfig := buildFirecrackerConfig(config, "/state.ext4", 2, "/logs/vm-1.log", "")
+	if _, ok := fcConfig["network-interfaces"]; ok {
+		t.Errorf("config without network has network-interfaces: %v", fcConfig["network-interfaces"])
+	}
+	bootArgs := fcConfig["boot-source"].(map[string]any)["boot_args"].(string)
+	if strings.Contains(bootArgs, "ip=") {
+		t.Errorf("boot_args = %q, want no ip config without network", bootArgs)
+	}
+
+	config.Network = &network.NetworkConfig{
+		TAPDevice:  "walkio-7d3f89ab",
+		IPAddress:  "172.16.0.2",
+		MACAddress: "AA:FC:00:A1:B2:C3",
+		Gateway:    network.DefaultGateway,
+		DNS:        network.DefaultDNS,
+	}
+	fcConfig = buildFirecrackerConfig(config, "/state.ext4", 2, "/logs/vm-1.log", "")
+
+	ifaces, ok := fcConfig["network-interfaces"].([]map[string]any)
+	if !ok || len(ifaces) != 1 {
+		t.Fatalf("network-interfaces = %v, want one interface", fcConfig["network-interfaces"])
+	}
+	if ifaces[0]["host_dev_name"] != "walkio-7d3f89ab" || ifaces[0]["guest_mac"] != "AA:FC:00:A1:B2:C3" {
+		t.Errorf("network interface = %v, want TAP walkio-7d3f89ab with MAC AA:FC:00:A1:B2:C3", ifaces[0])
+	}
+
+	bootArgs = fcConfig["boot-source"].(map[string]any)["boot_args"].(string)
+	wantIP := "ip=172.16.0.2::172.16.0.1:255.255.255.0::eth0:off:172.16.0.1"
+	if !strings.Contains(bootArgs, wantIP) {
+		t.Errorf("boot_args = %q, want %q", bootArgs, wantIP)
+	}
+}
+
+func TestBuildFirecrackerConfigRateLimits(t *testing.T) {
+	config := &VMConfig{
+		BaseVersion: "v0.1.1",
+		VCPU:        1,
+		Memory:      128 * utils.MB,
+		Network:     &network.NetworkConfig{TAPDevice: "walkio-7d3f89ab", MACAddress: "AA:FC:00:A1:B2:C3"},
+	}
+
+	fcConfig := buildFirecrackerConfig(config, "/state.ext4", 2, "/logs/vm-1.log", "")
+	for _, drive := range fcConfig["drives"].([]map[string]any) {
+		if _, ok := drive["rate_limiter"]; ok {
+			t.Errorf("unlimited drive %v has a rate_limiter", drive["drive_id"])
+		}
+	}
+	iface := fcConfig["network-interfaces"].([]map[string]any)[0]
+	if _, ok := iface["rx_rate_limiter"]; ok {
+		t.Errorf("unlimited network interface has a rate limiter: %v", iface)
+	}
+
+	config.DriveRateLimit = RateLimit{BytesPerSec: 50 * utils.MB, OpsPerSec: 1000, Burst: 100 * utils.MB}
+	config.NetRateLimit = RateLimit{OpsPerSec: 5000}
+	fcConfig = buildFirecrackerConfig(config, "/state.ext4", 2, "/logs/vm-1.log", "")
+
+	for _, drive := range fcConfig["drives"].([]map[string]any) {
+		limiter := drive["rate_limiter"].(map[string]any)
+		bandwidth := limiter["bandwidth"].(map[string]any)
+		if bandwidth["size"] != int64(50*utils.MB) || bandwidth["one_time_burst"] != int64(100*utils.MB) || bandwidth["refill_time"] != 1000 {
+			t.Errorf("drive %v bandwidth = %v, want 50M per second with 100M burst", drive["drive_id"], bandwidth)
+		}
+		ops := limiter["ops"].(map[string]any)
+		if ops["size"] != int64(1000) || ops["refill_time"] != 1000 {
+			t.Errorf("drive %v ops = %v, want 1000 per second", drive["drive_id"], ops)
+		}
+	}
+
+	iface = fcConfig["network-interfaces"].([]map[string]any)[0]
+	for _, key := range []string{"rx_rate_limiter", "tx_rate_limiter"} {
+		limiter, ok := iface[key].(map[string]any)
+		if !ok {
+			t.Fatalf("network interface has no %s: %v", key, iface)
+		}
+		if _, ok := limiter["bandwidth"]; ok {
+			t.Errorf("%s has a bandwidth bucket without a byte limit: %v", key, limiter)
+		}
+		if ops := limiter["ops"].(map[string]any); ops["size"] != int64(5000) {
+			t.Errorf("%s ops = %v, want 5000 packets per second", key, ops)
+		}
+	}
+}
+
+func TestBuildFirecrackerConfigVsock(t *testing.T) {
+	config := &VMConfig{BaseVersion: "v0.1.1", VCPU: 1, Memory: 128 * utils.MB}
+
+	fcConfig := buildFirecrackerConfig(config, "/state.ext4", 2, "/logs/vm-1.log", "")
+	if _, ok := fcConfig["vsock"]; ok {
+		t.Errorf("config without vsock cid has vsock: %v", fcConfig["vsock"])
+	}
+
+	config.VsockCID = 3
+	fcConfig = buildFirecrackerConfig(config, "/state.ext4", 2, "/logs/vm-1.log", "/vms/vm-1/vm-1.vsock")
+	vsock, ok := fcConfig["vsock"].(map[string]any)
+	if !ok {
+		t.Fatal("config has no vsock section")
+	}
+	if vsock["guest_cid"] != uint32(3) || vsock["uds_path"] != "/vms/vm-1/vm-1.vsock" {
+		t.Errorf("vsock = %v, want cid 3 on /vms/vm-1/vm-1.vsock", vsock)
+	}
+}
+
+func TestNewMachineReservedVsockCID(t *testing.T) {
+	for _, cid := range []uint32{1, 2} {
+		if _, err := newMachine("/state.ext4", &VMConfig{VsockCID: cid}); err == nil {
+			t.Errorf("newMachine accepted reserved vsock cid %d", cid)
+		}
+	}
+}
+
+func TestBuildFirecrackerConfigMMDS(t *testing.T) {
+	config := &VMConfig{
+		BaseVersion: "v0.1.1",
+		VCPU:        1,
+		Memory:      128 * utils.MB,
+		Network:     &network.NetworkConfig{TAPDevice: "tap-vm-1", MACAddress: "02:00:00:00:00:01"},
+	}
+
+	fcConfig := buildFirecrackerConfig(config, "/state.ext4", 2, "/logs/vm-1.log", "")
+	if _, ok := fcConfig["mmds-config"]; ok {
+		t.Errorf("config without metadata has mmds-config: %v", fcConfig["mmds-config"])
+	}
+
+	config.MMDS = map[string]any{"env": map[string]string{"PORT": "8080"}}
+	fcConfig = buildFirecrackerConfig(config, "/state.ext4", 2, "/logs/vm-1.log", "")
+	mmds, ok := fcConfig["mmds-config"].(map[string]any)
+	if !ok {
+		t.Fatal("config has no mmds-config section")
+	}
+	ifaces := mmds["network_interfaces"].([]string)
+	if len(ifaces) != 1 || ifaces[0] != fcConfig["network-interfaces"].([]map[string]any)[0]["iface_id"] {
+		t.Errorf("mmds network_interfaces = %v, want the guest NIC", ifaces)
+	}
+	if mmds["version"] != "V2" || mmds["ipv4_address"] != MMDSAddress {
+		t.Errorf("mmds-config = %v, want V2 on %s", mmds, MMDSAddress)
+	}
+}
+
+func TestNewFirecrackerMachineMMDSNeedsNetwork(t *testing.T) {
+	config := &VMConfig{MMDS: map[string]any{"argv": []string{"/app"}}}
+	if _, err := NewFirecrackerMachine("/state.ext4", config); err == nil || !strings.Contains(err.Error(), "mmds") {
+		t.Errorf("NewFirecrackerMachine error = %v, want mmds without network rejected", err)
+	}
+}
+
+func TestBuildFirecrackerConfigBootArgs(t *testing.T) {
+	netConfig := &network.NetworkConfig{IPAddress: "172.16.0.2", Gateway: network.DefaultGateway, DNS: network.DefaultDNS}
+	tests := []struct {
+		name     string
+		bootArgs string
+		network  *network.NetworkConfig
+		want     string
+	}{
+		{name: "default", want: DefaultBootArgs + " walkio.contract=2"},
+		{
+			name:     "custom",
+			bootArgs: "console=ttyS0 quiet init=/sbin/init",
+			network:  netConfig,
+			want:     "console=ttyS0 quiet init=/sbin/init walkio.contract=2 " + netConfig.BootArg(),
+		},
+		{
+			name:     "own ip arg",
+			bootArgs: "console=ttyS0 ip=dhcp",
+			network:  netConfig,
+			want:     "console=ttyS0 ip=dhcp walkio.contract=2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &VMConfig{BaseVersion: "v0.1.1", VCPU: 1, Memory: 128 * utils.MB, BootArgs: tt.bootArgs, Network: tt.network}
+
+			fcConfig := buildFirecrackerConfig(config, "/state.ext4", 2, "/logs/vm-1.log", "")
+			if got := fcConfig["boot-source"].(map[string]any)["boot_args"]; got != tt.want {
+				t.Errorf("boot_args = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
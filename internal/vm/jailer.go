@@ -0,0 +1,154 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// DefaultJailerChrootBase is where the jailer creates the chroots of the VMs
+const DefaultJailerChrootBase = "/srv/jailer"
+
+// paths inside the chroot of a jailed firecracker
+const (
+	jailAPISocket  = "/firecracker.socket"
+	jailConfigFile = "/config.json"
+	jailVsock      = "/vsock.sock"
+	jailKernel     = "/vmlinux"
+)
+
+// jail is the chroot a jailed firecracker runs in
+type jail struct {
+	execFile   string // firecracker binary, the jailer copies it into the chroot
+	chrootBase string
+	id         string
+	uid, gid   int
+}
+
+func newJail(config *VMConfig, id, execFile string) (*jail, error) {
+	if config.JailerUID <= 0 || config.JailerGID <= 0 {
+		return nil, fmt.Errorf("jailer needs a non-root uid and gid, got %d:%d", config.JailerUID, config.JailerGID)
+	}
+
+	chrootBase := config.JailerChrootBase
+	if len(chrootBase) == 0 {
+		chrootBase = DefaultJailerChrootBase
+	}
+
+	return &jail{execFile: execFile, chrootBase: chrootBase, id: id, uid: config.JailerUID, gid: config.JailerGID}, nil
+}
+
+// dir is the jailer's dir of the VM, {chroot base}/{exec file name}/{vm id}
+func (j *jail) dir() string {
+	return filepath.Join(j.chrootBase, filepath.Base(j.execFile), j.id)
+}
+
+// root is the chroot of the VM
+func (j *jail) root() string {
+	return filepath.Join(j.dir(), "root")
+}
+
+// hostPath returns the host path of a path inside the chroot
+func (j *jail) hostPath(jailPath string) string {
+	return filepath.Join(j.root(), jailPath)
+}
+
+// args returns the jailer argv starting firecracker with firecrackerArgs
+func (j *jail) args(firecrackerArgs ...string) []string {
+	args := []string{
+		"--id", j.id,
+		"--exec-file", j.execFile,
+		"--uid", strconv.Itoa(j.uid),
+		"--gid", strconv.Itoa(j.gid),
+		"--chroot-base-dir", j.chrootBase,
+		"--",
+	}
+	return append(args, firecrackerArgs...)
+}
+
+// adopt links the kernel and the drives of a firecracker config into the chroot
+// and rewrites the config to the paths inside it. The logger is dropped, the
+// jailed firecracker logs to stderr, which ends up in the stderr file of the VM.
+func (j *jail) adopt(fcConfig map[string]any) error {
+	if err := os.MkdirAll(j.root(), 0o755); err != nil {
+		return fmt.Errorf("create chroot: %w", err)
+	}
+
+	delete(fcConfig, "logger")
+
+	bootSource := fcConfig["boot-source"].(map[string]any)
+	kernelPath, err := j.link(bootSource["kernel_image_path"].(string), jailKernel, false)
+	if err != nil {
+		return err
+	}
+	bootSource["kernel_image_path"] = kernelPath
+
+	for _, drive := range fcConfig["drives"].([]map[string]any) {
+		hostPath := drive["path_on_host"].(string)
+		writable := drive["is_read_only"] == false
+		jailPath, err := j.link(hostPath, "/"+drive["drive_id"].(string)+filepath.Ext(hostPath), writable)
+		if err != nil {
+			return err
+		}
+		drive["path_on_host"] = jailPath
+	}
+
+	if vsock, ok := fcConfig["vsock"].(map[string]any); ok {
+		vsock["uds_path"] = jailVsock
+	}
+
+	return nil
+}
+
+// link hard links src into the chroot as jailPath. Read-only files on another
+// filesystem are copied, a writable file has to be linked, so the guest writes
+// to it and not to a copy. Writable files are chowned to the jailed user.
+func (j *jail) link(src, jailPath string, writable bool) (string, error) {
+	dst := j.hostPath(jailPath)
+	_ = os.Remove(dst)
+
+	err := os.Link(src, dst)
+	if errors.Is(err, syscall.EXDEV) && !writable {
+		err = copyFile(src, dst)
+	}
+	if err != nil {
+		return "", fmt.Errorf("move %s into the chroot: %w", src, err)
+	}
+
+	if writable {
+		if err := os.Chown(dst, j.uid, j.gid); err != nil {
+			return "", fmt.Errorf("chown %s to the jailed user: %w", src, err)
+		}
+	}
+
+	return jailPath, nil
+}
+
+// remove deletes the chroot, linked files keep their originals
+func (j *jail) remove() error {
+	if err := os.RemoveAll(j.dir()); err != nil {
+		return fmt.Errorf("remove chroot of %s: %w", j.id, err)
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		return errors.Join(err, out.Close())
+	}
+	return out.Close()
+}
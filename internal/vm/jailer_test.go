@@ -0,0 +1,131 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/maxdollinger/walk.io/pkg/utils"
+)
+
+func TestJailArgs(t *testing.T) {
+	config := &VMConfig{UseJailer: true, JailerUID: 1000, JailerGID: 1001}
+	vmJail, err := newJail(config, "vm-1", "/opt/firecracker-v1.7.0")
+	if err != nil {
+		t.Fatalf("newJail failed: %v", err)
+	}
+
+	got := vmJail.args("--api-sock", jailAPISocket)
+	want := []string{
+		"--id", "vm-1",
+		"--exec-file", "/opt/firecracker-v1.7.0",
+		"--uid", "1000",
+		"--gid", "1001",
+		"--chroot-base-dir", DefaultJailerChrootBase,
+		"--",
+		"--api-sock", jailAPISocket,
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("args = %v, want %v", got, want)
+	}
+	if root := vmJail.root(); root != "/srv/jailer/firecracker-v1.7.0/vm-1/root" {
+		t.Errorf("root = %s, want the jailer's chroot of the exec file", root)
+	}
+
+	for _, ids := range [][2]int{{0, 1001}, {1000, 0}} {
+		config := &VMConfig{UseJailer: true, JailerUID: ids[0], JailerGID: ids[1]}
+		if _, err := newJail(config, "vm-1", "/opt/firecracker"); err == nil {
+			t.Errorf("newJail with %d:%d succeeded, want root rejected", ids[0], ids[1])
+		}
+	}
+}
+
+func TestJailAdopt(t *testing.T) {
+	files := t.TempDir()
+	paths := map[string]string{}
+	for _, name := range []string{"vmlinux", "rootfs.ext4", "app.ext4", "state.ext4"} {
+		paths[name] = filepath.Join(files, name)
+		if err := os.WriteFile(paths[name], []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := &VMConfig{BaseVersion: "v0.1.1", AppFsPath: paths["app.ext4"], VCPU: 1, Memory: 128 * utils.MB, VsockCID: 3}
+	fcConfig := buildFirecrackerConfig(config, paths["state.ext4"], ContractVersion, "/logs/vm-1.log", "/vm/vm-1.vsock")
+	fcConfig["boot-source"].(map[string]any)["kernel_image_path"] = paths["vmlinux"]
+	fcConfig["drives"].([]map[string]any)[0]["path_on_host"] = paths["rootfs.ext4"]
+
+	vmJail := &jail{execFile: "/opt/firecracker", chrootBase: t.TempDir(), id: "vm-1", uid: os.Getuid(), gid: os.Getgid()}
+	if err := vmJail.adopt(fcConfig); err != nil {
+		t.Fatalf("adopt failed: %v", err)
+	}
+
+	if _, ok := fcConfig["logger"]; ok {
+		t.Error("jailed config still logs to a host path")
+	}
+	if got := fcConfig["vsock"].(map[string]any)["uds_path"]; got != jailVsock {
+		t.Errorf("vsock uds_path = %v, want %s", got, jailVsock)
+	}
+
+	moved := map[string]string{jailKernel: paths["vmlinux"]}
+	if got := fcConfig["boot-source"].(map[string]any)["kernel_image_path"]; got != jailKernel {
+		t.Errorf("kernel_image_path = %v, want %s", got, jailKernel)
+	}
+	for i, want := range []string{"/rootfs.ext4", "/app.ext4", "/state.ext4"} {
+		drive := fcConfig["drives"].([]map[string]any)[i]
+		if drive["path_on_host"] != want {
+			t.Errorf("drive %v path = %v, want %s", drive["drive_id"], drive["path_on_host"], want)
+		}
+		moved[want] = paths[filepath.Base(want)]
+	}
+
+	for jailPath, src := range moved {
+		srcInfo, err := os.Stat(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jailInfo, err := os.Stat(vmJail.hostPath(jailPath))
+		if err != nil {
+			t.Fatalf("%s not in the chroot: %v", jailPath, err)
+		}
+		if !os.SameFile(srcInfo, jailInfo) {
+			t.Errorf("%s is not linked to %s", jailPath, src)
+		}
+	}
+
+	if err := vmJail.remove(); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	if _, err := os.Stat(paths["state.ext4"]); err != nil {
+		t.Errorf("state device gone with the chroot: %v", err)
+	}
+}
+
+func TestReleaseRemovesJail(t *testing.T) {
+	originalDir := vmDir
+	vmDir = t.TempDir()
+	t.Cleanup(func() { vmDir = originalDir })
+
+	logFile, _, consoleFile, err := createMachineLogs(t.TempDir(), "vm-1")
+	if err != nil {
+		t.Fatalf("createMachineLogs failed: %v", err)
+	}
+	vmJail := &jail{execFile: "/opt/firecracker", chrootBase: t.TempDir(), id: "vm-1", uid: os.Getuid(), gid: os.Getgid()}
+	if err := os.MkdirAll(vmJail.root(), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	base := &machine{ID: "vm-1", LogFile: logFile, ConsoleFile: consoleFile, MachineConfig: &VMConfig{UseJailer: true}}
+	m := newFirecrackerMachine(base, vmJail.hostPath(jailConfigFile), vmJail)
+	// Release is the one of the embedded machine, it has to reach the jail anyway
+	if err := m.Release(context.Background()); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+
+	if _, err := os.Stat(vmJail.dir()); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("jail dir %s still exists after Release: %v", vmJail.dir(), err)
+	}
+}
@@ -0,0 +1,525 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	models "github.com/maxdollinger/walk.io/internal/db/models"
+	"github.com/maxdollinger/walk.io/pkg/fs"
+	"github.com/maxdollinger/walk.io/pkg/network"
+	"github.com/maxdollinger/walk.io/pkg/utils"
+)
+
+const (
+	LOG_DIR = "/var/walkio/machines/logs"
+	VM_DIR  = "/var/walkio/machines/"
+)
+
+// minVsockCID is the lowest guest context ID, lower ones address the hypervisor and host
+const minVsockCID = 3
+
+// Supported virtual machine monitors, selected by VMConfig.VMM
+const (
+	VMMFirecracker     = "firecracker"
+	VMMCloudHypervisor = "cloud-hypervisor"
+)
+
+// VMRuntime is a VM managed by one of the supported VMMs
+type VMRuntime interface {
+	Start() error
+	Stop() error
+	Status() (VMStatus, error)
+	Clean() error
+	TailConsole(ctx context.Context, w io.Writer) error
+	Release(ctx context.Context) error
+	// String describes the VM in one line for logs, e.g. "vm 0190... (app app-1, pid 42)"
+	String() string
+}
+
+// NewMachine creates the VM for config with the VMM selected by config.VMM (default firecracker)
+func NewMachine(stateDevPath string, config *VMConfig) (VMRuntime, error) {
+	switch config.VMM {
+	case "", VMMFirecracker:
+		return NewFirecrackerMachine(stateDevPath, config)
+	case VMMCloudHypervisor:
+		return NewCloudHypervisorMachine(stateDevPath, config)
+	default:
+		return nil, fmt.Errorf("unsupported vmm %q", config.VMM)
+	}
+}
+
+// NetworkReleaser returns the network resources of a stopped VM to their pools,
+// implemented by *network.NetworkManager
+type NetworkReleaser interface {
+	ReleaseVMNetwork(ctx context.Context, vmID string, ip net.IP, ports []int) error
+}
+
+var _ NetworkReleaser = (*network.NetworkManager)(nil)
+
+// InstanceStore keeps the DB rows of a VM in sync with its VMM process,
+// implemented by *models.CrutchStore
+type InstanceStore interface {
+	// StartInstance records the VM as running and rejects it if its app runs its limit of VMs
+	StartInstance(ctx context.Context, appID, vmID string, pid int, socketPath string) error
+	StopInstance(ctx context.Context, vmID string) error
+	DeleteInstance(ctx context.Context, vmID string) error
+}
+
+var _ InstanceStore = (*models.CrutchStore)(nil)
+
+// destroyTAP removes the TAP device of a stopped VM, overridden in tests
+var destroyTAP = network.DestroyTAP
+
+// vmDir holds the machine dirs, overridden in tests
+var vmDir = VM_DIR
+
+// machine is the VMM independent part of a VM: its files and the VMM process
+type machine struct {
+	ID              string
+	ContractVersion int // negotiated host/guest contract version
+	Cmd             *exec.Cmd
+	exit            *processExit // exit of the VMM process, nil before Start
+	LogFile         *os.File     // the VMM's own log, written by the VMM itself
+	StderrFile      *os.File     // stderr of the VMM process, e.g. panics and jailer errors
+	ConsoleFile     *os.File     // guest serial console (ttyS0) output
+	ConsolePath     string
+	SocketPath      string
+	VsockPath       string // host unix socket of the guest vsock, empty without vsock
+	StateDevPath    string
+	MachineConfig   *VMConfig
+	NetworkConfig   *network.NetworkConfig
+	released        bool // set once Release freed everything
+	// cleanVMM removes the files of the concrete VMM, e.g. the chroot of a jailed
+	// firecracker. Clean runs it, so Release and a failed start reach it as well.
+	cleanVMM func() error
+}
+
+// newMachine negotiates the guest contract and creates the machine dir and log files
+func newMachine(stateDevPath string, config *VMConfig) (*machine, error) {
+	if config.Network != nil {
+		if err := config.Network.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.VsockCID > 0 && config.VsockCID < minVsockCID {
+		return nil, fmt.Errorf("vsock cid %d is reserved, use %d or higher", config.VsockCID, minVsockCID)
+	}
+
+	id, err := utils.NewUUID7()
+	if err != nil {
+		return nil, fmt.Errorf("generate vm id: %w", err)
+	}
+
+	guestContract, err := ReadGuestContract(config.GetContractPath())
+	if err != nil {
+		return nil, fmt.Errorf("base %s: %w", config.BaseVersion, err)
+	}
+
+	contractVersion, err := NegotiateContract(guestContract)
+	if err != nil {
+		return nil, fmt.Errorf("base %s: %w", config.BaseVersion, err)
+	}
+
+	machineDir := path.Join(vmDir, id)
+	if err := os.MkdirAll(machineDir, 0o755); err != nil {
+		return nil, fmt.Errorf("could not create machineDir: %w", err)
+	}
+
+	logFile, stderrFile, consoleFile, err := createMachineLogs(LOG_DIR, id)
+	if err != nil {
+		err = errors.Join(err, os.RemoveAll(machineDir))
+		return nil, err
+	}
+
+	vsockPath := ""
+	if config.VsockCID > 0 {
+		vsockPath = config.VsockUDSPath
+		if len(vsockPath) == 0 {
+			vsockPath = filepath.Join(machineDir, id+".vsock")
+		}
+	}
+
+	return &machine{
+		ID:              id,
+		ContractVersion: contractVersion,
+		SocketPath:      filepath.Join(machineDir, id+".sock"),
+		VsockPath:       vsockPath,
+		LogFile:         logFile,
+		StderrFile:      stderrFile,
+		ConsoleFile:     consoleFile,
+		ConsolePath:     consoleFile.Name(),
+		StateDevPath:    stateDevPath,
+		MachineConfig:   config,
+		NetworkConfig:   config.Network,
+	}, nil
+}
+
+func (m *machine) dir() string {
+	return path.Join(vmDir, m.ID)
+}
+
+// startProcess verifies the drives and starts the VMM binary with args.
+// The VMM has to write the guest serial console to stdout.
+func (m *machine) startProcess(binary string, args ...string) error {
+	if err := verifyDriveLabels(m.MachineConfig.AppFsPath, m.StateDevPath); err != nil {
+		return fmt.Errorf("verify drives of %s: %w", m.ID, err)
+	}
+
+	// the VMMs refuse to bind to stale sockets of a previous run
+	_ = os.Remove(m.SocketPath)
+	if len(m.VsockPath) > 0 {
+		_ = os.Remove(m.VsockPath)
+	}
+
+	// the app's limit of running VMs is checked before the VMM is spawned
+	store := m.MachineConfig.Instances
+	if store != nil {
+		if err := store.StartInstance(context.Background(), m.MachineConfig.AppID, m.ID, 0, m.SocketPath); err != nil {
+			return fmt.Errorf("start %s: %w", m.ID, err)
+		}
+	}
+
+	cmd := exec.Command(binary, args...)
+	cmd.Stdout = m.ConsoleFile
+	// the VMM opens LogFile on its own, a second writer would overwrite its lines
+	cmd.Stderr = m.StderrFile
+	if err := cmd.Start(); err != nil {
+		err = errors.Join(err, m.stopInstance(), m.Clean())
+		return fmt.Errorf("start %s process: %w", path.Base(binary), err)
+	}
+	m.Cmd = cmd
+	m.exit = waitProcess(cmd)
+
+	if store != nil {
+		if err := store.StartInstance(context.Background(), m.MachineConfig.AppID, m.ID, cmd.Process.Pid, m.SocketPath); err != nil {
+			return errors.Join(fmt.Errorf("start %s: %w", m.ID, err), m.Stop())
+		}
+	}
+
+	return nil
+}
+
+// stopInstance marks the VM as stopped in the InstanceStore
+func (m *machine) stopInstance() error {
+	store := m.MachineConfig.Instances
+	if store == nil {
+		return nil
+	}
+
+	if err := store.StopInstance(context.Background(), m.ID); err != nil {
+		return fmt.Errorf("stop %s: record stop: %w", m.ID, err)
+	}
+	return nil
+}
+
+// Status reports a VM whose VMM exited on its own as stopped after a clean
+// shutdown (exit code 0) and as error otherwise, e.g. after a crash.
+func (m *machine) Status() (VMStatus, error) {
+	if m.Cmd == nil || m.exit == nil {
+		return VMStatusStopped, nil
+	}
+
+	if !m.exit.exited() {
+		return VMStatusRunning, nil
+	}
+	if m.exit.code != 0 {
+		return VMStatusError, nil
+	}
+
+	return VMStatusStopped, nil
+}
+
+func (m *machine) String() string {
+	if m.Cmd == nil || m.Cmd.Process == nil {
+		return fmt.Sprintf("vm %s (app %s, not running)", m.ID, m.MachineConfig.AppID)
+	}
+
+	return fmt.Sprintf("vm %s (app %s, pid %d)", m.ID, m.MachineConfig.AppID, m.Cmd.Process.Pid)
+}
+
+// LogValue logs the VM as a group of its id, app, pid and guest IP, the last two only if set
+func (m *machine) LogValue() slog.Value {
+	attrs := []slog.Attr{slog.String("id", m.ID), slog.String("app", m.MachineConfig.AppID)}
+	if m.Cmd != nil && m.Cmd.Process != nil {
+		attrs = append(attrs, slog.Int("pid", m.Cmd.Process.Pid))
+	}
+	if m.NetworkConfig != nil {
+		attrs = append(attrs, slog.String("ip", m.NetworkConfig.IPAddress))
+	}
+
+	return slog.GroupValue(attrs...)
+}
+
+// console tailing of TailConsole, the idle timeout covers quiet phases of a booting guest
+var (
+	consoleTailIdle = 10 * time.Second
+	consoleTailPoll = 100 * time.Millisecond
+)
+
+// TailConsole streams the guest serial console (ttyS0) to w as it is written,
+// from the start of the boot. It returns once the console was quiet for a while,
+// or with ctx.Err() when ctx is done.
+func (m *machine) TailConsole(ctx context.Context, w io.Writer) error {
+	if len(m.ConsolePath) == 0 {
+		return fmt.Errorf("machine %s has no console", m.ID)
+	}
+
+	return utils.TailPollUntilIdleContext(ctx, m.ConsolePath, w, consoleTailIdle, consoleTailPoll)
+}
+
+// ExitCode returns the exit code of the VMM process, -1 if it was killed by a signal.
+// ok is false while the process runs or was never started.
+func (m *machine) ExitCode() (code int, ok bool) {
+	if m.exit == nil || !m.exit.exited() {
+		return 0, false
+	}
+
+	return m.exit.code, true
+}
+
+// ExitedAt returns when the VMM process exited, zero while it runs or was never started
+func (m *machine) ExitedAt() time.Time {
+	if m.exit == nil || !m.exit.exited() {
+		return time.Time{}
+	}
+
+	return m.exit.at
+}
+
+// Stop terminates the VMM process (SIGTERM, SIGKILL after VMConfig.StopGracePeriod),
+// removes its sockets and tears down the VM's network: the TAP device is destroyed
+// and the IP and host ports are released.
+func (m *machine) Stop() error {
+	if m.Cmd == nil {
+		return m.releaseNetwork()
+	}
+
+	gracePeriod := m.MachineConfig.StopGracePeriod
+	if gracePeriod <= 0 {
+		gracePeriod = DefaultStopGracePeriod
+	}
+	if err := terminate(m.Cmd.Process, m.exit, gracePeriod); err != nil {
+		return fmt.Errorf("stop %s: %w", m.ID, err)
+	}
+	m.Cmd = nil
+
+	if err := m.stopInstance(); err != nil {
+		return err
+	}
+
+	for _, socketPath := range []string{m.SocketPath, m.VsockPath} {
+		if len(socketPath) == 0 {
+			continue
+		}
+		err := os.Remove(socketPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return m.releaseNetwork()
+}
+
+// releaseNetwork destroys the TAP device and releases IP and host ports once,
+// NetworkConfig is cleared afterwards so repeated Stops don't release twice
+func (m *machine) releaseNetwork() error {
+	netConfig := m.NetworkConfig
+	if netConfig == nil {
+		return nil
+	}
+
+	if len(netConfig.TAPDevice) > 0 {
+		if err := destroyTAP(netConfig.TAPDevice); err != nil {
+			return fmt.Errorf("stop %s: %w", m.ID, err)
+		}
+	}
+
+	if releaser := m.MachineConfig.NetworkManager; releaser != nil {
+		ports := make([]int, 0, len(netConfig.PortMapping))
+		for _, mapping := range netConfig.PortMapping {
+			ports = append(ports, mapping.HostPort)
+		}
+
+		err := releaser.ReleaseVMNetwork(context.Background(), netConfig.VMID, net.ParseIP(netConfig.IPAddress), ports)
+		if err != nil {
+			return fmt.Errorf("stop %s: release network: %w", m.ID, err)
+		}
+	}
+
+	m.NetworkConfig = nil
+	return nil
+}
+
+func (m *machine) Clean() error {
+	if m.Cmd != nil {
+		return fmt.Errorf("machine %s is still running", m.ID)
+	}
+
+	err := os.RemoveAll(m.dir())
+	if err != nil {
+		return fmt.Errorf("could not clean vm %s: %w", m.ID, err)
+	}
+
+	_ = m.LogFile.Close()
+	if m.StderrFile != nil {
+		_ = m.StderrFile.Close()
+	}
+	_ = m.ConsoleFile.Close()
+
+	if m.cleanVMM != nil {
+		if err := m.cleanVMM(); err != nil {
+			return err
+		}
+	}
+
+	m.SocketPath = ""
+	m.VsockPath = ""
+
+	return nil
+}
+
+// Release frees everything the VM owns: the VMM process is stopped, the network
+// released, an ephemeral state device and the machine dir removed and the DB rows
+// deleted. If Stop fails the VM may still use its state, so Release returns
+// before touching it, the other steps are all tried even if one fails. Release
+// is idempotent, so it can be deferred right after the machine was created.
+func (m *machine) Release(ctx context.Context) error {
+	if m.released {
+		return nil
+	}
+
+	// Stop releases the network also if the VMM never ran
+	if err := m.Stop(); err != nil {
+		return fmt.Errorf("release %s: %w", m.ID, err)
+	}
+
+	var errs []error
+
+	if m.MachineConfig.EphemeralState && len(m.StateDevPath) > 0 {
+		err := os.Remove(m.StateDevPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("remove state device of %s: %w", m.ID, err))
+		}
+	}
+
+	errs = append(errs, m.Clean())
+
+	if store := m.MachineConfig.Instances; store != nil {
+		if err := store.DeleteInstance(ctx, m.ID); err != nil {
+			errs = append(errs, fmt.Errorf("delete records of %s: %w", m.ID, err))
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("release %s: %w", m.ID, err)
+	}
+
+	m.released = true
+	return nil
+}
+
+// verifyDriveLabels checks that the app and state devices carry the label of their role,
+// so a mixed up device fails here instead of booting a broken VM.
+func verifyDriveLabels(appFsPath, stateDevPath string) error {
+	if err := verifyDriveLabel("app", appFsPath); err != nil {
+		return err
+	}
+	return verifyDriveLabel("state", stateDevPath)
+}
+
+// verifyDriveLabel checks that the new device of a drive exists and the app and
+// state devices are ext4, xfs or squashfs filesystems with the label of their role
+func verifyDriveLabel(driveID, path string) error {
+	if driveID == "rootfs" {
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("rootfs drive: %w", err)
+		}
+		return nil
+	}
+
+	format, label, err := fs.ReadLabel(path)
+	if err != nil {
+		return fmt.Errorf("%s drive: %w", driveID, err)
+	}
+	// squashfs has no label, it can only be an AppFS as it is read-only
+	if driveID == "app" && format == fs.FormatSquashfs {
+		return nil
+	}
+	if driveID == "app" && label != fs.AppFSLabel {
+		return fmt.Errorf("app drive %s has label %q, want %q", path, label, fs.AppFSLabel)
+	}
+	if driveID == "state" && !strings.HasPrefix(label, fs.StateFSLabelPrefix) {
+		return fmt.Errorf("state drive %s has label %q, want %q prefix", path, label, fs.StateFSLabelPrefix)
+	}
+
+	return nil
+}
+
+// createMachineLogs creates the VMM log, the VMM stderr and the guest console file
+// of a machine in logDir
+func createMachineLogs(logDir, id string) (logFile, stderrFile, consoleFile *os.File, err error) {
+	if err := os.MkdirAll(logDir, 0o755); err != nil {
+		return nil, nil, nil, fmt.Errorf("could not create log dir: %w", err)
+	}
+
+	logFile, err = os.Create(filepath.Join(logDir, id+".log"))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("could not create log file: %w", err)
+	}
+
+	stderrFile, err = os.Create(filepath.Join(logDir, id+".stderr.log"))
+	if err != nil {
+		_ = logFile.Close()
+		return nil, nil, nil, fmt.Errorf("could not create stderr file: %w", err)
+	}
+
+	consoleFile, err = os.Create(filepath.Join(logDir, id+".console.log"))
+	if err != nil {
+		_ = logFile.Close()
+		_ = stderrFile.Close()
+		return nil, nil, nil, fmt.Errorf("could not create console file: %w", err)
+	}
+
+	return logFile, stderrFile, consoleFile, nil
+}
+
+// DefaultBootArgs are the kernel args of a VM without VMConfig.BootArgs
+const DefaultBootArgs = "console=ttyS0 reboot=k panic=1 init=/walkio/init"
+
+// guestBootArgs are the kernel args every VMM passes to the guest: VMConfig.BootArgs
+// or DefaultBootArgs, the negotiated contract version and the network args.
+func guestBootArgs(config *VMConfig, contractVersion int) string {
+	args := strings.TrimSpace(config.BootArgs)
+	if len(args) == 0 {
+		args = DefaultBootArgs
+	}
+	args = fmt.Sprintf("%s walkio.contract=%d", args, contractVersion)
+
+	return AppendNetworkBootArgs(args, config.Network)
+}
+
+// AppendNetworkBootArgs appends the ip= arg of netConfig to the kernel args, so the
+// kernel brings up eth0 with the static guest IP. Args without a network config or
+// with an ip= arg of their own are returned unchanged.
+func AppendNetworkBootArgs(args string, netConfig *network.NetworkConfig) string {
+	if netConfig == nil {
+		return args
+	}
+	for _, arg := range strings.Fields(args) {
+		if strings.HasPrefix(arg, "ip=") {
+			return args
+		}
+	}
+
+	return args + " " + netConfig.BootArg()
+}
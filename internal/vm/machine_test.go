@@ -0,0 +1,396 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxdollinger/walk.io/pkg/fs"
+	"github.com/maxdollinger/walk.io/pkg/network"
+)
+
+func TestCreateMachineLogs(t *testing.T) {
+	logDir := filepath.Join(t.TempDir(), "logs")
+
+	logFile, stderrFile, consoleFile, err := createMachineLogs(logDir, "vm-1")
+	if err != nil {
+		t.Fatalf("createMachineLogs failed: %v", err)
+	}
+	defer logFile.Close()
+	defer stderrFile.Close()
+	defer consoleFile.Close()
+
+	// the VMM writes its log itself, stderr and the console must not share it
+	names := []string{logFile.Name(), stderrFile.Name(), consoleFile.Name()}
+	if distinct := slices.Compact(slices.Sorted(slices.Values(names))); len(distinct) != len(names) {
+		t.Fatalf("log files %v are not distinct", names)
+	}
+
+	for _, path := range names {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s not created: %v", path, err)
+		}
+	}
+}
+
+// newLabeledDevice formats a small ext4 image with the given label
+func newLabeledDevice(t *testing.T, label string) string {
+	t.Helper()
+
+	devicePath := filepath.Join(t.TempDir(), "device.ext4")
+	_, err := fs.NewExt4Builder().NewDevice(context.Background(), fs.BlockDeviceOptions{
+		OutputFilePath: devicePath,
+		Label:          label,
+	})
+	if err != nil {
+		t.Fatalf("create device: %v", err)
+	}
+	return devicePath
+}
+
+func TestVerifyDriveLabels(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+
+	appDev := newLabeledDevice(t, fs.AppFSLabel)
+	stateDev := newLabeledDevice(t, fs.StateFSLabelPrefix+"0123456789")
+	unlabeledDev := newLabeledDevice(t, "")
+
+	tests := []struct {
+		name     string
+		appDev   string
+		stateDev string
+		wantErr  bool
+	}{
+		{name: "correct labels", appDev: appDev, stateDev: stateDev},
+		{name: "swapped drives", appDev: stateDev, stateDev: appDev, wantErr: true},
+		{name: "unlabeled app drive", appDev: unlabeledDev, stateDev: stateDev, wantErr: true},
+		{name: "unlabeled state drive", appDev: appDev, stateDev: unlabeledDev, wantErr: true},
+		{name: "missing state drive", appDev: appDev, stateDev: filepath.Join(t.TempDir(), "missing.ext4"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyDriveLabels(tt.appDev, tt.stateDev)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyDriveLabels() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyDriveLabelFormats(t *testing.T) {
+	writeImage := func(name string, image []byte) string {
+		devicePath := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(devicePath, image, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return devicePath
+	}
+	// only the magic and the label of the superblocks
+	xfsImage := func(label string) []byte {
+		image := make([]byte, 4096)
+		copy(image, "XFSB")
+		copy(image[108:], label)
+		return image
+	}
+
+	tests := []struct {
+		name    string
+		driveID string
+		path    string
+		wantErr bool
+	}{
+		{name: "xfs app", driveID: "app", path: writeImage("app.xfs", xfsImage(fs.AppFSLabel))},
+		{name: "xfs state", driveID: "state", path: writeImage("state.xfs", xfsImage(fs.StateFSLabelPrefix+"app"))},
+		{name: "xfs state as app", driveID: "app", path: writeImage("state.xfs", xfsImage(fs.StateFSLabelPrefix+"app")), wantErr: true},
+		{name: "squashfs app", driveID: "app", path: writeImage("app.squashfs", append([]byte("hsqs"), make([]byte, 4096)...))},
+		{name: "squashfs state", driveID: "state", path: writeImage("state.squashfs", append([]byte("hsqs"), make([]byte, 4096)...)), wantErr: true},
+		{name: "raw-tar app", driveID: "app", path: writeImage("app.tar", make([]byte, 4096)), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := verifyDriveLabel(tt.driveID, tt.path); (err != nil) != tt.wantErr {
+				t.Errorf("verifyDriveLabel() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+type fakeReleaser struct {
+	calls []string
+	ip    net.IP
+	ports []int
+}
+
+func (r *fakeReleaser) ReleaseVMNetwork(ctx context.Context, vmID string, ip net.IP, ports []int) error {
+	r.calls = append(r.calls, vmID)
+	r.ip, r.ports = ip, ports
+	return nil
+}
+
+func TestStopReleasesNetwork(t *testing.T) {
+	var destroyed []string
+	original := destroyTAP
+	destroyTAP = func(name string) error { destroyed = append(destroyed, name); return nil }
+	t.Cleanup(func() { destroyTAP = original })
+
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start process: %v", err)
+	}
+
+	releaser := &fakeReleaser{}
+	m := &machine{
+		ID:            "vm-1",
+		Cmd:           cmd,
+		exit:          waitProcess(cmd),
+		SocketPath:    filepath.Join(t.TempDir(), "vm-1.sock"),
+		MachineConfig: &VMConfig{NetworkManager: releaser},
+		NetworkConfig: &network.NetworkConfig{
+			VMID:        "alloc-1",
+			TAPDevice:   "walkio-7d3f89ab",
+			IPAddress:   "172.16.0.2",
+			PortMapping: []network.PortMapping{{HostPort: 40000, GuestPort: 80, Protocol: "tcp"}},
+		},
+	}
+
+	if err := m.Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	if err := m.Stop(); err != nil {
+		t.Fatalf("second Stop failed: %v", err)
+	}
+
+	if !slices.Equal(destroyed, []string{"walkio-7d3f89ab"}) {
+		t.Errorf("destroyed TAPs = %v, want walkio-7d3f89ab once", destroyed)
+	}
+	if !slices.Equal(releaser.calls, []string{"alloc-1"}) {
+		t.Errorf("released VMs = %v, want alloc-1 once", releaser.calls)
+	}
+	if releaser.ip.String() != "172.16.0.2" || !slices.Equal(releaser.ports, []int{40000}) {
+		t.Errorf("released %s %v, want 172.16.0.2 [40000]", releaser.ip, releaser.ports)
+	}
+}
+
+func TestTailConsole(t *testing.T) {
+	originalIdle := consoleTailIdle
+	consoleTailIdle = 100 * time.Millisecond
+	t.Cleanup(func() { consoleTailIdle = originalIdle })
+
+	logFile, _, consoleFile, err := createMachineLogs(filepath.Join(t.TempDir(), "logs"), "vm-1")
+	if err != nil {
+		t.Fatalf("createMachineLogs failed: %v", err)
+	}
+	defer logFile.Close()
+	defer consoleFile.Close()
+
+	// the VMM writes its own log and the guest console to separate files
+	if _, err := logFile.WriteString("firecracker: api server started\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := consoleFile.WriteString("Linux version 6.1\nwalkio init\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &machine{ID: "vm-1", LogFile: logFile, ConsoleFile: consoleFile, ConsolePath: consoleFile.Name()}
+	var out strings.Builder
+	if err := m.TailConsole(context.Background(), &out); err != nil {
+		t.Fatalf("TailConsole failed: %v", err)
+	}
+	if got, want := out.String(), "Linux version 6.1\nwalkio init\n"; got != want {
+		t.Errorf("console = %q, want %q", got, want)
+	}
+}
+
+type fakeInstanceStore struct {
+	stopped []string
+	deleted []string
+}
+
+func (s *fakeInstanceStore) StartInstance(ctx context.Context, appID, vmID string, pid int, socketPath string) error {
+	return nil
+}
+
+func (s *fakeInstanceStore) StopInstance(ctx context.Context, vmID string) error {
+	s.stopped = append(s.stopped, vmID)
+	return nil
+}
+
+func (s *fakeInstanceStore) DeleteInstance(ctx context.Context, vmID string) error {
+	s.deleted = append(s.deleted, vmID)
+	return nil
+}
+
+func TestReleaseFreesOwnedResources(t *testing.T) {
+	var destroyed []string
+	originalTAP, originalDir := destroyTAP, vmDir
+	destroyTAP = func(name string) error { destroyed = append(destroyed, name); return nil }
+	vmDir = t.TempDir()
+	t.Cleanup(func() { destroyTAP, vmDir = originalTAP, originalDir })
+
+	logFile, _, consoleFile, err := createMachineLogs(t.TempDir(), "vm-1")
+	if err != nil {
+		t.Fatalf("createMachineLogs failed: %v", err)
+	}
+	machineDir := filepath.Join(vmDir, "vm-1")
+	if err := os.MkdirAll(machineDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	stateDevPath := filepath.Join(t.TempDir(), "state.ext4")
+	if err := os.WriteFile(stateDevPath, []byte("state"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start process: %v", err)
+	}
+
+	releaser := &fakeReleaser{}
+	store := &fakeInstanceStore{}
+	m := &machine{
+		ID:           "vm-1",
+		Cmd:          cmd,
+		exit:         waitProcess(cmd),
+		LogFile:      logFile,
+		ConsoleFile:  consoleFile,
+		SocketPath:   filepath.Join(machineDir, "vm-1.sock"),
+		StateDevPath: stateDevPath,
+		MachineConfig: &VMConfig{
+			NetworkManager: releaser,
+			EphemeralState: true,
+			Instances:      store,
+		},
+		NetworkConfig: &network.NetworkConfig{VMID: "alloc-1", TAPDevice: "walkio-7d3f89ab", IPAddress: "172.16.0.2"},
+	}
+
+	for i := range 2 {
+		if err := m.Release(context.Background()); err != nil {
+			t.Fatalf("Release %d failed: %v", i, err)
+		}
+	}
+
+	if !m.exit.exited() {
+		t.Error("VMM process still running after Release")
+	}
+	if !slices.Equal(destroyed, []string{"walkio-7d3f89ab"}) || !slices.Equal(releaser.calls, []string{"alloc-1"}) {
+		t.Errorf("network released as TAPs %v and VMs %v, want once", destroyed, releaser.calls)
+	}
+	for _, path := range []string{stateDevPath, machineDir} {
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s still exists after Release", path)
+		}
+	}
+	if !slices.Equal(store.stopped, []string{"vm-1"}) || !slices.Equal(store.deleted, []string{"vm-1"}) {
+		t.Errorf("records stopped %v and deleted %v, want vm-1 once", store.stopped, store.deleted)
+	}
+}
+
+func TestReleaseKeepsStateWhenStopFails(t *testing.T) {
+	tapErr := errors.New("device or resource busy")
+	originalTAP, originalDir := destroyTAP, vmDir
+	destroyTAP = func(string) error { return tapErr }
+	vmDir = t.TempDir()
+	t.Cleanup(func() { destroyTAP, vmDir = originalTAP, originalDir })
+
+	logFile, _, consoleFile, err := createMachineLogs(t.TempDir(), "vm-1")
+	if err != nil {
+		t.Fatalf("createMachineLogs failed: %v", err)
+	}
+	stateDevPath := filepath.Join(t.TempDir(), "state.ext4")
+	if err := os.WriteFile(stateDevPath, []byte("state"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	store := &fakeInstanceStore{}
+	m := &machine{
+		ID:            "vm-1",
+		LogFile:       logFile,
+		ConsoleFile:   consoleFile,
+		StateDevPath:  stateDevPath,
+		MachineConfig: &VMConfig{EphemeralState: true, Instances: store},
+		NetworkConfig: &network.NetworkConfig{VMID: "vm-1", TAPDevice: "walkio-7d3f89ab"},
+	}
+
+	if err := m.Release(context.Background()); !errors.Is(err, tapErr) {
+		t.Fatalf("Release error = %v, want %v", err, tapErr)
+	}
+	if _, err := os.Stat(stateDevPath); err != nil {
+		t.Errorf("state device removed although Stop failed: %v", err)
+	}
+	if len(store.deleted) > 0 {
+		t.Errorf("records deleted although Stop failed: %v", store.deleted)
+	}
+
+	// a retry finishes the release
+	destroyTAP = func(string) error { return nil }
+	if err := m.Release(context.Background()); err != nil {
+		t.Fatalf("retried Release failed: %v", err)
+	}
+	if _, err := os.Stat(stateDevPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("state device still exists after the retried Release: %v", err)
+	}
+}
+
+func TestReleaseKeepsPersistentState(t *testing.T) {
+	originalDir := vmDir
+	vmDir = t.TempDir()
+	t.Cleanup(func() { vmDir = originalDir })
+
+	logFile, _, consoleFile, err := createMachineLogs(t.TempDir(), "vm-1")
+	if err != nil {
+		t.Fatalf("createMachineLogs failed: %v", err)
+	}
+	stateDevPath := filepath.Join(t.TempDir(), "state.ext4")
+	if err := os.WriteFile(stateDevPath, []byte("state"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &machine{ID: "vm-1", LogFile: logFile, ConsoleFile: consoleFile, StateDevPath: stateDevPath, MachineConfig: &VMConfig{}}
+	if err := m.Release(context.Background()); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if _, err := os.Stat(stateDevPath); err != nil {
+		t.Errorf("persistent state device removed: %v", err)
+	}
+}
+
+func TestMachineString(t *testing.T) {
+	m := &machine{ID: "vm-1", MachineConfig: &VMConfig{AppID: "app-1"}}
+	if got, want := m.String(), "vm vm-1 (app app-1, not running)"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start process: %v", err)
+	}
+	defer cmd.Process.Kill()
+	m.Cmd = cmd
+	m.NetworkConfig = &network.NetworkConfig{IPAddress: "172.16.0.2"}
+
+	if got := m.String(); !strings.Contains(got, "vm-1") || !strings.Contains(got, "pid "+strconv.Itoa(cmd.Process.Pid)) {
+		t.Errorf("String() = %q, want id and pid", got)
+	}
+
+	var out bytes.Buffer
+	slog.New(slog.NewTextHandler(&out, nil)).Info("started", "vm", m)
+	for _, want := range []string{"vm.id=vm-1", "vm.app=app-1", "vm.pid=", "vm.ip=172.16.0.2"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("log %q is missing %q", out.String(), want)
+		}
+	}
+}
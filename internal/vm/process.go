@@ -0,0 +1,72 @@
+package vm
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// DefaultStopGracePeriod is how long Stop waits for the VMM to exit after SIGTERM
+const DefaultStopGracePeriod = 5 * time.Second
+
+// processExit is the outcome of a VMM process, filled in once it was reaped
+type processExit struct {
+	done chan struct{} // closed once the process was reaped, the fields are set before
+	code int           // exit code, -1 if the process was killed by a signal
+	at   time.Time
+	err  error // failure to wait, an unsuccessful exit is not an error
+}
+
+// waitProcess reaps the started cmd in the background, so an exited VMM doesn't
+// linger as a zombie and its exit is recorded whether or not Stop was called.
+func waitProcess(cmd *exec.Cmd) *processExit {
+	exit := &processExit{done: make(chan struct{})}
+	go func() {
+		defer close(exit.done)
+
+		err := cmd.Wait()
+		exit.at = time.Now()
+		exit.code = -1
+		if cmd.ProcessState != nil {
+			exit.code = cmd.ProcessState.ExitCode()
+		}
+
+		var exitErr *exec.ExitError
+		if err != nil && !errors.As(err, &exitErr) {
+			exit.err = err
+		}
+	}()
+
+	return exit
+}
+
+// exited reports whether the process was reaped
+func (e *processExit) exited() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// terminate sends SIGTERM to process and SIGKILL if it has not exited after graceTimeout.
+// It returns once exit reports the process as reaped.
+func terminate(process *os.Process, exit *processExit, graceTimeout time.Duration) error {
+	if err := process.Signal(syscall.SIGTERM); err == nil {
+		timer := time.NewTimer(graceTimeout)
+		defer timer.Stop()
+
+		select {
+		case <-exit.done:
+		case <-timer.C:
+			_ = process.Kill()
+		}
+	}
+
+	// a failed signal means the process already exited
+	<-exit.done
+	return exit.err
+}
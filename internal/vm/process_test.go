@@ -0,0 +1,114 @@
+package vm
+
+import (
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func startProcess(t *testing.T, script string) (*exec.Cmd, *processExit) {
+	t.Helper()
+
+	cmd := exec.Command("sh", "-c", script)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start process: %v", err)
+	}
+	return cmd, waitProcess(cmd)
+}
+
+func TestTerminate(t *testing.T) {
+	tests := []struct {
+		name       string
+		script     string
+		wantSignal syscall.Signal
+		minTime    time.Duration
+	}{
+		{name: "exits on SIGTERM", script: "exec sleep 10", wantSignal: syscall.SIGTERM},
+		{name: "killed after grace period", script: `trap "" TERM; exec sleep 10`, wantSignal: syscall.SIGKILL, minTime: 200 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, exit := startProcess(t, tt.script)
+			// let the shell install its trap before signalling
+			time.Sleep(50 * time.Millisecond)
+
+			start := time.Now()
+			if err := terminate(cmd.Process, exit, 200*time.Millisecond); err != nil {
+				t.Fatalf("terminate failed: %v", err)
+			}
+			elapsed := time.Since(start)
+
+			if !exit.exited() || cmd.ProcessState == nil {
+				t.Fatal("process was not reaped")
+			}
+			status := cmd.ProcessState.Sys().(syscall.WaitStatus)
+			if !status.Signaled() || status.Signal() != tt.wantSignal {
+				t.Errorf("process ended with %v, want signal %v", status, tt.wantSignal)
+			}
+			if exit.code != -1 {
+				t.Errorf("exit code = %d, want -1 for a signal", exit.code)
+			}
+			if elapsed < tt.minTime || elapsed > 5*time.Second {
+				t.Errorf("terminate took %v, want at least %v", elapsed, tt.minTime)
+			}
+		})
+	}
+}
+
+func TestTerminateExitedProcess(t *testing.T) {
+	cmd, exit := startProcess(t, "exit 0")
+	<-exit.done
+
+	if err := terminate(cmd.Process, exit, time.Second); err != nil {
+		t.Fatalf("terminate of an exited process failed: %v", err)
+	}
+	if exit.code != 0 {
+		t.Errorf("exit code = %d, want 0", exit.code)
+	}
+}
+
+func TestMachineStatusAfterExit(t *testing.T) {
+	tests := []struct {
+		name       string
+		script     string
+		wantStatus VMStatus
+		wantCode   int
+	}{
+		{name: "clean shutdown", script: "exit 0", wantStatus: VMStatusStopped, wantCode: 0},
+		{name: "crash", script: "exit 3", wantStatus: VMStatusError, wantCode: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, exit := startProcess(t, tt.script)
+			m := &machine{ID: "vm-1", Cmd: cmd, exit: exit}
+			<-exit.done
+
+			status, err := m.Status()
+			if err != nil || status != tt.wantStatus {
+				t.Errorf("Status() = %v, %v, want %v", status, err, tt.wantStatus)
+			}
+			if code, ok := m.ExitCode(); !ok || code != tt.wantCode {
+				t.Errorf("ExitCode() = %d, %v, want %d", code, ok, tt.wantCode)
+			}
+			if m.ExitedAt().IsZero() {
+				t.Error("ExitedAt() is zero after the process exited")
+			}
+		})
+	}
+}
+
+func TestMachineStatusRunning(t *testing.T) {
+	cmd, exit := startProcess(t, "exec sleep 10")
+	t.Cleanup(func() { _ = terminate(cmd.Process, exit, time.Second) })
+	m := &machine{ID: "vm-1", Cmd: cmd, exit: exit}
+
+	if status, _ := m.Status(); status != VMStatusRunning {
+		t.Errorf("Status() = %v, want %v", status, VMStatusRunning)
+	}
+	if _, ok := m.ExitCode(); ok {
+		t.Error("ExitCode() reported an exit of a running process")
+	}
+}
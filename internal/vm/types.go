@@ -1,8 +1,14 @@
 package vm
 
 import (
+	"fmt"
 	"path"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/maxdollinger/walk.io/pkg/network"
+	"github.com/maxdollinger/walk.io/pkg/utils"
 )
 
 const WALKIO_PATH = "/var/lib/walkio/"
@@ -13,6 +19,28 @@ type ExposedPort struct {
 	Protocol string // Protocol: "tcp" or "udp"
 }
 
+// ParseExposedPorts parses the exposed ports of an OCI image config, e.g.
+// "80/tcp" or "53/udp", a port without protocol is tcp.
+func ParseExposedPorts(ports []string) ([]ExposedPort, error) {
+	exposed := make([]ExposedPort, 0, len(ports))
+	for _, port := range ports {
+		number, protocol, ok := strings.Cut(port, "/")
+		if !ok {
+			protocol = "tcp"
+		}
+		if protocol != "tcp" && protocol != "udp" {
+			return nil, fmt.Errorf("exposed port %q: %w", port, network.ErrInvalidProtocol)
+		}
+		n, err := strconv.Atoi(number)
+		if err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("exposed port %q: %w", port, network.ErrInvalidPort)
+		}
+		exposed = append(exposed, ExposedPort{Port: n, Protocol: protocol})
+	}
+
+	return exposed, nil
+}
+
 // VMConfig holds essential Firecracker VM configuration.
 // This is intentionally minimal to keep the design clean and extensible.
 type VMConfig struct {
@@ -20,12 +48,97 @@ type VMConfig struct {
 	AppFsPath   string        // path to /var/lib/walkio/apps/{digest}.ext4
 	BaseVersion string        // base bundle version (e.g., "v1.0") for reference/logging
 	VCPU        int           // number of vCPUs (default: 1)
-	Memory      int           // memory in MB (default: 512)
+	Memory      utils.Bytes   // guest memory, passed to the VMM in whole MB (default: 512M)
 	Timeout     time.Duration // operation timeout
+	VMM         string        // VMMFirecracker (default) or VMMCloudHypervisor
+
+	// kernel args replacing DefaultBootArgs, e.g. with quiet or another init.
+	// walkio.contract and the ip= arg of Network (see AppendNetworkBootArgs) are appended.
+	BootArgs string
+
+	// CPU settings of firecracker's machine-config, not supported by cloud-hypervisor
+	SMT         bool   // simultaneous multithreading (hyperthreading) in the guest
+	CPUTemplate string // static CPU template masking CPU features, e.g. for snapshot portability, one of CPUTemplates
+
+	// virtio-balloon device to reclaim guest memory of idle VMs, resized at runtime
+	// with FirecrackerMachine.UpdateBalloon. The device is added if any field is set.
+	// Not supported by cloud-hypervisor.
+	BalloonSizeMiB       int           // initial size of the balloon, memory taken from the guest
+	DeflateOnOOM         bool          // the guest deflates the balloon instead of running out of memory
+	BalloonStatsInterval time.Duration // enables FirecrackerMachine.BalloonStats, polled in whole seconds
+
+	// time the VMM gets to exit after SIGTERM on Stop before it is killed (default: DefaultStopGracePeriod)
+	StopGracePeriod time.Duration
 
 	// Network configuration (default: true)
-	NetworkEnabled bool          // Whether to setup networking for this VM
-	ExposedPorts   []ExposedPort // Ports exposed by the OCI image
+	NetworkEnabled bool                   // Whether to setup networking for this VM
+	ExposedPorts   []ExposedPort          // Ports exposed by the OCI image
+	Network        *network.NetworkConfig // TAP, MAC and IP of the guest NIC, nil boots without network
+	NetworkManager NetworkReleaser        // gets the IP and host ports of Network back on Stop (optional)
+
+	// cleanup on Release
+	EphemeralState bool          // the state device is deleted with the VM
+	Instances      InstanceStore // deletes the DB rows of the VM (optional)
+
+	// IO limits enforced by Firecracker (default: unlimited)
+	DriveRateLimit RateLimit // applied to each drive
+	NetRateLimit   RateLimit // applied to rx and tx of the guest NIC, ops are packets
+
+	// vsock device for host agents to talk to the guest init without a network stack
+	VsockCID     uint32 // guest context ID, 0 disables vsock, 1 and 2 are reserved by the host
+	VsockUDSPath string // host unix socket of the device (default: {vm dir}/{vm id}.vsock)
+
+	// run firecracker through its jailer, chrooted to {JailerChrootBase}/firecracker/{vm id}/root
+	// with the privileges of JailerUID and JailerGID. The kernel and drives are linked
+	// into the chroot, the state device is chowned to the jailed user. The TAP device
+	// has to be usable by that user. Direct launch is the default, e.g. for development.
+	UseJailer        bool
+	JailerUID        int    // has to be non-root
+	JailerGID        int    // has to be non-root
+	JailerChrootBase string // default: DefaultJailerChrootBase
+
+	// metadata for the guest init, e.g. the app's env and argv, served by
+	// Firecracker's MMDS (version 2) at MMDSAddress on the guest NIC eth0.
+	// The network config is added below network.MMDSKey unless set.
+	// Needs Network, nil disables MMDS. Not supported by cloud-hypervisor.
+	MMDS map[string]any
+}
+
+// RateLimit configures Firecracker's token buckets for a device.
+// A bucket holds a rate's worth of tokens (bytes or ops) and is refilled completely
+// every second, so the rate is sustained and at most one second of IO can be saved up.
+// Burst is an extra one-time budget of bytes, spent before the bucket and never
+// refilled, e.g. to load an app quickly after boot. Zero values mean unlimited.
+type RateLimit struct {
+	BytesPerSec utils.Bytes
+	OpsPerSec   int64 // IO operations for drives, packets for network interfaces
+	Burst       utils.Bytes
+}
+
+// hasBalloon reports if the VM gets a balloon device
+func (c *VMConfig) hasBalloon() bool {
+	return c.BalloonSizeMiB > 0 || c.DeflateOnOOM || c.BalloonStatsInterval > 0
+}
+
+// GuestPorts returns the exposed ports of the VM as the guest ports of
+// NetworkManager.SetupVM, which allocates their host ports.
+func (c *VMConfig) GuestPorts() []network.PortMapping {
+	ports := make([]network.PortMapping, len(c.ExposedPorts))
+	for i, port := range c.ExposedPorts {
+		ports[i] = network.PortMapping{GuestPort: port.Port, Protocol: port.Protocol}
+	}
+
+	return ports
+}
+
+// TAPOwner returns the owner of the TAP device for NetworkManager.SetupVM, a
+// jailed firecracker runs as JailerUID and JailerGID and has to open it itself
+func (c *VMConfig) TAPOwner() network.TAPOwner {
+	if !c.UseJailer {
+		return network.TAPOwner{}
+	}
+
+	return network.TAPOwner{UID: c.JailerUID, GID: c.JailerGID}
 }
 
 func (c *VMConfig) GetRootFSPath() string {
@@ -40,6 +153,18 @@ func (c *VMConfig) GetFirecrackerPath() string {
 	return path.Join(WALKIO_PATH, "base", c.BaseVersion, "firecracker")
 }
 
+func (c *VMConfig) GetJailerPath() string {
+	return path.Join(WALKIO_PATH, "base", c.BaseVersion, "jailer")
+}
+
+func (c *VMConfig) GetCloudHypervisorPath() string {
+	return path.Join(WALKIO_PATH, "base", c.BaseVersion, "cloud-hypervisor")
+}
+
+func (c *VMConfig) GetContractPath() string {
+	return path.Join(WALKIO_PATH, "base", c.BaseVersion, "contract.json")
+}
+
 // VMStatus represents the current operational state of a VM.
 type VMStatus string
 
@@ -0,0 +1,53 @@
+package vm
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/maxdollinger/walk.io/pkg/network"
+)
+
+func TestParseExposedPorts(t *testing.T) {
+	got, err := ParseExposedPorts([]string{"80/tcp", "53/udp", "8080"})
+	if err != nil {
+		t.Fatalf("ParseExposedPorts failed: %v", err)
+	}
+	want := []ExposedPort{{Port: 80, Protocol: "tcp"}, {Port: 53, Protocol: "udp"}, {Port: 8080, Protocol: "tcp"}}
+	if !slices.Equal(got, want) {
+		t.Errorf("ParseExposedPorts() = %v, want %v", got, want)
+	}
+
+	tests := map[string]error{
+		"80/sctp":   network.ErrInvalidProtocol,
+		"0/tcp":     network.ErrInvalidPort,
+		"65536/tcp": network.ErrInvalidPort,
+		"http/tcp":  network.ErrInvalidPort,
+	}
+	for port, wantErr := range tests {
+		if _, err := ParseExposedPorts([]string{port}); !errors.Is(err, wantErr) {
+			t.Errorf("ParseExposedPorts(%q) error = %v, want %v", port, err, wantErr)
+		}
+	}
+}
+
+func TestGuestPorts(t *testing.T) {
+	config := VMConfig{ExposedPorts: []ExposedPort{{Port: 80, Protocol: "tcp"}, {Port: 53, Protocol: "udp"}}}
+
+	want := []network.PortMapping{{GuestPort: 80, Protocol: "tcp"}, {GuestPort: 53, Protocol: "udp"}}
+	if got := config.GuestPorts(); !slices.Equal(got, want) {
+		t.Errorf("GuestPorts() = %v, want %v", got, want)
+	}
+}
+
+func TestTAPOwner(t *testing.T) {
+	config := VMConfig{JailerUID: 1000, JailerGID: 1001}
+	if got := config.TAPOwner(); got != (network.TAPOwner{}) {
+		t.Errorf("TAPOwner() of an unjailed VM = %+v, want root", got)
+	}
+
+	config.UseJailer = true
+	if got, want := config.TAPOwner(), (network.TAPOwner{UID: 1000, GID: 1001}); got != want {
+		t.Errorf("TAPOwner() = %+v, want %+v", got, want)
+	}
+}
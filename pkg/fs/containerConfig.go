@@ -4,14 +4,72 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"maps"
 	"os"
 	"path"
+	"slices"
 	"strings"
 
 	"github.com/maxdollinger/walk.io/pkg/oci"
 )
 
+// ErrInvalidArgv is returned for an argv that can't be written to the line based /walkio/argv file
+var ErrInvalidArgv = errors.New("invalid argv")
+
+// /walkio/env holds one KEY=VALUE per line, /walkio/argv one arg per line.
+// Values and args are escaped, so they stay on their line: a backslash is
+// written as \\, a newline as \n and a carriage return as \r. Everything else,
+// spaces, quotes and further '=' included, is written as is. The guest init
+// splits env lines at the first '=' and unescapes with DecodeConfigValue.
+var configValueEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r")
+
+// EncodeConfigValue escapes an env value or arg for /walkio/env and /walkio/argv
+func EncodeConfigValue(value string) string {
+	return configValueEscaper.Replace(value)
+}
+
+// DecodeConfigValue reverses EncodeConfigValue, a backslash before any other
+// character or at the end of the value is kept literally.
+func DecodeConfigValue(encoded string) string {
+	if !strings.Contains(encoded, "\\") {
+		return encoded
+	}
+
+	var value strings.Builder
+	for i := 0; i < len(encoded); i++ {
+		if encoded[i] != '\\' || i+1 == len(encoded) {
+			value.WriteByte(encoded[i])
+			continue
+		}
+		switch encoded[i+1] {
+		case '\\':
+			value.WriteByte('\\')
+		case 'n':
+			value.WriteByte('\n')
+		case 'r':
+			value.WriteByte('\r')
+		default:
+			value.WriteByte('\\')
+			continue
+		}
+		i++
+	}
+	return value.String()
+}
+
+// ValidateArgv checks that no arg of argv is blank, /walkio/argv holds one
+// trimmed arg per line.
+func ValidateArgv(argv []string) error {
+	for i, arg := range argv {
+		if len(strings.TrimSpace(arg)) == 0 {
+			return fmt.Errorf("%w: arg %d is blank", ErrInvalidArgv, i)
+		}
+	}
+	return nil
+}
+
 func WriteContainerConfig(ctx context.Context, config *oci.ImageConfig, rootfsDir string) error {
 	configDir := path.Join(rootfsDir, "walkio")
 	err := os.MkdirAll(configDir, 0o755)
@@ -29,16 +87,50 @@ func WriteContainerConfig(ctx context.Context, config *oci.ImageConfig, rootfsDi
 		return fmt.Errorf("write argv file: %w", err)
 	}
 
+	err = writeAppLabels(configDir, config)
+	if err != nil {
+		return fmt.Errorf("write labels file: %w", err)
+	}
+
+	err = writeAppUser(configDir, rootfsDir, config.User)
+	if err != nil {
+		return fmt.Errorf("write user file: %w", err)
+	}
+
 	return nil
 }
 
 // writeEnv creates /walkio/env file with environment variables from image config.
+// Entries must be KEY=VALUE with a shell identifier as key, see ValidateEnvKey,
+// values are escaped with EncodeConfigValue.
+// They are sorted by key, so the same env gives a byte-identical file whatever
+// order it was merged in, and end with the WORKDIR line.
 func writeAppEnv(configDir string, config *oci.ImageConfig) error {
 	var env bytes.Buffer
 	writer := bufio.NewWriter(&env)
 
+	lines := make([]string, 0, len(config.Env))
 	for _, line := range config.Env {
-		_, err := writer.WriteString(strings.TrimSpace(line))
+		line = strings.TrimSpace(line)
+		key, _, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%w: entry %q has no '='", ErrInvalidEnvKey, line)
+		}
+		if err := ValidateEnvKey(key); err != nil {
+			return err
+		}
+		_, value, _ := strings.Cut(line, "=")
+		lines = append(lines, key+"="+EncodeConfigValue(value))
+	}
+	// stable, so of duplicate keys the later entry still comes last and wins
+	slices.SortStableFunc(lines, func(a, b string) int {
+		keyA, _, _ := strings.Cut(a, "=")
+		keyB, _, _ := strings.Cut(b, "=")
+		return strings.Compare(keyA, keyB)
+	})
+
+	for _, line := range lines {
+		_, err := writer.WriteString(line)
 		if err != nil {
 			return fmt.Errorf("write env to buffer: %w", err)
 		}
@@ -52,7 +144,7 @@ func writeAppEnv(configDir string, config *oci.ImageConfig) error {
 	if len(config.WorkingDir) > 0 {
 		workdir = config.WorkingDir
 	}
-	_, err := fmt.Fprintf(writer, "WORKDIR=%s", workdir)
+	_, err := fmt.Fprintf(writer, "WORKDIR=%s", EncodeConfigValue(workdir))
 	if err != nil {
 		return fmt.Errorf("write workdir to buffer: %w", err)
 	}
@@ -71,13 +163,14 @@ func writeAppEnv(configDir string, config *oci.ImageConfig) error {
 	return nil
 }
 
-// writeArgv creates /walkio/argv file with entrypoint and cmd from image config.
+// writeArgv creates /walkio/argv file with entrypoint and cmd from image config,
+// args are escaped with EncodeConfigValue.
 func writeAppArgv(configDir string, config *oci.ImageConfig) error {
 	var argv bytes.Buffer
 	writer := bufio.NewWriter(&argv)
 
 	for _, line := range config.Entrypoint {
-		_, err := writer.WriteString(strings.TrimSpace(line))
+		_, err := writer.WriteString(EncodeConfigValue(strings.TrimSpace(line)))
 		if err != nil {
 			return fmt.Errorf("write entrypoint to buffer: %w", err)
 		}
@@ -88,7 +181,7 @@ func writeAppArgv(configDir string, config *oci.ImageConfig) error {
 	}
 
 	for _, line := range config.Cmd {
-		_, err := writer.WriteString(strings.TrimSpace(line))
+		_, err := writer.WriteString(EncodeConfigValue(strings.TrimSpace(line)))
 		if err != nil {
 			return fmt.Errorf("write cmd to buffer: %w", err)
 		}
@@ -111,3 +204,24 @@ func writeAppArgv(configDir string, config *oci.ImageConfig) error {
 
 	return nil
 }
+
+// writeAppLabels creates /walkio/labels with the image labels as KEY=VALUE lines
+// sorted by key, keys and values are escaped with EncodeConfigValue. Labels with
+// an empty key or a '=' in the key can't be split and are skipped.
+func writeAppLabels(configDir string, config *oci.ImageConfig) error {
+	var labels strings.Builder
+	for _, key := range slices.Sorted(maps.Keys(config.Labels)) {
+		if len(key) == 0 || strings.Contains(key, "=") {
+			continue
+		}
+		fmt.Fprintf(&labels, "%s=%s\n", EncodeConfigValue(key), EncodeConfigValue(config.Labels[key]))
+	}
+
+	labelsFilePath := path.Join(configDir, "labels")
+	err := os.WriteFile(labelsFilePath, []byte(labels.String()), 0o644)
+	if err != nil {
+		return fmt.Errorf("write labels file: %w", err)
+	}
+
+	return nil
+}
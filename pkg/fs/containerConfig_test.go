@@ -0,0 +1,187 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/maxdollinger/walk.io/pkg/oci"
+)
+
+func TestWriteContainerConfigEnv(t *testing.T) {
+	rootfsDir := t.TempDir()
+	config := &oci.ImageConfig{Env: []string{"PATH=/usr/bin", " _FOO123=a=b "}, WorkingDir: "/app"}
+
+	if err := WriteContainerConfig(context.Background(), config, rootfsDir); err != nil {
+		t.Fatalf("WriteContainerConfig failed: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(rootfsDir, "walkio", "env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "PATH=/usr/bin\n_FOO123=a=b\nWORKDIR=/app"; string(got) != want {
+		t.Errorf("env file = %q, want %q", got, want)
+	}
+}
+
+func TestWriteContainerConfigInvalidEnv(t *testing.T) {
+	for _, env := range []string{"MY KEY=value", "=value", "NO_VALUE"} {
+		config := &oci.ImageConfig{Env: []string{env}}
+		err := WriteContainerConfig(context.Background(), config, t.TempDir())
+		if !errors.Is(err, ErrInvalidEnvKey) {
+			t.Errorf("WriteContainerConfig with env %q error = %v, want %v", env, err, ErrInvalidEnvKey)
+		}
+	}
+}
+
+func TestWriteContainerConfigEnvOrder(t *testing.T) {
+	env := map[string]string{"ZETA": "1", "ALPHA": "2", "MODE": "prod", "_PRIVATE": "3", "DB_HOST": "db", "B": "4"}
+
+	var written []string
+	for range 10 {
+		// map iteration order differs between runs
+		config := &oci.ImageConfig{WorkingDir: "/app"}
+		for key, value := range env {
+			config.Env = append(config.Env, key+"="+value)
+		}
+
+		rootfsDir := t.TempDir()
+		if err := WriteContainerConfig(context.Background(), config, rootfsDir); err != nil {
+			t.Fatalf("WriteContainerConfig failed: %v", err)
+		}
+		data, err := os.ReadFile(filepath.Join(rootfsDir, "walkio", "env"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		written = append(written, string(data))
+	}
+
+	want := "ALPHA=2\nB=4\nDB_HOST=db\nMODE=prod\nZETA=1\n_PRIVATE=3\nWORKDIR=/app"
+	for _, got := range written {
+		if got != want {
+			t.Fatalf("env file = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestWriteContainerConfigEnvDuplicateKeys(t *testing.T) {
+	config := &oci.ImageConfig{Env: []string{"MODE=image", "A=1", "MODE=override"}}
+	rootfsDir := t.TempDir()
+	if err := WriteContainerConfig(context.Background(), config, rootfsDir); err != nil {
+		t.Fatalf("WriteContainerConfig failed: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(rootfsDir, "walkio", "env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "A=1\nMODE=image\nMODE=override\nWORKDIR=/"; string(got) != want {
+		t.Errorf("env file = %q, want %q", got, want)
+	}
+}
+
+func TestWriteContainerConfigLabels(t *testing.T) {
+	rootfsDir := t.TempDir()
+	config := &oci.ImageConfig{Labels: map[string]string{
+		"version":                 "1.0",
+		"org.example.description": "two\nlines",
+		"bad=key":                 "skipped",
+		"org.example.maintainer":  "Jane <jane@example.com>",
+	}}
+
+	if err := WriteContainerConfig(context.Background(), config, rootfsDir); err != nil {
+		t.Fatalf("WriteContainerConfig failed: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(rootfsDir, "walkio", "labels"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "org.example.description=two\\nlines\norg.example.maintainer=Jane <jane@example.com>\nversion=1.0\n"
+	if string(got) != want {
+		t.Errorf("labels file = %q, want %q", got, want)
+	}
+}
+
+func TestValidateArgv(t *testing.T) {
+	if err := ValidateArgv([]string{"/bin/app", "--name", "a b", "two\nlines"}); err != nil {
+		t.Errorf("ValidateArgv of a valid argv failed: %v", err)
+	}
+	for _, argv := range [][]string{{"/bin/app", " "}, {""}, {"\r\n"}} {
+		if err := ValidateArgv(argv); !errors.Is(err, ErrInvalidArgv) {
+			t.Errorf("ValidateArgv(%q) error = %v, want %v", argv, err, ErrInvalidArgv)
+		}
+	}
+}
+
+func TestWriteContainerConfigEscapesValues(t *testing.T) {
+	values := []string{
+		"with spaces",
+		"a=b=c",
+		`"double" and 'single' quotes`,
+		"first\nsecond\r\nthird",
+		`C:\path\n`,
+		`trailing\`,
+	}
+
+	rootfsDir := t.TempDir()
+	config := &oci.ImageConfig{Cmd: values}
+	for i, value := range values {
+		config.Env = append(config.Env, fmt.Sprintf("V%d=%s", i, value))
+	}
+	if err := WriteContainerConfig(context.Background(), config, rootfsDir); err != nil {
+		t.Fatalf("WriteContainerConfig failed: %v", err)
+	}
+
+	env, err := os.ReadFile(filepath.Join(rootfsDir, "walkio", "env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(env), "\n")
+	if len(lines) != len(values)+1 {
+		t.Fatalf("env file has %d lines, want %d: %q", len(lines), len(values)+1, env)
+	}
+	for i, value := range values {
+		key, encoded, _ := strings.Cut(lines[i], "=")
+		if got := DecodeConfigValue(encoded); key != fmt.Sprintf("V%d", i) || got != value {
+			t.Errorf("env line %d decodes to %s=%q, want V%d=%q", i, key, got, i, value)
+		}
+	}
+
+	argv, err := os.ReadFile(filepath.Join(rootfsDir, "walkio", "argv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := strings.Split(strings.TrimSuffix(string(argv), "\n"), "\n")
+	if len(args) != len(values) {
+		t.Fatalf("argv file has %d lines, want %d: %q", len(args), len(values), argv)
+	}
+	for i, value := range values {
+		if got := DecodeConfigValue(args[i]); got != value {
+			t.Errorf("arg %d decodes to %q, want %q", i, got, value)
+		}
+	}
+}
+
+func TestDecodeConfigValue(t *testing.T) {
+	tests := map[string]string{
+		"plain":      "plain",
+		`a\\b`:       `a\b`,
+		`line\nnext`: "line\nnext",
+		`cr\r`:       "cr\r",
+		`unknown\t`:  `unknown\t`,
+		`trailing\`:  `trailing\`,
+		`\\n`:        `\n`,
+		`\\\n`:       "\\\n",
+	}
+	for encoded, want := range tests {
+		if got := DecodeConfigValue(encoded); got != want {
+			t.Errorf("DecodeConfigValue(%q) = %q, want %q", encoded, got, want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// ErrDeviceInUse is returned for devices that are opened by a process or loop mounted
+var ErrDeviceInUse = errors.New("device is in use")
+
+// FileID identifies a file by its device and inode, so all hard links of a
+// file, e.g. the one in the chroot of a jailed VM, have the same FileID
+type FileID struct {
+	Dev uint64
+	Ino uint64
+}
+
+// StatFileID returns the FileID of the file at path, symlinks are followed
+func StatFileID(path string) (FileID, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return FileID{}, err
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return FileID{}, fmt.Errorf("stat %s: no device and inode", path)
+	}
+	return FileID{Dev: uint64(stat.Dev), Ino: stat.Ino}, nil
+}
+
+// CheckDeviceIdle fails with ErrDeviceInUse if a process (e.g. the VMM of a
+// running VM) or a loop device holds the device file at path, also through
+// another hard link of it.
+func CheckDeviceIdle(path string) error {
+	id, err := StatFileID(path)
+	if err != nil {
+		return err
+	}
+
+	openFiles, err := OpenFileIDs()
+	if err != nil {
+		return err
+	}
+	if openFiles[id] {
+		return fmt.Errorf("%w: opened by a process", ErrDeviceInUse)
+	}
+
+	backingFiles, err := filepath.Glob("/sys/block/loop*/loop/backing_file")
+	if err != nil {
+		return err
+	}
+	for _, backingFile := range backingFiles {
+		data, err := os.ReadFile(backingFile)
+		if err != nil {
+			continue
+		}
+		backingID, err := StatFileID(strings.TrimSpace(string(data)))
+		if err == nil && backingID == id {
+			return fmt.Errorf("%w: attached to %s", ErrDeviceInUse, strings.Split(backingFile, "/")[3])
+		}
+	}
+
+	return nil
+}
+
+// OpenFileIDs returns the FileIDs of all files currently opened by any process
+func OpenFileIDs() (map[FileID]bool, error) {
+	fdDirs, err := filepath.Glob("/proc/[0-9]*/fd")
+	if err != nil {
+		return nil, err
+	}
+
+	openFiles := make(map[FileID]bool)
+	for _, fdDir := range fdDirs {
+		// processes may exit or deny access while scanning
+		entries, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			// stat follows the fd to the opened file, whatever path it was opened by
+			id, err := StatFileID(filepath.Join(fdDir, entry.Name()))
+			if err != nil {
+				continue
+			}
+			openFiles[id] = true
+		}
+	}
+
+	return openFiles, nil
+}
@@ -0,0 +1,34 @@
+package fs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckDeviceIdleThroughHardLink(t *testing.T) {
+	dir := t.TempDir()
+	devicePath := filepath.Join(dir, "state.ext4")
+	if err := os.WriteFile(devicePath, []byte("state"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckDeviceIdle(devicePath); err != nil {
+		t.Fatalf("CheckDeviceIdle of an unused device: %v", err)
+	}
+
+	// like a jailed VM, which opens the device by its link in the chroot
+	jailPath := filepath.Join(dir, "state-jailed.ext4")
+	if err := os.Link(devicePath, jailPath); err != nil {
+		t.Fatal(err)
+	}
+	holder, err := os.Open(jailPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Close()
+
+	if err := CheckDeviceIdle(devicePath); !errors.Is(err, ErrDeviceInUse) {
+		t.Errorf("CheckDeviceIdle error = %v, want %v", err, ErrDeviceInUse)
+	}
+}
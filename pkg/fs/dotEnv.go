@@ -0,0 +1,169 @@
+package fs
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var ErrInvalidEnvKey = errors.New("invalid env key")
+
+// ValidateEnvKey checks that key is a shell identifier ([A-Za-z_][A-Za-z0-9_]*).
+// Other keys, e.g. with '=' or spaces, break the line based /walkio/env file.
+func ValidateEnvKey(key string) error {
+	if len(key) == 0 {
+		return fmt.Errorf("%w: empty key", ErrInvalidEnvKey)
+	}
+
+	for i, c := range key {
+		isLetter := c == '_' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+		isDigit := c >= '0' && c <= '9'
+		if !isLetter && (i == 0 || !isDigit) {
+			return fmt.Errorf("%w: %q must be a shell identifier", ErrInvalidEnvKey, key)
+		}
+	}
+
+	return nil
+}
+
+// ReadDotEnvFile parses the dotenv file at filePath, see ParseDotEnv.
+func ReadDotEnvFile(filePath string) ([]string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("open dotenv file: %w", err)
+	}
+	defer f.Close()
+
+	env, err := ParseDotEnv(f)
+	if err != nil {
+		return nil, fmt.Errorf("dotenv file %s: %w", filePath, err)
+	}
+
+	return env, nil
+}
+
+// ParseDotEnv parses dotenv content into KEY=VALUE entries in file order.
+//
+// Supported syntax:
+//   - blank lines and lines starting with # are ignored
+//   - an optional "export " prefix
+//   - unquoted values are trimmed, " #" starts a trailing comment
+//   - 'single quoted' values are taken literally
+//   - "double quoted" values support the escapes \n, \t, \" and \\
+func ParseDotEnv(r io.Reader) ([]string, error) {
+	var env []string
+
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		line = strings.TrimPrefix(line, "export ")
+		key, rawValue, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: missing '='", lineNumber)
+		}
+
+		key = strings.TrimSpace(key)
+		if err := ValidateEnvKey(key); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+
+		value, err := parseDotEnvValue(strings.TrimSpace(rawValue))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+
+		env = append(env, key+"="+value)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read dotenv: %w", err)
+	}
+
+	return env, nil
+}
+
+func parseDotEnvValue(raw string) (string, error) {
+	if len(raw) == 0 {
+		return "", nil
+	}
+
+	switch raw[0] {
+	case '\'':
+		end := strings.IndexByte(raw[1:], '\'')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated single quote")
+		}
+		return raw[1 : end+1], checkTrailing(raw[end+2:])
+
+	case '"':
+		var value strings.Builder
+		for i := 1; i < len(raw); i++ {
+			switch c := raw[i]; c {
+			case '"':
+				return value.String(), checkTrailing(raw[i+1:])
+			case '\\':
+				if i+1 == len(raw) {
+					return "", fmt.Errorf("unterminated double quote")
+				}
+				i++
+				switch raw[i] {
+				case 'n':
+					value.WriteByte('\n')
+				case 't':
+					value.WriteByte('\t')
+				default:
+					value.WriteByte(raw[i])
+				}
+			default:
+				value.WriteByte(c)
+			}
+		}
+		return "", fmt.Errorf("unterminated double quote")
+
+	default:
+		if idx := strings.Index(raw, " #"); idx >= 0 {
+			raw = raw[:idx]
+		}
+		return strings.TrimSpace(raw), nil
+	}
+}
+
+// checkTrailing allows only whitespace or a comment after a quoted value
+func checkTrailing(rest string) error {
+	rest = strings.TrimSpace(rest)
+	if len(rest) > 0 && !strings.HasPrefix(rest, "#") {
+		return fmt.Errorf("unexpected characters after quoted value: %q", rest)
+	}
+
+	return nil
+}
+
+// MergeEnv merges KEY=VALUE lists, later lists override keys of earlier ones.
+// Keys keep the position of their first occurrence.
+func MergeEnv(envs ...[]string) []string {
+	var merged []string
+	index := make(map[string]int)
+
+	for _, env := range envs {
+		for _, entry := range env {
+			key, _, _ := strings.Cut(entry, "=")
+			if i, ok := index[key]; ok {
+				merged[i] = entry
+				continue
+			}
+			index[key] = len(merged)
+			merged = append(merged, entry)
+		}
+	}
+
+	return merged
+}
@@ -0,0 +1,101 @@
+package fs
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseDotEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "plain values and comments",
+			input: "# database\nDB_HOST=localhost\n\nDB_PORT = 5432 # default port\nexport MODE=prod\n",
+			want:  []string{"DB_HOST=localhost", "DB_PORT=5432", "MODE=prod"},
+		},
+		{
+			name:  "double quoted with escapes",
+			input: `GREETING="hello # not a comment\n\"world\""`,
+			want:  []string{"GREETING=hello # not a comment\n\"world\""},
+		},
+		{
+			name:  "single quoted is literal",
+			input: `PATTERN='a\nb $HOME' # comment`,
+			want:  []string{`PATTERN=a\nb $HOME`},
+		},
+		{
+			name:  "value containing equals",
+			input: "DSN=postgres://u:p@host/db?sslmode=disable",
+			want:  []string{"DSN=postgres://u:p@host/db?sslmode=disable"},
+		},
+		{
+			name:  "empty value",
+			input: "EMPTY=\nQUOTED=\"\"",
+			want:  []string{"EMPTY=", "QUOTED="},
+		},
+		{
+			name:    "missing equals",
+			input:   "NOT_AN_ASSIGNMENT",
+			wantErr: true,
+		},
+		{
+			name:    "key with spaces",
+			input:   "MY KEY=value",
+			wantErr: true,
+		},
+		{
+			name:    "unterminated quote",
+			input:   `BROKEN="open`,
+			wantErr: true,
+		},
+		{
+			name:    "garbage after quoted value",
+			input:   `BROKEN="a"b`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseDotEnv(strings.NewReader(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseDotEnv() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ParseDotEnv() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeEnvPrecedence(t *testing.T) {
+	imageEnv := []string{"PATH=/usr/bin", "MODE=image", "LANG=C"}
+	fileEnv := []string{"MODE=file", "DB_HOST=db"}
+	appEnv := []string{"DB_HOST=app-db"}
+
+	got := MergeEnv(imageEnv, fileEnv, appEnv)
+	want := []string{"PATH=/usr/bin", "MODE=file", "LANG=C", "DB_HOST=app-db"}
+	if !slices.Equal(got, want) {
+		t.Errorf("MergeEnv() = %q, want %q", got, want)
+	}
+}
+
+func TestValidateEnvKey(t *testing.T) {
+	for _, key := range []string{"PATH", "_FOO123", "_", "a", "lower_case"} {
+		if err := ValidateEnvKey(key); err != nil {
+			t.Errorf("ValidateEnvKey(%q) failed: %v", key, err)
+		}
+	}
+
+	for _, key := range []string{"", "1FOO", "FOO=BAR", "MY KEY", " FOO", "FOO-BAR", "FOO.BAR", "FÖÖ"} {
+		if err := ValidateEnvKey(key); !errors.Is(err, ErrInvalidEnvKey) {
+			t.Errorf("ValidateEnvKey(%q) error = %v, want %v", key, err, ErrInvalidEnvKey)
+		}
+	}
+}
@@ -2,11 +2,23 @@ package fs
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"os/exec"
-	"path"
+	"strconv"
 	"strings"
+
+	"github.com/maxdollinger/walk.io/pkg/utils"
+)
+
+var ErrShrinkBelowUsage = errors.New("new size is below the filesystem usage")
+
+var (
+	_ BlockDeviceBuilder = (*Ext4Builder)(nil)
+	_ BlockDeviceBuilder = (*Ext4NodeBuilder)(nil)
+	_ BlockDevice        = (*Ext4Device)(nil)
 )
 
 type Ext4Builder struct{}
@@ -16,13 +28,14 @@ func NewExt4Builder() BlockDeviceBuilder {
 }
 
 type Ext4Device struct {
-	label     string
-	sizeBytes int64
-	path      string
+	label string
+	size  utils.Bytes
+	path  string
+	retry RetryPolicy // of Mount
 }
 
-func (d *Ext4Device) SizeBytes() int64 {
-	return d.sizeBytes
+func (d *Ext4Device) Size() utils.Bytes {
+	return d.size
 }
 
 func (d *Ext4Device) Label() string {
@@ -30,74 +43,215 @@ func (d *Ext4Device) Label() string {
 }
 
 func (d *Ext4Device) Mount() (string, error) {
-	mountDir := path.Join(os.TempDir(), d.mountDirName())
-	if err := os.RemoveAll(mountDir); err != nil {
-		return "", fmt.Errorf("removing ext4 mountdir: %w", err)
-	}
-	if err := os.Mkdir(mountDir, 0o755); err != nil {
-		return "", fmt.Errorf("creating ext4 mountdir: %w", err)
+	return mountImage(d.retry, d.path)
+}
+
+func (d *Ext4Device) Unmount() error {
+	return unmountImage(d.path)
+}
+
+func (d *Ext4Device) Path() string {
+	return d.path
+}
+
+func (d *Ext4Device) String() string {
+	return fmt.Sprintf("%s %s (%s)", d.label, d.path, d.size)
+}
+
+// LogValue logs the device as a group of label, path and size
+func (d *Ext4Device) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("label", d.label),
+		slog.String("path", d.path),
+		slog.String("size", d.size.String()),
+	)
+}
+
+// OpenExt4Device opens an existing ext4 image file, e.g. to resize it
+func OpenExt4Device(devicePath string) (*Ext4Device, error) {
+	label, err := ReadExt4Label(devicePath)
+	if err != nil {
+		return nil, err
 	}
 
-	out, err := exec.Command("sudo", "mount", d.path, mountDir).CombinedOutput()
+	info, err := os.Stat(devicePath)
 	if err != nil {
-		return "", fmt.Errorf("error mounting ext4 device to dir %s:\n%w\n%s", mountDir, err, out)
+		return nil, fmt.Errorf("stat device: %w", err)
 	}
 
-	return mountDir, nil
+	return &Ext4Device{
+		path:  devicePath,
+		size:  utils.Bytes(info.Size()),
+		label: label,
+		retry: DefaultRetryPolicy,
+	}, nil
 }
 
-func (d *Ext4Device) Unmount() error {
-	mountDir := path.Join(os.TempDir(), d.mountDirName())
-	// if mountDir does not exists nothing to unmount
-	if _, err := os.Stat(mountDir); err != nil {
-		return nil
+// Resize changes the size of the backing file and the filesystem on it.
+// Growing works for any size, shrinking is refused with ErrShrinkBelowUsage
+// if the data would not fit anymore.
+//
+// The filesystem is resized offline, so a device held by a running VM (or a
+// loop mount) is refused with ErrDeviceInUse.
+func (d *Ext4Device) Resize(newSize utils.Bytes) error {
+	if err := CheckDeviceIdle(d.path); err != nil {
+		return fmt.Errorf("resize %s: %w", d.path, err)
 	}
 
-	if err := exec.Command("sudo", "umount", mountDir).Run(); err != nil {
-		return fmt.Errorf("umounting ext4 device from %s : %w", mountDir, err)
+	blockSize, err := readExt4BlockSize(d.path)
+	if err != nil {
+		return err
 	}
+	newSizeBytes := int64(newSize) / blockSize * blockSize
 
-	if err := os.RemoveAll(mountDir); err != nil {
-		return fmt.Errorf("removing mountdir %s: %w", mountDir, err)
+	if newSizeBytes == int64(d.size) {
+		return nil
 	}
 
-	return nil
-}
+	// resize2fs refuses to work on a filesystem that was mounted since its last check
+	if err := checkExt4(d.path); err != nil {
+		return err
+	}
 
-func (d *Ext4Device) Path() string {
-	return d.path
-}
+	if newSizeBytes > int64(d.size) {
+		if err := os.Truncate(d.path, newSizeBytes); err != nil {
+			return fmt.Errorf("growing backing file: %w", err)
+		}
+		if err := resizeExt4(d.path, newSizeBytes/blockSize); err != nil {
+			return err
+		}
+		d.size = utils.Bytes(newSizeBytes)
+		return nil
+	}
+
+	minBlocks, err := minimumExt4Blocks(d.path)
+	if err != nil {
+		return err
+	}
+	if newSizeBytes < minBlocks*blockSize {
+		return fmt.Errorf("%w: %s needs at least %d bytes, requested %d", ErrShrinkBelowUsage, d.path, minBlocks*blockSize, newSizeBytes)
+	}
 
-func (d *Ext4Device) mountDirName() string {
-	fileName := path.Base(d.path)
-	ext := path.Ext(fileName)
+	if err := resizeExt4(d.path, newSizeBytes/blockSize); err != nil {
+		return err
+	}
+	if err := os.Truncate(d.path, newSizeBytes); err != nil {
+		return fmt.Errorf("shrinking backing file: %w", err)
+	}
+	d.size = utils.Bytes(newSizeBytes)
 
-	return strings.ReplaceAll(fileName, ext, "") + "_mount"
+	return nil
 }
 
 // NewDevice heavily shells out for fs operations, maybe I ipmlement more in go later
+//
+// If opts.SourceDirPath is set the device is sized to fit the directory content
+// and populated by mkfs.ext4 directly, so no (privileged) mount is needed.
+// Cancelling ctx stops mkfs.ext4 and the partial device file is removed.
 func (b *Ext4Builder) NewDevice(ctx context.Context, opts BlockDeviceOptions) (BlockDevice, error) {
 	// min save file size to write journal
-	sizeBytes := max(opts.SizeBytes, int64(5*1024*1024))
+	sizeBytes := max(int64(opts.Size), int64(5*utils.MB))
+
+	if len(opts.SourceDirPath) > 0 {
+		contentBytes, entries, err := diskUsage(opts.SourceDirPath)
+		if err != nil {
+			return nil, fmt.Errorf("error sizing source dir: %w", err)
+		}
+		sizeBytes = max(sizeBytes, contentBytes*int64(100+opts.sizeBufferPercent())/100)
+		opts.InodeCount = opts.inodeCount(entries)
+	}
 
 	err := createSparseFile(opts.OutputFilePath, sizeBytes)
 	if err != nil {
 		return nil, fmt.Errorf("error createing sparse file: %w", err)
 	}
 
-	var out []byte
-	if len(opts.Label) > 0 {
-		out, err = exec.Command("mkfs.ext4", "-F", "-L", opts.Label, opts.OutputFilePath).CombinedOutput()
-	} else {
-		out, err = exec.Command("mkfs.ext4", "-F", opts.OutputFilePath).CombinedOutput()
-	}
+	err = formatExt4(ctx, opts)
 	if err != nil {
-		return nil, fmt.Errorf("error formating file as ext4: %w \n%s", err, out)
+		err = errors.Join(err, os.Remove(opts.OutputFilePath))
+		return nil, fmt.Errorf("error formating file as ext4: %w", err)
 	}
 
 	return &Ext4Device{
-		path:      opts.OutputFilePath,
-		sizeBytes: opts.SizeBytes,
-		label:     opts.Label,
+		path:  opts.OutputFilePath,
+		size:  utils.Bytes(sizeBytes),
+		label: opts.Label,
+		retry: opts.retryPolicy(),
 	}, nil
 }
+
+// checkExt4 runs a forced filesystem check, fixing what is safe to fix automatically
+func checkExt4(devicePath string) error {
+	out, err := exec.Command("e2fsck", "-f", "-p", devicePath).CombinedOutput()
+	var exitErr *exec.ExitError
+	// exit code 1 means errors were corrected
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error checking ext4 filesystem: %w \n%s", err, out)
+	}
+
+	return nil
+}
+
+func resizeExt4(devicePath string, blocks int64) error {
+	out, err := exec.Command("resize2fs", devicePath, strconv.FormatInt(blocks, 10)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error resizing ext4 filesystem: %w \n%s", err, out)
+	}
+
+	return nil
+}
+
+// minimumExt4Blocks returns the smallest size in blocks resize2fs can shrink the filesystem to
+func minimumExt4Blocks(devicePath string) (int64, error) {
+	out, err := exec.Command("resize2fs", "-P", devicePath).CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("error estimating minimum ext4 size: %w \n%s", err, out)
+	}
+
+	_, value, ok := strings.Cut(string(out), "Estimated minimum size of the filesystem:")
+	if !ok {
+		return 0, fmt.Errorf("unexpected resize2fs output: %s", out)
+	}
+
+	blocks, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing minimum ext4 size: %w", err)
+	}
+
+	return blocks, nil
+}
+
+// formatExt4 creates an ext4 filesystem on the file or block device at opts.OutputFilePath
+func formatExt4(ctx context.Context, opts BlockDeviceOptions) error {
+	args := []string{"-F"}
+	if len(opts.Label) > 0 {
+		args = append(args, "-L", opts.Label)
+	}
+	if percent, ok := opts.reservedBlocksPercent(); ok {
+		args = append(args, "-m", strconv.Itoa(percent))
+	}
+	if opts.BytesPerInode > 0 {
+		args = append(args, "-i", strconv.Itoa(opts.BytesPerInode))
+	}
+	if opts.InodeCount > 0 {
+		args = append(args, "-N", strconv.Itoa(opts.InodeCount))
+	}
+	if len(opts.SourceDirPath) > 0 {
+		args = append(args, "-d", opts.SourceDirPath)
+	}
+	args = append(args, opts.OutputFilePath)
+
+	out, err := opts.retryPolicy().run(ctx, "mkfs.ext4", args...)
+	if err != nil {
+		// mkfs was killed because of ctx
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return fmt.Errorf("%w \n%s", err, out)
+	}
+
+	return nil
+}
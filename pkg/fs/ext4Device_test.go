@@ -0,0 +1,388 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/maxdollinger/walk.io/pkg/utils"
+)
+
+// reservedBlockCount reads the reserved block count from the ext4 superblock
+func reservedBlockCount(t *testing.T, devicePath string) int {
+	t.Helper()
+
+	out, err := exec.Command("dumpe2fs", "-h", devicePath).CombinedOutput()
+	if err != nil {
+		t.Fatalf("dumpe2fs failed: %v\n%s", err, out)
+	}
+
+	match := regexp.MustCompile(`Reserved block count:\s+(\d+)`).FindSubmatch(out)
+	if match == nil {
+		t.Fatalf("no reserved block count in dumpe2fs output:\n%s", out)
+	}
+
+	count, err := strconv.Atoi(string(match[1]))
+	if err != nil {
+		t.Fatalf("parse reserved block count: %v", err)
+	}
+
+	return count
+}
+
+func TestExt4BuilderReservedBlocks(t *testing.T) {
+	for _, tool := range []string{"mkfs.ext4", "dumpe2fs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not available", tool)
+		}
+	}
+
+	one := 1
+	tests := []struct {
+		name         string
+		opts         BlockDeviceOptions
+		wantReserved bool
+	}{
+		{
+			name:         "read-only AppFS reserves nothing",
+			opts:         BlockDeviceOptions{Label: "APP_FS", ReadOnly: true},
+			wantReserved: false,
+		},
+		{
+			name:         "writable StateFS keeps reserve",
+			opts:         BlockDeviceOptions{},
+			wantReserved: true,
+		},
+		{
+			name:         "explicit override on read-only device",
+			opts:         BlockDeviceOptions{ReadOnly: true, ReservedBlocksPercent: &one},
+			wantReserved: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.OutputFilePath = filepath.Join(t.TempDir(), "device.ext4")
+			opts.Size = 32 * 1024 * 1024
+
+			device, err := NewExt4Builder().NewDevice(context.Background(), opts)
+			if err != nil {
+				t.Fatalf("NewDevice failed: %v", err)
+			}
+
+			reserved := reservedBlockCount(t, device.Path())
+			if (reserved > 0) != tt.wantReserved {
+				t.Errorf("reserved block count = %d, want reserved %v", reserved, tt.wantReserved)
+			}
+		})
+	}
+}
+
+func TestExt4BuilderPopulatesFromSourceDir(t *testing.T) {
+	for _, tool := range []string{"mkfs.ext4", "debugfs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not available", tool)
+		}
+	}
+
+	sourceDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(sourceDir, "etc"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(sourceDir, "etc", "hostname"), []byte("walkio"), 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	// content larger than the minimal device size
+	if err := os.WriteFile(filepath.Join(sourceDir, "blob"), make([]byte, 8*1024*1024), 0o644); err != nil {
+		t.Fatalf("write blob: %v", err)
+	}
+
+	device, err := NewExt4Builder().NewDevice(context.Background(), BlockDeviceOptions{
+		OutputFilePath: filepath.Join(t.TempDir(), "app.ext4"),
+		SourceDirPath:  sourceDir,
+		Label:          "APP_FS",
+		ReadOnly:       true,
+	})
+	if err != nil {
+		t.Fatalf("NewDevice failed: %v", err)
+	}
+
+	if device.Size() < 8*1024*1024 {
+		t.Errorf("Size() = %d, too small for content", device.Size())
+	}
+
+	out, err := exec.Command("debugfs", "-R", "cat /etc/hostname", device.Path()).Output()
+	if err != nil {
+		t.Fatalf("debugfs failed: %v", err)
+	}
+	if string(out) != "walkio" {
+		t.Errorf("/etc/hostname = %q, want %q", out, "walkio")
+	}
+}
+
+func TestExt4BuilderInodeOptions(t *testing.T) {
+	for _, tool := range []string{"mkfs.ext4", "dumpe2fs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not available", tool)
+		}
+	}
+
+	const sizeBytes = 32 * 1024 * 1024
+	inodeCount := func(t *testing.T, opts BlockDeviceOptions) int {
+		t.Helper()
+
+		opts.OutputFilePath = filepath.Join(t.TempDir(), "device.ext4")
+		opts.Size = sizeBytes
+		device, err := NewExt4Builder().NewDevice(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("NewDevice failed: %v", err)
+		}
+
+		out, err := exec.Command("dumpe2fs", "-h", device.Path()).CombinedOutput()
+		if err != nil {
+			t.Fatalf("dumpe2fs failed: %v\n%s", err, out)
+		}
+		match := regexp.MustCompile(`Inode count:\s+(\d+)`).FindSubmatch(out)
+		if match == nil {
+			t.Fatalf("no inode count in dumpe2fs output:\n%s", out)
+		}
+		count, _ := strconv.Atoi(string(match[1]))
+		return count
+	}
+
+	defaultCount := inodeCount(t, BlockDeviceOptions{})
+
+	ratioCount := inodeCount(t, BlockDeviceOptions{BytesPerInode: 1024})
+	if ratioCount != sizeBytes/1024 {
+		t.Errorf("inode count with -i 1024 = %d, want %d", ratioCount, sizeBytes/1024)
+	}
+
+	explicitCount := inodeCount(t, BlockDeviceOptions{InodeCount: 20000})
+	if explicitCount < 20000 || explicitCount == defaultCount {
+		t.Errorf("inode count with -N 20000 = %d (default %d)", explicitCount, defaultCount)
+	}
+}
+
+func TestExt4DeviceManyTinyFiles(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+
+	// empty files cost an inode but no blocks, so the device is sized far below
+	// what the default ratio needs for this many inodes
+	sourceDir := t.TempDir()
+	for dir := range 10 {
+		dirPath := filepath.Join(sourceDir, "node_modules", strconv.Itoa(dir))
+		if err := os.MkdirAll(dirPath, 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		for file := range 500 {
+			if err := os.WriteFile(filepath.Join(dirPath, strconv.Itoa(file)+".js"), nil, 0o644); err != nil {
+				t.Fatalf("write file: %v", err)
+			}
+		}
+	}
+
+	build := func(opts BlockDeviceOptions) error {
+		opts.OutputFilePath = filepath.Join(t.TempDir(), "device.ext4")
+		opts.SourceDirPath = sourceDir
+		_, err := NewExt4Builder().NewDevice(context.Background(), opts)
+		return err
+	}
+
+	if err := build(BlockDeviceOptions{BytesPerInode: 16384}); err == nil {
+		t.Fatal("build with the default inode ratio succeeded, the tree is too small to test tuning")
+	}
+	if err := build(BlockDeviceOptions{}); err != nil {
+		t.Errorf("build with tuned inode count failed: %v", err)
+	}
+}
+
+func TestExt4BuilderCancelled(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+
+	sourceDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(sourceDir, "app"), []byte("data"), 0o644); err != nil {
+		t.Fatalf("write source file: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	outputPath := filepath.Join(t.TempDir(), "device.ext4")
+	_, err := NewExt4Builder().NewDevice(ctx, BlockDeviceOptions{
+		OutputFilePath: outputPath,
+		SourceDirPath:  sourceDir,
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("NewDevice() error = %v, want context.Canceled", err)
+	}
+	if _, err := os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Errorf("partial device %s was not removed", outputPath)
+	}
+}
+
+func TestInodeCount(t *testing.T) {
+	tests := []struct {
+		name string
+		opts BlockDeviceOptions
+		want int
+	}{
+		{name: "tuned", opts: BlockDeviceOptions{}, want: ext4FirstInode + 1150},
+		{name: "tuned with buffer", opts: BlockDeviceOptions{SizeBufferPercent: 50}, want: ext4FirstInode + 1500},
+		{name: "explicit count", opts: BlockDeviceOptions{InodeCount: 42}, want: 42},
+		{name: "explicit ratio", opts: BlockDeviceOptions{BytesPerInode: 4096}, want: 0},
+	}
+
+	for _, tt := range tests {
+		if got := tt.opts.inodeCount(1000); got != tt.want {
+			t.Errorf("%s: inodeCount(1000) = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSizeBufferPercent(t *testing.T) {
+	if got := (BlockDeviceOptions{}).sizeBufferPercent(); got != sizeBufferPercent {
+		t.Errorf("default sizeBufferPercent() = %d, want %d", got, sizeBufferPercent)
+	}
+	if got := (BlockDeviceOptions{SizeBufferPercent: 40}).sizeBufferPercent(); got != 40 {
+		t.Errorf("sizeBufferPercent() = %d, want 40", got)
+	}
+}
+
+func TestExt4DeviceResize(t *testing.T) {
+	for _, tool := range []string{"mkfs.ext4", "e2fsck", "resize2fs", "dumpe2fs"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not available", tool)
+		}
+	}
+
+	blockCount := func(t *testing.T, devicePath string) int64 {
+		t.Helper()
+
+		out, err := exec.Command("dumpe2fs", "-h", devicePath).CombinedOutput()
+		if err != nil {
+			t.Fatalf("dumpe2fs failed: %v\n%s", err, out)
+		}
+		match := regexp.MustCompile(`Block count:\s+(\d+)`).FindSubmatch(out)
+		if match == nil {
+			t.Fatalf("no block count in dumpe2fs output:\n%s", out)
+		}
+		count, _ := strconv.ParseInt(string(match[1]), 10, 64)
+		return count
+	}
+
+	// random content, mkfs.ext4 -d stores zero blocks as holes
+	blob := make([]byte, 12*1024*1024)
+	if _, err := rand.Read(blob); err != nil {
+		t.Fatal(err)
+	}
+	sourceDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(sourceDir, "blob"), blob, 0o644); err != nil {
+		t.Fatalf("write blob: %v", err)
+	}
+
+	created, err := NewExt4Builder().NewDevice(context.Background(), BlockDeviceOptions{
+		OutputFilePath: filepath.Join(t.TempDir(), "state.ext4"),
+		Size:           24 * 1024 * 1024,
+		SourceDirPath:  sourceDir,
+		Label:          "state-test",
+	})
+	if err != nil {
+		t.Fatalf("NewDevice failed: %v", err)
+	}
+
+	device, err := OpenExt4Device(created.Path())
+	if err != nil {
+		t.Fatalf("OpenExt4Device failed: %v", err)
+	}
+	if device.Label() != "state-test" || device.Size() != created.Size() {
+		t.Fatalf("OpenExt4Device() = %q/%d, want %q/%d", device.Label(), device.Size(), "state-test", created.Size())
+	}
+
+	blockSize, err := readExt4BlockSize(device.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const grownBytes = 64 * 1024 * 1024
+	if err := device.Resize(grownBytes); err != nil {
+		t.Fatalf("Resize grow failed: %v", err)
+	}
+	info, err := os.Stat(device.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != grownBytes || device.Size() != grownBytes {
+		t.Errorf("file size = %d, SizeBytes() = %d, want %d", info.Size(), device.Size(), grownBytes)
+	}
+	if got := blockCount(t, device.Path()); got != grownBytes/blockSize {
+		t.Errorf("block count = %d, want %d", got, grownBytes/blockSize)
+	}
+
+	err = device.Resize(8 * 1024 * 1024)
+	if !errors.Is(err, ErrShrinkBelowUsage) {
+		t.Errorf("Resize below usage error = %v, want %v", err, ErrShrinkBelowUsage)
+	}
+	if device.Size() != grownBytes {
+		t.Errorf("Size() = %d after refused shrink, want %d", device.Size(), grownBytes)
+	}
+
+	const shrunkBytes = 32 * 1024 * 1024
+	if err := device.Resize(shrunkBytes); err != nil {
+		t.Fatalf("Resize shrink failed: %v", err)
+	}
+	if got := blockCount(t, device.Path()); got != shrunkBytes/blockSize {
+		t.Errorf("block count = %d, want %d", got, shrunkBytes/blockSize)
+	}
+}
+
+func TestExt4DeviceString(t *testing.T) {
+	device := &Ext4Device{label: AppFSLabel, path: "/var/walkio/app/abc.ext4", size: 512 * utils.MB}
+
+	if got, want := device.String(), AppFSLabel+" /var/walkio/app/abc.ext4 (512M)"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	var out bytes.Buffer
+	slog.New(slog.NewTextHandler(&out, nil)).Info("built", "device", device)
+	for _, want := range []string{"device.path=/var/walkio/app/abc.ext4", "device.size=512M", "device.label=" + AppFSLabel} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("log %q is missing %q", out.String(), want)
+		}
+	}
+}
+
+func TestExt4DeviceResizeInUse(t *testing.T) {
+	devicePath := filepath.Join(t.TempDir(), "state.ext4")
+	if err := createSparseFile(devicePath, 8*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+
+	// like the VMM of a running VM holding the drive
+	holder, err := os.Open(devicePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Close()
+
+	device := &Ext4Device{path: devicePath, size: 8 * 1024 * 1024}
+	if err := device.Resize(16 * 1024 * 1024); !errors.Is(err, ErrDeviceInUse) {
+		t.Errorf("Resize error = %v, want %v", err, ErrDeviceInUse)
+	}
+	if info, err := os.Stat(devicePath); err != nil || info.Size() != 8*1024*1024 {
+		t.Errorf("backing file changed by the refused Resize: %v", err)
+	}
+}
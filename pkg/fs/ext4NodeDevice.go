@@ -0,0 +1,79 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/maxdollinger/walk.io/pkg/utils"
+)
+
+// Ext4NodeBuilder formats an already attached block device node (loop, nbd, ...)
+// instead of a sparse file. This avoids the final copy when the device is the
+// publish target anyway.
+type Ext4NodeBuilder struct{}
+
+func NewExt4NodeBuilder() BlockDeviceBuilder {
+	return &Ext4NodeBuilder{}
+}
+
+// NewDevice expects opts.OutputFilePath to be an existing block device node
+// with a capacity of at least opts.Size.
+func (b *Ext4NodeBuilder) NewDevice(ctx context.Context, opts BlockDeviceOptions) (BlockDevice, error) {
+	nodeSize, err := blockNodeSize(opts.OutputFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if utils.Bytes(nodeSize) < opts.Size {
+		return nil, fmt.Errorf("block device %s too small: has %d bytes, need %d", opts.OutputFilePath, nodeSize, opts.Size)
+	}
+
+	if len(opts.SourceDirPath) > 0 {
+		_, entries, err := diskUsage(opts.SourceDirPath)
+		if err != nil {
+			return nil, fmt.Errorf("error sizing source dir: %w", err)
+		}
+		opts.InodeCount = opts.inodeCount(entries)
+	}
+
+	err = formatExt4(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error formating block device as ext4: %w", err)
+	}
+
+	return &Ext4Device{
+		path:  opts.OutputFilePath,
+		size:  utils.Bytes(nodeSize),
+		label: opts.Label,
+		retry: opts.retryPolicy(),
+	}, nil
+}
+
+// blockNodeSize validates that devicePath is a block device and returns its capacity in bytes
+func blockNodeSize(devicePath string) (int64, error) {
+	info, err := os.Stat(devicePath)
+	if err != nil {
+		return 0, fmt.Errorf("stat block device: %w", err)
+	}
+
+	mode := info.Mode()
+	if mode&os.ModeDevice == 0 || mode&os.ModeCharDevice != 0 {
+		return 0, fmt.Errorf("%s is not a block device", devicePath)
+	}
+
+	f, err := os.Open(devicePath)
+	if err != nil {
+		return 0, fmt.Errorf("open block device: %w", err)
+	}
+	defer f.Close()
+
+	// stat reports 0 for device nodes, seeking to the end yields the capacity
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, fmt.Errorf("get block device size: %w", err)
+	}
+
+	return size, nil
+}
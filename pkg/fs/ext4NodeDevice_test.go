@@ -0,0 +1,92 @@
+package fs
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setupLoopDevice attaches a fresh backing file of sizeBytes to a free loop device.
+// Skips the test if not running as root or losetup is unavailable.
+func setupLoopDevice(t *testing.T, sizeBytes int64) string {
+	t.Helper()
+
+	if os.Geteuid() != 0 {
+		t.Skip("loop devices require root")
+	}
+	if _, err := exec.LookPath("losetup"); err != nil {
+		t.Skip("losetup not available")
+	}
+
+	backingFile := filepath.Join(t.TempDir(), "backing.img")
+	if err := createSparseFile(backingFile, sizeBytes); err != nil {
+		t.Fatalf("create backing file: %v", err)
+	}
+
+	out, err := exec.Command("losetup", "--find", "--show", backingFile).CombinedOutput()
+	if err != nil {
+		t.Skipf("could not attach loop device: %v\n%s", err, out)
+	}
+
+	loopDevice := strings.TrimSpace(string(out))
+	t.Cleanup(func() {
+		_ = exec.Command("losetup", "--detach", loopDevice).Run()
+	})
+
+	return loopDevice
+}
+
+func TestExt4NodeBuilderLoopDevice(t *testing.T) {
+	const sizeBytes = 16 * 1024 * 1024
+	loopDevice := setupLoopDevice(t, sizeBytes)
+
+	device, err := NewExt4NodeBuilder().NewDevice(context.Background(), BlockDeviceOptions{
+		OutputFilePath: loopDevice,
+		Size:           sizeBytes,
+		Label:          "APP_FS",
+	})
+	if err != nil {
+		t.Fatalf("NewDevice failed: %v", err)
+	}
+
+	if device.Size() != sizeBytes {
+		t.Errorf("Size() = %d, want %d", device.Size(), sizeBytes)
+	}
+
+	out, err := exec.Command("dumpe2fs", "-h", loopDevice).CombinedOutput()
+	if err != nil {
+		t.Fatalf("dumpe2fs failed: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "Filesystem volume name:   APP_FS") {
+		t.Errorf("device not labeled APP_FS:\n%s", out)
+	}
+}
+
+func TestExt4NodeBuilderTooSmall(t *testing.T) {
+	loopDevice := setupLoopDevice(t, 8*1024*1024)
+
+	_, err := NewExt4NodeBuilder().NewDevice(context.Background(), BlockDeviceOptions{
+		OutputFilePath: loopDevice,
+		Size:           16 * 1024 * 1024,
+	})
+	if err == nil {
+		t.Fatal("expected error for undersized block device")
+	}
+}
+
+func TestExt4NodeBuilderRejectsRegularFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "regular.img")
+	if err := createSparseFile(file, 8*1024*1024); err != nil {
+		t.Fatalf("create file: %v", err)
+	}
+
+	_, err := NewExt4NodeBuilder().NewDevice(context.Background(), BlockDeviceOptions{
+		OutputFilePath: file,
+	})
+	if err == nil || !strings.Contains(err.Error(), "not a block device") {
+		t.Errorf("NewDevice() error = %v, want not a block device error", err)
+	}
+}
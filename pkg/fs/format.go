@@ -0,0 +1,80 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+)
+
+// Format is the on-disk format of a built device
+type Format string
+
+const (
+	FormatExt4     Format = "ext4"
+	FormatXFS      Format = "xfs"
+	FormatSquashfs Format = "squashfs" // compressed and read-only
+	FormatRawTar   Format = "raw-tar"  // plain tar of the tree, not mountable
+)
+
+// ErrUnsupportedFormat is returned for unknown formats and formats whose tools are missing on the host
+var ErrUnsupportedFormat = errors.New("unsupported device format")
+
+// lookPath finds the tool of a format, overridden in tests
+var lookPath = exec.LookPath
+
+// formatTools are the commands a format is built with
+var formatTools = map[Format]string{
+	FormatExt4:     "mkfs.ext4",
+	FormatXFS:      "mkfs.xfs",
+	FormatSquashfs: "mksquashfs",
+	FormatRawTar:   "tar",
+}
+
+// formatExtensions are the device file extensions per format
+var formatExtensions = map[Format]string{
+	FormatExt4:     ".ext4",
+	FormatXFS:      ".xfs",
+	FormatSquashfs: ".squashfs",
+	FormatRawTar:   ".tar",
+}
+
+// Extension returns the device file extension of the format, e.g. ".ext4"
+func (f Format) Extension() string {
+	return formatExtensions[f]
+}
+
+// FormatOf returns the format of a device file by its extension
+func FormatOf(devicePath string) (Format, bool) {
+	ext := path.Ext(devicePath)
+	for format, formatExt := range formatExtensions {
+		if ext == formatExt {
+			return format, true
+		}
+	}
+
+	return "", false
+}
+
+// NewBuilderForFormat returns the builder of format, failing with
+// ErrUnsupportedFormat if the format is unknown or its tool is not installed
+func NewBuilderForFormat(format Format) (BlockDeviceBuilder, error) {
+	tool, ok := formatTools[format]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedFormat, format)
+	}
+	if _, err := lookPath(tool); err != nil {
+		return nil, fmt.Errorf("%w: %s needs %s: %w", ErrUnsupportedFormat, format, tool, err)
+	}
+
+	switch format {
+	case FormatXFS:
+		return NewXFSBuilder(), nil
+	case FormatSquashfs:
+		return NewSquashfsBuilder(), nil
+	case FormatRawTar:
+		return NewRawTarBuilder(), nil
+	default:
+		return NewExt4Builder(), nil
+	}
+}
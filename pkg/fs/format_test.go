@@ -0,0 +1,66 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"testing"
+)
+
+func TestNewBuilderForFormat(t *testing.T) {
+	original := lookPath
+	lookPath = func(file string) (string, error) { return "/usr/sbin/" + file, nil }
+	t.Cleanup(func() { lookPath = original })
+
+	tests := []struct {
+		format Format
+		want   BlockDeviceBuilder
+	}{
+		{format: FormatExt4, want: &Ext4Builder{}},
+		{format: FormatXFS, want: &XFSBuilder{}},
+		{format: FormatSquashfs, want: &SquashfsBuilder{}},
+		{format: FormatRawTar, want: &RawTarBuilder{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.format), func(t *testing.T) {
+			got, err := NewBuilderForFormat(tt.format)
+			if err != nil {
+				t.Fatalf("NewBuilderForFormat failed: %v", err)
+			}
+			if gotType, wantType := typeName(got), typeName(tt.want); gotType != wantType {
+				t.Errorf("NewBuilderForFormat(%s) = %s, want %s", tt.format, gotType, wantType)
+			}
+		})
+	}
+
+	if _, err := NewBuilderForFormat("btrfs"); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("NewBuilderForFormat(btrfs) error = %v, want %v", err, ErrUnsupportedFormat)
+	}
+}
+
+func TestNewBuilderForFormatMissingTool(t *testing.T) {
+	original := lookPath
+	lookPath = func(file string) (string, error) { return "", exec.ErrNotFound }
+	t.Cleanup(func() { lookPath = original })
+
+	_, err := NewBuilderForFormat(FormatSquashfs)
+	if !errors.Is(err, ErrUnsupportedFormat) || !errors.Is(err, exec.ErrNotFound) {
+		t.Errorf("NewBuilderForFormat without mksquashfs error = %v, want %v", err, ErrUnsupportedFormat)
+	}
+}
+
+func TestFormatOf(t *testing.T) {
+	for _, format := range []Format{FormatExt4, FormatXFS, FormatSquashfs, FormatRawTar} {
+		if got, ok := FormatOf("/app/abc" + format.Extension()); !ok || got != format {
+			t.Errorf("FormatOf(abc%s) = %s, %v, want %s", format.Extension(), got, ok, format)
+		}
+	}
+	if _, ok := FormatOf("/app/abc.wanted"); ok {
+		t.Error("FormatOf(abc.wanted) reported a device format")
+	}
+}
+
+func typeName(v any) string {
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,244 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/maxdollinger/walk.io/pkg/utils"
+)
+
+var (
+	// ErrNotMountable is returned by Mount of devices without a filesystem, e.g. raw-tar
+	ErrNotMountable = errors.New("device format can't be mounted")
+	// ErrResizeUnsupported is returned by Resize of formats that are built to size, e.g. squashfs
+	ErrResizeUnsupported = errors.New("device format can't be resized")
+	// ErrReadOnlyFormat is returned when a writable device is requested in a read-only format
+	ErrReadOnlyFormat = errors.New("device format is read-only")
+)
+
+var (
+	_ BlockDeviceBuilder = (*SquashfsBuilder)(nil)
+	_ BlockDeviceBuilder = (*RawTarBuilder)(nil)
+	_ BlockDevice        = (*imageDevice)(nil)
+)
+
+// imageDevice is a device file of a format other than ext4. Mounting relies on
+// the kernel detecting the filesystem, only xfs devices can be resized.
+type imageDevice struct {
+	format Format
+	label  string
+	size   utils.Bytes
+	path   string
+	retry  RetryPolicy // of Mount
+}
+
+func (d *imageDevice) Size() utils.Bytes {
+	return d.size
+}
+
+func (d *imageDevice) Label() string {
+	return d.label
+}
+
+func (d *imageDevice) Path() string {
+	return d.path
+}
+
+func (d *imageDevice) Mount() (string, error) {
+	if d.format == FormatRawTar {
+		return "", fmt.Errorf("mount %s: %w", d.path, ErrNotMountable)
+	}
+
+	return mountImage(d.retry, d.path)
+}
+
+func (d *imageDevice) Unmount() error {
+	return unmountImage(d.path)
+}
+
+// Resize grows xfs devices, see growXFS. The other formats are built to size.
+// growXFS mounts the device on the host, so a device held by a running VM is
+// refused with ErrDeviceInUse.
+func (d *imageDevice) Resize(newSize utils.Bytes) error {
+	if d.format != FormatXFS {
+		return fmt.Errorf("resize %s: %w", d.path, ErrResizeUnsupported)
+	}
+	if err := CheckDeviceIdle(d.path); err != nil {
+		return fmt.Errorf("resize %s: %w", d.path, err)
+	}
+
+	if err := growXFS(d.path, d.size, newSize, d.retry); err != nil {
+		return fmt.Errorf("resize %s: %w", d.path, err)
+	}
+	d.size = newSize
+	return nil
+}
+
+func (d *imageDevice) String() string {
+	return fmt.Sprintf("%s %s %s (%s)", d.format, d.label, d.path, d.size)
+}
+
+// LogValue logs the device as a group of format, label, path and size
+func (d *imageDevice) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("format", string(d.format)),
+		slog.String("label", d.label),
+		slog.String("path", d.path),
+		slog.String("size", d.size.String()),
+	)
+}
+
+// newImageDevice stats the built device file, its size is what the format made of the content
+func newImageDevice(format Format, opts BlockDeviceOptions) (*imageDevice, error) {
+	info, err := os.Stat(opts.OutputFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("stat %s device: %w", format, err)
+	}
+
+	return &imageDevice{
+		format: format,
+		label:  opts.Label,
+		size:   utils.Bytes(info.Size()),
+		path:   opts.OutputFilePath,
+		retry:  opts.retryPolicy(),
+	}, nil
+}
+
+// SquashfsBuilder packs the source dir into a compressed read-only squashfs image.
+// Squashfs has no label, guests have to address the device by its position.
+type SquashfsBuilder struct{}
+
+func NewSquashfsBuilder() BlockDeviceBuilder {
+	return &SquashfsBuilder{}
+}
+
+// NewDevice runs mksquashfs on opts.SourceDirPath, opts.Size is ignored as the
+// image is exactly as large as the compressed content
+func (b *SquashfsBuilder) NewDevice(ctx context.Context, opts BlockDeviceOptions) (BlockDevice, error) {
+	if !opts.ReadOnly {
+		return nil, fmt.Errorf("squashfs device %s: %w", opts.OutputFilePath, ErrReadOnlyFormat)
+	}
+
+	sourceDir, cleanup, err := sourceDirOrEmpty(opts.SourceDirPath)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	out, err := opts.retryPolicy().run(ctx, "mksquashfs", sourceDir, opts.OutputFilePath, "-noappend", "-no-progress")
+	if err != nil {
+		err = errors.Join(commandError(ctx, err, out), removeIfExists(opts.OutputFilePath))
+		return nil, fmt.Errorf("error creating squashfs image: %w", err)
+	}
+
+	return newImageDevice(FormatSquashfs, opts)
+}
+
+// RawTarBuilder writes the source dir as an uncompressed tar, for consumers
+// that unpack the app themselves instead of mounting it
+type RawTarBuilder struct{}
+
+func NewRawTarBuilder() BlockDeviceBuilder {
+	return &RawTarBuilder{}
+}
+
+// NewDevice archives opts.SourceDirPath keeping numeric owners and xattrs
+func (b *RawTarBuilder) NewDevice(ctx context.Context, opts BlockDeviceOptions) (BlockDevice, error) {
+	if !opts.ReadOnly {
+		return nil, fmt.Errorf("raw-tar device %s: %w", opts.OutputFilePath, ErrReadOnlyFormat)
+	}
+
+	sourceDir, cleanup, err := sourceDirOrEmpty(opts.SourceDirPath)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	out, err := runCommand(ctx, "tar", "--numeric-owner", "--xattrs", "-C", sourceDir, "-cf", opts.OutputFilePath, ".")
+	if err != nil {
+		err = errors.Join(commandError(ctx, err, out), removeIfExists(opts.OutputFilePath))
+		return nil, fmt.Errorf("error creating tar image: %w", err)
+	}
+
+	return newImageDevice(FormatRawTar, opts)
+}
+
+// sourceDirOrEmpty returns dir, or an empty temp dir for formats that can only be built from a tree
+func sourceDirOrEmpty(dir string) (string, func(), error) {
+	if len(dir) > 0 {
+		return dir, func() {}, nil
+	}
+
+	empty, err := os.MkdirTemp("", "walkio-empty-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("create empty source dir: %w", err)
+	}
+
+	return empty, func() { os.RemoveAll(empty) }, nil
+}
+
+// commandError prefers the ctx error over the error of a killed command
+func commandError(ctx context.Context, err error, out []byte) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+
+	return fmt.Errorf("%w \n%s", err, out)
+}
+
+func removeIfExists(filePath string) error {
+	if err := os.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// mountImage loop mounts the device file to a dir in the temp dir named after it
+func mountImage(retry RetryPolicy, devicePath string) (string, error) {
+	mountDir := path.Join(os.TempDir(), mountDirName(devicePath))
+	if err := os.RemoveAll(mountDir); err != nil {
+		return "", fmt.Errorf("removing mountdir: %w", err)
+	}
+	if err := os.Mkdir(mountDir, 0o755); err != nil {
+		return "", fmt.Errorf("creating mountdir: %w", err)
+	}
+
+	out, err := retry.run(context.Background(), "sudo", "mount", devicePath, mountDir)
+	if err != nil {
+		return "", fmt.Errorf("error mounting device to dir %s:\n%w\n%s", mountDir, err, out)
+	}
+
+	return mountDir, nil
+}
+
+func unmountImage(devicePath string) error {
+	mountDir := path.Join(os.TempDir(), mountDirName(devicePath))
+	// if mountDir does not exists nothing to unmount
+	if _, err := os.Stat(mountDir); err != nil {
+		return nil
+	}
+
+	// not cancellable, a loop mount must not be leaked
+	if out, err := runCommand(context.Background(), "sudo", "umount", mountDir); err != nil {
+		return fmt.Errorf("umounting device from %s : %w\n%s", mountDir, err, out)
+	}
+
+	if err := os.RemoveAll(mountDir); err != nil {
+		return fmt.Errorf("removing mountdir %s: %w", mountDir, err)
+	}
+
+	return nil
+}
+
+func mountDirName(devicePath string) string {
+	fileName := path.Base(devicePath)
+	ext := path.Ext(fileName)
+
+	return strings.ReplaceAll(fileName, ext, "") + "_mount"
+}
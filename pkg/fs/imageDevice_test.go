@@ -0,0 +1,87 @@
+package fs
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestRawTarBuilder(t *testing.T) {
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("tar not available")
+	}
+
+	sourceDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(sourceDir, "app"), []byte("binary"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	devicePath := filepath.Join(t.TempDir(), "app.tar")
+
+	device, err := NewRawTarBuilder().NewDevice(context.Background(), BlockDeviceOptions{
+		OutputFilePath: devicePath,
+		SourceDirPath:  sourceDir,
+		Label:          AppFSLabel,
+		ReadOnly:       true,
+	})
+	if err != nil {
+		t.Fatalf("NewDevice failed: %v", err)
+	}
+
+	info, err := os.Stat(devicePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(device.Size()) != info.Size() {
+		t.Errorf("Size() = %d, want the tar size %d", device.Size(), info.Size())
+	}
+	if names := tarNames(t, devicePath); !slices.Contains(names, "./app") {
+		t.Errorf("tar holds %v, want ./app", names)
+	}
+
+	if _, err := device.Mount(); !errors.Is(err, ErrNotMountable) {
+		t.Errorf("Mount error = %v, want %v", err, ErrNotMountable)
+	}
+	if err := device.Resize(device.Size() * 2); !errors.Is(err, ErrResizeUnsupported) {
+		t.Errorf("Resize error = %v, want %v", err, ErrResizeUnsupported)
+	}
+}
+
+func TestReadOnlyFormatsRejectWritableDevices(t *testing.T) {
+	for _, builder := range []BlockDeviceBuilder{NewRawTarBuilder(), NewSquashfsBuilder()} {
+		_, err := builder.NewDevice(context.Background(), BlockDeviceOptions{
+			OutputFilePath: filepath.Join(t.TempDir(), "state"),
+		})
+		if !errors.Is(err, ErrReadOnlyFormat) {
+			t.Errorf("%T.NewDevice of a writable device error = %v, want %v", builder, err, ErrReadOnlyFormat)
+		}
+	}
+}
+
+func tarNames(t *testing.T, tarPath string) []string {
+	t.Helper()
+
+	file, err := os.Open(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var names []string
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return names
+		}
+		if err != nil {
+			t.Fatalf("read tar: %v", err)
+		}
+		names = append(names, header.Name)
+	}
+}
@@ -0,0 +1,136 @@
+package fs
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var ErrUnknownUser = errors.New("unknown user")
+
+// ResolveUser resolves the User of an image config (user[:group], each a name
+// or a numeric id) to numeric ids, so the guest init can setuid/setgid without
+// name lookups. Names are looked up in etc/passwd and etc/group of rootfsDir.
+// Without group the user's primary group from etc/passwd is used, 0 if the
+// numeric user has no entry. An empty User is root.
+func ResolveUser(rootfsDir, user string) (uid, gid int, err error) {
+	userPart, groupPart, hasGroup := strings.Cut(strings.TrimSpace(user), ":")
+	if len(userPart) == 0 {
+		if hasGroup {
+			return 0, 0, fmt.Errorf("%w: %q has no user", ErrUnknownUser, user)
+		}
+		return 0, 0, nil
+	}
+
+	// symlinks in the image must not point the lookups at files of the host
+	root, err := os.OpenRoot(rootfsDir)
+	if err != nil {
+		return 0, 0, fmt.Errorf("resolve user %q: %w", user, err)
+	}
+	defer root.Close()
+
+	uid, primaryGID, found, err := lookupID(root, "etc/passwd", userPart)
+	if err != nil {
+		return 0, 0, fmt.Errorf("resolve user %q: %w", user, err)
+	}
+	if !found {
+		return 0, 0, fmt.Errorf("%w: %q is not in /etc/passwd", ErrUnknownUser, userPart)
+	}
+
+	if !hasGroup {
+		return uid, primaryGID, nil
+	}
+
+	gid, _, found, err = lookupID(root, "etc/group", groupPart)
+	if err != nil {
+		return 0, 0, fmt.Errorf("resolve group %q: %w", groupPart, err)
+	}
+	if !found {
+		return 0, 0, fmt.Errorf("%w: group %q is not in /etc/group", ErrUnknownUser, groupPart)
+	}
+
+	return uid, gid, nil
+}
+
+// lookupID finds name (or a numeric id) in a passwd or group file and returns its
+// id and, for passwd, the primary gid. Numeric ids and root are found without an
+// entry, e.g. in scratch images without /etc/passwd.
+func lookupID(root *os.Root, file, name string) (id, gid int, found bool, err error) {
+	if name == "root" {
+		name = "0"
+	}
+	numericID, numErr := strconv.Atoi(name)
+	if numErr == nil && numericID < 0 {
+		return 0, 0, false, fmt.Errorf("negative id %d", numericID)
+	}
+
+	f, err := root.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return numericID, 0, numErr == nil, nil
+	}
+	if err != nil {
+		return 0, 0, false, err
+	}
+	defer f.Close()
+
+	// only passwd entries carry a gid, group entries list members there
+	entryID, entryGID, found, err := scanIDFile(f, name, numErr == nil, file == "etc/passwd")
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("read /%s: %w", file, err)
+	}
+	if found {
+		return entryID, entryGID, true, nil
+	}
+
+	return numericID, 0, numErr == nil, nil
+}
+
+// scanIDFile parses name:password:id[:gid:...] lines, the gid only if withGID.
+// Numeric names match the id column.
+func scanIDFile(r io.Reader, name string, numeric, withGID bool) (id, gid int, found bool, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ":")
+		if len(fields) < 3 {
+			continue
+		}
+		if numeric && fields[2] != name || !numeric && fields[0] != name {
+			continue
+		}
+
+		id, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return 0, 0, false, fmt.Errorf("invalid id in %q", line)
+		}
+		if withGID && len(fields) > 3 {
+			gid, err = strconv.Atoi(fields[3])
+			if err != nil {
+				return 0, 0, false, fmt.Errorf("invalid gid in %q", line)
+			}
+		}
+		return id, gid, true, nil
+	}
+
+	return 0, 0, false, scanner.Err()
+}
+
+// writeAppUser creates /walkio/user with the numeric "uid:gid" the guest init
+// drops to before it execs argv
+func writeAppUser(configDir, rootfsDir, user string) error {
+	uid, gid, err := ResolveUser(rootfsDir, user)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path.Join(configDir, "user"), fmt.Appendf(nil, "%d:%d\n", uid, gid), 0o644)
+}
@@ -0,0 +1,126 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxdollinger/walk.io/pkg/oci"
+)
+
+// newUserRootfs creates a rootfs with the passwd and group files of a typical image
+func newUserRootfs(t *testing.T) string {
+	t.Helper()
+
+	rootfsDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootfsDir, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	passwd := "root:x:0:0:root:/root:/bin/sh\n" +
+		"# service accounts\n" +
+		"nginx:x:101:101:nginx:/var/cache/nginx:/sbin/nologin\n" +
+		"app:x:1000:1001::/home/app:/bin/sh\n"
+	group := "root:x:0:\nnginx:x:101:\napp:x:1001:\nwww-data:x:33:nginx\n"
+	for name, content := range map[string]string{"passwd": passwd, "group": group} {
+		if err := os.WriteFile(filepath.Join(rootfsDir, "etc", name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return rootfsDir
+}
+
+func TestResolveUser(t *testing.T) {
+	rootfsDir := newUserRootfs(t)
+
+	tests := []struct {
+		user    string
+		wantUID int
+		wantGID int
+		wantErr bool
+	}{
+		{user: "", wantUID: 0, wantGID: 0},
+		{user: "root", wantUID: 0, wantGID: 0},
+		{user: "nginx", wantUID: 101, wantGID: 101},
+		{user: "app", wantUID: 1000, wantGID: 1001},
+		{user: "1000", wantUID: 1000, wantGID: 1001},
+		{user: "4242", wantUID: 4242, wantGID: 0},
+		{user: "nginx:www-data", wantUID: 101, wantGID: 33},
+		{user: "app:0", wantUID: 1000, wantGID: 0},
+		{user: "4242:4343", wantUID: 4242, wantGID: 4343},
+		{user: "nobody", wantErr: true},
+		{user: "app:missing", wantErr: true},
+		{user: ":app", wantErr: true},
+		{user: "-1", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			uid, gid, err := ResolveUser(rootfsDir, tt.user)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolveUser(%q) error = %v, wantErr %v", tt.user, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if uid != tt.wantUID || gid != tt.wantGID {
+				t.Errorf("ResolveUser(%q) = %d:%d, want %d:%d", tt.user, uid, gid, tt.wantUID, tt.wantGID)
+			}
+		})
+	}
+}
+
+func TestResolveUserWithoutPasswd(t *testing.T) {
+	rootfsDir := t.TempDir()
+
+	if uid, gid, err := ResolveUser(rootfsDir, "65532:65532"); err != nil || uid != 65532 || gid != 65532 {
+		t.Errorf("ResolveUser(65532:65532) = %d:%d, %v, want 65532:65532", uid, gid, err)
+	}
+	if _, _, err := ResolveUser(rootfsDir, "nonroot"); !errors.Is(err, ErrUnknownUser) {
+		t.Errorf("ResolveUser(nonroot) error = %v, want %v", err, ErrUnknownUser)
+	}
+}
+
+func TestResolveUserIgnoresEscapingSymlink(t *testing.T) {
+	rootfsDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootfsDir, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	hostPasswd := filepath.Join(t.TempDir(), "passwd")
+	if err := os.WriteFile(hostPasswd, []byte("hostuser:x:1234:1234::/:/bin/sh\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(hostPasswd, filepath.Join(rootfsDir, "etc", "passwd")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := ResolveUser(rootfsDir, "hostuser"); err == nil {
+		t.Error("ResolveUser followed a symlink out of the rootfs")
+	}
+}
+
+func TestWriteContainerConfigUser(t *testing.T) {
+	rootfsDir := newUserRootfs(t)
+
+	config := &oci.ImageConfig{User: "nginx:www-data"}
+	if err := WriteContainerConfig(context.Background(), config, rootfsDir); err != nil {
+		t.Fatalf("WriteContainerConfig failed: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(rootfsDir, "walkio", "user"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "101:33\n" {
+		t.Errorf("user file = %q, want %q", got, "101:33\n")
+	}
+
+	config.User = "nobody"
+	if err := WriteContainerConfig(context.Background(), config, rootfsDir); !errors.Is(err, ErrUnknownUser) {
+		t.Errorf("WriteContainerConfig with unknown user error = %v, want %v", err, ErrUnknownUser)
+	}
+}
@@ -0,0 +1,115 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Filesystem labels identifying the role of a device
+const (
+	AppFSLabel         = "APP_FS"
+	StateFSLabelPrefix = "state-"
+)
+
+// ext4 superblock layout, see https://www.kernel.org/doc/html/latest/filesystems/ext4/globals.html
+const (
+	ext4SuperblockOffset = 1024
+	ext4LogBlockOffset   = 0x18
+	ext4MagicOffset      = 0x38
+	ext4LabelOffset      = 0x78
+	ext4LabelLength      = 16
+	ext4Magic            = 0xEF53
+)
+
+// xfs and squashfs superblock layout, see xfs_sb(5) and the squashfs docs
+const (
+	xfsMagic       = "XFSB"
+	xfsLabelOffset = 108
+	xfsLabelLength = 12
+	squashfsMagic  = "hsqs"
+)
+
+// ErrUnknownFilesystem is returned by ReadLabel for devices that are not ext4,
+// xfs or squashfs, e.g. raw-tar devices
+var ErrUnknownFilesystem = errors.New("not an ext4, xfs or squashfs filesystem")
+
+// ReadLabel detects the filesystem of a device and reads its volume label.
+// Squashfs has no label, its label is empty.
+func ReadLabel(devicePath string) (Format, string, error) {
+	f, err := os.Open(devicePath)
+	if err != nil {
+		return "", "", fmt.Errorf("open device: %w", err)
+	}
+	defer f.Close()
+
+	// long enough for the ext4 magic, the xfs and squashfs superblocks start at 0
+	ext4MagicEnd := ext4SuperblockOffset + ext4MagicOffset + 2
+	head := make([]byte, ext4MagicEnd)
+	n, err := f.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return "", "", fmt.Errorf("read superblock: %w", err)
+	}
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, []byte(xfsMagic)) && n >= xfsLabelOffset+xfsLabelLength:
+		label := head[xfsLabelOffset : xfsLabelOffset+xfsLabelLength]
+		return FormatXFS, string(bytes.TrimRight(label, "\x00")), nil
+	case bytes.HasPrefix(head, []byte(squashfsMagic)):
+		return FormatSquashfs, "", nil
+	case n == ext4MagicEnd && binary.LittleEndian.Uint16(head[ext4SuperblockOffset+ext4MagicOffset:]) == ext4Magic:
+		label, err := ReadExt4Label(devicePath)
+		return FormatExt4, label, err
+	}
+
+	return "", "", fmt.Errorf("%s: %w", devicePath, ErrUnknownFilesystem)
+}
+
+// ReadExt4Label reads the volume label from the superblock of an ext2/3/4 device.
+// An unlabeled filesystem returns an empty label.
+func ReadExt4Label(devicePath string) (string, error) {
+	superblock, err := readExt4Superblock(devicePath)
+	if err != nil {
+		return "", err
+	}
+
+	label := superblock[ext4LabelOffset : ext4LabelOffset+ext4LabelLength]
+	return string(bytes.TrimRight(label, "\x00")), nil
+}
+
+// readExt4BlockSize reads the filesystem block size from the superblock
+func readExt4BlockSize(devicePath string) (int64, error) {
+	superblock, err := readExt4Superblock(devicePath)
+	if err != nil {
+		return 0, err
+	}
+
+	return 1024 << binary.LittleEndian.Uint32(superblock[ext4LogBlockOffset:]), nil
+}
+
+// readExt4Superblock reads the start of the superblock up to the label and checks the magic
+func readExt4Superblock(devicePath string) ([]byte, error) {
+	f, err := os.Open(devicePath)
+	if err != nil {
+		return nil, fmt.Errorf("open device: %w", err)
+	}
+	defer f.Close()
+
+	superblock := make([]byte, ext4LabelOffset+ext4LabelLength)
+	if _, err := f.ReadAt(superblock, ext4SuperblockOffset); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s is not an ext4 filesystem: too small", devicePath)
+		}
+		return nil, fmt.Errorf("read superblock: %w", err)
+	}
+
+	if binary.LittleEndian.Uint16(superblock[ext4MagicOffset:]) != ext4Magic {
+		return nil, fmt.Errorf("%s is not an ext4 filesystem: bad magic", devicePath)
+	}
+
+	return superblock, nil
+}
@@ -0,0 +1,104 @@
+package fs
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeSuperblock writes a minimal image containing only the ext4 magic and label
+func writeSuperblock(t *testing.T, magic uint16, label string) string {
+	t.Helper()
+
+	image := make([]byte, 2*ext4SuperblockOffset)
+	binary.LittleEndian.PutUint16(image[ext4SuperblockOffset+ext4MagicOffset:], magic)
+	copy(image[ext4SuperblockOffset+ext4LabelOffset:], label)
+
+	path := filepath.Join(t.TempDir(), "device.ext4")
+	if err := os.WriteFile(path, image, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadExt4Label(t *testing.T) {
+	tests := []struct {
+		name    string
+		magic   uint16
+		label   string
+		want    string
+		wantErr bool
+	}{
+		{name: "app label", magic: ext4Magic, label: AppFSLabel, want: AppFSLabel},
+		{name: "full length label", magic: ext4Magic, label: "state-0123456789", want: "state-0123456789"},
+		{name: "unlabeled", magic: ext4Magic, want: ""},
+		{name: "not ext4", magic: 0x1234, label: AppFSLabel, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadExt4Label(writeSuperblock(t, tt.magic, tt.label))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadExt4Label() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ReadExt4Label() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadExt4LabelTooSmall(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "small.ext4")
+	if err := os.WriteFile(path, make([]byte, 512), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ReadExt4Label(path); err == nil {
+		t.Error("ReadExt4Label() succeeded on a truncated image")
+	}
+}
+
+func TestReadLabel(t *testing.T) {
+	xfs := make([]byte, 4096)
+	copy(xfs, xfsMagic)
+	copy(xfs[xfsLabelOffset:], AppFSLabel)
+	squashfs := append([]byte(squashfsMagic), make([]byte, 4096)...)
+
+	tests := []struct {
+		name       string
+		image      []byte
+		wantFormat Format
+		wantLabel  string
+		wantErr    error
+	}{
+		{name: "xfs", image: xfs, wantFormat: FormatXFS, wantLabel: AppFSLabel},
+		{name: "squashfs", image: squashfs, wantFormat: FormatSquashfs},
+		{name: "raw-tar", image: make([]byte, 4096), wantErr: ErrUnknownFilesystem},
+		{name: "too small", image: []byte("XF"), wantErr: ErrUnknownFilesystem},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			devicePath := filepath.Join(t.TempDir(), "device")
+			if err := os.WriteFile(devicePath, tt.image, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			format, label, err := ReadLabel(devicePath)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ReadLabel() error = %v, want %v", err, tt.wantErr)
+			}
+			if format != tt.wantFormat || label != tt.wantLabel {
+				t.Errorf("ReadLabel() = %s %q, want %s %q", format, label, tt.wantFormat, tt.wantLabel)
+			}
+		})
+	}
+
+	format, label, err := ReadLabel(writeSuperblock(t, ext4Magic, AppFSLabel))
+	if err != nil || format != FormatExt4 || label != AppFSLabel {
+		t.Errorf("ReadLabel() of ext4 = %s %q, %v, want ext4 %q", format, label, err, AppFSLabel)
+	}
+}
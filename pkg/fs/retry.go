@@ -0,0 +1,62 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"time"
+)
+
+// RetryPolicy bounds the retries of mkfs.ext4 and mount. Only transient failures
+// are retried, the backoff doubles after every attempt.
+type RetryPolicy struct {
+	Attempts int           // total runs including the first, values below 1 mean one run
+	Backoff  time.Duration // wait before the first retry
+}
+
+// DefaultRetryPolicy rides out loop devices and udev that are briefly busy on loaded hosts
+var DefaultRetryPolicy = RetryPolicy{Attempts: 3, Backoff: 200 * time.Millisecond}
+
+// runCommand runs a command and returns its combined output, overridden in tests
+var runCommand = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, name, args...).CombinedOutput()
+}
+
+// transientFailures are output fragments of failures that may pass on a retry,
+// everything else (bad arguments, missing files, a too small device) is permanent
+var transientFailures = [][]byte{
+	[]byte("device or resource busy"),
+	[]byte("resource temporarily unavailable"),
+	[]byte("could not find any free loop device"),
+	[]byte("failed to setup loop device"),
+}
+
+func isTransientFailure(out []byte) bool {
+	out = bytes.ToLower(out)
+	for _, fragment := range transientFailures {
+		if bytes.Contains(out, fragment) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// run runs the command until it succeeds, fails permanently, the attempts are
+// used up or ctx is done. It returns the output and error of the last run.
+func (p RetryPolicy) run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	backoff := p.Backoff
+	for attempt := 1; ; attempt++ {
+		out, err := runCommand(ctx, name, args...)
+		if err == nil || ctx.Err() != nil || attempt >= p.Attempts || !isTransientFailure(out) {
+			return out, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return out, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
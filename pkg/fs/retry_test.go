@@ -0,0 +1,86 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRunner answers the runs of runCommand with outputs in order, a non-empty
+// output is returned as failure
+func fakeRunner(t *testing.T, outputs ...string) *[][]string {
+	t.Helper()
+
+	var calls [][]string
+	original := runCommand
+	runCommand = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		calls = append(calls, append([]string{name}, args...))
+		out := outputs[min(len(calls), len(outputs))-1]
+		if len(out) == 0 {
+			return nil, nil
+		}
+		return []byte(out), errors.New("exit status 1")
+	}
+	t.Cleanup(func() { runCommand = original })
+
+	return &calls
+}
+
+func TestFormatExt4Retry(t *testing.T) {
+	const busy = "mkfs.ext4: Device or resource busy while trying to determine filesystem size"
+	const badArgs = "mkfs.ext4: invalid inodes option - -5"
+
+	tests := []struct {
+		name      string
+		outputs   []string
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "transient failure passes on retry", outputs: []string{busy, ""}, wantCalls: 2},
+		{name: "permanent failure is not retried", outputs: []string{badArgs, ""}, wantCalls: 1, wantErr: true},
+		{name: "attempts are bounded", outputs: []string{busy}, wantCalls: 3, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := fakeRunner(t, tt.outputs...)
+			opts := BlockDeviceOptions{
+				OutputFilePath: "/dev/null",
+				Retry:          &RetryPolicy{Attempts: 3, Backoff: time.Millisecond},
+			}
+
+			err := formatExt4(context.Background(), opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("formatExt4() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.outputs[0]) {
+				t.Errorf("error %q should contain the mkfs output", err)
+			}
+			if len(*calls) != tt.wantCalls {
+				t.Errorf("mkfs.ext4 ran %d times, want %d", len(*calls), tt.wantCalls)
+			}
+			for _, call := range *calls {
+				if call[0] != "mkfs.ext4" {
+					t.Errorf("ran %v, want mkfs.ext4", call)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryPolicyStopsOnCancel(t *testing.T) {
+	calls := fakeRunner(t, "mount: /mnt: device or resource busy.")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	policy := RetryPolicy{Attempts: 100, Backoff: 10 * time.Millisecond}
+	if _, err := policy.run(ctx, "mount", "/dev/loop0", "/mnt"); err == nil {
+		t.Fatal("run succeeded with a failing command")
+	}
+	if len(*calls) >= 100 {
+		t.Errorf("ran %d times, want to stop once ctx is done", len(*calls))
+	}
+}
@@ -2,23 +2,82 @@ package fs
 
 import (
 	"context"
+
+	"github.com/maxdollinger/walk.io/pkg/utils"
 )
 
+// BlockDeviceBuilder is the single way devices are created, implemented by
+// Ext4Builder (sparse image files) and Ext4NodeBuilder (existing block nodes),
+// and per Format by XFSBuilder, SquashfsBuilder and RawTarBuilder.
 type BlockDeviceBuilder interface {
-	// Creates an ext4 image with minimal size for the content
+	// Creates a device populated from opts.SourceDirPath if set
 	NewDevice(ctx context.Context, opts BlockDeviceOptions) (BlockDevice, error)
 }
 
 type BlockDeviceOptions struct {
-	OutputFilePath string // Path of the dir the device is created in
-	SizeBytes      int64  // Blockdevice size in bytes (for journaled block devices greater than 6144 bytes)
-	Label          string // filesystem label (optional)
+	OutputFilePath        string       // Path of the device file (or block node) to create
+	Size                  utils.Bytes  // Blockdevice size (for journaled block devices greater than 6144 bytes)
+	SourceDirPath         string       // populate the filesystem from this directory without mounting (optional)
+	Label                 string       // filesystem label (optional)
+	ReadOnly              bool         // device is only mounted read-only, so no blocks are reserved for root
+	ReservedBlocksPercent *int         // overrides the blocks reserved for root (optional, mkfs default 5%)
+	SizeBufferPercent     int          // extra space on top of the SourceDirPath content (default 15%)
+	BytesPerInode         int          // bytes-per-inode ratio passed to mkfs as -i (optional)
+	InodeCount            int          // number of inodes passed to mkfs as -N (optional, tuned to SourceDirPath if neither is set)
+	Retry                 *RetryPolicy // retries of mkfs.ext4 and mount on transient failures (optional, default DefaultRetryPolicy)
+}
+
+func (o BlockDeviceOptions) retryPolicy() RetryPolicy {
+	if o.Retry != nil {
+		return *o.Retry
+	}
+
+	return DefaultRetryPolicy
+}
+
+func (o BlockDeviceOptions) sizeBufferPercent() int {
+	if o.SizeBufferPercent > 0 {
+		return o.SizeBufferPercent
+	}
+
+	return sizeBufferPercent
+}
+
+// inodeCount returns the -N for a source tree of entries files and directories.
+// The mkfs default ratio is made for average file sizes and runs out of inodes
+// on trees of many tiny files (node_modules), so without an explicit -i or -N
+// the count is derived from the tree plus the size buffer.
+func (o BlockDeviceOptions) inodeCount(entries int) int {
+	if o.BytesPerInode > 0 || o.InodeCount > 0 {
+		return o.InodeCount
+	}
+
+	return ext4FirstInode + entries*(100+o.sizeBufferPercent())/100
+}
+
+// reservedBlocksPercent returns the reserved blocks percentage to pass to mkfs
+// and false if the mkfs default should be kept
+func (o BlockDeviceOptions) reservedBlocksPercent() (int, bool) {
+	if o.ReservedBlocksPercent != nil {
+		return *o.ReservedBlocksPercent, true
+	}
+
+	if o.ReadOnly {
+		return 0, true
+	}
+
+	return 0, false
 }
 
 type BlockDevice interface {
 	Mount() (string, error)
 	Unmount() error
-	SizeBytes() int64
+	Size() utils.Bytes
 	Label() string
 	Path() string
+	// Resize grows (or shrinks down to its usage) the filesystem and its backing file.
+	// The device must not be mounted or attached to a running VM.
+	Resize(newSize utils.Bytes) error
+	// String describes the device in one line for logs, e.g. "walkio-app /app.ext4 (512M)"
+	String() string
 }
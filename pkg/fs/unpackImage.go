@@ -16,22 +16,184 @@ import (
 	"archive/tar"
 	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/maxdollinger/walk.io/pkg/oci"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
 )
 
+// paxXattrPrefix marks PAX records holding extended attributes
+const paxXattrPrefix = "SCHILY.xattr."
+
+// Layer media types that are not gzip compressed (tar+gzip and docker rootfs.diff.tar.gzip are)
+const (
+	mediaTypeLayerTar     = "application/vnd.oci.image.layer.v1.tar"
+	mediaTypeLayerZstd    = "application/vnd.oci.image.layer.v1.tar+zstd"
+	mediaTypeNondistLayer = "application/vnd.oci.image.layer.nondistributable.v1.tar"
+	mediaTypeNondistZstd  = "application/vnd.oci.image.layer.nondistributable.v1.tar+zstd"
+)
+
+var ErrLayerDigestMismatch = errors.New("layer content does not match its digest")
+
+// ProgressEvent reports how far a layer was read. Read and Size count the
+// compressed bytes, as they come from the registry.
+type ProgressEvent struct {
+	Layer  int // index of the layer
+	Layers int // number of layers of the image
+	Digest digest.Digest
+	Read   int64
+	Size   int64 // compressed size of the layer, 0 if unknown
+	Done   bool  // the layer was read completely and its digest verified
+}
+
+// ProgressFunc receives ProgressEvents, calls never overlap
+type ProgressFunc func(event ProgressEvent)
+
+// LayerFlattener merges OCI image layers into a single directory tree.
+type LayerFlattener struct {
+	concurrency int          // number of layers downloaded and decompressed in parallel
+	stripPaths  []string     // removed from the flattened tree, rooted at the target dir
+	progress    ProgressFunc // optional
+}
+
+// FlattenerOption configures optional settings of a LayerFlattener
+type FlattenerOption func(*LayerFlattener)
+
+// WithConcurrency sets how many layers are downloaded and decompressed in parallel.
+// Layers are always applied to the target directory in layer order.
+func WithConcurrency(n int) FlattenerOption {
+	return func(f *LayerFlattener) {
+		f.concurrency = max(n, 1)
+	}
+}
+
+// WithStripPaths removes the given paths from the flattened tree, e.g. /etc/resolv.conf
+// so the guest manages it. Paths are resolved inside the target dir, missing paths are ignored.
+func WithStripPaths(paths ...string) FlattenerOption {
+	return func(f *LayerFlattener) {
+		f.stripPaths = append(f.stripPaths, paths...)
+	}
+}
+
+// WithProgress reports the progress of each layer as it is read
+func WithProgress(fn ProgressFunc) FlattenerOption {
+	return func(f *LayerFlattener) {
+		f.progress = fn
+	}
+}
+
+func NewLayerFlattener(opts ...FlattenerOption) *LayerFlattener {
+	flattener := &LayerFlattener{
+		concurrency: 1,
+	}
+	for _, opt := range opts {
+		opt(flattener)
+	}
+
+	return flattener
+}
+
+// UnpackImage flattens the layers into targetDir one layer at a time
 func UnpackImage(ctx context.Context, layers []oci.Layer, targetDir string) error {
+	return NewLayerFlattener().Flatten(ctx, layers, targetDir)
+}
+
+// Flatten extracts all layers into targetDir and removes the strip paths afterwards.
+//
+// With a concurrency of 1 every layer is streamed directly into targetDir. Otherwise
+// up to concurrency layers are downloaded and decompressed into a staging tar file in
+// parallel, while the staged layers are applied sequentially in layer order so that
+// overwrites and whiteouts behave exactly as in the sequential case.
+func (f *LayerFlattener) Flatten(ctx context.Context, layers []oci.Layer, targetDir string) error {
 	if err := os.MkdirAll(targetDir, 0o755); err != nil {
 		return fmt.Errorf("create target directory: %w", err)
 	}
 
-	for i, layer := range layers {
-		if err := extractLayer(ctx, layer, targetDir); err != nil {
+	if err := f.extractLayers(ctx, layers, targetDir); err != nil {
+		return err
+	}
+
+	for _, stripPath := range f.stripPaths {
+		if err := removeInRoot(targetDir, stripPath); err != nil {
+			return fmt.Errorf("strip %s: %w", stripPath, err)
+		}
+	}
+
+	return nil
+}
+
+func (f *LayerFlattener) extractLayers(ctx context.Context, layers []oci.Layer, targetDir string) error {
+	var progressMu sync.Mutex
+	if f.concurrency <= 1 || len(layers) <= 1 {
+		for i, layer := range layers {
+			if err := extractLayer(ctx, layer, targetDir, f.layerProgress(&progressMu, layers, i)); err != nil {
+				return fmt.Errorf("extract layer %d: %w", i, err)
+			}
+		}
+		return nil
+	}
+
+	stagingDir, err := os.MkdirTemp("", "walkio-layers-*")
+	if err != nil {
+		return fmt.Errorf("create staging directory: %w", err)
+	}
+	defer os.RemoveAll(stagingDir)
+
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(ctx)
+	// stop and wait for all workers before the staging dir is removed
+	defer wg.Wait()
+	defer cancel()
+
+	// one buffered result channel per layer, so results can be consumed in order
+	results := make([]chan stagedLayer, len(layers))
+	for i := range results {
+		results[i] = make(chan stagedLayer, 1)
+	}
+
+	// a slot is taken when a layer starts staging and freed once it was applied,
+	// this bounds both the parallel downloads and the staged data on disk
+	slots := make(chan struct{}, f.concurrency)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i, layer := range layers {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				results[i] <- stagedLayer{err: ctx.Err()}
+				continue
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				stagedPath, err := stageLayer(ctx, layer, stagingDir, i, f.layerProgress(&progressMu, layers, i))
+				results[i] <- stagedLayer{path: stagedPath, err: err}
+			}()
+		}
+	}()
+
+	for i := range layers {
+		staged := <-results[i]
+		if staged.err != nil {
+			return fmt.Errorf("extract layer %d: %w", i, staged.err)
+		}
+
+		err := applyStagedLayer(ctx, staged.path, targetDir)
+		_ = os.Remove(staged.path)
+		<-slots
+		if err != nil {
 			return fmt.Errorf("extract layer %d: %w", i, err)
 		}
 	}
@@ -39,22 +201,174 @@ func UnpackImage(ctx context.Context, layers []oci.Layer, targetDir string) erro
 	return nil
 }
 
-func extractLayer(ctx context.Context, layer oci.Layer, targetDir string) error {
-	reader, err := layer.Compressed(ctx)
+// layerProgress returns the progress reporter of layer index, nil without WithProgress.
+// mu serializes the reports of the layers read in parallel.
+func (f *LayerFlattener) layerProgress(mu *sync.Mutex, layers []oci.Layer, index int) progressReporter {
+	if f.progress == nil {
+		return nil
+	}
+
+	layer := layers[index]
+	return func(read int64, done bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		f.progress(ProgressEvent{
+			Layer:  index,
+			Layers: len(layers),
+			Digest: layer.Digest(),
+			Read:   read,
+			Size:   layer.Size(),
+			Done:   done,
+		})
+	}
+}
+
+// removeInRoot removes name from the tree at root, symlinks in its parents are
+// resolved inside root and a symlink at name itself is removed, not followed
+func removeInRoot(root, name string) error {
+	targetPath, err := entryPath(root, name)
+	if err != nil {
+		return err
+	}
+	if targetPath == filepath.Clean(root) {
+		return fmt.Errorf("refusing to remove the root directory")
+	}
+
+	return os.RemoveAll(targetPath)
+}
+
+type stagedLayer struct {
+	path string // decompressed layer tar
+	err  error
+}
+
+// stageLayer downloads and decompresses the layer into a tar file inside stagingDir
+func stageLayer(ctx context.Context, layer oci.Layer, stagingDir string, index int, report progressReporter) (string, error) {
+	reader, err := openLayer(ctx, layer, report)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	layerReader, err := decompressLayer(reader, layer.MediaType())
+	if err != nil {
+		return "", err
+	}
+	defer layerReader.Close()
+
+	stagedPath := filepath.Join(stagingDir, strconv.Itoa(index)+".tar")
+	stagedFile, err := os.Create(stagedPath)
+	if err != nil {
+		return "", fmt.Errorf("create staging file: %w", err)
+	}
+	defer stagedFile.Close()
+
+	if _, err := io.Copy(stagedFile, layerReader); err != nil {
+		return "", fmt.Errorf("stage layer: %w", err)
+	}
+	// a corrupt layer is never applied
+	if err := reader.verify(); err != nil {
+		return "", err
+	}
+
+	return stagedPath, ctx.Err()
+}
+
+func applyStagedLayer(ctx context.Context, stagedPath string, targetDir string) error {
+	stagedFile, err := os.Open(stagedPath)
+	if err != nil {
+		return fmt.Errorf("open staged layer: %w", err)
+	}
+	defer stagedFile.Close()
+
+	return applyTar(ctx, tar.NewReader(stagedFile), targetDir)
+}
+
+func extractLayer(ctx context.Context, layer oci.Layer, targetDir string, report progressReporter) error {
+	reader, err := openLayer(ctx, layer, report)
 	if err != nil {
-		return fmt.Errorf("get compressed layer: %w", err)
+		return err
 	}
 	defer reader.Close()
 
-	gzipReader, err := gzip.NewReader(reader)
+	layerReader, err := decompressLayer(reader, layer.MediaType())
 	if err != nil {
-		return fmt.Errorf("decompress gzip: %w", err)
+		return err
+	}
+	defer layerReader.Close()
+
+	// streamed layers are verified after they were applied, the build still fails on a mismatch
+	if err := applyTar(ctx, tar.NewReader(layerReader), targetDir); err != nil {
+		return err
 	}
-	defer gzipReader.Close()
 
-	tarReader := tar.NewReader(gzipReader)
+	return reader.verify()
+}
+
+// progressReporter gets the bytes read of a layer so far
+type progressReporter func(read int64, done bool)
+
+// digestReader hashes the compressed layer as it is read
+type digestReader struct {
+	io.ReadCloser
+	digest   digest.Digest
+	verifier digest.Verifier
+	read     int64
+	report   progressReporter // optional
+}
+
+// openLayer opens the compressed layer for reading, verify checks it against layer.Digest()
+func openLayer(ctx context.Context, layer oci.Layer, report progressReporter) (*digestReader, error) {
+	dgst := layer.Digest()
+	if err := dgst.Validate(); err != nil {
+		return nil, fmt.Errorf("layer digest %q: %w", dgst, err)
+	}
+
+	reader, err := layer.Compressed(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get compressed layer: %w", err)
+	}
+
+	return &digestReader{ReadCloser: reader, digest: dgst, verifier: dgst.Verifier(), report: report}, nil
+}
+
+func (r *digestReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	_, _ = r.verifier.Write(p[:n])
+	r.read += int64(n)
+	if n > 0 && r.report != nil {
+		r.report(r.read, false)
+	}
+	return n, err
+}
+
+// verify reads what the decompressor left, e.g. the padding after the end of
+// the tar, and compares the digest of the whole layer
+func (r *digestReader) verify() error {
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return fmt.Errorf("read layer %s: %w", r.digest, err)
+	}
+	if !r.verifier.Verified() {
+		return fmt.Errorf("%w: %s", ErrLayerDigestMismatch, r.digest)
+	}
+
+	if r.report != nil {
+		r.report(r.read, true)
+	}
+	return nil
+}
+
+// applyTar writes all entries of a layer tar into targetDir, handling whiteouts
+func applyTar(ctx context.Context, tarReader *tar.Reader, targetDir string) error {
+	// directory times are restored after the layer is extracted,
+	// creating children would otherwise update their mtime again
+	var dirHeaders []*tar.Header
 
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		header, err := tarReader.Next()
 		if err == io.EOF {
 			break
@@ -74,11 +388,49 @@ func extractLayer(ctx context.Context, layer oci.Layer, targetDir string) error
 			return fmt.Errorf("extract tar entry %q: %w", header.Name, err)
 		}
 
+		if header.Typeflag == tar.TypeDir {
+			dirHeaders = append(dirHeaders, header)
+		}
+	}
+
+	// deepest directories last in the tar come first
+	for i := len(dirHeaders) - 1; i >= 0; i-- {
+		header := dirHeaders[i]
+		dirPath, err := entryPath(targetDir, header.Name)
+		if err != nil {
+			return err
+		}
+		if err := restoreTimes(dirPath, header); err != nil {
+			return fmt.Errorf("restore times of %q: %w", header.Name, err)
+		}
 	}
 
 	return nil
 }
 
+// decompressLayer wraps the layer reader with the decompressor matching the media type.
+// Unknown media types are treated as gzip, the historic default for docker layers.
+func decompressLayer(reader io.Reader, mediaType string) (io.ReadCloser, error) {
+	switch mediaType {
+	case mediaTypeLayerTar, mediaTypeNondistLayer:
+		return io.NopCloser(reader), nil
+
+	case mediaTypeLayerZstd, mediaTypeNondistZstd:
+		zstdReader, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("decompress zstd: %w", err)
+		}
+		return zstdReader.IOReadCloser(), nil
+
+	default:
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("decompress gzip: %w", err)
+		}
+		return gzipReader, nil
+	}
+}
+
 func isWhiteout(name string) bool {
 	// OCI whiteout: .wh.FILENAME deletes FILENAME
 	// Opaque whiteout: .wh..wh..opaque deletes the directory
@@ -93,12 +445,15 @@ func handleWhiteout(targetDir, whiteoutPath string) error {
 	actualName := strings.TrimPrefix(file, ".wh.")
 
 	// Reconstruct the full path of what to delete
-	deletePath := filepath.Join(targetDir, dir, actualName)
+	deletePath, err := entryPath(targetDir, filepath.Join(dir, actualName))
+	if err != nil {
+		return err
+	}
 
 	// Check for opaque whiteout
 	if actualName == ".wh..opaque" {
 		// Remove the entire directory
-		opaqueDir := filepath.Join(targetDir, dir)
+		opaqueDir := filepath.Dir(deletePath)
 		if err := os.RemoveAll(opaqueDir); err != nil && !os.IsNotExist(err) {
 			return fmt.Errorf("remove opaque directory: %w", err)
 		}
@@ -120,21 +475,29 @@ func handleWhiteout(targetDir, whiteoutPath string) error {
 // extractTarEntry extracts a single tar entry to the target directory
 func extractTarEntry(targetDir string, header *tar.Header, reader io.Reader) error {
 	// Sanitize path to prevent directory traversal
-	targetPath := filepath.Join(targetDir, filepath.Clean(header.Name))
-
-	// Make sure the path is still within targetDir
-	if !strings.HasPrefix(targetPath, targetDir) {
-		return fmt.Errorf("path traversal detected: %s", header.Name)
+	targetPath, err := entryPath(targetDir, header.Name)
+	if err != nil {
+		return err
 	}
 
 	switch header.Typeflag {
 	case tar.TypeDir:
+		// A directory replaces a symlink of a lower layer, following it could leave the rootfs
+		if err := removeSymlink(targetPath); err != nil {
+			return err
+		}
+
 		// Create directory
 		if err := os.MkdirAll(targetPath, os.FileMode(header.Mode)); err != nil {
 			return fmt.Errorf("mkdir: %w", err)
 		}
 		// Restore ownership if possible (may require root)
 		_ = os.Lchown(targetPath, header.Uid, header.Gid)
+		restoreXattrs(targetPath, header)
+
+		if err := restoreMode(targetPath, header); err != nil {
+			return err
+		}
 
 	case tar.TypeReg:
 		// Create parent directory
@@ -142,6 +505,11 @@ func extractTarEntry(targetDir string, header *tar.Header, reader io.Reader) err
 			return fmt.Errorf("mkdir parent: %w", err)
 		}
 
+		// The file replaces a symlink of a lower layer, opening it would follow the link
+		if err := removeSymlink(targetPath); err != nil {
+			return err
+		}
+
 		// Create the file
 		file, err := os.OpenFile(targetPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode))
 		if err != nil {
@@ -149,31 +517,54 @@ func extractTarEntry(targetDir string, header *tar.Header, reader io.Reader) err
 		}
 		defer file.Close()
 
-		if _, err := io.CopyN(file, reader, header.Size); err != nil && err != io.EOF {
+		// streamed in small chunks, runs of zeros become holes, e.g. of disk images
+		content := newSparseWriter(file)
+		if _, err := io.CopyN(content, reader, header.Size); err != nil && err != io.EOF {
+			return fmt.Errorf("copy file content: %w", err)
+		}
+		if err := content.finish(); err != nil {
 			return fmt.Errorf("copy file content: %w", err)
 		}
 
 		// Restore ownership if possible (may require root)
 		_ = os.Lchown(targetPath, header.Uid, header.Gid)
+		restoreXattrs(targetPath, header)
+
+		if err := restoreMode(targetPath, header); err != nil {
+			return err
+		}
+
+		if err := restoreTimes(targetPath, header); err != nil {
+			return fmt.Errorf("restore times: %w", err)
+		}
 
 	case tar.TypeSymlink:
+		linkname := clampSymlinkTarget(targetDir, targetPath, header.Linkname)
+
 		// Create symlink (remove existing first)
 		_ = os.Remove(targetPath)
-		if err := os.Symlink(header.Linkname, targetPath); err != nil {
+		if err := os.Symlink(linkname, targetPath); err != nil {
 			return fmt.Errorf("create symlink: %w", err)
 		}
 
 	case tar.TypeLink:
+		// The link replaces a symlink of a lower layer, creating the fallback file would follow it
+		if err := removeSymlink(targetPath); err != nil {
+			return err
+		}
+
 		// Hard link - create a copy instead if target is outside rootfs
-		linkTarget := filepath.Join(targetDir, filepath.Clean(header.Linkname))
-		if !strings.HasPrefix(linkTarget, targetDir) {
+		linkTarget, err := entryPath(targetDir, header.Linkname)
+		if err != nil {
 			// Fallback: create empty file
 			if err := os.MkdirAll(filepath.Dir(targetPath), 0o755); err != nil {
 				return fmt.Errorf("mkdir parent: %w", err)
 			}
-			if _, err := os.Create(targetPath); err != nil {
+			file, err := os.OpenFile(targetPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|unix.O_NOFOLLOW, os.FileMode(header.Mode))
+			if err != nil {
 				return fmt.Errorf("create hardlink fallback file: %w", err)
 			}
+			file.Close()
 		} else {
 			// Create hard link
 			if err := os.Link(linkTarget, targetPath); err != nil {
@@ -182,8 +573,20 @@ func extractTarEntry(targetDir string, header *tar.Header, reader io.Reader) err
 		}
 
 	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
-		// Skip special files (device nodes, pipes) - will be created by container on startup
-		return nil
+		// Device nodes require root, without privileges they are skipped
+		// and have to be created by the guest on startup
+		created, err := createSpecialFile(targetPath, header)
+		if err != nil {
+			return err
+		}
+		if !created {
+			return nil
+		}
+
+		_ = os.Lchown(targetPath, header.Uid, header.Gid)
+		if err := restoreMode(targetPath, header); err != nil {
+			return err
+		}
 
 	default:
 		// Unknown type - skip
@@ -192,3 +595,181 @@ func extractTarEntry(targetDir string, header *tar.Header, reader io.Reader) err
 
 	return nil
 }
+
+// createSpecialFile creates a device node or fifo, reporting false if
+// the node was skipped because of missing privileges
+func createSpecialFile(targetPath string, header *tar.Header) (bool, error) {
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0o755); err != nil {
+		return false, fmt.Errorf("mkdir parent: %w", err)
+	}
+
+	var fileType uint32
+	switch header.Typeflag {
+	case tar.TypeChar:
+		fileType = unix.S_IFCHR
+	case tar.TypeBlock:
+		fileType = unix.S_IFBLK
+	default:
+		fileType = unix.S_IFIFO
+	}
+
+	_ = os.Remove(targetPath)
+	dev := unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))
+	err := unix.Mknod(targetPath, fileType|uint32(header.Mode&0o7777), int(dev))
+	if errors.Is(err, unix.EPERM) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("mknod: %w", err)
+	}
+
+	return true, nil
+}
+
+// restoreMode applies the full mode including setuid, setgid and sticky bits.
+// The mode passed on creation is masked by the umask and chown clears setuid,
+// so this has to run after ownership was restored.
+func restoreMode(targetPath string, header *tar.Header) error {
+	mode := header.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if err := os.Chmod(targetPath, mode); err != nil {
+		return fmt.Errorf("chmod: %w", err)
+	}
+
+	return nil
+}
+
+// restoreXattrs applies the extended attributes stored in the PAX records
+// (e.g. security.capability). Best effort, like ownership most of them require root.
+func restoreXattrs(targetPath string, header *tar.Header) {
+	for key, value := range header.PAXRecords {
+		name, ok := strings.CutPrefix(key, paxXattrPrefix)
+		if !ok {
+			continue
+		}
+		_ = unix.Lsetxattr(targetPath, name, []byte(value), 0)
+	}
+}
+
+// restoreTimes sets access and modification time from the tar header,
+// the access time falls back to the modification time if not recorded.
+func restoreTimes(targetPath string, header *tar.Header) error {
+	accessTime := header.AccessTime
+	if accessTime.IsZero() {
+		accessTime = header.ModTime
+	}
+
+	return os.Chtimes(targetPath, accessTime, header.ModTime)
+}
+
+// maxSymlinkHops bounds symlink resolution like the kernel does (ELOOP)
+const maxSymlinkHops = 40
+
+// entryPath returns the host path of a tar entry inside targetDir.
+// Names escaping targetDir are rejected, symlinks in the parent directories are
+// resolved inside targetDir so writing through a symlink can't leave the rootfs.
+func entryPath(targetDir, name string) (string, error) {
+	if !isWithinDir(targetDir, filepath.Join(targetDir, name)) {
+		return "", fmt.Errorf("path traversal detected: %s", name)
+	}
+
+	parent, base := filepath.Split(filepath.Clean("/" + name))
+	resolvedParent, err := resolveInRoot(targetDir, parent)
+	if err != nil {
+		return "", fmt.Errorf("resolve %s: %w", name, err)
+	}
+
+	return filepath.Join(resolvedParent, base), nil
+}
+
+// resolveInRoot follows symlinks in dirPath the way the guest will see them:
+// absolute link targets are rooted at root and ".." never leaves root.
+// Components that don't exist yet are taken as is.
+func resolveInRoot(root, dirPath string) (string, error) {
+	resolved := "/"
+	remaining := strings.Split(dirPath, "/")
+	hops := 0
+
+	for len(remaining) > 0 {
+		part := remaining[0]
+		remaining = remaining[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		hops++
+		if hops > maxSymlinkHops {
+			return "", fmt.Errorf("too many levels of symbolic links")
+		}
+
+		link, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", fmt.Errorf("read symlink: %w", err)
+		}
+		if filepath.IsAbs(link) {
+			resolved = "/"
+		}
+		remaining = append(strings.Split(link, "/"), remaining...)
+	}
+
+	return filepath.Join(root, resolved), nil
+}
+
+// removeSymlink removes path if it is a symlink
+func removeSymlink(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("remove replaced symlink: %w", err)
+	}
+
+	return nil
+}
+
+// isWithinDir reports whether path is dir or below it
+func isWithinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
+
+// clampSymlinkTarget cleans a symlink target against the location of the link
+// and clamps it at the rootfs, like the guest resolves ".." at its root anyway,
+// e.g. "../../etc" of /lib/link becomes "../etc". targetPath is the resolved
+// location of the link, so links below symlinked directories keep their target.
+// Absolute targets are always rooted at the rootfs inside the guest.
+func clampSymlinkTarget(targetDir, targetPath, linkname string) string {
+	if filepath.IsAbs(linkname) {
+		return filepath.Clean(linkname)
+	}
+
+	rel, err := filepath.Rel(targetDir, filepath.Dir(targetPath))
+	if err != nil {
+		return linkname
+	}
+	linkDir := filepath.Join("/", rel)
+
+	// cleaning below "/" drops every ".." that would climb above the rootfs
+	clamped, err := filepath.Rel(linkDir, filepath.Join(linkDir, linkname))
+	if err != nil {
+		return linkname
+	}
+	return clamped
+}
@@ -0,0 +1,709 @@
+package fs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/maxdollinger/walk.io/pkg/oci"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
+)
+
+// testLayer is an in-memory oci.Layer
+type testLayer struct {
+	data      []byte
+	mediaType string
+}
+
+func (l *testLayer) Digest() digest.Digest { return digest.FromBytes(l.data) }
+func (l *testLayer) Size() int64           { return int64(len(l.data)) }
+func (l *testLayer) MediaType() string     { return l.mediaType }
+func (l *testLayer) Compressed(ctx context.Context) (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(l.data)), nil
+}
+
+// tamperedLayer serves data but claims the digest of the original content
+type tamperedLayer struct {
+	testLayer
+	original []byte
+}
+
+func (l *tamperedLayer) Digest() digest.Digest { return digest.FromBytes(l.original) }
+
+type tarEntry struct {
+	header  tar.Header
+	content string
+}
+
+func buildTar(t *testing.T, entries []tarEntry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		header := entry.header
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(entry.content))
+		}
+		if err := tw.WriteHeader(&header); err != nil {
+			t.Fatalf("write tar header: %v", err)
+		}
+		if _, err := tw.Write([]byte(entry.content)); err != nil {
+			t.Fatalf("write tar content: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar writer: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(data); err != nil {
+		t.Fatalf("gzip write: %v", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("gzip close: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func zstdBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("zstd writer: %v", err)
+	}
+	defer encoder.Close()
+
+	return encoder.EncodeAll(data, nil)
+}
+
+func TestUnpackImageCompression(t *testing.T) {
+	tarball := buildTar(t, []tarEntry{
+		{header: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o755}},
+		{header: tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0o644}, content: "walkio"},
+	})
+
+	tests := []struct {
+		name  string
+		layer *testLayer
+	}{
+		{
+			name:  "gzip",
+			layer: &testLayer{data: gzipBytes(t, tarball), mediaType: "application/vnd.oci.image.layer.v1.tar+gzip"},
+		},
+		{
+			name:  "docker gzip",
+			layer: &testLayer{data: gzipBytes(t, tarball), mediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip"},
+		},
+		{
+			name:  "zstd",
+			layer: &testLayer{data: zstdBytes(t, tarball), mediaType: mediaTypeLayerZstd},
+		},
+		{
+			name:  "uncompressed",
+			layer: &testLayer{data: tarball, mediaType: mediaTypeLayerTar},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targetDir := t.TempDir()
+			if err := UnpackImage(context.Background(), []oci.Layer{tt.layer}, targetDir); err != nil {
+				t.Fatalf("UnpackImage failed: %v", err)
+			}
+
+			data, err := os.ReadFile(filepath.Join(targetDir, "etc", "hostname"))
+			if err != nil {
+				t.Fatalf("read extracted file: %v", err)
+			}
+			if string(data) != "walkio" {
+				t.Errorf("content = %q, want %q", data, "walkio")
+			}
+		})
+	}
+}
+
+// zeroReader reads endless zeros
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestUnpackImageStreamsSparseFile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("extracts a 200M file")
+	}
+
+	// 200M of zeros between two markers, gzip keeps the layer itself small
+	const size = 200 * 1024 * 1024
+	head, tail := "walkio head", "walkio tail"
+	var layer bytes.Buffer
+	gw := gzip.NewWriter(&layer)
+	tw := tar.NewWriter(gw)
+	if err := tw.WriteHeader(&tar.Header{Name: "disk.img", Typeflag: tar.TypeReg, Mode: 0o644, Size: size}); err != nil {
+		t.Fatal(err)
+	}
+	content := io.MultiReader(strings.NewReader(head), io.LimitReader(zeroReader{}, size-int64(len(head)+len(tail))), strings.NewReader(tail))
+	if _, err := io.Copy(tw, content); err != nil {
+		t.Fatal(err)
+	}
+	if err := errors.Join(tw.Close(), gw.Close()); err != nil {
+		t.Fatal(err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	targetDir := t.TempDir()
+	err := UnpackImage(context.Background(), []oci.Layer{&testLayer{data: layer.Bytes(), mediaType: "application/vnd.oci.image.layer.v1.tar+gzip"}}, targetDir)
+	if err != nil {
+		t.Fatalf("UnpackImage failed: %v", err)
+	}
+	runtime.ReadMemStats(&after)
+
+	// the file is streamed, never held in memory
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16*1024*1024 {
+		t.Errorf("extracting allocated %d bytes, want the content streamed", allocated)
+	}
+
+	filePath := filepath.Join(targetDir, "disk.img")
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != size {
+		t.Errorf("size = %d, want %d", info.Size(), size)
+	}
+	if allocatedBytes := info.Sys().(*syscall.Stat_t).Blocks * 512; allocatedBytes > 1024*1024 {
+		t.Errorf("file occupies %d bytes on disk, want the zeros kept as holes", allocatedBytes)
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gotHead, gotTail := make([]byte, len(head)), make([]byte, len(tail))
+	if _, err := file.ReadAt(gotHead, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.ReadAt(gotTail, size-int64(len(tail))); err != nil {
+		t.Fatal(err)
+	}
+	if string(gotHead) != head || string(gotTail) != tail {
+		t.Errorf("content starts with %q and ends with %q, want %q and %q", gotHead, gotTail, head, tail)
+	}
+}
+
+func TestLayerFlattenerOrderedMerge(t *testing.T) {
+	layers := []oci.Layer{
+		&testLayer{mediaType: mediaTypeLayerTar, data: buildTar(t, []tarEntry{
+			{header: tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0o755}},
+			{header: tar.Header{Name: "a/removed", Typeflag: tar.TypeReg, Mode: 0o644}, content: "one"},
+			{header: tar.Header{Name: "a/overwritten", Typeflag: tar.TypeReg, Mode: 0o644}, content: "v1"},
+			{header: tar.Header{Name: "b/", Typeflag: tar.TypeDir, Mode: 0o755}},
+			{header: tar.Header{Name: "b/cleared", Typeflag: tar.TypeReg, Mode: 0o644}, content: "old"},
+		})},
+		&testLayer{mediaType: mediaTypeLayerTar, data: buildTar(t, []tarEntry{
+			{header: tar.Header{Name: "a/.wh.removed", Typeflag: tar.TypeReg, Mode: 0o644}},
+			{header: tar.Header{Name: "a/overwritten", Typeflag: tar.TypeReg, Mode: 0o644}, content: "v2"},
+		})},
+		&testLayer{mediaType: mediaTypeLayerTar, data: buildTar(t, []tarEntry{
+			{header: tar.Header{Name: "b/.wh..wh..opaque", Typeflag: tar.TypeReg, Mode: 0o644}},
+			{header: tar.Header{Name: "b/new", Typeflag: tar.TypeReg, Mode: 0o644}, content: "new"},
+			{header: tar.Header{Name: "a/overwritten", Typeflag: tar.TypeReg, Mode: 0o644}, content: "v3"},
+		})},
+	}
+
+	for _, concurrency := range []int{1, 2, 4} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			targetDir := t.TempDir()
+			flattener := NewLayerFlattener(WithConcurrency(concurrency))
+			if err := flattener.Flatten(context.Background(), layers, targetDir); err != nil {
+				t.Fatalf("Flatten failed: %v", err)
+			}
+
+			data, err := os.ReadFile(filepath.Join(targetDir, "a", "overwritten"))
+			if err != nil || string(data) != "v3" {
+				t.Errorf("a/overwritten = %q (err %v), want %q", data, err, "v3")
+			}
+
+			data, err = os.ReadFile(filepath.Join(targetDir, "b", "new"))
+			if err != nil || string(data) != "new" {
+				t.Errorf("b/new = %q (err %v), want %q", data, err, "new")
+			}
+
+			for _, removed := range []string{"a/removed", "b/cleared"} {
+				if _, err := os.Stat(filepath.Join(targetDir, removed)); !os.IsNotExist(err) {
+					t.Errorf("%s should have been removed by whiteout", removed)
+				}
+			}
+		})
+	}
+}
+
+func TestLayerFlattenerVerifiesDigest(t *testing.T) {
+	original := gzipBytes(t, buildTar(t, []tarEntry{
+		{header: tar.Header{Name: "app", Typeflag: tar.TypeReg, Mode: 0o755}, content: "trusted"},
+	}))
+	tampered := gzipBytes(t, buildTar(t, []tarEntry{
+		{header: tar.Header{Name: "app", Typeflag: tar.TypeReg, Mode: 0o755}, content: "evil!!!"},
+	}))
+	base := &testLayer{mediaType: mediaTypeLayerTar, data: buildTar(t, []tarEntry{
+		{header: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o755}},
+	})}
+
+	layers := []oci.Layer{
+		base,
+		&tamperedLayer{testLayer: testLayer{mediaType: "application/vnd.oci.image.layer.v1.tar+gzip", data: tampered}, original: original},
+	}
+
+	for _, concurrency := range []int{1, 2} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			targetDir := t.TempDir()
+			err := NewLayerFlattener(WithConcurrency(concurrency)).Flatten(context.Background(), layers, targetDir)
+			if !errors.Is(err, ErrLayerDigestMismatch) {
+				t.Fatalf("Flatten error = %v, want %v", err, ErrLayerDigestMismatch)
+			}
+		})
+	}
+
+	// staged layers are verified before they are applied
+	targetDir := t.TempDir()
+	_ = NewLayerFlattener(WithConcurrency(2)).Flatten(context.Background(), layers, targetDir)
+	if _, err := os.Stat(filepath.Join(targetDir, "app")); !os.IsNotExist(err) {
+		t.Error("content of the tampered layer was applied")
+	}
+}
+
+func TestLayerFlattenerProgress(t *testing.T) {
+	layers := []oci.Layer{
+		&testLayer{mediaType: mediaTypeLayerTar, data: buildTar(t, []tarEntry{
+			{header: tar.Header{Name: "big", Typeflag: tar.TypeReg, Mode: 0o644}, content: strings.Repeat("x", 256*1024)},
+		})},
+		&testLayer{mediaType: "application/vnd.oci.image.layer.v1.tar+gzip", data: gzipBytes(t, buildTar(t, []tarEntry{
+			{header: tar.Header{Name: "small", Typeflag: tar.TypeReg, Mode: 0o644}, content: "small"},
+		}))},
+	}
+
+	for _, concurrency := range []int{1, 2} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			var events []ProgressEvent
+			flattener := NewLayerFlattener(WithConcurrency(concurrency), WithProgress(func(event ProgressEvent) {
+				events = append(events, event)
+			}))
+			if err := flattener.Flatten(context.Background(), layers, t.TempDir()); err != nil {
+				t.Fatalf("Flatten failed: %v", err)
+			}
+
+			lastRead := make([]int64, len(layers))
+			done := make([]bool, len(layers))
+			for _, event := range events {
+				if event.Layers != len(layers) || event.Digest != layers[event.Layer].Digest() {
+					t.Fatalf("event %+v does not describe layer %d of %d", event, event.Layer, len(layers))
+				}
+				if event.Read < lastRead[event.Layer] || done[event.Layer] {
+					t.Errorf("event %+v after %d bytes read, done %v", event, lastRead[event.Layer], done[event.Layer])
+				}
+				lastRead[event.Layer], done[event.Layer] = event.Read, event.Done
+			}
+			for i, layer := range layers {
+				if !done[i] || lastRead[i] != layer.Size() {
+					t.Errorf("layer %d ended at %d of %d bytes, done %v", i, lastRead[i], layer.Size(), done[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLayerFlattenerStripPaths(t *testing.T) {
+	layers := []oci.Layer{
+		&testLayer{mediaType: mediaTypeLayerTar, data: buildTar(t, []tarEntry{
+			{header: tar.Header{Name: ".dockerenv", Typeflag: tar.TypeReg, Mode: 0o644}},
+			{header: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o755}},
+			{header: tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0o644}, content: "container"},
+			{header: tar.Header{Name: "etc/hosts", Typeflag: tar.TypeReg, Mode: 0o644}, content: "127.0.0.1 localhost"},
+			{header: tar.Header{Name: "etc/resolv.conf", Typeflag: tar.TypeSymlink, Linkname: "/run/resolv.conf"}},
+			{header: tar.Header{Name: "config", Typeflag: tar.TypeSymlink, Linkname: "/etc"}},
+		})},
+	}
+
+	for _, concurrency := range []int{1, 2} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			targetDir := t.TempDir()
+			flattener := NewLayerFlattener(
+				WithConcurrency(concurrency),
+				WithStripPaths("/etc/resolv.conf", "/.dockerenv", "config/hostname", "/not/there"),
+			)
+			if err := flattener.Flatten(context.Background(), append(layers, layers[0]), targetDir); err != nil {
+				t.Fatalf("Flatten failed: %v", err)
+			}
+
+			for _, removed := range []string{".dockerenv", "etc/resolv.conf", "etc/hostname"} {
+				if _, err := os.Lstat(filepath.Join(targetDir, removed)); !os.IsNotExist(err) {
+					t.Errorf("%s should have been stripped", removed)
+				}
+			}
+
+			for _, kept := range []string{"etc/hosts", "config"} {
+				if _, err := os.Lstat(filepath.Join(targetDir, kept)); err != nil {
+					t.Errorf("%s should have been kept: %v", kept, err)
+				}
+			}
+		})
+	}
+}
+
+func TestLayerFlattenerStripPathsTraversal(t *testing.T) {
+	outside := filepath.Join(t.TempDir(), "keep")
+	if err := os.WriteFile(outside, []byte("data"), 0o644); err != nil {
+		t.Fatalf("write outside file: %v", err)
+	}
+
+	targetDir := t.TempDir()
+	rel, err := filepath.Rel(targetDir, outside)
+	if err != nil {
+		t.Fatalf("rel path: %v", err)
+	}
+
+	flattener := NewLayerFlattener(WithStripPaths(rel))
+	if err := flattener.Flatten(context.Background(), nil, targetDir); err == nil {
+		t.Errorf("Flatten() should reject a strip path outside the target dir")
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Errorf("file outside the target dir was removed: %v", err)
+	}
+}
+
+func TestLayerFlattenerCancelled(t *testing.T) {
+	layer := &testLayer{mediaType: mediaTypeLayerTar, data: buildTar(t, []tarEntry{
+		{header: tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0o644}, content: "data"},
+	})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	flattener := NewLayerFlattener(WithConcurrency(2))
+	err := flattener.Flatten(ctx, []oci.Layer{layer, layer, layer}, t.TempDir())
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Flatten() error = %v, want context.Canceled", err)
+	}
+}
+
+func TestUnpackImageRestoresTimes(t *testing.T) {
+	fileTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	dirTime := time.Date(2019, 6, 7, 8, 9, 10, 0, time.UTC)
+
+	layer := &testLayer{mediaType: mediaTypeLayerTar, data: buildTar(t, []tarEntry{
+		{header: tar.Header{Name: "app/", Typeflag: tar.TypeDir, Mode: 0o755, ModTime: dirTime}},
+		{header: tar.Header{Name: "app/bin", Typeflag: tar.TypeReg, Mode: 0o755, ModTime: fileTime}, content: "#!/bin/sh"},
+	})}
+
+	targetDir := t.TempDir()
+	if err := UnpackImage(context.Background(), []oci.Layer{layer}, targetDir); err != nil {
+		t.Fatalf("UnpackImage failed: %v", err)
+	}
+
+	for name, want := range map[string]time.Time{"app": dirTime, "app/bin": fileTime} {
+		info, err := os.Stat(filepath.Join(targetDir, name))
+		if err != nil {
+			t.Fatalf("stat %s: %v", name, err)
+		}
+		if !info.ModTime().Equal(want) {
+			t.Errorf("%s mtime = %v, want %v", name, info.ModTime(), want)
+		}
+	}
+}
+
+func TestUnpackImageRestoresXattrs(t *testing.T) {
+	targetDir := t.TempDir()
+
+	probe := filepath.Join(targetDir, "probe")
+	if err := os.WriteFile(probe, nil, 0o644); err != nil {
+		t.Fatalf("write probe: %v", err)
+	}
+	if err := unix.Lsetxattr(probe, "user.probe", []byte("1"), 0); err != nil {
+		t.Skipf("user xattrs not supported on temp dir: %v", err)
+	}
+
+	layer := &testLayer{mediaType: mediaTypeLayerTar, data: buildTar(t, []tarEntry{
+		{header: tar.Header{
+			Name:       "bin",
+			Typeflag:   tar.TypeReg,
+			Mode:       0o755,
+			Format:     tar.FormatPAX,
+			PAXRecords: map[string]string{paxXattrPrefix + "user.walkio": "value"},
+		}, content: "binary"},
+	})}
+
+	if err := UnpackImage(context.Background(), []oci.Layer{layer}, targetDir); err != nil {
+		t.Fatalf("UnpackImage failed: %v", err)
+	}
+
+	buf := make([]byte, 64)
+	n, err := unix.Lgetxattr(filepath.Join(targetDir, "bin"), "user.walkio", buf)
+	if err != nil {
+		t.Fatalf("get xattr: %v", err)
+	}
+	if string(buf[:n]) != "value" {
+		t.Errorf("xattr = %q, want %q", buf[:n], "value")
+	}
+}
+
+func TestUnpackImageRejectsTraversal(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+	}{
+		{
+			name: "parent directory escape",
+			entries: []tarEntry{
+				{header: tar.Header{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0o644}, content: "pwned"},
+			},
+		},
+		{
+			name: "sibling prefix escape",
+			entries: []tarEntry{
+				{header: tar.Header{Name: "../root-evil/file", Typeflag: tar.TypeReg, Mode: 0o644}, content: "pwned"},
+			},
+		},
+		{
+			name: "whiteout escape",
+			entries: []tarEntry{
+				{header: tar.Header{Name: "../.wh.outside", Typeflag: tar.TypeReg, Mode: 0o644}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			baseDir := t.TempDir()
+			targetDir := filepath.Join(baseDir, "root")
+			outsideDir := filepath.Join(baseDir, "outside")
+			if err := os.Mkdir(outsideDir, 0o755); err != nil {
+				t.Fatalf("mkdir outside: %v", err)
+			}
+
+			layer := &testLayer{mediaType: mediaTypeLayerTar, data: buildTar(t, tt.entries)}
+			err := UnpackImage(context.Background(), []oci.Layer{layer}, targetDir)
+			if err == nil {
+				t.Fatal("expected path traversal error")
+			}
+
+			if _, err := os.Stat(filepath.Join(baseDir, "evil")); !os.IsNotExist(err) {
+				t.Error("file written outside of rootfs")
+			}
+			if _, err := os.Stat(filepath.Join(baseDir, "root-evil")); !os.IsNotExist(err) {
+				t.Error("file written into sibling directory")
+			}
+			if _, err := os.Stat(outsideDir); err != nil {
+				t.Error("directory outside of rootfs removed")
+			}
+		})
+	}
+}
+
+func TestUnpackImageAbsoluteSymlinkStaysInRoot(t *testing.T) {
+	baseDir := t.TempDir()
+	targetDir := filepath.Join(baseDir, "root")
+	outsideDir := filepath.Join(baseDir, "outside")
+	if err := os.Mkdir(outsideDir, 0o755); err != nil {
+		t.Fatalf("mkdir outside: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(outsideDir, "passwd"), []byte("host"), 0o644); err != nil {
+		t.Fatalf("write host file: %v", err)
+	}
+
+	layers := []oci.Layer{
+		&testLayer{mediaType: mediaTypeLayerTar, data: buildTar(t, []tarEntry{
+			// absolute symlinks are valid in images, they point into the rootfs
+			{header: tar.Header{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: outsideDir}},
+			{header: tar.Header{Name: "passwd", Typeflag: tar.TypeSymlink, Linkname: filepath.Join(outsideDir, "passwd")}},
+		})},
+		&testLayer{mediaType: mediaTypeLayerTar, data: buildTar(t, []tarEntry{
+			{header: tar.Header{Name: "etc/shadow", Typeflag: tar.TypeReg, Mode: 0o644}, content: "through symlink"},
+			{header: tar.Header{Name: "passwd", Typeflag: tar.TypeReg, Mode: 0o644}, content: "replaced"},
+		})},
+	}
+
+	if err := UnpackImage(context.Background(), layers, targetDir); err != nil {
+		t.Fatalf("UnpackImage failed: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(outsideDir, "shadow")); !os.IsNotExist(err) {
+		t.Error("file written through absolute symlink outside of rootfs")
+	}
+	data, err := os.ReadFile(filepath.Join(outsideDir, "passwd"))
+	if err != nil || string(data) != "host" {
+		t.Errorf("host file modified through symlink: %q (err %v)", data, err)
+	}
+
+	data, err = os.ReadFile(filepath.Join(targetDir, outsideDir, "shadow"))
+	if err != nil || string(data) != "through symlink" {
+		t.Errorf("file not written inside rootfs: %q (err %v)", data, err)
+	}
+}
+
+func TestUnpackImageClampsRelativeSymlinks(t *testing.T) {
+	baseDir := t.TempDir()
+	targetDir := filepath.Join(baseDir, "root")
+
+	layer := &testLayer{mediaType: mediaTypeLayerTar, data: buildTar(t, []tarEntry{
+		{header: tar.Header{Name: "usr/lib/", Typeflag: tar.TypeDir, Mode: 0o755}},
+		{header: tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0o755}},
+		{header: tar.Header{Name: "lib", Typeflag: tar.TypeSymlink, Linkname: "usr/lib"}},
+		// harmless in the guest, ".." of / is / again
+		{header: tar.Header{Name: "bin/escape", Typeflag: tar.TypeSymlink, Linkname: "../../../outside"}},
+		{header: tar.Header{Name: "top", Typeflag: tar.TypeSymlink, Linkname: "../.."}},
+		{header: tar.Header{Name: "bin/sh", Typeflag: tar.TypeSymlink, Linkname: "../usr/bin/dash"}},
+		// written to usr/lib/ld.so, two levels below the root
+		{header: tar.Header{Name: "lib/ld.so", Typeflag: tar.TypeSymlink, Linkname: "../../bin/ld.so"}},
+		{header: tar.Header{Name: "bin/mid", Typeflag: tar.TypeSymlink, Linkname: "x/../../../../etc/passwd"}},
+		{header: tar.Header{Name: "abs", Typeflag: tar.TypeSymlink, Linkname: "/../../etc/./passwd"}},
+	})}
+	if err := UnpackImage(context.Background(), []oci.Layer{layer}, targetDir); err != nil {
+		t.Fatalf("UnpackImage failed: %v", err)
+	}
+
+	tests := map[string]string{
+		"bin/escape":    "../outside",
+		"top":           ".",
+		"bin/sh":        "../usr/bin/dash",
+		"usr/lib/ld.so": "../../bin/ld.so",
+		"bin/mid":       "../etc/passwd",
+		"abs":           "/etc/passwd",
+	}
+	for name, want := range tests {
+		got, err := os.Readlink(filepath.Join(targetDir, name))
+		if err != nil || got != want {
+			t.Errorf("%s -> %q (err %v), want %q", name, got, err, want)
+		}
+	}
+}
+
+func TestUnpackImageHardlinkReplacesSymlink(t *testing.T) {
+	baseDir := t.TempDir()
+	targetDir := filepath.Join(baseDir, "root")
+	hostFile := filepath.Join(baseDir, "host")
+	if err := os.WriteFile(hostFile, []byte("host"), 0o644); err != nil {
+		t.Fatalf("write host file: %v", err)
+	}
+
+	layer := &testLayer{mediaType: mediaTypeLayerTar, data: buildTar(t, []tarEntry{
+		{header: tar.Header{Name: "victim", Typeflag: tar.TypeSymlink, Linkname: hostFile}},
+		{header: tar.Header{Name: "victim", Typeflag: tar.TypeLink, Linkname: "../escape", Mode: 0o644}},
+	})}
+	if err := UnpackImage(context.Background(), []oci.Layer{layer}, targetDir); err != nil {
+		t.Fatalf("UnpackImage failed: %v", err)
+	}
+
+	data, err := os.ReadFile(hostFile)
+	if err != nil || string(data) != "host" {
+		t.Errorf("host file modified through symlink: %q (err %v)", data, err)
+	}
+	info, err := os.Lstat(filepath.Join(targetDir, "victim"))
+	if err != nil || !info.Mode().IsRegular() {
+		t.Errorf("victim not replaced by a regular file (err %v)", err)
+	}
+}
+
+func TestIsWithinDir(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "/build/root", want: true},
+		{path: "/build/root/etc/passwd", want: true},
+		{path: "/build/root/..data", want: true},
+		{path: "/build/rootfs-evil", want: false},
+		{path: "/build", want: false},
+		{path: "/etc/passwd", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := isWithinDir("/build/root", tt.path); got != tt.want {
+			t.Errorf("isWithinDir(/build/root, %s) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestUnpackImagePreservesSpecialModes(t *testing.T) {
+	layer := &testLayer{mediaType: mediaTypeLayerTar, data: buildTar(t, []tarEntry{
+		{header: tar.Header{Name: "bin/ping", Typeflag: tar.TypeReg, Mode: 0o4755}, content: "binary"},
+		{header: tar.Header{Name: "tmp/", Typeflag: tar.TypeDir, Mode: 0o1777}},
+		{header: tar.Header{Name: "run/fifo", Typeflag: tar.TypeFifo, Mode: 0o600}},
+	})}
+
+	targetDir := t.TempDir()
+	if err := UnpackImage(context.Background(), []oci.Layer{layer}, targetDir); err != nil {
+		t.Fatalf("UnpackImage failed: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		want os.FileMode
+	}{
+		{name: "bin/ping", want: 0o755 | os.ModeSetuid},
+		{name: "tmp", want: 0o777 | os.ModeSticky | os.ModeDir},
+		{name: "run/fifo", want: 0o600 | os.ModeNamedPipe},
+	}
+	for _, tt := range tests {
+		info, err := os.Lstat(filepath.Join(targetDir, tt.name))
+		if err != nil {
+			t.Errorf("stat %s: %v", tt.name, err)
+			continue
+		}
+		if info.Mode() != tt.want {
+			t.Errorf("%s mode = %v, want %v", tt.name, info.Mode(), tt.want)
+		}
+	}
+}
+
+func TestUnpackImageCreatesDeviceNodes(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("device nodes require root")
+	}
+
+	layer := &testLayer{mediaType: mediaTypeLayerTar, data: buildTar(t, []tarEntry{
+		{header: tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0o666, Devmajor: 1, Devminor: 3}},
+	})}
+
+	targetDir := t.TempDir()
+	if err := UnpackImage(context.Background(), []oci.Layer{layer}, targetDir); err != nil {
+		t.Fatalf("UnpackImage failed: %v", err)
+	}
+
+	var stat unix.Stat_t
+	if err := unix.Lstat(filepath.Join(targetDir, "dev", "null"), &stat); err != nil {
+		t.Skipf("device node not created, mknod not permitted: %v", err)
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFCHR {
+		t.Errorf("dev/null is not a char device: mode %o", stat.Mode)
+	}
+	if unix.Major(stat.Rdev) != 1 || unix.Minor(stat.Rdev) != 3 {
+		t.Errorf("dev/null = %d:%d, want 1:3", unix.Major(stat.Rdev), unix.Minor(stat.Rdev))
+	}
+}
@@ -1,31 +1,60 @@
 package fs
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
-	"os/exec"
 	"path"
-	"strconv"
-	"strings"
+	"path/filepath"
 )
 
-func diskUsage(path string) (int64, error) {
-	output, err := exec.Command("du", "-sb", path).Output()
-	if err != nil {
-		return 0, fmt.Errorf("error getting dir size: %w", err)
-	}
-
-	fields := strings.Fields(string(output))
-	if len(fields) < 1 {
-		return 0, fmt.Errorf("unexpected du output: %q", output)
-	}
+// Estimates used to size an ext4 device for a directory tree
+const (
+	ext4BlockSize     = 4096 // default block size of mkfs.ext4
+	ext4InodeSize     = 256  // default on-disk inode size of mkfs.ext4
+	ext4FirstInode    = 11   // inodes below are reserved by ext4
+	sizeBufferPercent = 15   // default extra space for journal, group descriptors and bitmaps
+)
 
-	sizeBytes, err := strconv.ParseInt(fields[0], 10, 64)
+// diskUsage estimates the space the tree below path occupies on ext4:
+// every file and directory costs an inode plus its content rounded up to full blocks.
+// It also returns the number of entries, each needs its own inode.
+func diskUsage(path string) (int64, int, error) {
+	var sizeBytes int64
+	var entries int
+	err := filepath.WalkDir(path, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		entries++
+		sizeBytes += ext4InodeSize
+		switch {
+		case info.IsDir():
+			sizeBytes += ext4BlockSize
+		case info.Mode().IsRegular():
+			sizeBytes += roundUp(info.Size(), ext4BlockSize)
+		}
+		// symlinks, device nodes and fifos fit into the inode
+
+		return nil
+	})
 	if err != nil {
-		return 0, fmt.Errorf("parse du size: %w", err)
+		return 0, 0, fmt.Errorf("error getting dir size: %w", err)
 	}
 
-	return sizeBytes, nil
+	return sizeBytes, entries, nil
+}
+
+func roundUp(n, multiple int64) int64 {
+	return (n + multiple - 1) / multiple * multiple
 }
 
 func createSparseFile(path string, sizeBytes int64) error {
@@ -49,6 +78,44 @@ func createSparseFile(path string, sizeBytes int64) error {
 	return nil
 }
 
+// zeroBlock is compared against to find the holes of sparse files
+var zeroBlock [ext4BlockSize]byte
+
+// sparseWriter writes to an empty file and seeks over blocks of zeros instead of
+// writing them, so they stay holes. Seeking past the end doesn't grow the file,
+// finish sets its size to the bytes written, e.g. for a trailing hole.
+type sparseWriter struct {
+	file    *os.File
+	written int64
+}
+
+func newSparseWriter(file *os.File) *sparseWriter {
+	return &sparseWriter{file: file}
+}
+
+func (w *sparseWriter) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		block := p[:min(len(p), ext4BlockSize)]
+		if bytes.Equal(block, zeroBlock[:len(block)]) {
+			if _, err := w.file.Seek(int64(len(block)), io.SeekCurrent); err != nil {
+				return total - len(p), err
+			}
+		} else if n, err := w.file.Write(block); err != nil {
+			w.written += int64(n)
+			return total - len(p) + n, err
+		}
+		w.written += int64(len(block))
+		p = p[len(block):]
+	}
+
+	return total, nil
+}
+
+func (w *sparseWriter) finish() error {
+	return w.file.Truncate(w.written)
+}
+
 func WriteFileAtomic(filePath string, data []byte, perm os.FileMode) error {
 	dir := path.Dir(filePath)
 	tmp, err := os.CreateTemp(dir, "*.tmp")
@@ -0,0 +1,87 @@
+package fs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskUsage(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "small"), []byte("x"), 0o644); err != nil {
+		t.Fatalf("write small: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "sub", "large"), make([]byte, ext4BlockSize+1), 0o644); err != nil {
+		t.Fatalf("write large: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "empty"), nil, 0o644); err != nil {
+		t.Fatalf("write empty: %v", err)
+	}
+	if err := os.Symlink("small", filepath.Join(root, "link")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	got, entries, err := diskUsage(root)
+	if err != nil {
+		t.Fatalf("diskUsage failed: %v", err)
+	}
+
+	want := int64(0)
+	want += 2 * (ext4InodeSize + ext4BlockSize) // root and sub directory
+	want += ext4InodeSize + ext4BlockSize       // small: 1 byte rounded up to one block
+	want += ext4InodeSize + 2*ext4BlockSize     // large: one byte over a block
+	want += ext4InodeSize                       // empty file
+	want += ext4InodeSize                       // symlink
+	if got != want {
+		t.Errorf("diskUsage() = %d, want %d", got, want)
+	}
+	if entries != 6 {
+		t.Errorf("diskUsage() entries = %d, want 6", entries)
+	}
+}
+
+func TestDiskUsageMissingDir(t *testing.T) {
+	if _, _, err := diskUsage(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected error for missing directory")
+	}
+}
+
+func TestSparseWriter(t *testing.T) {
+	// data, a hole, data not aligned to a block and a trailing hole
+	content := append([]byte("head"), make([]byte, 3*ext4BlockSize)...)
+	content = append(content, []byte("middle")...)
+	content = append(content, make([]byte, 2*ext4BlockSize+7)...)
+
+	filePath := filepath.Join(t.TempDir(), "sparse")
+	file, err := os.Create(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := newSparseWriter(file)
+	// odd write sizes, as they come from a decompressor
+	for rest := content; len(rest) > 0; {
+		n := min(len(rest), 1000)
+		if _, err := writer.Write(rest[:n]); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		rest = rest[n:]
+	}
+	if err := writer.finish(); err != nil {
+		t.Fatalf("finish failed: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("file has %d bytes, want the %d written ones", len(got), len(content))
+	}
+}
@@ -0,0 +1,216 @@
+package fs
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/maxdollinger/walk.io/pkg/utils"
+	"golang.org/x/sys/unix"
+)
+
+// xfsMinSize is the smallest filesystem current mkfs.xfs creates
+const xfsMinSize = 300 * utils.MB
+
+var _ BlockDeviceBuilder = (*XFSBuilder)(nil)
+
+// XFSBuilder creates sparse XFS image files. The source dir is copied in by
+// mkfs.xfs from a protofile, so like ext4 no mount is needed.
+type XFSBuilder struct{}
+
+func NewXFSBuilder() BlockDeviceBuilder {
+	return &XFSBuilder{}
+}
+
+// NewDevice sizes the device like Ext4Builder, but at least xfsMinSize.
+// Cancelling ctx stops mkfs.xfs and the partial device file is removed.
+func (b *XFSBuilder) NewDevice(ctx context.Context, opts BlockDeviceOptions) (BlockDevice, error) {
+	sizeBytes := max(int64(opts.Size), int64(xfsMinSize))
+
+	args := []string{"-f"}
+	if len(opts.Label) > 0 {
+		args = append(args, "-L", opts.Label)
+	}
+
+	if len(opts.SourceDirPath) > 0 {
+		contentBytes, _, err := diskUsage(opts.SourceDirPath)
+		if err != nil {
+			return nil, fmt.Errorf("error sizing source dir: %w", err)
+		}
+		sizeBytes = max(sizeBytes, contentBytes*int64(100+opts.sizeBufferPercent())/100)
+
+		protofile, err := os.CreateTemp("", "walkio-xfs-proto-*")
+		if err != nil {
+			return nil, fmt.Errorf("create xfs protofile: %w", err)
+		}
+		defer os.Remove(protofile.Name())
+
+		err = errors.Join(writeXFSProtofile(protofile, opts.SourceDirPath), protofile.Close())
+		if err != nil {
+			return nil, fmt.Errorf("write xfs protofile: %w", err)
+		}
+		args = append(args, "-p", protofile.Name())
+	}
+	args = append(args, opts.OutputFilePath)
+
+	if err := createSparseFile(opts.OutputFilePath, sizeBytes); err != nil {
+		return nil, fmt.Errorf("error createing sparse file: %w", err)
+	}
+
+	out, err := opts.retryPolicy().run(ctx, "mkfs.xfs", args...)
+	if err != nil {
+		err = errors.Join(commandError(ctx, err, out), os.Remove(opts.OutputFilePath))
+		return nil, fmt.Errorf("error formating file as xfs: %w", err)
+	}
+
+	return &imageDevice{
+		format: FormatXFS,
+		label:  opts.Label,
+		size:   utils.Bytes(sizeBytes),
+		path:   opts.OutputFilePath,
+		retry:  opts.retryPolicy(),
+	}, nil
+}
+
+// growXFS grows the xfs device file at devicePath from size to newSize. xfs can't
+// shrink and xfs_growfs only works on a mounted filesystem, so the device is
+// mounted for the resize and must not be in use otherwise.
+func growXFS(devicePath string, size, newSize utils.Bytes, retry RetryPolicy) error {
+	if newSize < size {
+		return fmt.Errorf("xfs can't shrink from %s to %s: %w", size, newSize, ErrResizeUnsupported)
+	}
+	if newSize == size {
+		return nil
+	}
+
+	if err := os.Truncate(devicePath, int64(newSize)); err != nil {
+		return fmt.Errorf("grow device file: %w", err)
+	}
+
+	mountDir, err := mountImage(retry, devicePath)
+	if err != nil {
+		return errors.Join(err, os.Truncate(devicePath, int64(size)))
+	}
+	out, err := runCommand(context.Background(), "sudo", "xfs_growfs", mountDir)
+	if err != nil {
+		err = fmt.Errorf("xfs_growfs: %w\n%s", err, out)
+	}
+
+	return errors.Join(err, unmountImage(devicePath))
+}
+
+// writeXFSProtofile describes the tree below root in the protofile format of
+// mkfs.xfs -p. The format can't express names with whitespace or the sticky
+// bit, and hardlinked files become copies.
+func writeXFSProtofile(w io.Writer, root string) error {
+	buf := bufio.NewWriter(w)
+	// boot image (unused) and block/inode counts (ignored by mkfs.xfs)
+	fmt.Fprint(buf, "/dev/null\n0 0\n")
+
+	rootInfo, err := os.Lstat(root)
+	if err != nil {
+		return err
+	}
+	rootEntry, err := xfsProtoEntry(root, rootInfo)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(buf, rootEntry)
+
+	if err := writeXFSProtoDir(buf, root, 1); err != nil {
+		return err
+	}
+	fmt.Fprintln(buf, "$")
+
+	return buf.Flush()
+}
+
+func writeXFSProtoDir(w io.Writer, dir string, depth int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	indent := strings.Repeat(" ", depth)
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.ContainsFunc(name, func(r rune) bool { return r == ' ' || r == '\t' || r == '\n' }) {
+			return fmt.Errorf("xfs protofile can't hold %q: name contains whitespace", filepath.Join(dir, name))
+		}
+
+		entryPath := filepath.Join(dir, name)
+		info, err := os.Lstat(entryPath)
+		if err != nil {
+			return err
+		}
+		line, err := xfsProtoEntry(entryPath, info)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s%s %s\n", indent, name, line)
+
+		if info.IsDir() {
+			if err := writeXFSProtoDir(w, entryPath, depth+1); err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%s$\n", indent)
+		}
+	}
+
+	return nil
+}
+
+// xfsProtoEntry returns "{mode} {uid} {gid} [source]" of a protofile entry, e.g. "---644 0 0 /src/file"
+func xfsProtoEntry(entryPath string, info fs.FileInfo) (string, error) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("no owner of %s", entryPath)
+	}
+
+	mode := info.Mode()
+	setuid, setgid := "-", "-"
+	if mode&fs.ModeSetuid != 0 {
+		setuid = "u"
+	}
+	if mode&fs.ModeSetgid != 0 {
+		setgid = "g"
+	}
+
+	var fileType, source string
+	switch {
+	case mode.IsRegular():
+		fileType, source = "-", entryPath
+	case mode.IsDir():
+		fileType = "d"
+	case mode&fs.ModeSymlink != 0:
+		target, err := os.Readlink(entryPath)
+		if err != nil {
+			return "", err
+		}
+		fileType, source = "l", target
+	case mode&fs.ModeCharDevice != 0:
+		fileType = "c"
+		source = fmt.Sprintf("%d %d", unix.Major(uint64(stat.Rdev)), unix.Minor(uint64(stat.Rdev)))
+	case mode&fs.ModeDevice != 0:
+		fileType = "b"
+		source = fmt.Sprintf("%d %d", unix.Major(uint64(stat.Rdev)), unix.Minor(uint64(stat.Rdev)))
+	case mode&fs.ModeNamedPipe != 0:
+		fileType = "p"
+	default:
+		return "", fmt.Errorf("xfs protofile can't hold %s of type %s", entryPath, mode.Type())
+	}
+
+	line := fmt.Sprintf("%s%s%s%03o %d %d", fileType, setuid, setgid, mode.Perm(), stat.Uid, stat.Gid)
+	if len(source) > 0 {
+		line += " " + source
+	}
+
+	return line, nil
+}
@@ -0,0 +1,95 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestWriteXFSProtofile(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Chmod(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "bin"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "bin", "app"), []byte("#!/bin/sh"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(root, "bin", "app"), os.ModeSetuid|0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("bin/app", filepath.Join(root, "entry")); err != nil {
+		t.Fatal(err)
+	}
+
+	var proto strings.Builder
+	if err := writeXFSProtofile(&proto, root); err != nil {
+		t.Fatalf("writeXFSProtofile failed: %v", err)
+	}
+
+	owner := fmt.Sprintf("%d %d", os.Getuid(), os.Getgid())
+	want := strings.Join([]string{
+		"/dev/null",
+		"0 0",
+		"d--755 " + owner,
+		" bin d--750 " + owner,
+		"  app -u-755 " + owner + " " + filepath.Join(root, "bin", "app"),
+		" $",
+		" entry l--777 " + owner + " bin/app",
+		"$",
+		"",
+	}, "\n")
+	if proto.String() != want {
+		t.Errorf("protofile =\n%s\nwant\n%s", proto.String(), want)
+	}
+}
+
+func TestWriteXFSProtofileRejectsWhitespace(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "my file"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeXFSProtofile(&strings.Builder{}, root); err == nil {
+		t.Error("writeXFSProtofile succeeded for a name with a space")
+	}
+}
+
+func TestXFSDeviceResize(t *testing.T) {
+	calls := fakeRunner(t, "")
+	devicePath := filepath.Join(t.TempDir(), "state.xfs")
+	if err := createSparseFile(devicePath, int64(xfsMinSize)); err != nil {
+		t.Fatal(err)
+	}
+	device := &imageDevice{format: FormatXFS, size: xfsMinSize, path: devicePath}
+
+	if err := device.Resize(xfsMinSize / 2); !errors.Is(err, ErrResizeUnsupported) {
+		t.Errorf("shrinking Resize error = %v, want %v", err, ErrResizeUnsupported)
+	}
+
+	if err := device.Resize(2 * xfsMinSize); err != nil {
+		t.Fatalf("Resize failed: %v", err)
+	}
+	info, err := os.Stat(devicePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(2*xfsMinSize) || device.Size() != 2*xfsMinSize {
+		t.Errorf("file size %d, Size() %s after Resize, want %s", info.Size(), device.Size(), 2*xfsMinSize)
+	}
+
+	// xfs_growfs runs on the mounted filesystem
+	var commands []string
+	for _, call := range *calls {
+		commands = append(commands, call[1])
+	}
+	if want := []string{"mount", "xfs_growfs", "umount"}; !slices.Equal(commands, want) {
+		t.Errorf("ran %v, want %v", commands, want)
+	}
+}
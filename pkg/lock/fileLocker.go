@@ -0,0 +1,293 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const DefaultLockDir = "/var/lib/walkio/locks"
+
+// DefaultLeaseTTL is how long a lock stays valid without a heartbeat. Held locks
+// refresh their lease every third of the TTL, so only a hung or frozen holder
+// loses its lock. It has to stay well above the clock skew between hosts
+// sharing the lock dir.
+const DefaultLeaseTTL = 30 * time.Second
+
+// lockPollInterval is how often a contended lock is retried
+var lockPollInterval = 50 * time.Millisecond
+
+// FileLocker takes advisory flock locks on {dir}/{key}.lock, so builds in
+// different processes exclude each other. The holder writes its PID and the
+// expiry of its lease into the lock file and renews the lease in the background.
+// A lock file whose holder is dead or whose lease expired is removed and taken over.
+type FileLocker struct {
+	dir    string
+	ttl    time.Duration
+	logger *slog.Logger
+}
+
+// FileLockerOption configures optional settings of a FileLocker
+type FileLockerOption func(*FileLocker)
+
+// WithLeaseTTL overrides DefaultLeaseTTL, non-positive values keep the default
+func WithLeaseTTL(ttl time.Duration) FileLockerOption {
+	return func(l *FileLocker) {
+		if ttl > 0 {
+			l.ttl = ttl
+		}
+	}
+}
+
+// WithLogger sets the logger reclaimed stale locks are reported to, default slog.Default()
+func WithLogger(logger *slog.Logger) FileLockerOption {
+	return func(l *FileLocker) {
+		if logger != nil {
+			l.logger = logger
+		}
+	}
+}
+
+func NewFileLocker(dir string, opts ...FileLockerOption) *FileLocker {
+	locker := &FileLocker{dir: dir, ttl: DefaultLeaseTTL, logger: slog.Default()}
+	for _, opt := range opts {
+		opt(locker)
+	}
+
+	return locker
+}
+
+func (l *FileLocker) AcquireLock(ctx context.Context, key string) (Lock, error) {
+	if len(key) == 0 || strings.ContainsAny(key, `/\`) || key == "." || key == ".." {
+		return nil, fmt.Errorf("invalid lock key %q", key)
+	}
+
+	if err := os.MkdirAll(l.dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create lock dir: %w", err)
+	}
+	lockPath := filepath.Join(l.dir, key+".lock")
+
+	for {
+		lock, err := l.tryLock(lockPath)
+		if err != nil {
+			return nil, fmt.Errorf("lock %s: %w", key, err)
+		}
+		if lock != nil {
+			lock.startHeartbeat()
+			return lock, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("lock %s: %w", key, ctx.Err())
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+type fileLock struct {
+	mu   sync.Mutex // serializes Refresh and Release
+	file *os.File
+	ttl  time.Duration
+	stop chan struct{} // closed by Release to end the heartbeat
+	done chan struct{} // closed when the heartbeat ended
+	lost chan struct{} // closed once Refresh noticed the takeover of the lease
+}
+
+// startHeartbeat refreshes the lease every third of the TTL until Release or
+// until the lease is lost
+func (l *fileLock) startHeartbeat() {
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+
+	go func() {
+		defer close(l.done)
+
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.stop:
+				return
+			case <-ticker.C:
+				if errors.Is(l.Refresh(), ErrLeaseLost) {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// Refresh extends the lease by the TTL, it fails with ErrLeaseLost if the
+// lease expired and another holder reclaimed the lock file
+func (l *fileLock) Refresh() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	select {
+	case <-l.lost:
+		return ErrLeaseLost
+	default:
+	}
+	if !isSameFile(l.file.Name(), l.file) {
+		close(l.lost)
+		return ErrLeaseLost
+	}
+
+	return writeLease(l.file, time.Now().Add(l.ttl))
+}
+
+func (l *fileLock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Release ends the heartbeat, removes the lock file and drops the flock.
+// Removing first keeps waiters from locking the old file, they recheck the path
+// after locking. A file that was reclaimed by another holder is left alone.
+func (l *fileLock) Release() error {
+	if l.stop != nil {
+		close(l.stop)
+		<-l.done
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var removeErr error
+	if isSameFile(l.file.Name(), l.file) {
+		removeErr = os.Remove(l.file.Name())
+		if errors.Is(removeErr, os.ErrNotExist) {
+			removeErr = nil
+		}
+	}
+
+	unlockErr := unix.Flock(int(l.file.Fd()), unix.LOCK_UN)
+	return errors.Join(removeErr, unlockErr, l.file.Close())
+}
+
+// tryLock takes the lock without blocking, a nil lock means it is held by someone else
+func (l *FileLocker) tryLock(lockPath string) (*fileLock, error) {
+	file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open lock file: %w", err)
+	}
+
+	err = unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		if holder, reason, ok := reclaimStaleLock(lockPath, file); ok {
+			l.logger.Warn("reclaimed stale lock", "path", lockPath, "holder", holder, "reason", reason)
+		}
+		file.Close()
+		return nil, nil
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("flock: %w", err)
+	}
+
+	// the previous holder may have released (and removed) the file between open and flock
+	if !isSameFile(lockPath, file) {
+		file.Close()
+		return nil, nil
+	}
+
+	if err := writeLease(file, time.Now().Add(l.ttl)); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &fileLock{file: file, ttl: l.ttl, lost: make(chan struct{})}, nil
+}
+
+// reclaimStaleLock removes the lock file if the PID written into it is no longer
+// alive or its lease expired. The flock of a dead process is gone with it, so a
+// dead holder means the lock is kept by a leaked descriptor (e.g. inherited by a
+// child process). An expired lease means the holder hangs or runs on another host.
+// Returns the stale holder and why it was reclaimed, ok is false if the lock was left alone.
+func reclaimStaleLock(lockPath string, file *os.File) (pid int, reason string, ok bool) {
+	pid, expiresAt, err := readLease(file)
+	if err != nil {
+		return pid, "", false
+	}
+
+	switch {
+	case !processAlive(pid):
+		reason = "holder not alive"
+	case !expiresAt.IsZero() && time.Now().After(expiresAt):
+		reason = "lease expired"
+	default:
+		return pid, "", false
+	}
+
+	// the holder released and another one took over since we opened the file
+	if !isSameFile(lockPath, file) {
+		return pid, "", false
+	}
+	if err := os.Remove(lockPath); err != nil {
+		return pid, "", false
+	}
+
+	return pid, reason, true
+}
+
+func processAlive(pid int) bool {
+	err := unix.Kill(pid, 0)
+	return err == nil || errors.Is(err, unix.EPERM)
+}
+
+func isSameFile(lockPath string, file *os.File) bool {
+	pathInfo, err := os.Stat(lockPath)
+	if err != nil {
+		return false
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(pathInfo, fileInfo)
+}
+
+// writeLease writes "{pid}\n{expiry in unix nanoseconds}\n" into the lock file
+func writeLease(file *os.File, expiresAt time.Time) error {
+	lease := fmt.Sprintf("%d\n%d\n", os.Getpid(), expiresAt.UnixNano())
+	if err := file.Truncate(0); err != nil {
+		return fmt.Errorf("write lock lease: %w", err)
+	}
+	if _, err := file.WriteAt([]byte(lease), 0); err != nil {
+		return fmt.Errorf("write lock lease: %w", err)
+	}
+
+	return nil
+}
+
+// readLease parses the lock file, files of holders without lease have a zero expiry
+func readLease(file *os.File) (int, time.Time, error) {
+	data := make([]byte, 64)
+	n, _ := file.ReadAt(data, 0)
+
+	pidLine, expiryLine, _ := strings.Cut(strings.TrimSpace(string(data[:n])), "\n")
+	pid, err := strconv.Atoi(pidLine)
+	if err != nil || pid <= 0 {
+		return 0, time.Time{}, fmt.Errorf("invalid lock holder %q", pidLine)
+	}
+	if len(expiryLine) == 0 {
+		return pid, time.Time{}, nil
+	}
+
+	expiry, err := strconv.ParseInt(expiryLine, 10, 64)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("invalid lock lease %q", expiryLine)
+	}
+
+	return pid, time.Unix(0, expiry), nil
+}
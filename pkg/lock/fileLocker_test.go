@@ -0,0 +1,256 @@
+package lock
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func fastLockPoll(t *testing.T) {
+	t.Helper()
+
+	original := lockPollInterval
+	lockPollInterval = time.Millisecond
+	t.Cleanup(func() { lockPollInterval = original })
+}
+
+func TestFileLockerExcludes(t *testing.T) {
+	fastLockPoll(t)
+	locker := NewFileLocker(t.TempDir())
+
+	var mu sync.Mutex
+	holders, maxHolders := 0, 0
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			lock, err := locker.AcquireLock(context.Background(), "sha256-abc")
+			if err != nil {
+				t.Errorf("AcquireLock failed: %v", err)
+				return
+			}
+
+			mu.Lock()
+			holders++
+			maxHolders = max(maxHolders, holders)
+			mu.Unlock()
+
+			time.Sleep(2 * time.Millisecond)
+
+			mu.Lock()
+			holders--
+			mu.Unlock()
+
+			if err := lock.Release(); err != nil {
+				t.Errorf("Release failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if maxHolders != 1 {
+		t.Errorf("lock held by %d goroutines at once, want 1", maxHolders)
+	}
+}
+
+func TestFileLockerRespectsContext(t *testing.T) {
+	fastLockPoll(t)
+	locker := NewFileLocker(t.TempDir())
+
+	held, err := locker.AcquireLock(context.Background(), "digest")
+	if err != nil {
+		t.Fatalf("AcquireLock failed: %v", err)
+	}
+	defer held.Release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err = locker.AcquireLock(ctx, "digest")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("AcquireLock error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestFileLockerReclaimsDeadHolder(t *testing.T) {
+	fastLockPoll(t)
+	dir := t.TempDir()
+
+	// a pid that is guaranteed to be gone
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("cannot run true: %v", err)
+	}
+	deadPID := cmd.Process.Pid
+
+	// a leaked descriptor keeps the flock although its holder is dead
+	leaked, err := os.OpenFile(filepath.Join(dir, "digest.lock"), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leaked.Close()
+	if err := unix.Flock(int(leaked.Fd()), unix.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leaked.WriteString(strconv.Itoa(deadPID) + "\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	lock, err := NewFileLocker(dir, WithLogger(logger)).AcquireLock(ctx, "digest")
+	if err != nil {
+		t.Fatalf("AcquireLock did not reclaim stale lock: %v", err)
+	}
+
+	if pid := lockHolder(t, filepath.Join(dir, "digest.lock")); pid != os.Getpid() {
+		t.Errorf("lock holder = %d, want own pid %d", pid, os.Getpid())
+	}
+	wantLog := "holder=" + strconv.Itoa(deadPID) + ` reason="holder not alive"`
+	if !strings.Contains(logs.String(), wantLog) {
+		t.Errorf("reclamation log = %q, want it to contain %q", logs.String(), wantLog)
+	}
+
+	if err := lock.Release(); err != nil {
+		t.Errorf("Release failed: %v", err)
+	}
+}
+
+func TestFileLockerRespectsLiveHolder(t *testing.T) {
+	fastLockPoll(t)
+	lockPath := filepath.Join(t.TempDir(), "digest.lock")
+
+	// a live holder with a valid lease, held through a descriptor the locker doesn't know
+	held, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	if err := unix.Flock(int(held.Fd()), unix.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeLease(held, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := NewFileLocker(filepath.Dir(lockPath)).AcquireLock(ctx, "digest"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("AcquireLock error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if !isSameFile(lockPath, held) {
+		t.Error("lock file of the live holder was removed")
+	}
+}
+
+func TestFileLockerRejectsInvalidKey(t *testing.T) {
+	locker := NewFileLocker(t.TempDir())
+	for _, key := range []string{"", "..", "a/b"} {
+		if _, err := locker.AcquireLock(context.Background(), key); err == nil {
+			t.Errorf("AcquireLock(%q) succeeded", key)
+		}
+	}
+}
+
+// lockHolder returns the PID written into the lock file
+func lockHolder(t *testing.T, lockPath string) int {
+	t.Helper()
+
+	file, err := os.Open(lockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	pid, _, err := readLease(file)
+	if err != nil {
+		t.Fatalf("readLease failed: %v", err)
+	}
+	return pid
+}
+
+func TestFileLockerReclaimsExpiredLease(t *testing.T) {
+	fastLockPoll(t)
+	dir := t.TempDir()
+	lockPath := filepath.Join(dir, "digest.lock")
+
+	// a hung holder: alive and still flocking the file, but its lease ran out
+	hung, err := NewFileLocker(dir, WithLeaseTTL(time.Minute)).tryLock(lockPath)
+	if err != nil || hung == nil {
+		t.Fatalf("tryLockFile failed: %v", err)
+	}
+	defer hung.file.Close()
+	if err := writeLease(hung.file, time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	lock, err := NewFileLocker(dir).AcquireLock(ctx, "digest")
+	if err != nil {
+		t.Fatalf("AcquireLock did not reclaim the expired lease: %v", err)
+	}
+
+	if err := hung.Refresh(); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("Refresh of the reclaimed lock error = %v, want %v", err, ErrLeaseLost)
+	}
+	select {
+	case <-hung.Lost():
+	default:
+		t.Error("Lost not closed after the lease was reclaimed")
+	}
+	select {
+	case <-lock.Lost():
+		t.Error("Lost of the new holder closed")
+	default:
+	}
+	// the old holder must not remove the lock file of the new one
+	if err := hung.Release(); err != nil {
+		t.Errorf("Release of the reclaimed lock failed: %v", err)
+	}
+	if _, err := os.Stat(lockPath); err != nil {
+		t.Errorf("lock file of the new holder removed: %v", err)
+	}
+
+	if err := lock.Release(); err != nil {
+		t.Errorf("Release failed: %v", err)
+	}
+}
+
+func TestFileLockerHeartbeatKeepsLease(t *testing.T) {
+	fastLockPoll(t)
+	locker := NewFileLocker(t.TempDir(), WithLeaseTTL(30*time.Millisecond))
+
+	held, err := locker.AcquireLock(context.Background(), "digest")
+	if err != nil {
+		t.Fatalf("AcquireLock failed: %v", err)
+	}
+	defer held.Release()
+
+	// waits several TTLs, the heartbeat has to keep the lease alive
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := locker.AcquireLock(ctx, "digest"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("AcquireLock error = %v, want %v while the holder heartbeats", err, context.DeadlineExceeded)
+	}
+	if err := held.Refresh(); err != nil {
+		t.Errorf("Refresh failed: %v", err)
+	}
+}
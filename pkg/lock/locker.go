@@ -0,0 +1,52 @@
+// Package lock serializes work on the same key (e.g. an image digest) across goroutines and processes.
+package lock
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrLeaseLost is returned by Refresh once the lease expired and the lock was taken by another holder
+var ErrLeaseLost = errors.New("lock lease lost")
+
+// Locker hands out exclusive locks per key
+type Locker interface {
+	// AcquireLock blocks until the lock for key is held or ctx is done
+	AcquireLock(ctx context.Context, key string) (Lock, error)
+}
+
+// Lock is a held lock, Release must be called exactly once
+type Lock interface {
+	// Refresh extends the lease of the lock, locks refresh themselves while held
+	Refresh() error
+	// Lost is closed once the lease was lost to another holder, work done under
+	// the lock must not be published then
+	Lost() <-chan struct{}
+	Release() error
+}
+
+// NoOpLocker never blocks, for single process use and tests
+type NoOpLocker struct{}
+
+func NewNoOpLocker() *NoOpLocker {
+	return &NoOpLocker{}
+}
+
+func (l *NoOpLocker) AcquireLock(ctx context.Context, key string) (Lock, error) {
+	return noOpLock{}, ctx.Err()
+}
+
+type noOpLock struct{}
+
+func (noOpLock) Refresh() error {
+	return nil
+}
+
+// Lost never closes, a no-op lock can't be taken over
+func (noOpLock) Lost() <-chan struct{} {
+	return nil
+}
+
+func (noOpLock) Release() error {
+	return nil
+}
@@ -0,0 +1,456 @@
+package network
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// AllocateVMNetwork allocates an IP and portCount host ports for a VM and persists
+// them if the manager was restored from a database, so they survive a restart.
+// The VM's MAC (GenerateMAC) is checked to be unique among the allocated VMs.
+func (m *NetworkManager) AllocateVMNetwork(ctx context.Context, vmID string, portCount int) (net.IP, []int, error) {
+	return m.allocateVMNetwork(ctx, vmID, portCount, func() (net.IP, error) {
+		return m.ipPool.AllocateIP(vmID)
+	})
+}
+
+// AllocateVMNetworkWithIP is AllocateVMNetwork with the fixed ip instead of the
+// next free one, e.g. for a database other VMs connect to, see IPPool.AllocateSpecificIP.
+func (m *NetworkManager) AllocateVMNetworkWithIP(ctx context.Context, vmID string, ip net.IP, portCount int) ([]int, error) {
+	_, ports, err := m.allocateVMNetwork(ctx, vmID, portCount, func() (net.IP, error) {
+		return ip, m.ipPool.AllocateSpecificIP(vmID, ip)
+	})
+	return ports, err
+}
+
+// allocateVMNetwork does the work of AllocateVMNetwork with the IP of allocateIP
+func (m *NetworkManager) allocateVMNetwork(ctx context.Context, vmID string, portCount int, allocateIP func() (net.IP, error)) (net.IP, []int, error) {
+	if _, err := m.macPool.AllocateMAC(vmID); err != nil {
+		return nil, nil, err
+	}
+
+	ip, err := allocateIP()
+	if err != nil {
+		return nil, nil, errors.Join(err, m.macPool.ReleaseMAC(vmID))
+	}
+
+	ports, err := m.hostPortPool.AllocatePorts(vmID, portCount)
+	if err != nil {
+		return nil, nil, errors.Join(err, m.ipPool.ReleaseIP(&ip, vmID), m.macPool.ReleaseMAC(vmID))
+	}
+
+	if m.db != nil {
+		if err := saveAllocation(ctx, m.db, vmID, ip.String(), ports); err != nil {
+			err = errors.Join(err, m.hostPortPool.ReleasePorts(ports, vmID), m.ipPool.ReleaseIP(&ip, vmID), m.macPool.ReleaseMAC(vmID))
+			return nil, nil, fmt.Errorf("persist network allocation: %w", err)
+		}
+	}
+
+	return ip, ports, nil
+}
+
+// AllocatePortRange allocates count contiguous host ports to a VM allocated by
+// AllocateVMNetwork, e.g. for MapPortRange, see HostPortPool.AllocatePortRange.
+// They are persisted with the other ports of the VM and released with them.
+func (m *NetworkManager) AllocatePortRange(ctx context.Context, vmID string, count int) ([]int, error) {
+	if _, ok := m.ipPool.ipOf(vmID); !ok {
+		return nil, fmt.Errorf("allocate port range of VM %s: %w", vmID, ErrIPNotAllocated)
+	}
+
+	ports, err := m.hostPortPool.AllocatePortRange(vmID, count)
+	if err != nil {
+		return nil, fmt.Errorf("allocate port range of VM %s: %w", vmID, err)
+	}
+
+	if m.db != nil {
+		_, err := m.db.ExecContext(ctx, `UPDATE network_allocations SET host_ports = ? WHERE vm_id = ?`,
+			formatPorts(m.hostPortPool.portsOf(vmID)), vmID)
+		if err != nil {
+			err = errors.Join(err, m.hostPortPool.ReleasePorts(ports, vmID))
+			return nil, fmt.Errorf("persist port range: %w", err)
+		}
+	}
+
+	return ports, nil
+}
+
+// MapPorts installs the DNAT rules forwarding host ports of a VM to its guest ports
+// and records them, so EnsureInfrastructure can re-install them.
+func (m *NetworkManager) MapPorts(ctx context.Context, vmID string, vmIP net.IP, mappings []PortMapping) error {
+	if err := AddPortMappings(vmIP.String(), mappings); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	mapped := m.portMappings[vmID]
+	mapped.vmIP, mapped.mappings = vmIP.String(), mappings
+	m.portMappings[vmID] = mapped
+	m.mu.Unlock()
+
+	if m.db != nil {
+		_, err := m.db.ExecContext(ctx, `UPDATE network_allocations SET port_mappings = ? WHERE vm_id = ?`,
+			formatPortMappings(mappings), vmID)
+		if err != nil {
+			return fmt.Errorf("persist port mappings: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// MapPortRange installs the DNAT rule forwarding a host port range of a VM, see
+// AddRangePortMapping, and records it next to the mappings of MapPorts, so it is
+// re-installed by EnsureInfrastructure and removed with the VM's network.
+func (m *NetworkManager) MapPortRange(ctx context.Context, vmID string, vmIP net.IP, portRange PortRange) error {
+	if err := AddRangePortMapping(vmIP.String(), portRange); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	mapped := m.portMappings[vmID]
+	mapped.vmIP = vmIP.String()
+	if !slices.Contains(mapped.ranges, portRange) {
+		mapped.ranges = append(mapped.ranges, portRange)
+	}
+	m.portMappings[vmID] = mapped
+	ranges := slices.Clone(mapped.ranges)
+	m.mu.Unlock()
+
+	if m.db != nil {
+		_, err := m.db.ExecContext(ctx, `UPDATE network_allocations SET port_ranges = ? WHERE vm_id = ?`,
+			formatPortRanges(ranges), vmID)
+		if err != nil {
+			return fmt.Errorf("persist port ranges: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// ReleaseVMNetwork removes the port mappings of a VM, returns its IP and ports
+// to the pools and removes the persisted allocation. It is TeardownVM for callers
+// that destroy the TAP device themselves, a failed step doesn't stop the others.
+func (m *NetworkManager) ReleaseVMNetwork(ctx context.Context, vmID string, ip net.IP, ports []int) error {
+	if errs := m.releaseAllocation(ctx, vmID, ip, ports); len(errs) > 0 {
+		return fmt.Errorf("release network of VM %s: %w", vmID, errors.Join(errs...))
+	}
+	return nil
+}
+
+// releaseAllocation undoes AllocateVMNetwork, AllocatePortRange and MapPorts of
+// a VM, a nil ip and empty ports are skipped. Returns the errors of all failed steps.
+func (m *NetworkManager) releaseAllocation(ctx context.Context, vmID string, ip net.IP, ports []int) []error {
+	var errs []error
+
+	m.mu.Lock()
+	mapped, ok := m.portMappings[vmID]
+	delete(m.portMappings, vmID)
+	m.mu.Unlock()
+	if ok {
+		if err := RemovePortMappings(mapped.vmIP, mapped.mappings); err != nil {
+			errs = append(errs, fmt.Errorf("remove port mappings: %w", err))
+		}
+		for _, portRange := range mapped.ranges {
+			if err := RemoveRangePortMapping(mapped.vmIP, portRange); err != nil {
+				errs = append(errs, fmt.Errorf("remove port range: %w", err))
+			}
+		}
+	}
+
+	if len(ports) > 0 {
+		if err := m.hostPortPool.ReleasePorts(ports, vmID); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	// ports allocated later on by AllocatePortRange
+	if rest := m.hostPortPool.portsOf(vmID); len(rest) > 0 {
+		if err := m.hostPortPool.ReleasePorts(rest, vmID); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if ip != nil {
+		if err := m.ipPool.ReleaseIP(&ip, vmID); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := m.macPool.ReleaseMAC(vmID); err != nil && !errors.Is(err, ErrMACNotAllocated) {
+		errs = append(errs, err)
+	}
+
+	if m.db != nil {
+		if err := deleteAllocation(ctx, m.db, vmID); err != nil {
+			errs = append(errs, fmt.Errorf("delete network allocation: %w", err))
+		}
+	}
+
+	return errs
+}
+
+// TAP operations of SetupVM and TeardownVM, overridden in tests
+var (
+	createTAP  = CreateTAP
+	destroyTAP = DestroyTAP
+)
+
+// SetupVM does all network setup of a VM: it ensures the bridge and NAT, allocates
+// an IP, a host port per guest port and the MAC, creates the TAP device and forwards
+// each host port to its guest port. guestPorts are the ports the VM exposes, their
+// HostPort is ignored, see vm.VMConfig.GuestPorts. The TAP device is owned by
+// tapOwner, see vm.VMConfig.TAPOwner. The returned config is ready for
+// VMConfig.Network. On failure everything set up so far is undone.
+func (m *NetworkManager) SetupVM(ctx context.Context, vmID string, guestPorts []PortMapping, tapOwner TAPOwner) (*NetworkConfig, error) {
+	if err := validateProtocols(guestPorts); err != nil {
+		return nil, err
+	}
+	if err := m.ensureInitialized(); err != nil {
+		return nil, err
+	}
+
+	ip, ports, err := m.AllocateVMNetwork(ctx, vmID, len(guestPorts))
+	if err != nil {
+		return nil, fmt.Errorf("allocate network of VM %s: %w", vmID, err)
+	}
+
+	// an existing TAP of the same name is not ours to destroy
+	tapName, err := createTAP(vmID, m.opts.BridgeName, tapOwner)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("create TAP of VM %s: %w", vmID, err), m.ReleaseVMNetwork(ctx, vmID, ip, ports))
+	}
+
+	mappings := make([]PortMapping, len(ports))
+	for i, port := range ports {
+		mappings[i] = PortMapping{HostPort: port, GuestPort: guestPorts[i].GuestPort, Protocol: guestPorts[i].Protocol}
+	}
+	if err := m.MapPorts(ctx, vmID, ip, mappings); err != nil {
+		// MapPorts may fail after some of the rules were added
+		return nil, errors.Join(fmt.Errorf("map ports of VM %s: %w", vmID, err),
+			RemovePortMappings(ip.String(), mappings), destroyTAP(tapName), m.ReleaseVMNetwork(ctx, vmID, ip, ports))
+	}
+
+	return &NetworkConfig{
+		VMID:        vmID,
+		PortMapping: mappings,
+		TAPDevice:   tapName,
+		IPAddress:   ip.String(),
+		MACAddress:  GenerateMAC(vmID),
+		Gateway:     m.opts.BridgeIP,
+		Netmask:     m.opts.SubnetMask(),
+		DNS:         m.opts.BridgeIP,
+	}, nil
+}
+
+// TeardownVM undoes all network setup of a VM: it removes its DNAT rules and its
+// TAP device, returns its IP, ports and MAC to the pools and deletes the persisted
+// allocation. Resources the VM never got are skipped, so it is safe to call for a
+// VM that crashed mid-setup. A failed step doesn't stop the others, the errors of
+// all failed steps are joined.
+func (m *NetworkManager) TeardownVM(vmID string) error {
+	// free pool entries are stored with an empty vmID
+	if len(vmID) == 0 {
+		return errors.New("teardown network: empty VM ID")
+	}
+
+	var errs []error
+	if err := destroyTAP(GenerateTAPName(vmID)); err != nil {
+		errs = append(errs, err)
+	}
+
+	ip, _ := m.ipPool.ipOf(vmID)
+	errs = append(errs, m.releaseAllocation(context.Background(), vmID, ip, m.hostPortPool.portsOf(vmID))...)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("teardown network of VM %s: %w", vmID, errors.Join(errs...))
+	}
+	return nil
+}
+
+// Restore rehydrates the pools and port mappings from the persisted allocations
+// and keeps persisting to db from now on. Allocations of VMs without a crutch or
+// whose firecracker process is gone are deleted instead of restored.
+func (m *NetworkManager) Restore(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT a.vm_id, a.ip, a.host_ports, a.port_mappings, a.port_ranges, c.pid
+		FROM network_allocations a LEFT JOIN crutches c ON c.id = a.vm_id
+	`)
+	if err != nil {
+		return fmt.Errorf("read network allocations: %w", err)
+	}
+
+	type allocation struct {
+		vmID     string
+		ip       string
+		ports    []int
+		mappings []PortMapping
+		ranges   []PortRange
+		alive    bool
+	}
+	var allocations []allocation
+	for rows.Next() {
+		var a allocation
+		var hostPorts, portMappings, portRanges string
+		var pid sql.NullInt64
+		if err := rows.Scan(&a.vmID, &a.ip, &hostPorts, &portMappings, &portRanges, &pid); err != nil {
+			rows.Close()
+			return fmt.Errorf("read network allocations: %w", err)
+		}
+		a.ports, err = parsePorts(hostPorts)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("network allocation of %s: %w", a.vmID, err)
+		}
+		a.mappings, err = parsePortMappings(portMappings)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("network allocation of %s: %w", a.vmID, err)
+		}
+		a.ranges, err = parsePortRanges(portRanges)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("network allocation of %s: %w", a.vmID, err)
+		}
+		a.alive = pid.Valid && pid.Int64 > 0 && processAlive(int(pid.Int64))
+		allocations = append(allocations, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("read network allocations: %w", err)
+	}
+
+	for _, a := range allocations {
+		if !a.alive {
+			if err := deleteAllocation(ctx, db, a.vmID); err != nil {
+				return fmt.Errorf("delete stale network allocation: %w", err)
+			}
+			continue
+		}
+
+		if _, err := m.macPool.AllocateMAC(a.vmID); err != nil {
+			return fmt.Errorf("restore network allocation of %s: %w", a.vmID, err)
+		}
+		if err := m.ipPool.reserveIP(a.ip, a.vmID); err != nil {
+			return fmt.Errorf("restore network allocation of %s: %w", a.vmID, err)
+		}
+		if err := m.hostPortPool.reservePorts(a.ports, a.vmID); err != nil {
+			return fmt.Errorf("restore network allocation of %s: %w", a.vmID, err)
+		}
+		if len(a.mappings) > 0 || len(a.ranges) > 0 {
+			m.mu.Lock()
+			m.portMappings[a.vmID] = vmPortMappings{vmIP: a.ip, mappings: a.mappings, ranges: a.ranges}
+			m.mu.Unlock()
+		}
+	}
+
+	m.db = db
+	return nil
+}
+
+func saveAllocation(ctx context.Context, db *sql.DB, vmID, ip string, ports []int) error {
+	_, err := db.ExecContext(ctx,
+		`INSERT INTO network_allocations (vm_id, ip, host_ports) VALUES (?, ?, ?)`,
+		vmID, ip, formatPorts(ports))
+	return err
+}
+
+func deleteAllocation(ctx context.Context, db *sql.DB, vmID string) error {
+	_, err := db.ExecContext(ctx, `DELETE FROM network_allocations WHERE vm_id = ?`, vmID)
+	return err
+}
+
+func formatPorts(ports []int) string {
+	parts := make([]string, len(ports))
+	for i, port := range ports {
+		parts[i] = strconv.Itoa(port)
+	}
+	return strings.Join(parts, ",")
+}
+
+func parsePorts(s string) ([]int, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+
+	var ports []int
+	for part := range strings.SplitSeq(s, ",") {
+		port, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host port %q", part)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// formatPortMappings stores mappings as "hostPort:guestPort/protocol" separated by commas
+func formatPortMappings(mappings []PortMapping) string {
+	parts := make([]string, len(mappings))
+	for i, mapping := range mappings {
+		parts[i] = fmt.Sprintf("%d:%d/%s", mapping.HostPort, mapping.GuestPort, mapping.Protocol)
+	}
+	return strings.Join(parts, ",")
+}
+
+func parsePortMappings(s string) ([]PortMapping, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+
+	var mappings []PortMapping
+	for part := range strings.SplitSeq(s, ",") {
+		ports, protocol, _ := strings.Cut(part, "/")
+		hostPort, guestPort, _ := strings.Cut(ports, ":")
+
+		mapping := PortMapping{Protocol: protocol}
+		var errHost, errGuest error
+		mapping.HostPort, errHost = strconv.Atoi(hostPort)
+		mapping.GuestPort, errGuest = strconv.Atoi(guestPort)
+		if errHost != nil || errGuest != nil || len(protocol) == 0 {
+			return nil, fmt.Errorf("invalid port mapping %q", part)
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings, nil
+}
+
+// formatPortRanges stores ranges as "first-last/protocol" separated by commas
+func formatPortRanges(ranges []PortRange) string {
+	parts := make([]string, len(ranges))
+	for i, portRange := range ranges {
+		parts[i] = fmt.Sprintf("%d-%d/%s", portRange.First, portRange.Last, portRange.Protocol)
+	}
+	return strings.Join(parts, ",")
+}
+
+func parsePortRanges(s string) ([]PortRange, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+
+	var ranges []PortRange
+	for part := range strings.SplitSeq(s, ",") {
+		ports, protocol, _ := strings.Cut(part, "/")
+		first, last, _ := strings.Cut(ports, "-")
+
+		portRange := PortRange{Protocol: protocol}
+		var errFirst, errLast error
+		portRange.First, errFirst = strconv.Atoi(first)
+		portRange.Last, errLast = strconv.Atoi(last)
+		if errFirst != nil || errLast != nil || len(protocol) == 0 {
+			return nil, fmt.Errorf("invalid port range %q", part)
+		}
+		ranges = append(ranges, portRange)
+	}
+	return ranges, nil
+}
+
+func processAlive(pid int) bool {
+	err := unix.Kill(pid, 0)
+	return err == nil || errors.Is(err, unix.EPERM)
+}
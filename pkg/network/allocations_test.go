@@ -0,0 +1,613 @@
+package network
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/maxdollinger/walk.io/internal/db/dbtest"
+)
+
+func newTestManager(t *testing.T) *NetworkManager {
+	t.Helper()
+
+	ipPool, err := NewIPPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	portPool, err := NewHostPortPool(HostPortPoolStart, HostPortPoolEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &NetworkManager{
+		opts:         DefaultOptions(),
+		ipPool:       ipPool,
+		hostPortPool: portPool,
+		macPool:      NewMACPool(),
+		portMappings: make(map[string]vmPortMappings),
+	}
+}
+
+func insertCrutch(t *testing.T, walkDB *sql.DB, vmID string, pid int) {
+	t.Helper()
+
+	// crutches reference their app
+	_, err := walkDB.Exec(`INSERT OR IGNORE INTO apps (id, digest, base_version) VALUES ('app-1', 'sha256:abc', 'v0.1.1')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = walkDB.Exec(`INSERT INTO crutches (id, app_id, pid, socket_path) VALUES (?, 'app-1', ?, '/vm.sock')`, vmID, pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreNetworkAllocations(t *testing.T) {
+	ctx := context.Background()
+	walkDB := dbtest.NewDB(t)
+
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("cannot run true: %v", err)
+	}
+	deadPID := cmd.Process.Pid
+
+	// allocations made before the restart
+	before := newTestManager(t)
+	if err := before.Restore(ctx, walkDB); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	liveIP, livePorts, err := before.AllocateVMNetwork(ctx, "vm-live", 2)
+	if err != nil {
+		t.Fatalf("AllocateVMNetwork failed: %v", err)
+	}
+	deadIP, deadPorts, err := before.AllocateVMNetwork(ctx, "vm-dead", 1)
+	if err != nil {
+		t.Fatalf("AllocateVMNetwork failed: %v", err)
+	}
+	orphanIP, _, err := before.AllocateVMNetwork(ctx, "vm-without-crutch", 0)
+	if err != nil {
+		t.Fatalf("AllocateVMNetwork failed: %v", err)
+	}
+	insertCrutch(t, walkDB, "vm-live", os.Getpid())
+	insertCrutch(t, walkDB, "vm-dead", deadPID)
+
+	after := newTestManager(t)
+	if err := after.Restore(ctx, walkDB); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	if !after.ipPool.IsAllocated(&liveIP) {
+		t.Errorf("IP %s of live VM not restored", liveIP)
+	}
+	for _, port := range livePorts {
+		if !after.hostPortPool.IsAllocated(port) {
+			t.Errorf("port %d of live VM not restored", port)
+		}
+	}
+
+	for _, ip := range []net.IP{deadIP, orphanIP} {
+		if after.ipPool.IsAllocated(&ip) {
+			t.Errorf("IP %s of a gone VM restored", ip)
+		}
+	}
+	if after.hostPortPool.IsAllocated(deadPorts[0]) {
+		t.Errorf("port %d of dead VM restored", deadPorts[0])
+	}
+
+	var vmIDs []string
+	rows, err := walkDB.Query(`SELECT vm_id FROM network_allocations`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var vmID string
+		if err := rows.Scan(&vmID); err != nil {
+			t.Fatal(err)
+		}
+		vmIDs = append(vmIDs, vmID)
+	}
+	if !slices.Equal(vmIDs, []string{"vm-live"}) {
+		t.Errorf("persisted allocations = %v, want only vm-live", vmIDs)
+	}
+}
+
+func TestReleaseVMNetworkDeletesAllocation(t *testing.T) {
+	ctx := context.Background()
+	walkDB := dbtest.NewDB(t)
+
+	manager := newTestManager(t)
+	if err := manager.Restore(ctx, walkDB); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	ip, ports, err := manager.AllocateVMNetwork(ctx, "vm-1", 1)
+	if err != nil {
+		t.Fatalf("AllocateVMNetwork failed: %v", err)
+	}
+	if err := manager.ReleaseVMNetwork(ctx, "vm-1", ip, ports); err != nil {
+		t.Fatalf("ReleaseVMNetwork failed: %v", err)
+	}
+
+	var count int
+	if err := walkDB.QueryRow(`SELECT COUNT(*) FROM network_allocations`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("%d allocations left after release", count)
+	}
+	if manager.ipPool.IsAllocated(&ip) {
+		t.Errorf("IP %s still allocated", ip)
+	}
+}
+
+func TestRestoreSpecificIPAndPortRange(t *testing.T) {
+	ctx := context.Background()
+	walkDB := dbtest.NewDB(t)
+
+	before := newTestManager(t)
+	if err := before.Restore(ctx, walkDB); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if _, err := before.AllocatePortRange(ctx, "vm-1", 2); !errors.Is(err, ErrIPNotAllocated) {
+		t.Fatalf("AllocatePortRange without allocation = %v, want %v", err, ErrIPNotAllocated)
+	}
+
+	ip := net.ParseIP(IPPoolEnd).To4()
+	ports, err := before.AllocateVMNetworkWithIP(ctx, "vm-1", ip, 1)
+	if err != nil {
+		t.Fatalf("AllocateVMNetworkWithIP failed: %v", err)
+	}
+	rangePorts, err := before.AllocatePortRange(ctx, "vm-1", 3)
+	if err != nil {
+		t.Fatalf("AllocatePortRange failed: %v", err)
+	}
+	insertCrutch(t, walkDB, "vm-1", os.Getpid())
+
+	after := newTestManager(t)
+	if err := after.Restore(ctx, walkDB); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if restored, ok := after.ipPool.ipOf("vm-1"); !ok || !restored.Equal(ip) {
+		t.Errorf("restored IP = %v, want %s", restored, ip)
+	}
+	allPorts := append(slices.Clone(ports), rangePorts...)
+	for _, port := range allPorts {
+		if !after.hostPortPool.IsAllocated(port) {
+			t.Errorf("port %d not restored", port)
+		}
+	}
+
+	if err := after.ReleaseVMNetwork(ctx, "vm-1", ip, ports); err != nil {
+		t.Fatalf("ReleaseVMNetwork failed: %v", err)
+	}
+	for _, port := range allPorts {
+		if after.hostPortPool.IsAllocated(port) {
+			t.Errorf("port %d still allocated after release", port)
+		}
+	}
+}
+
+func TestReleaseVMNetworkContinuesAfterFailure(t *testing.T) {
+	ctx := context.Background()
+	walkDB := dbtest.NewDB(t)
+
+	manager := newTestManager(t)
+	if err := manager.Restore(ctx, walkDB); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	ip, _, err := manager.AllocateVMNetwork(ctx, "vm-1", 1)
+	if err != nil {
+		t.Fatalf("AllocateVMNetwork failed: %v", err)
+	}
+
+	// a port outside the pool fails, the rest is released anyway
+	if err := manager.ReleaseVMNetwork(ctx, "vm-1", ip, []int{HostPortPoolEnd + 1}); err == nil {
+		t.Error("ReleaseVMNetwork of a port outside the pool succeeded")
+	}
+	if manager.ipPool.IsAllocated(&ip) {
+		t.Errorf("IP %s still allocated", ip)
+	}
+	var count int
+	if err := walkDB.QueryRow(`SELECT COUNT(*) FROM network_allocations`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("%d allocations left after release", count)
+	}
+}
+
+func TestEnsureInfrastructureRestoresRules(t *testing.T) {
+	ctx := context.Background()
+	walkDB := dbtest.NewDB(t)
+	fake := newFakeIPTables(t)
+
+	forwardFile := filepath.Join(t.TempDir(), "ip_forward")
+	if err := os.WriteFile(forwardFile, []byte("0\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	originalForward, originalBridge := ipForwardPath, ensureBridge
+	t.Cleanup(func() { ipForwardPath, ensureBridge = originalForward, originalBridge })
+	ipForwardPath = forwardFile
+	bridgeCalls := 0
+	ensureBridge = func(Options) error { bridgeCalls++; return nil }
+	stubResolvConf(t, "9.9.9.9")
+
+	before := newTestManager(t)
+	if err := before.Restore(ctx, walkDB); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	ip, ports, err := before.AllocateVMNetwork(ctx, "vm-live", 2)
+	if err != nil {
+		t.Fatalf("AllocateVMNetwork failed: %v", err)
+	}
+	mappings := []PortMapping{
+		{HostPort: ports[0], GuestPort: 80, Protocol: "tcp"},
+		{HostPort: ports[1], GuestPort: 53, Protocol: "udp"},
+	}
+	if err := before.MapPorts(ctx, "vm-live", ip, mappings); err != nil {
+		t.Fatalf("MapPorts failed: %v", err)
+	}
+	portRange := PortRange{First: 41000, Last: 41009, Protocol: "tcp"}
+	if err := before.MapPortRange(ctx, "vm-live", ip, portRange); err != nil {
+		t.Fatalf("MapPortRange failed: %v", err)
+	}
+	insertCrutch(t, walkDB, "vm-live", os.Getpid())
+
+	// reboot: iptables is empty and the manager starts from the database
+	fake.rules = make(map[string][]string)
+	after := newTestManager(t)
+	if err := after.Restore(ctx, walkDB); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	for range 2 {
+		if err := after.EnsureInfrastructure(); err != nil {
+			t.Fatalf("EnsureInfrastructure failed: %v", err)
+		}
+	}
+
+	if bridgeCalls != 2 || !after.bridgeInitialized {
+		t.Errorf("bridge ensured %d times (initialized %v), want 2", bridgeCalls, after.bridgeInitialized)
+	}
+	if data, _ := os.ReadFile(forwardFile); string(data) != "1" {
+		t.Errorf("ip_forward = %q, want 1", data)
+	}
+
+	dnsRules := []string{
+		"-A PREROUTING -d 172.16.0.1/32 -p udp --dport 53 -j DNAT --to-destination 9.9.9.9:53",
+		"-A PREROUTING -d 172.16.0.1/32 -p tcp --dport 53 -j DNAT --to-destination 9.9.9.9:53",
+	}
+	want := map[string][]string{
+		"nat/POSTROUTING": {"-A POSTROUTING -s 172.16.0.0/24 -j MASQUERADE"},
+		"filter/FORWARD": {
+			"-A FORWARD -i walkio-br0 -j ACCEPT",
+			"-A FORWARD -o walkio-br0 -j ACCEPT",
+		},
+		"nat/PREROUTING": append([]string{
+			fake.ruleString("PREROUTING", dnatRuleSpec(ip.String(), mappings[0])),
+			fake.ruleString("PREROUTING", dnatRuleSpec(ip.String(), mappings[1])),
+			fake.ruleString("PREROUTING", dnatRangeRuleSpec(ip.String(), portRange)),
+		}, dnsRules...),
+	}
+	for chain, rules := range want {
+		got := slices.Clone(fake.rules[chain])
+		slices.Sort(got)
+		slices.Sort(rules)
+		if !slices.Equal(got, rules) {
+			t.Errorf("%s rules = %v, want %v", chain, got, rules)
+		}
+	}
+
+	if err := after.ReleaseVMNetwork(ctx, "vm-live", ip, ports); err != nil {
+		t.Fatalf("ReleaseVMNetwork failed: %v", err)
+	}
+	if got := fake.rules["nat/PREROUTING"]; !slices.Equal(got, dnsRules) {
+		t.Errorf("rules after release = %v, want only the DNS redirects %v", got, dnsRules)
+	}
+}
+
+func TestEnsureInitializedOnce(t *testing.T) {
+	newFakeIPTables(t)
+	stubResolvConf(t, "9.9.9.9")
+
+	forwardFile := filepath.Join(t.TempDir(), "ip_forward")
+	if err := os.WriteFile(forwardFile, []byte("1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	originalForward, originalBridge := ipForwardPath, ensureBridge
+	t.Cleanup(func() { ipForwardPath, ensureBridge = originalForward, originalBridge })
+	ipForwardPath = forwardFile
+	bridgeCalls := 0
+	ensureBridge = func(Options) error { bridgeCalls++; return nil }
+
+	manager := newTestManager(t)
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Go(func() {
+			if err := manager.ensureInitialized(); err != nil {
+				t.Errorf("ensureInitialized failed: %v", err)
+			}
+		})
+	}
+	wg.Wait()
+
+	if bridgeCalls != 1 {
+		t.Errorf("infrastructure ensured %d times, want once", bridgeCalls)
+	}
+}
+
+func TestPortMappingsFormat(t *testing.T) {
+	mappings := []PortMapping{
+		{HostPort: 40000, GuestPort: 80, Protocol: "tcp"},
+		{HostPort: 40001, GuestPort: 53, Protocol: "udp"},
+	}
+
+	formatted := formatPortMappings(mappings)
+	if formatted != "40000:80/tcp,40001:53/udp" {
+		t.Errorf("formatPortMappings() = %q", formatted)
+	}
+
+	parsed, err := parsePortMappings(formatted)
+	if err != nil || !slices.Equal(parsed, mappings) {
+		t.Errorf("parsePortMappings(%q) = %v, %v, want %v", formatted, parsed, err, mappings)
+	}
+
+	for _, invalid := range []string{"40000", "40000:80", "x:80/tcp", "40000:y/udp"} {
+		if _, err := parsePortMappings(invalid); err == nil {
+			t.Errorf("parsePortMappings(%q) accepted an invalid mapping", invalid)
+		}
+	}
+}
+
+func TestPortRangesFormat(t *testing.T) {
+	ranges := []PortRange{{First: 40000, Last: 40009, Protocol: "tcp"}, {First: 41000, Last: 41000, Protocol: "udp"}}
+
+	formatted := formatPortRanges(ranges)
+	if formatted != "40000-40009/tcp,41000-41000/udp" {
+		t.Errorf("formatPortRanges() = %q", formatted)
+	}
+
+	parsed, err := parsePortRanges(formatted)
+	if err != nil || !slices.Equal(parsed, ranges) {
+		t.Errorf("parsePortRanges(%q) = %v, %v, want %v", formatted, parsed, err, ranges)
+	}
+
+	for _, invalid := range []string{"40000", "40000-40009", "x-40009/tcp", "40000-y/udp"} {
+		if _, err := parsePortRanges(invalid); err == nil {
+			t.Errorf("parsePortRanges(%q) accepted an invalid range", invalid)
+		}
+	}
+}
+
+func TestTeardownVMContinuesAfterFailure(t *testing.T) {
+	ctx := context.Background()
+	walkDB := dbtest.NewDB(t)
+	fake := newFakeIPTables(t)
+
+	original := destroyTAP
+	t.Cleanup(func() { destroyTAP = original })
+	var destroyed []string
+	tapErr := errors.New("tap busy")
+	destroyTAP = func(name string) error {
+		destroyed = append(destroyed, name)
+		return tapErr
+	}
+
+	manager := newTestManager(t)
+	if err := manager.Restore(ctx, walkDB); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	ip, ports, err := manager.AllocateVMNetwork(ctx, "vm-1", 2)
+	if err != nil {
+		t.Fatalf("AllocateVMNetwork failed: %v", err)
+	}
+	mappings := []PortMapping{{HostPort: ports[0], GuestPort: 80, Protocol: "tcp"}}
+	if err := manager.MapPorts(ctx, "vm-1", ip, mappings); err != nil {
+		t.Fatalf("MapPorts failed: %v", err)
+	}
+
+	err = manager.TeardownVM("vm-1")
+	if !errors.Is(err, tapErr) {
+		t.Errorf("TeardownVM error = %v, want %v", err, tapErr)
+	}
+
+	if !slices.Equal(destroyed, []string{GenerateTAPName("vm-1")}) {
+		t.Errorf("destroyed TAPs = %v, want the TAP of vm-1", destroyed)
+	}
+	if got := fake.rules["nat/PREROUTING"]; len(got) != 0 {
+		t.Errorf("port mappings left after teardown: %v", got)
+	}
+	if manager.ipPool.IsAllocated(&ip) {
+		t.Errorf("IP %s still allocated", ip)
+	}
+	for _, port := range ports {
+		if manager.hostPortPool.IsAllocated(port) {
+			t.Errorf("port %d still allocated", port)
+		}
+	}
+	if _, err := manager.macPool.AllocateMAC("vm-1"); err != nil {
+		t.Errorf("MAC of vm-1 not released: %v", err)
+	}
+
+	var count int
+	if err := walkDB.QueryRow(`SELECT COUNT(*) FROM network_allocations`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("%d allocations left after teardown", count)
+	}
+}
+
+func TestTeardownVMPartialSetup(t *testing.T) {
+	original := destroyTAP
+	t.Cleanup(func() { destroyTAP = original })
+	destroyTAP = func(string) error { return nil }
+
+	// crashed after the IP was allocated, before ports, TAP and mappings
+	manager := newTestManager(t)
+	if _, err := manager.macPool.AllocateMAC("vm-1"); err != nil {
+		t.Fatal(err)
+	}
+	ip, err := manager.ipPool.AllocateIP("vm-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := manager.ipPool.AllocateIP("vm-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := manager.TeardownVM("vm-1"); err != nil {
+		t.Fatalf("TeardownVM failed: %v", err)
+	}
+	if manager.ipPool.IsAllocated(&ip) {
+		t.Errorf("IP %s still allocated", ip)
+	}
+	if !manager.ipPool.IsAllocated(&other) {
+		t.Errorf("IP %s of another VM released", other)
+	}
+
+	if err := manager.TeardownVM(""); err == nil {
+		t.Error("TeardownVM of an empty VM ID succeeded")
+	}
+}
+
+func TestSetupVM(t *testing.T) {
+	ctx := context.Background()
+	walkDB := dbtest.NewDB(t)
+	fake := newFakeIPTables(t)
+
+	forwardFile := filepath.Join(t.TempDir(), "ip_forward")
+	if err := os.WriteFile(forwardFile, []byte("0\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	originalForward, originalBridge, originalCreate := ipForwardPath, ensureBridge, createTAP
+	t.Cleanup(func() { ipForwardPath, ensureBridge, createTAP = originalForward, originalBridge, originalCreate })
+	ipForwardPath = forwardFile
+	bridgeCalls := 0
+	ensureBridge = func(Options) error { bridgeCalls++; return nil }
+	createTAP = func(vmID, bridgeName string, owner TAPOwner) (string, error) {
+		if bridgeName != BridgeName {
+			t.Errorf("TAP attached to %s, want %s", bridgeName, BridgeName)
+		}
+		if owner != (TAPOwner{UID: 1000, GID: 1000}) {
+			t.Errorf("TAP owned by %+v, want the jailed user 1000:1000", owner)
+		}
+		return GenerateTAPName(vmID), nil
+	}
+	stubResolvConf(t, "9.9.9.9")
+
+	manager := newTestManager(t)
+	if err := manager.Restore(ctx, walkDB); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	guestPorts := []PortMapping{{GuestPort: 80, Protocol: "tcp"}, {GuestPort: 53, Protocol: "udp"}}
+	var configs []*NetworkConfig
+	for _, vmID := range []string{"vm-1", "vm-2"} {
+		config, err := manager.SetupVM(ctx, vmID, guestPorts, TAPOwner{UID: 1000, GID: 1000})
+		if err != nil {
+			t.Fatalf("SetupVM(%s) failed: %v", vmID, err)
+		}
+		if err := config.Validate(); err != nil {
+			t.Errorf("config of %s is invalid: %v", vmID, err)
+		}
+		configs = append(configs, config)
+	}
+	if bridgeCalls != 1 {
+		t.Errorf("infrastructure ensured %d times, want once", bridgeCalls)
+	}
+
+	config := configs[0]
+	if config.VMID != "vm-1" || config.TAPDevice != GenerateTAPName("vm-1") || config.MACAddress != GenerateMAC("vm-1") {
+		t.Errorf("config = %+v, want the TAP and MAC of vm-1", config)
+	}
+	if config.Gateway != BridgeIP || config.DNS != BridgeIP || config.Netmask != SubnetMask {
+		t.Errorf("gateway %s, dns %s, netmask %s, want the bridge", config.Gateway, config.DNS, config.Netmask)
+	}
+	if len(config.PortMapping) != 2 {
+		t.Fatalf("%d port mappings, want 2", len(config.PortMapping))
+	}
+
+	// the bridge IP only answers DNS through the redirect to the host nameserver
+	rules := []string{
+		"-A PREROUTING -d 172.16.0.1/32 -p udp --dport 53 -j DNAT --to-destination 9.9.9.9:53",
+		"-A PREROUTING -d 172.16.0.1/32 -p tcp --dport 53 -j DNAT --to-destination 9.9.9.9:53",
+	}
+	for i, mapping := range config.PortMapping {
+		if mapping.GuestPort != guestPorts[i].GuestPort || mapping.Protocol != guestPorts[i].Protocol {
+			t.Errorf("mapping %+v, want guest port %+v", mapping, guestPorts[i])
+		}
+		rules = append(rules, fake.ruleString("PREROUTING", dnatRuleSpec(config.IPAddress, mapping)))
+	}
+	if got := fake.rules["nat/PREROUTING"][:4]; !slices.Equal(got, rules) {
+		t.Errorf("rules = %v, want %v", got, rules)
+	}
+
+	var stored string
+	if err := walkDB.QueryRow(`SELECT port_mappings FROM network_allocations WHERE vm_id = 'vm-1'`).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != formatPortMappings(config.PortMapping) {
+		t.Errorf("stored mappings = %q, want %q", stored, formatPortMappings(config.PortMapping))
+	}
+}
+
+func TestSetupVMRollsBackOnFailure(t *testing.T) {
+	ctx := context.Background()
+	walkDB := dbtest.NewDB(t)
+	fake := newFakeIPTables(t)
+
+	originalCreate, originalDestroy := createTAP, destroyTAP
+	t.Cleanup(func() { createTAP, destroyTAP = originalCreate, originalDestroy })
+	tapErr := errors.New("tap exists")
+	createTAP = func(string, string, TAPOwner) (string, error) { return "", tapErr }
+	destroyTAP = func(name string) error {
+		t.Errorf("destroyed TAP %s that SetupVM didn't create", name)
+		return nil
+	}
+
+	manager := newTestManager(t)
+	manager.bridgeInitialized = true
+	if err := manager.Restore(ctx, walkDB); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+
+	if _, err := manager.SetupVM(ctx, "vm-1", []PortMapping{{GuestPort: 80, Protocol: "tcp"}}, TAPOwner{}); !errors.Is(err, tapErr) {
+		t.Fatalf("SetupVM error = %v, want %v", err, tapErr)
+	}
+	if _, err := manager.SetupVM(ctx, "vm-1", []PortMapping{{GuestPort: 80, Protocol: "sctp"}}, TAPOwner{}); !errors.Is(err, ErrInvalidProtocol) {
+		t.Fatalf("SetupVM error = %v, want %v", err, ErrInvalidProtocol)
+	}
+
+	if ip, ok := manager.ipPool.ipOf("vm-1"); ok {
+		t.Errorf("IP %s still allocated", ip)
+	}
+	if ports := manager.hostPortPool.portsOf("vm-1"); len(ports) > 0 {
+		t.Errorf("ports %v still allocated", ports)
+	}
+	if _, err := manager.macPool.AllocateMAC("vm-1"); err != nil {
+		t.Errorf("MAC of vm-1 not released: %v", err)
+	}
+	if got := fake.rules["nat/PREROUTING"]; len(got) != 0 {
+		t.Errorf("port mappings installed: %v", got)
+	}
+
+	var count int
+	if err := walkDB.QueryRow(`SELECT COUNT(*) FROM network_allocations`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("%d allocations left after the failed setup", count)
+	}
+}
@@ -2,20 +2,24 @@ package network
 
 import (
 	"fmt"
-	"net"
 
 	"github.com/vishvananda/netlink"
 )
 
 // EnsureBridge creates the walkio bridge if it doesn't exist and configures its IP address.
 // This is idempotent - safe to call multiple times.
-func EnsureBridge() error {
+func EnsureBridge(opts Options) error {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return err
+	}
+
 	// Check if bridge already exists
-	bridge, ok := GetWalkioBridge()
+	bridge, ok := GetWalkioBridge(opts.BridgeName)
 	if !ok {
 		// Bridge doesn't exist, create it
 		la := netlink.NewLinkAttrs()
-		la.Name = BridgeName
+		la.Name = opts.BridgeName
 		bridge = &netlink.Bridge{LinkAttrs: la}
 
 		if err := netlink.LinkAdd(bridge); err != nil {
@@ -24,13 +28,13 @@ func EnsureBridge() error {
 	}
 
 	// Ensure it's up and has correct IP
-	return configureBridge(bridge)
+	return configureBridge(bridge, opts.bridgeAddr())
 }
 
-// configureBridge sets the IP address and brings the bridge up.
-func configureBridge(bridge *netlink.Bridge) error {
+// configureBridge sets the IP address (e.g. 172.16.0.1/24) and brings the bridge up.
+func configureBridge(bridge *netlink.Bridge, bridgeAddr string) error {
 	// Parse and add IP address
-	addr, err := netlink.ParseAddr(BridgeIP + "/24")
+	addr, err := netlink.ParseAddr(bridgeAddr)
 	if err != nil {
 		return fmt.Errorf("failed to parse bridge IP: %w", err)
 	}
@@ -64,9 +68,9 @@ func configureBridge(bridge *netlink.Bridge) error {
 	return nil
 }
 
-// GetWalkioBridge checks if the walkio bridge exists.
-func GetWalkioBridge() (*netlink.Bridge, bool) {
-	link, err := netlink.LinkByName(BridgeName)
+// GetWalkioBridge checks if the walkio bridge with the given name exists.
+func GetWalkioBridge(name string) (*netlink.Bridge, bool) {
+	link, err := netlink.LinkByName(name)
 	if err != nil {
 		return nil, false
 	}
@@ -81,8 +85,13 @@ func GetWalkioBridge() (*netlink.Bridge, bool) {
 
 // DestroyBridge removes the walkio bridge.
 // This will fail if any TAP devices are still attached.
-func DestroyBridge() error {
-	bridge, ok := GetWalkioBridge()
+func DestroyBridge(opts Options) error {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return err
+	}
+
+	bridge, ok := GetWalkioBridge(opts.BridgeName)
 	if !ok {
 		return nil
 	}
@@ -93,8 +102,3 @@ func DestroyBridge() error {
 
 	return nil
 }
-
-// GetBridgeIP returns the bridge IP address as a net.IP.
-func GetBridgeIP() net.IP {
-	return net.ParseIP(BridgeIP)
-}
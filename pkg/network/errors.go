@@ -7,6 +7,11 @@ var (
 	ErrIPPoolExhausted = errors.New("no available IP addresses in pool")
 	ErrIPNotAllocated  = errors.New("IP address is not currently allocated")
 	ErrIPAlreadyInUse  = errors.New("IP address is already in use")
+	ErrIPNotInPool     = errors.New("IP address is not in the pool")
+
+	// MAC errors
+	ErrMACAlreadyInUse = errors.New("MAC address is already in use")
+	ErrMACNotAllocated = errors.New("MAC address is not currently allocated")
 
 	// Port pool errors
 	ErrPortPoolExhausted = errors.New("no available ports in pool")
@@ -14,6 +19,7 @@ var (
 	// Port mapping errors
 	ErrHostPortInUse   = errors.New("host port is already in use")
 	ErrInvalidPort     = errors.New("invalid port number (must be 1-65535)")
+	ErrInvalidProtocol = errors.New("invalid port mapping protocol (must be tcp or udp)")
 	ErrMappingNotFound = errors.New("port mapping not found")
 
 	// Bridge errors
@@ -28,6 +34,7 @@ var (
 	// NAT/iptables errors
 	ErrNATSetupFailed     = errors.New("failed to setup NAT rules")
 	ErrForwardingDisabled = errors.New("IP forwarding is disabled")
+	ErrNoUpstreamDNS      = errors.New("no usable IPv4 nameserver")
 
 	// Permission errors
 	ErrNeedRoot = errors.New("operation requires root privileges")
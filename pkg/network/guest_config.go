@@ -0,0 +1,178 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// GuestInterface is the name of the guest NIC in the boot arg and MMDS metadata
+const GuestInterface = "eth0"
+
+// MMDSKey is the key of the network metadata in the MMDS payload of a VM
+const MMDSKey = "network"
+
+var ErrInvalidNetworkConfig = errors.New("invalid network config")
+
+// guestNetwork is the MMDS view of a NetworkConfig. TAP device and allocation ID
+// are host-side names and stay on the host.
+type guestNetwork struct {
+	Interface   string        `json:"interface"`
+	IPAddress   string        `json:"ipAddress"`
+	MACAddress  string        `json:"macAddress"`
+	Gateway     string        `json:"gateway,omitempty"`
+	Netmask     string        `json:"netmask"`
+	DNS         string        `json:"dns,omitempty"`
+	PortMapping []portMapping `json:"portMapping,omitempty"`
+}
+
+type portMapping struct {
+	HostPort  int    `json:"hostPort"`
+	GuestPort int    `json:"guestPort"`
+	Protocol  string `json:"protocol"`
+}
+
+// Validate checks the guest facing fields: IP and MAC are required, gateway and
+// DNS are optional IPv4 addresses, the gateway has to be inside the subnet of
+// the IP and port mappings need valid ports and protocols
+func (c *NetworkConfig) Validate() error {
+	if _, err := net.ParseMAC(c.MACAddress); err != nil {
+		return fmt.Errorf("%w: mac address %q", ErrInvalidNetworkConfig, c.MACAddress)
+	}
+	if err := c.validateAddresses(); err != nil {
+		return err
+	}
+
+	for _, mapping := range c.PortMapping {
+		if !validPort(mapping.HostPort) || !validPort(mapping.GuestPort) {
+			return fmt.Errorf("%w: %d->%d", ErrInvalidPort, mapping.HostPort, mapping.GuestPort)
+		}
+	}
+
+	return validateProtocols(c.PortMapping)
+}
+
+// validateAddresses checks IP, netmask, gateway and DNS
+func (c *NetworkConfig) validateAddresses() error {
+	ip := net.ParseIP(c.IPAddress).To4()
+	if ip == nil {
+		return fmt.Errorf("%w: ip address %q is not IPv4", ErrInvalidNetworkConfig, c.IPAddress)
+	}
+
+	mask := net.IPMask(net.ParseIP(c.netmask()).To4())
+	if ones, bits := mask.Size(); bits == 0 || ones == 0 {
+		return fmt.Errorf("%w: netmask %q", ErrInvalidNetworkConfig, c.Netmask)
+	}
+
+	if len(c.Gateway) > 0 {
+		gateway := net.ParseIP(c.Gateway).To4()
+		if gateway == nil {
+			return fmt.Errorf("%w: gateway %q is not IPv4", ErrInvalidNetworkConfig, c.Gateway)
+		}
+		if !ip.Mask(mask).Equal(gateway.Mask(mask)) {
+			return fmt.Errorf("%w: gateway %s is outside the subnet of %s/%s", ErrInvalidNetworkConfig, c.Gateway, c.IPAddress, c.netmask())
+		}
+	}
+	if len(c.DNS) > 0 && net.ParseIP(c.DNS).To4() == nil {
+		return fmt.Errorf("%w: dns %q is not IPv4", ErrInvalidNetworkConfig, c.DNS)
+	}
+
+	return nil
+}
+
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
+
+// netmask returns Netmask or the default SubnetMask
+func (c *NetworkConfig) netmask() string {
+	if len(c.Netmask) > 0 {
+		return c.Netmask
+	}
+
+	return SubnetMask
+}
+
+// MarshalMMDS returns the JSON the guest reads from MMDS below MMDSKey
+func (c *NetworkConfig) MarshalMMDS() ([]byte, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	guest := guestNetwork{
+		Interface:  GuestInterface,
+		IPAddress:  c.IPAddress,
+		MACAddress: c.MACAddress,
+		Gateway:    c.Gateway,
+		Netmask:    c.netmask(),
+		DNS:        c.DNS,
+	}
+	for _, mapping := range c.PortMapping {
+		guest.PortMapping = append(guest.PortMapping, portMapping(mapping))
+	}
+
+	return json.Marshal(guest)
+}
+
+// UnmarshalMMDS parses and validates the JSON of MarshalMMDS
+func UnmarshalMMDS(data []byte) (*NetworkConfig, error) {
+	var guest guestNetwork
+	if err := json.Unmarshal(data, &guest); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidNetworkConfig, err)
+	}
+
+	config := &NetworkConfig{
+		IPAddress:  guest.IPAddress,
+		MACAddress: guest.MACAddress,
+		Gateway:    guest.Gateway,
+		Netmask:    guest.Netmask,
+		DNS:        guest.DNS,
+	}
+	for _, mapping := range guest.PortMapping {
+		config.PortMapping = append(config.PortMapping, PortMapping(mapping))
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// BootArg returns the kernel ip= argument that brings up the guest NIC with the
+// static IP: ip=<client-ip>:<server-ip>:<gw-ip>:<netmask>:<hostname>:<device>:<autoconf>:<dns0>
+func (c *NetworkConfig) BootArg() string {
+	return fmt.Sprintf("ip=%s::%s:%s::%s:off:%s", c.IPAddress, c.Gateway, c.netmask(), GuestInterface, c.DNS)
+}
+
+// ParseBootArg parses an ip= argument of BootArg. The MAC address is not part of
+// the argument, it is taken from the NIC, so only the addresses are validated.
+func ParseBootArg(arg string) (*NetworkConfig, error) {
+	value, ok := strings.CutPrefix(arg, "ip=")
+	if !ok {
+		return nil, fmt.Errorf("%w: %q is no ip= argument", ErrInvalidNetworkConfig, arg)
+	}
+
+	fields := strings.Split(value, ":")
+	if len(fields) < 7 || len(fields) > 8 {
+		return nil, fmt.Errorf("%w: %q has %d fields, want 7 or 8", ErrInvalidNetworkConfig, arg, len(fields))
+	}
+	if fields[6] != "off" && fields[6] != "none" {
+		return nil, fmt.Errorf("%w: autoconf %q, want a static config", ErrInvalidNetworkConfig, fields[6])
+	}
+
+	config := &NetworkConfig{
+		IPAddress: fields[0],
+		Gateway:   fields[2],
+		Netmask:   fields[3],
+	}
+	if len(fields) == 8 {
+		config.DNS = fields[7]
+	}
+
+	if err := config.validateAddresses(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
@@ -0,0 +1,124 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func testGuestConfig() *NetworkConfig {
+	return &NetworkConfig{
+		VMID:        "alloc-1",
+		TAPDevice:   "walkio-7d3f89ab",
+		IPAddress:   "172.16.0.2",
+		MACAddress:  "AA:FC:00:A1:B2:C3",
+		Gateway:     DefaultGateway,
+		Netmask:     SubnetMask,
+		DNS:         DefaultDNS,
+		PortMapping: []PortMapping{{HostPort: 40000, GuestPort: 80, Protocol: "tcp"}},
+	}
+}
+
+func TestNetworkConfigMMDSRoundTrip(t *testing.T) {
+	config := testGuestConfig()
+
+	data, err := config.MarshalMMDS()
+	if err != nil {
+		t.Fatalf("MarshalMMDS failed: %v", err)
+	}
+
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatalf("MMDS JSON is invalid: %v", err)
+	}
+	for _, hostField := range []string{"VMID", "vmId", "TAPDevice", "tapDevice"} {
+		if _, ok := raw[hostField]; ok {
+			t.Errorf("MMDS JSON exposes the host-side %s: %s", hostField, data)
+		}
+	}
+	if raw["interface"] != GuestInterface {
+		t.Errorf("interface = %v, want %s", raw["interface"], GuestInterface)
+	}
+
+	got, err := UnmarshalMMDS(data)
+	if err != nil {
+		t.Fatalf("UnmarshalMMDS failed: %v", err)
+	}
+
+	want := *config
+	want.VMID, want.TAPDevice = "", ""
+	if !reflect.DeepEqual(*got, want) {
+		t.Errorf("round trip = %+v, want %+v", *got, want)
+	}
+}
+
+func TestNetworkConfigBootArg(t *testing.T) {
+	config := testGuestConfig()
+
+	want := "ip=172.16.0.2::172.16.0.1:255.255.255.0::eth0:off:172.16.0.1"
+	if got := config.BootArg(); got != want {
+		t.Errorf("BootArg() = %q, want %q", got, want)
+	}
+
+	parsed, err := ParseBootArg(want)
+	if err != nil {
+		t.Fatalf("ParseBootArg failed: %v", err)
+	}
+	if parsed.IPAddress != config.IPAddress || parsed.Gateway != config.Gateway || parsed.Netmask != config.Netmask || parsed.DNS != config.DNS {
+		t.Errorf("ParseBootArg() = %+v, want the addresses of %+v", parsed, config)
+	}
+
+	// an empty netmask falls back to the default subnet
+	config.Netmask = ""
+	if got := config.BootArg(); got != want {
+		t.Errorf("BootArg() without netmask = %q, want %q", got, want)
+	}
+}
+
+func TestNetworkConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*NetworkConfig)
+		wantErr error
+	}{
+		{name: "valid", modify: func(c *NetworkConfig) {}},
+		{name: "without gateway and dns", modify: func(c *NetworkConfig) { c.Gateway, c.DNS = "", "" }},
+		{name: "missing ip", modify: func(c *NetworkConfig) { c.IPAddress = "" }, wantErr: ErrInvalidNetworkConfig},
+		{name: "IPv6 ip", modify: func(c *NetworkConfig) { c.IPAddress = "fd00::2" }, wantErr: ErrInvalidNetworkConfig},
+		{name: "invalid mac", modify: func(c *NetworkConfig) { c.MACAddress = "AA:FC" }, wantErr: ErrInvalidNetworkConfig},
+		{name: "invalid netmask", modify: func(c *NetworkConfig) { c.Netmask = "255.0.255.0" }, wantErr: ErrInvalidNetworkConfig},
+		{name: "gateway outside subnet", modify: func(c *NetworkConfig) { c.Gateway = "10.0.0.1" }, wantErr: ErrInvalidNetworkConfig},
+		{name: "invalid dns", modify: func(c *NetworkConfig) { c.DNS = "dns.local" }, wantErr: ErrInvalidNetworkConfig},
+		{name: "invalid port", modify: func(c *NetworkConfig) { c.PortMapping[0].GuestPort = 0 }, wantErr: ErrInvalidPort},
+		{name: "invalid protocol", modify: func(c *NetworkConfig) { c.PortMapping[0].Protocol = "sctp" }, wantErr: ErrInvalidProtocol},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testGuestConfig()
+			tt.modify(config)
+
+			err := config.Validate()
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("Validate() failed: %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("Validate() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseBootArgInvalid(t *testing.T) {
+	for _, arg := range []string{
+		"console=ttyS0",
+		"ip=172.16.0.2",
+		"ip=172.16.0.2::172.16.0.1:255.255.255.0::eth0:dhcp",
+		"ip=300.16.0.2::172.16.0.1:255.255.255.0::eth0:off:172.16.0.1",
+	} {
+		if _, err := ParseBootArg(arg); !errors.Is(err, ErrInvalidNetworkConfig) {
+			t.Errorf("ParseBootArg(%q) error = %v, want %v", arg, err, ErrInvalidNetworkConfig)
+		}
+	}
+}
@@ -2,24 +2,28 @@ package network
 
 import (
 	"fmt"
+	"slices"
 	"sync"
 )
 
 // HostPortPool manages allocation of host ports from a defined pool.
 // Thread-safe for concurrent VM creation.
 type HostPortPool struct {
-	mu   sync.RWMutex
-	pool map[int]string // port -> vmID mapping
+	mu         sync.RWMutex
+	pool       map[int]string // port -> vmID mapping
+	start, end int
 }
 
 // NewHostPortPool creates a new host port pool.
 func NewHostPortPool(startPort int, endPort int) (*HostPortPool, error) {
-	if HostPortPoolStart >= HostPortPoolEnd {
-		return nil, fmt.Errorf("invalid port pool range: start=%d, end=%d", HostPortPoolStart, HostPortPoolEnd)
+	if startPort >= endPort {
+		return nil, fmt.Errorf("invalid port pool range: start=%d, end=%d", startPort, endPort)
 	}
 
 	hostPortPool := &HostPortPool{
-		pool: make(map[int]string),
+		pool:  make(map[int]string),
+		start: startPort,
+		end:   endPort,
 	}
 
 	for port := startPort; port <= endPort; port++ {
@@ -30,21 +34,28 @@ func NewHostPortPool(startPort int, endPort int) (*HostPortPool, error) {
 }
 
 // AllocatePorts assigns N random ports to a VM.
-// Returns the allocated ports or an error if not enough ports are available.
+// Returns the allocated ports or ErrPortPoolExhausted if fewer than count ports
+// are free, then no port is allocated.
 func (p *HostPortPool) AllocatePorts(vmID string, count int) ([]int, error) {
+	// choosing and claiming the ports happen under the same lock, so concurrent
+	// callers can't pick a port that is chosen but not yet claimed
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
 	if count <= 0 {
 		return []int{}, nil
 	}
+	if count > len(p.pool) {
+		return nil, ErrPortPoolExhausted
+	}
 
 	ports := make([]int, 0, count)
 	for port, id := range p.pool {
-		if len(id) == 0 {
-			ports = append(ports, port)
+		if len(id) > 0 {
+			continue
 		}
 
+		ports = append(ports, port)
 		if len(ports) == count {
 			break
 		}
@@ -61,31 +72,111 @@ func (p *HostPortPool) AllocatePorts(vmID string, count int) ([]int, error) {
 	return ports, nil
 }
 
+// AllocatePortRange assigns count contiguous ports to a VM, e.g. for passive FTP.
+// The lowest free block is taken, so single ports allocated by AllocatePorts can
+// leave no block large enough although count ports are free in total, then
+// ErrPortPoolExhausted is returned. The ports are released with ReleasePorts.
+func (p *HostPortPool) AllocatePortRange(vmID string, count int) ([]int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if count <= 0 {
+		return []int{}, nil
+	}
+
+	// a block never wraps around from the end of the pool to its start
+	for first := p.start; first+count-1 <= p.end; first++ {
+		last := first + count - 1
+		if taken := p.lastTaken(first, last); taken >= 0 {
+			// no block starting before the taken port can fit
+			first = taken
+			continue
+		}
+
+		ports := make([]int, count)
+		for i := range ports {
+			ports[i] = first + i
+			p.pool[first+i] = vmID
+		}
+		return ports, nil
+	}
+
+	return nil, ErrPortPoolExhausted
+}
+
+// lastTaken returns the highest allocated port from first to last, -1 if all are free
+func (p *HostPortPool) lastTaken(first, last int) int {
+	for port := last; port >= first; port-- {
+		if len(p.pool[port]) > 0 {
+			return port
+		}
+	}
+	return -1
+}
+
 // ReleasePorts returns ports back to the available pool.
-// Returns an error if any port is not currently allocated to the specified VM.
+// Returns an error if any port is allocated to another VM, then no port is released.
 func (p *HostPortPool) ReleasePorts(ports []int, vmID string) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
+	// validate all before releasing, so a rejected release leaves the allocation intact
 	for _, port := range ports {
-
-		// validate port allocation
 		allocatedVM, ok := p.pool[port]
 		if !ok {
-			return fmt.Errorf("port %d is not int the pool", port)
+			return fmt.Errorf("port %d is not in the pool", port)
 		}
 
 		if len(allocatedVM) > 0 && allocatedVM != vmID {
 			return fmt.Errorf("port %d is allocated to VM %s, not %s", port, allocatedVM, vmID)
 		}
+	}
 
-		// release ports
+	for _, port := range ports {
 		p.pool[port] = ""
 	}
 
 	return nil
 }
 
+// portsOf returns the ports allocated to vmID in ascending order
+func (p *HostPortPool) portsOf(vmID string) []int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var ports []int
+	for port, allocatedVM := range p.pool {
+		if allocatedVM == vmID {
+			ports = append(ports, port)
+		}
+	}
+	slices.Sort(ports)
+
+	return ports
+}
+
+// reservePorts marks ports as allocated to vmID, used to restore persisted allocations
+func (p *HostPortPool) reservePorts(ports []int, vmID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, port := range ports {
+		allocatedVM, ok := p.pool[port]
+		if !ok {
+			return fmt.Errorf("port %d is not in the pool", port)
+		}
+		if len(allocatedVM) > 0 && allocatedVM != vmID {
+			return fmt.Errorf("%w: %d is allocated to VM %s", ErrHostPortInUse, port, allocatedVM)
+		}
+	}
+
+	for _, port := range ports {
+		p.pool[port] = vmID
+	}
+
+	return nil
+}
+
 // IsAllocated checks if a port is currently allocated.
 func (p *HostPortPool) IsAllocated(port int) bool {
 	p.mu.RLock()
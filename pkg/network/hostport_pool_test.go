@@ -0,0 +1,181 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// holders records which VM holds a resource, failing the test if two VMs hold it at once
+type holders[K comparable] struct {
+	mu   sync.Mutex
+	held map[K]string
+}
+
+func newHolders[K comparable]() *holders[K] {
+	return &holders[K]{held: make(map[K]string)}
+}
+
+func (h *holders[K]) take(t *testing.T, key K, vmID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if other, ok := h.held[key]; ok {
+		t.Errorf("%v allocated to %s while held by %s", key, vmID, other)
+	}
+	h.held[key] = vmID
+}
+
+func (h *holders[K]) drop(key K) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.held, key)
+}
+
+func TestHostPortPoolConcurrentAllocateRelease(t *testing.T) {
+	pool, err := NewHostPortPool(40000, 40063)
+	if err != nil {
+		t.Fatalf("NewHostPortPool failed: %v", err)
+	}
+
+	held := newHolders[int]()
+	var wg sync.WaitGroup
+	for worker := range 32 {
+		wg.Go(func() {
+			vmID := fmt.Sprintf("vm-%d", worker)
+			for range 200 {
+				ports, err := pool.AllocatePorts(vmID, 3)
+				if errors.Is(err, ErrPortPoolExhausted) {
+					continue
+				}
+				if err != nil {
+					t.Errorf("AllocatePorts failed: %v", err)
+					return
+				}
+				if len(ports) != 3 {
+					t.Errorf("AllocatePorts returned %d ports, want 3", len(ports))
+				}
+
+				for _, port := range ports {
+					held.take(t, port, vmID)
+				}
+				for _, port := range ports {
+					held.drop(port)
+				}
+				if err := pool.ReleasePorts(ports, vmID); err != nil {
+					t.Errorf("ReleasePorts failed: %v", err)
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	for port := 40000; port <= 40063; port++ {
+		if pool.IsAllocated(port) {
+			t.Errorf("port %d still allocated after all releases", port)
+		}
+	}
+}
+
+func TestHostPortPoolReleaseIsAllOrNothing(t *testing.T) {
+	pool, err := NewHostPortPool(40000, 40001)
+	if err != nil {
+		t.Fatalf("NewHostPortPool failed: %v", err)
+	}
+
+	first, _ := pool.AllocatePorts("vm-1", 1)
+	second, _ := pool.AllocatePorts("vm-2", 1)
+
+	if err := pool.ReleasePorts([]int{first[0], second[0]}, "vm-1"); err == nil {
+		t.Fatal("ReleasePorts released a port of another VM")
+	}
+	if !pool.IsAllocated(first[0]) || !pool.IsAllocated(second[0]) {
+		t.Error("rejected ReleasePorts released some of the ports")
+	}
+}
+
+func TestHostPortPoolAllocateCount(t *testing.T) {
+	tests := []struct {
+		name    string
+		count   int
+		wantErr error
+	}{
+		{name: "exactly enough", count: 4},
+		{name: "one short", count: 5, wantErr: ErrPortPoolExhausted},
+		{name: "larger than the pool", count: 100, wantErr: ErrPortPoolExhausted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := NewHostPortPool(40000, 40004)
+			if err != nil {
+				t.Fatalf("NewHostPortPool failed: %v", err)
+			}
+			if _, err := pool.AllocatePorts("vm-0", 1); err != nil {
+				t.Fatalf("AllocatePorts failed: %v", err)
+			}
+
+			ports, err := pool.AllocatePorts("vm-1", tt.count)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("AllocatePorts(%d) error = %v, want %v", tt.count, err, tt.wantErr)
+			}
+
+			allocated := 0
+			for port := 40000; port <= 40004; port++ {
+				if pool.IsAllocated(port) {
+					allocated++
+				}
+			}
+			if tt.wantErr != nil {
+				if ports != nil || allocated != 1 {
+					t.Errorf("failed AllocatePorts returned %v and left %d ports allocated, want none and 1", ports, allocated)
+				}
+				return
+			}
+			if len(ports) != tt.count || allocated != 5 {
+				t.Errorf("AllocatePorts returned %v with %d ports allocated, want %d ports and a full pool", ports, allocated, tt.count)
+			}
+		})
+	}
+}
+
+func TestHostPortPoolAllocatePortRange(t *testing.T) {
+	pool, err := NewHostPortPool(40000, 40009)
+	if err != nil {
+		t.Fatalf("NewHostPortPool failed: %v", err)
+	}
+	// fragment the pool into the free blocks 40000-40001, 40003-40005 and 40007-40009
+	if err := pool.reservePorts([]int{40002, 40006}, "vm-0"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		count int
+		want  []int
+		err   error
+	}{
+		{count: 3, want: []int{40003, 40004, 40005}},
+		{count: 4, err: ErrPortPoolExhausted}, // 5 ports free, but not in one block
+		{count: 2, want: []int{40000, 40001}},
+		{count: 3, want: []int{40007, 40008, 40009}},
+		{count: 1, err: ErrPortPoolExhausted},
+		{count: 11, err: ErrPortPoolExhausted},
+	}
+	for i, tt := range tests {
+		got, err := pool.AllocatePortRange(fmt.Sprintf("vm-%d", i+1), tt.count)
+		if !errors.Is(err, tt.err) {
+			t.Fatalf("AllocatePortRange(%d) error = %v, want %v", tt.count, err, tt.err)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("AllocatePortRange(%d) = %v, want %v", tt.count, got, tt.want)
+		}
+	}
+
+	if err := pool.ReleasePorts([]int{40003, 40004, 40005}, "vm-1"); err != nil {
+		t.Fatalf("ReleasePorts failed: %v", err)
+	}
+	if got, err := pool.AllocatePortRange("vm-7", 3); err != nil || !slices.Equal(got, []int{40003, 40004, 40005}) {
+		t.Errorf("AllocatePortRange after release = %v, %v, want the released block", got, err)
+	}
+}
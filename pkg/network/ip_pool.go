@@ -1,6 +1,7 @@
 package network
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"sync"
@@ -9,21 +10,23 @@ import (
 // IPPool manages allocation of IP addresses from a defined pool.
 // Thread-safe for concurrent VM creation.
 type IPPool struct {
-	mu   sync.RWMutex
-	pool map[string]string // IP -> VMID mapping
+	mu         sync.RWMutex
+	pool       map[string]string // IP -> VMID mapping
+	start, end uint32            // range of the pool, walked in order by AllocateIP
 }
 
-// NewIPPool creates and initializes a new IP pool with the configured range.
-// Parses IPPoolStart to IPPoolEnd and populates the available slice.
+// NewIPPool creates an IP pool of the default range IPPoolStart to IPPoolEnd.
+func NewIPPool() (*IPPool, error) {
+	return NewIPPoolRange(IPPoolStart, IPPoolEnd)
+}
 
-// Initialize populates the IP pool with available addresses from the configured range.
-// This must be called before any allocations can be made.
-func NewIPPool(ipPoolStart, ipPoolEnd string) (*IPPool, error) {
+// NewIPPoolRange creates an IP pool holding all addresses from ipPoolStart to ipPoolEnd (inclusive).
+func NewIPPoolRange(ipPoolStart, ipPoolEnd string) (*IPPool, error) {
 	startIP := net.ParseIP(ipPoolStart)
 	endIP := net.ParseIP(ipPoolEnd)
 
 	if startIP == nil || endIP == nil {
-		return nil, fmt.Errorf("invalid IP pool range: start=%s, end=%s", IPPoolStart, IPPoolEnd)
+		return nil, fmt.Errorf("invalid IP pool range: start=%s, end=%s", ipPoolStart, ipPoolEnd)
 	}
 
 	// Convert IPs to 4-byte representation
@@ -39,38 +42,57 @@ func NewIPPool(ipPoolStart, ipPoolEnd string) (*IPPool, error) {
 	end := ipToUint32(endIP)
 
 	if start > end {
-		return nil, fmt.Errorf("IP pool start (%s) is greater than end (%s)", IPPoolStart, IPPoolEnd)
+		return nil, fmt.Errorf("IP pool start (%s) is greater than end (%s)", ipPoolStart, ipPoolEnd)
 	}
 
-	pool := make(map[string]string, end-start)
+	pool := make(map[string]string, end-start+1)
 	for i := start; i <= end; i++ {
 		ip := uint32ToIP(i)
 		pool[ip.String()] = ""
 	}
 
-	return &IPPool{pool: pool}, nil
+	return &IPPool{pool: pool, start: start, end: end}, nil
 }
 
-// AllocateIP assigns a random IP address to a VM.
-// Returns the allocated IP or an error if the pool is exhausted.
+// AllocateIP assigns the lowest free IP address to a VM.
+// Returns the allocated IP or ErrIPPoolExhausted if all addresses are in use.
 func (p *IPPool) AllocateIP(vmID string) (net.IP, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	var allocatedIP string
-	for ip, allocatedVM := range p.pool {
-		if allocatedVM == "" {
-			p.pool[ip] = vmID
-			allocatedIP = ip
-			break
+	// uint64 so the loop ends at the last address of the IPv4 space
+	for i := uint64(p.start); i <= uint64(p.end); i++ {
+		ip := uint32ToIP(uint32(i))
+		if p.pool[ip.String()] == "" {
+			p.pool[ip.String()] = vmID
+			return ip, nil
 		}
 	}
 
-	if len(allocatedIP) == 0 {
-		return nil, ErrIPNotAllocated
+	return nil, ErrIPPoolExhausted
+}
+
+// AllocateSpecificIP assigns ip to a VM, e.g. for a database other VMs connect to.
+// Returns ErrIPNotInPool if ip is outside the pool or ErrIPAlreadyInUse if it is
+// allocated, also to vmID itself. It is released with ReleaseIP like any other IP.
+func (p *IPPool) AllocateSpecificIP(vmID string, ip net.IP) error {
+	if len(vmID) == 0 {
+		return errors.New("allocate IP: empty VM ID")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	allocatedVM, exists := p.pool[ip.String()]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrIPNotInPool, ip)
+	}
+	if allocatedVM != "" {
+		return fmt.Errorf("%w: %s is allocated to VM %s", ErrIPAlreadyInUse, ip, allocatedVM)
 	}
 
-	return net.ParseIP(allocatedIP), nil
+	p.pool[ip.String()] = vmID
+	return nil
 }
 
 // ReleaseIP returns an IP address back to the available pool.
@@ -94,6 +116,37 @@ func (p *IPPool) ReleaseIP(ip *net.IP, vmID string) error {
 	return nil
 }
 
+// ipOf returns the IP allocated to vmID
+func (p *IPPool) ipOf(vmID string) (net.IP, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for ip, allocatedVM := range p.pool {
+		if allocatedVM == vmID {
+			return net.ParseIP(ip), true
+		}
+	}
+
+	return nil, false
+}
+
+// reserveIP marks ip as allocated to vmID, used to restore persisted allocations
+func (p *IPPool) reserveIP(ip string, vmID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	allocatedVM, exists := p.pool[ip]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrIPNotInPool, ip)
+	}
+	if allocatedVM != "" && allocatedVM != vmID {
+		return fmt.Errorf("%w: %s is allocated to VM %s", ErrIPAlreadyInUse, ip, allocatedVM)
+	}
+
+	p.pool[ip] = vmID
+	return nil
+}
+
 // IsAllocated checks if an IP address is currently allocated.
 func (p *IPPool) IsAllocated(ip *net.IP) bool {
 	p.mu.RLock()
@@ -0,0 +1,186 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestIPPoolExhausted(t *testing.T) {
+	pool, err := NewIPPoolRange("10.0.0.2", "10.0.0.5")
+	if err != nil {
+		t.Fatalf("NewIPPoolRange failed: %v", err)
+	}
+
+	allocated := make(map[string]string) // IP -> VMID
+	for i := range 4 {
+		vmID := fmt.Sprintf("vm-%d", i)
+		ip, err := pool.AllocateIP(vmID)
+		if err != nil {
+			t.Fatalf("AllocateIP %d failed: %v", i, err)
+		}
+		if _, ok := allocated[ip.String()]; ok {
+			t.Fatalf("AllocateIP returned %s twice", ip)
+		}
+		allocated[ip.String()] = vmID
+	}
+
+	if _, err := pool.AllocateIP("vm-4"); !errors.Is(err, ErrIPPoolExhausted) {
+		t.Fatalf("AllocateIP on drained pool error = %v, want %v", err, ErrIPPoolExhausted)
+	}
+
+	released := net.ParseIP("10.0.0.3")
+	if err := pool.ReleaseIP(&released, allocated["10.0.0.3"]); err != nil {
+		t.Fatalf("ReleaseIP failed: %v", err)
+	}
+	ip, err := pool.AllocateIP("vm-4")
+	if err != nil {
+		t.Fatalf("AllocateIP after release failed: %v", err)
+	}
+	if !ip.Equal(released) {
+		t.Errorf("AllocateIP after release = %s, want %s", ip, released)
+	}
+}
+
+func TestIPPoolAllocatesLowestFree(t *testing.T) {
+	pool, err := NewIPPoolRange("10.0.0.2", "10.0.0.10")
+	if err != nil {
+		t.Fatalf("NewIPPoolRange failed: %v", err)
+	}
+
+	for i, want := range []string{"10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+		ip, err := pool.AllocateIP(fmt.Sprintf("vm-%d", i))
+		if err != nil {
+			t.Fatalf("AllocateIP %d failed: %v", i, err)
+		}
+		if ip.String() != want {
+			t.Errorf("AllocateIP %d = %s, want %s", i, ip, want)
+		}
+	}
+
+	// a released address is the lowest free one again
+	released := net.ParseIP("10.0.0.3")
+	if err := pool.ReleaseIP(&released, "vm-1"); err != nil {
+		t.Fatalf("ReleaseIP failed: %v", err)
+	}
+	ip, err := pool.AllocateIP("vm-3")
+	if err != nil {
+		t.Fatalf("AllocateIP after release failed: %v", err)
+	}
+	if !ip.Equal(released) {
+		t.Errorf("AllocateIP after release = %s, want %s", ip, released)
+	}
+}
+
+func TestIPPoolAllocateSpecificIP(t *testing.T) {
+	pool, err := NewIPPoolRange("10.0.0.2", "10.0.0.10")
+	if err != nil {
+		t.Fatalf("NewIPPoolRange failed: %v", err)
+	}
+
+	static := net.ParseIP("10.0.0.5")
+	if err := pool.AllocateSpecificIP("db", static); err != nil {
+		t.Fatalf("AllocateSpecificIP failed: %v", err)
+	}
+	if !pool.IsAllocated(&static) {
+		t.Errorf("%s not allocated", static)
+	}
+
+	tests := []struct {
+		vmID string
+		ip   string
+		want error
+	}{
+		{"other", "10.0.0.5", ErrIPAlreadyInUse},
+		{"db", "10.0.0.5", ErrIPAlreadyInUse},
+		{"other", "10.0.0.11", ErrIPNotInPool},
+		{"other", "fd00::5", ErrIPNotInPool},
+	}
+	for _, tt := range tests {
+		if err := pool.AllocateSpecificIP(tt.vmID, net.ParseIP(tt.ip)); !errors.Is(err, tt.want) {
+			t.Errorf("AllocateSpecificIP(%s, %s) error = %v, want %v", tt.vmID, tt.ip, err, tt.want)
+		}
+	}
+
+	// AllocateIP skips the static address
+	for i := range 8 {
+		ip, err := pool.AllocateIP(fmt.Sprintf("vm-%d", i))
+		if err != nil {
+			t.Fatalf("AllocateIP %d failed: %v", i, err)
+		}
+		if ip.Equal(static) {
+			t.Fatalf("AllocateIP returned the static %s", static)
+		}
+	}
+
+	if err := pool.ReleaseIP(&static, "db"); err != nil {
+		t.Fatalf("ReleaseIP failed: %v", err)
+	}
+	if ip, err := pool.AllocateIP("vm-8"); err != nil || !ip.Equal(static) {
+		t.Errorf("AllocateIP after release = %s, %v, want %s", ip, err, static)
+	}
+}
+
+func TestNewIPPoolDefaultRange(t *testing.T) {
+	pool, err := NewIPPool()
+	if err != nil {
+		t.Fatalf("NewIPPool failed: %v", err)
+	}
+
+	for _, ip := range []string{IPPoolStart, IPPoolEnd} {
+		if _, ok := pool.pool[ip]; !ok {
+			t.Errorf("default pool is missing %s", ip)
+		}
+	}
+	if got, want := len(pool.pool), 253; got != want {
+		t.Errorf("default pool size = %d, want %d", got, want)
+	}
+}
+
+func TestNewIPPoolRangeInvalid(t *testing.T) {
+	for _, r := range [][2]string{{"10.0.0.5", "10.0.0.2"}, {"10.0.0.2", "nope"}, {"fd00::2", "fd00::5"}} {
+		if _, err := NewIPPoolRange(r[0], r[1]); err == nil {
+			t.Errorf("NewIPPoolRange(%s, %s) succeeded", r[0], r[1])
+		}
+	}
+}
+
+func TestIPPoolConcurrentAllocateRelease(t *testing.T) {
+	pool, err := NewIPPoolRange("10.0.0.2", "10.0.0.17")
+	if err != nil {
+		t.Fatalf("NewIPPoolRange failed: %v", err)
+	}
+
+	held := newHolders[string]()
+	var wg sync.WaitGroup
+	for worker := range 32 {
+		wg.Go(func() {
+			vmID := fmt.Sprintf("vm-%d", worker)
+			for range 200 {
+				ip, err := pool.AllocateIP(vmID)
+				if errors.Is(err, ErrIPPoolExhausted) {
+					continue
+				}
+				if err != nil {
+					t.Errorf("AllocateIP failed: %v", err)
+					return
+				}
+
+				held.take(t, ip.String(), vmID)
+				held.drop(ip.String())
+				if err := pool.ReleaseIP(&ip, vmID); err != nil {
+					t.Errorf("ReleaseIP failed: %v", err)
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	for ip, vmID := range pool.pool {
+		if len(vmID) > 0 {
+			t.Errorf("%s still allocated to %s after all releases", ip, vmID)
+		}
+	}
+}
@@ -3,9 +3,10 @@ package network
 import (
 	"crypto/sha256"
 	"fmt"
+	"sync"
 )
 
-// GenerateMACAddress creates a MAC address from VM ID.
+// GenerateMAC creates the MAC address of a VM from its ID.
 // Format: AA:FC:00:XX:XX:XX (last 3 octets from vmID hash)
 //
 // The prefix AA:FC:00 is:
@@ -13,8 +14,9 @@ import (
 // - FC: Firecracker hint
 // - 00: Reserved for extension
 //
-// The last 3 octets are derived from the VM ID to ensure uniqueness.
-func GenerateMACAddress(vmID string) string {
+// The same VM ID always gets the same MAC. Different IDs can collide in the
+// 24 bits, MACPool detects that for the VMs on this host.
+func GenerateMAC(vmID string) string {
 	// Hash the VM ID to get deterministic but unique bytes
 	hash := sha256.Sum256([]byte(vmID))
 
@@ -26,3 +28,44 @@ func GenerateMACAddress(vmID string) string {
 		hash[2],
 	)
 }
+
+// MACPool tracks the MACs of the VMs on the bridge.
+// Thread-safe for concurrent VM creation.
+type MACPool struct {
+	mu   sync.Mutex
+	pool map[string]string // MAC -> vmID mapping
+}
+
+func NewMACPool() *MACPool {
+	return &MACPool{pool: make(map[string]string)}
+}
+
+// AllocateMAC generates the MAC of vmID and marks it as used.
+// Allocating again for the same VM returns the same MAC, a collision with
+// another VM returns ErrMACAlreadyInUse.
+func (p *MACPool) AllocateMAC(vmID string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	mac := GenerateMAC(vmID)
+	if allocatedVM, exists := p.pool[mac]; exists && allocatedVM != vmID {
+		return "", fmt.Errorf("%w: %s of VM %s is used by VM %s", ErrMACAlreadyInUse, mac, vmID, allocatedVM)
+	}
+
+	p.pool[mac] = vmID
+	return mac, nil
+}
+
+// ReleaseMAC frees the MAC of vmID
+func (p *MACPool) ReleaseMAC(vmID string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	mac := GenerateMAC(vmID)
+	if p.pool[mac] != vmID {
+		return fmt.Errorf("%w: %s", ErrMACNotAllocated, mac)
+	}
+
+	delete(p.pool, mac)
+	return nil
+}
@@ -0,0 +1,58 @@
+package network
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+)
+
+var macFormat = regexp.MustCompile(`^AA:FC:00(:[0-9A-F]{2}){3}$`)
+
+func TestGenerateMAC(t *testing.T) {
+	vmID := "01936f4e-8b2a-7c3d-9e4f-5a6b7c8d9e0f"
+
+	mac := GenerateMAC(vmID)
+	if !macFormat.MatchString(mac) {
+		t.Errorf("GenerateMAC(%q) = %q, want format AA:FC:00:XX:XX:XX", vmID, mac)
+	}
+	if again := GenerateMAC(vmID); again != mac {
+		t.Errorf("GenerateMAC is not deterministic: %q != %q", again, mac)
+	}
+	if other := GenerateMAC("01936f4e-8b2a-7c3d-9e4f-5a6b7c8d9e10"); other == mac {
+		t.Errorf("different VM IDs got the same MAC %q", mac)
+	}
+}
+
+func TestMACPool(t *testing.T) {
+	pool := NewMACPool()
+
+	mac, err := pool.AllocateMAC("vm-1")
+	if err != nil {
+		t.Fatalf("AllocateMAC failed: %v", err)
+	}
+	if mac != GenerateMAC("vm-1") {
+		t.Errorf("AllocateMAC() = %q, want %q", mac, GenerateMAC("vm-1"))
+	}
+	if again, err := pool.AllocateMAC("vm-1"); err != nil || again != mac {
+		t.Errorf("AllocateMAC() again = %q, %v, want %q", again, err, mac)
+	}
+
+	// vm-360229 shares the 24 generated bits with vm-1
+	const colliding = "vm-360229"
+	if GenerateMAC(colliding) != mac {
+		t.Fatalf("GenerateMAC(%q) = %q, want collision with %q", colliding, GenerateMAC(colliding), mac)
+	}
+	if _, err := pool.AllocateMAC(colliding); !errors.Is(err, ErrMACAlreadyInUse) {
+		t.Errorf("AllocateMAC(%q) error = %v, want %v", colliding, err, ErrMACAlreadyInUse)
+	}
+
+	if err := pool.ReleaseMAC(colliding); !errors.Is(err, ErrMACNotAllocated) {
+		t.Errorf("ReleaseMAC(%q) error = %v, want %v", colliding, err, ErrMACNotAllocated)
+	}
+	if err := pool.ReleaseMAC("vm-1"); err != nil {
+		t.Fatalf("ReleaseMAC failed: %v", err)
+	}
+	if _, err := pool.AllocateMAC(colliding); err != nil {
+		t.Errorf("AllocateMAC(%q) after release failed: %v", colliding, err)
+	}
+}
@@ -1,5 +1,11 @@
 package network
 
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+)
+
 // NetworkManager is the central coordinator for all networking operations.
 // It manages IP allocation, TAP devices, port mappings, and ensures
 // consistent state across all network resources.
@@ -7,25 +13,118 @@ package network
 // This should be created once at application startup and passed as a
 // dependency to components that need networking functionality.
 type NetworkManager struct {
+	// bridge, subnet and pool ranges, resolved by NewNetworkManager
+	opts Options
+
 	// Resource managers (each has its own mutex)
 	ipPool       *IPPool
 	hostPortPool *HostPortPool
+	macPool      *MACPool
 
-	// Infrastructure state
+	// Infrastructure state, infraMu serializes EnsureInfrastructure
+	infraMu           sync.Mutex
 	bridgeInitialized bool // Whether bridge and NAT are set up
+
+	// port mappings and ranges of the VMs (vmID -> mappings), re-installed by EnsureInfrastructure
+	mu           sync.Mutex
+	portMappings map[string]vmPortMappings
+
+	// allocations are persisted here once Restore was called
+	db *sql.DB
 }
 
-// NewNetworkManager creates a new NetworkManager instance.
+type vmPortMappings struct {
+	vmIP     string
+	mappings []PortMapping
+	ranges   []PortRange
+}
+
+// NewNetworkManager creates a new NetworkManager instance for the bridge and
+// pools of opts, empty fields keep the defaults of types.go.
 // This does not set up network infrastructure - call EnsureInfrastructure() separately.
-func NewNetworkManager() (*NetworkManager, error) {
-	portPool, err := NewHostPortPool(HostPortPoolStart, HostPortPoolEnd)
+func NewNetworkManager(opts Options) (*NetworkManager, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	ipPool, err := NewIPPoolRange(opts.IPPoolStart, opts.IPPoolEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	portPool, err := NewHostPortPool(opts.HostPortStart, opts.HostPortEnd)
 	if err != nil {
 		return nil, err
 	}
 
 	return &NetworkManager{
-		ipPool:            NewIPPool(),
+		opts:              opts,
+		ipPool:            ipPool,
 		hostPortPool:      portPool,
+		macPool:           NewMACPool(),
 		bridgeInitialized: false,
+		portMappings:      make(map[string]vmPortMappings),
 	}, nil
 }
+
+// Options returns the resolved options, e.g. the bridge IP VMs use as gateway
+func (m *NetworkManager) Options() Options {
+	return m.opts
+}
+
+// ensureBridge sets up the bridge device, overridden in tests
+var ensureBridge = EnsureBridge
+
+// EnsureInfrastructure (re-)applies the bridge, the MASQUERADE and FORWARD rules,
+// the DNS redirect of the bridge IP and the DNAT rules of all mapped VMs. Rules lost to a reboot or an iptables
+// reset are re-installed, existing ones are kept, so it is safe to run repeatedly.
+// Call it after Restore on startup.
+func (m *NetworkManager) EnsureInfrastructure() error {
+	m.infraMu.Lock()
+	defer m.infraMu.Unlock()
+
+	return m.ensureInfrastructure()
+}
+
+// ensureInitialized runs EnsureInfrastructure unless it already succeeded,
+// concurrent callers wait for the first one instead of setting up twice.
+func (m *NetworkManager) ensureInitialized() error {
+	m.infraMu.Lock()
+	defer m.infraMu.Unlock()
+
+	if m.bridgeInitialized {
+		return nil
+	}
+	return m.ensureInfrastructure()
+}
+
+// ensureInfrastructure does the work of EnsureInfrastructure, the caller holds infraMu
+func (m *NetworkManager) ensureInfrastructure() error {
+	if err := ensureBridge(m.opts); err != nil {
+		return fmt.Errorf("ensure bridge: %w", err)
+	}
+	if err := EnableNAT(m.opts); err != nil {
+		return fmt.Errorf("ensure NAT: %w", err)
+	}
+	// VMs get the bridge IP as DNS server, nothing listens there without the redirect
+	if err := SetupDNSRedirect(m.opts); err != nil {
+		return fmt.Errorf("ensure DNS redirect: %w", err)
+	}
+
+	live := make(map[string][]PortMapping)
+	liveRanges := make(map[string][]PortRange)
+	m.mu.Lock()
+	for _, vm := range m.portMappings {
+		live[vm.vmIP] = append(live[vm.vmIP], vm.mappings...)
+		liveRanges[vm.vmIP] = append(liveRanges[vm.vmIP], vm.ranges...)
+	}
+	m.mu.Unlock()
+
+	if err := ReconcilePortMappings(m.opts, live, liveRanges); err != nil {
+		return fmt.Errorf("ensure port mappings: %w", err)
+	}
+
+	m.bridgeInitialized = true
+	return nil
+}
@@ -2,42 +2,62 @@ package network
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/coreos/go-iptables/iptables"
 )
 
+// iptablesRunner is the subset of iptables operations used by this package.
+// It is satisfied by *iptables.IPTables and can be replaced in tests.
+type iptablesRunner interface {
+	List(table, chain string) ([]string, error)
+	AppendUnique(table, chain string, rulespec ...string) error
+	Delete(table, chain string, rulespec ...string) error
+}
+
+// newIPTables creates the iptables runner, overridden in tests
+var newIPTables = func() (iptablesRunner, error) {
+	return iptables.New()
+}
+
 // EnableNAT sets up IP forwarding and MASQUERADE for internet access.
 // This enables VMs to access the internet via the host.
-func EnableNAT() error {
+func EnableNAT(opts Options) error {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return err
+	}
+
 	// Enable IP forwarding
 	if err := enableIPForwarding(); err != nil {
 		return fmt.Errorf("failed to enable IP forwarding: %w", err)
 	}
 
 	// Create iptables instance
-	ipt, err := iptables.New()
+	ipt, err := newIPTables()
 	if err != nil {
 		return fmt.Errorf("failed to initialize iptables: %w", err)
 	}
 
 	// Add MASQUERADE rule for outbound traffic from VM network
 	// iptables -t nat -A POSTROUTING -s 172.16.0.0/24 -j MASQUERADE
-	err = ipt.AppendUnique("nat", "POSTROUTING", "-s", BridgeCIDR, "-j", "MASQUERADE")
+	err = ipt.AppendUnique("nat", "POSTROUTING", "-s", opts.BridgeCIDR, "-j", "MASQUERADE")
 	if err != nil {
 		return fmt.Errorf("%w: failed to add MASQUERADE rule: %v", ErrNATSetupFailed, err)
 	}
 
 	// Add FORWARD rules to allow traffic through the bridge
 	// iptables -A FORWARD -i walkio-br0 -j ACCEPT
-	err = ipt.AppendUnique("filter", "FORWARD", "-i", BridgeName, "-j", "ACCEPT")
+	err = ipt.AppendUnique("filter", "FORWARD", "-i", opts.BridgeName, "-j", "ACCEPT")
 	if err != nil {
 		return fmt.Errorf("%w: failed to add FORWARD rule: %v", ErrNATSetupFailed, err)
 	}
 
 	// iptables -A FORWARD -o walkio-br0 -j ACCEPT
-	err = ipt.AppendUnique("filter", "FORWARD", "-o", BridgeName, "-j", "ACCEPT")
+	err = ipt.AppendUnique("filter", "FORWARD", "-o", opts.BridgeName, "-j", "ACCEPT")
 	if err != nil {
 		return fmt.Errorf("%w: failed to add FORWARD rule: %v", ErrNATSetupFailed, err)
 	}
@@ -46,18 +66,23 @@ func EnableNAT() error {
 }
 
 // DisableNAT removes NAT rules (cleanup).
-func DisableNAT() error {
-	ipt, err := iptables.New()
+func DisableNAT(opts Options) error {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return err
+	}
+
+	ipt, err := newIPTables()
 	if err != nil {
 		return fmt.Errorf("failed to initialize iptables: %w", err)
 	}
 
 	// Remove MASQUERADE rule
-	_ = ipt.Delete("nat", "POSTROUTING", "-s", BridgeCIDR, "-j", "MASQUERADE")
+	_ = ipt.Delete("nat", "POSTROUTING", "-s", opts.BridgeCIDR, "-j", "MASQUERADE")
 
 	// Remove FORWARD rules
-	_ = ipt.Delete("filter", "FORWARD", "-i", BridgeName, "-j", "ACCEPT")
-	_ = ipt.Delete("filter", "FORWARD", "-o", BridgeName, "-j", "ACCEPT")
+	_ = ipt.Delete("filter", "FORWARD", "-i", opts.BridgeName, "-j", "ACCEPT")
+	_ = ipt.Delete("filter", "FORWARD", "-o", opts.BridgeName, "-j", "ACCEPT")
 
 	// Note: We don't disable IP forwarding as other services might be using it
 
@@ -71,24 +96,18 @@ func AddPortMappings(vmIP string, mappings []PortMapping) error {
 		return nil
 	}
 
-	ipt, err := iptables.New()
+	if err := validateProtocols(mappings); err != nil {
+		return err
+	}
+
+	ipt, err := newIPTables()
 	if err != nil {
 		return fmt.Errorf("failed to initialize iptables: %w", err)
 	}
 
 	for _, mapping := range mappings {
-		// Only support TCP for POC
-		if mapping.Protocol != "tcp" {
-			continue
-		}
-
-		// iptables -t nat -A PREROUTING -p tcp --dport {hostPort} -j DNAT --to-destination {vmIP}:{guestPort}
-		err = ipt.AppendUnique("nat", "PREROUTING",
-			"-p", "tcp",
-			"--dport", strconv.Itoa(mapping.HostPort),
-			"-j", "DNAT",
-			"--to-destination", fmt.Sprintf("%s:%d", vmIP, mapping.GuestPort))
-
+		// iptables -t nat -A PREROUTING -p {tcp|udp} --dport {hostPort} -j DNAT --to-destination {vmIP}:{guestPort}
+		err = ipt.AppendUnique("nat", "PREROUTING", dnatRuleSpec(vmIP, mapping)...)
 		if err != nil {
 			return fmt.Errorf("failed to add port mapping %d->%s:%d: %w",
 				mapping.HostPort, vmIP, mapping.GuestPort, err)
@@ -104,58 +123,423 @@ func RemovePortMappings(vmIP string, mappings []PortMapping) error {
 		return nil
 	}
 
-	ipt, err := iptables.New()
+	if err := validateProtocols(mappings); err != nil {
+		return err
+	}
+
+	ipt, err := newIPTables()
 	if err != nil {
 		return fmt.Errorf("failed to initialize iptables: %w", err)
 	}
 
 	for _, mapping := range mappings {
-		// Only TCP for POC
-		if mapping.Protocol != "tcp" {
+		// iptables -t nat -D PREROUTING -p {tcp|udp} --dport {hostPort} -j DNAT --to-destination {vmIP}:{guestPort}
+		_ = ipt.Delete("nat", "PREROUTING", dnatRuleSpec(vmIP, mapping)...)
+	}
+
+	return nil
+}
+
+// AddRangePortMapping forwards the host ports of portRange to the same guest
+// ports with a single DNAT rule, instead of one rule per port as AddPortMappings.
+func AddRangePortMapping(vmIP string, portRange PortRange) error {
+	if err := validatePortRange(portRange); err != nil {
+		return err
+	}
+
+	ipt, err := newIPTables()
+	if err != nil {
+		return fmt.Errorf("failed to initialize iptables: %w", err)
+	}
+
+	// iptables -t nat -A PREROUTING -p {tcp|udp} --dport {first}:{last} -j DNAT --to-destination {vmIP}
+	if err := ipt.AppendUnique("nat", "PREROUTING", dnatRangeRuleSpec(vmIP, portRange)...); err != nil {
+		return fmt.Errorf("failed to add port range mapping %d-%d->%s: %w", portRange.First, portRange.Last, vmIP, err)
+	}
+
+	return nil
+}
+
+// RemoveRangePortMapping removes the DNAT rule of AddRangePortMapping
+func RemoveRangePortMapping(vmIP string, portRange PortRange) error {
+	if err := validatePortRange(portRange); err != nil {
+		return err
+	}
+
+	ipt, err := newIPTables()
+	if err != nil {
+		return fmt.Errorf("failed to initialize iptables: %w", err)
+	}
+
+	_ = ipt.Delete("nat", "PREROUTING", dnatRangeRuleSpec(vmIP, portRange)...)
+
+	return nil
+}
+
+// validatePortRange rejects ranges outside 1-65535, reversed ranges and protocols other than tcp or udp
+func validatePortRange(portRange PortRange) error {
+	if portRange.First < 1 || portRange.Last > 65535 || portRange.First > portRange.Last {
+		return fmt.Errorf("%w: range %d-%d", ErrInvalidPort, portRange.First, portRange.Last)
+	}
+
+	return validateProtocols([]PortMapping{{HostPort: portRange.First, Protocol: portRange.Protocol}})
+}
+
+// dnatRangeRuleSpec returns the rulespec forwarding a host port range to the VM,
+// DNAT without a port keeps the destination port of each packet.
+func dnatRangeRuleSpec(vmIP string, portRange PortRange) []string {
+	return []string{
+		"-p", portRange.Protocol,
+		"--dport", fmt.Sprintf("%d:%d", portRange.First, portRange.Last),
+		"-j", "DNAT",
+		"--to-destination", vmIP,
+	}
+}
+
+// ReconcilePortMappings converges the DNAT rules of the host to the live set
+// (vmIP -> mappings) and the live port ranges (vmIP -> ranges). Walkio rules
+// (DNAT to an address inside the bridge subnet of opts) that are not live are
+// removed, live mappings and ranges without a rule are added. Rules of other
+// services are left untouched.
+func ReconcilePortMappings(opts Options, live map[string][]PortMapping, liveRanges map[string][]PortRange) error {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return err
+	}
+	subnet, err := opts.subnet()
+	if err != nil {
+		return err
+	}
+
+	desired := make(map[dnatRule]bool)
+	for vmIP, mappings := range live {
+		if err := validateProtocols(mappings); err != nil {
+			return err
+		}
+		for _, mapping := range mappings {
+			desired[newDNATRule(vmIP, mapping)] = true
+		}
+	}
+	for vmIP, portRanges := range liveRanges {
+		for _, portRange := range portRanges {
+			if err := validatePortRange(portRange); err != nil {
+				return err
+			}
+			desired[newRangeDNATRule(vmIP, portRange)] = true
+		}
+	}
+
+	ipt, err := newIPTables()
+	if err != nil {
+		return fmt.Errorf("failed to initialize iptables: %w", err)
+	}
+
+	rules, err := ipt.List("nat", "PREROUTING")
+	if err != nil {
+		return fmt.Errorf("failed to list nat rules: %w", err)
+	}
+
+	existing := make(map[dnatRule]bool)
+	for _, rule := range rules {
+		parsed, ok := parseDNATRule(rule, subnet)
+		if !ok {
+			continue
+		}
+
+		if desired[parsed] {
+			existing[parsed] = true
+			continue
+		}
+
+		err = ipt.Delete("nat", "PREROUTING", parsed.ruleSpec()...)
+		if err != nil {
+			return fmt.Errorf("failed to remove stale port mapping %s: %w", parsed, err)
+		}
+	}
+
+	for rule := range desired {
+		if existing[rule] {
 			continue
 		}
 
-		// iptables -t nat -D PREROUTING -p tcp --dport {hostPort} -j DNAT --to-destination {vmIP}:{guestPort}
-		_ = ipt.Delete("nat", "PREROUTING",
-			"-p", "tcp",
-			"--dport", strconv.Itoa(mapping.HostPort),
-			"-j", "DNAT",
-			"--to-destination", fmt.Sprintf("%s:%d", vmIP, mapping.GuestPort))
+		err = ipt.AppendUnique("nat", "PREROUTING", rule.ruleSpec()...)
+		if err != nil {
+			return fmt.Errorf("failed to add port mapping %s: %w", rule, err)
+		}
 	}
 
 	return nil
 }
 
-// SetupDNSRedirect redirects DNS queries from VMs to the host's DNS server.
-// This is a simple redirect approach for POC.
-func SetupDNSRedirect() error {
-	// Read host's DNS server from /etc/resolv.conf
-	// For POC, we'll just redirect to 8.8.8.8 (Google DNS)
-	// In production, you'd parse /etc/resolv.conf to get the actual nameserver
+// validateProtocols rejects the whole batch if a mapping has a protocol other than tcp or udp
+func validateProtocols(mappings []PortMapping) error {
+	for _, mapping := range mappings {
+		if mapping.Protocol != "tcp" && mapping.Protocol != "udp" {
+			return fmt.Errorf("%w: %q for host port %d", ErrInvalidProtocol, mapping.Protocol, mapping.HostPort)
+		}
+	}
 
-	ipt, err := iptables.New()
+	return nil
+}
+
+// dnatRule identifies a port forward rule in the nat PREROUTING chain, a rule
+// of a port range has lastHostPort set and no guestPort
+type dnatRule struct {
+	protocol     string
+	hostPort     int
+	lastHostPort int
+	vmIP         string
+	guestPort    int
+}
+
+func newDNATRule(vmIP string, mapping PortMapping) dnatRule {
+	return dnatRule{
+		protocol:  mapping.Protocol,
+		hostPort:  mapping.HostPort,
+		vmIP:      vmIP,
+		guestPort: mapping.GuestPort,
+	}
+}
+
+func newRangeDNATRule(vmIP string, portRange PortRange) dnatRule {
+	return dnatRule{
+		protocol:     portRange.Protocol,
+		hostPort:     portRange.First,
+		lastHostPort: portRange.Last,
+		vmIP:         vmIP,
+	}
+}
+
+// ruleSpec returns the rulespec of dnatRuleSpec or, for a port range, of dnatRangeRuleSpec
+func (r dnatRule) ruleSpec() []string {
+	if r.lastHostPort > 0 {
+		return dnatRangeRuleSpec(r.vmIP, PortRange{First: r.hostPort, Last: r.lastHostPort, Protocol: r.protocol})
+	}
+
+	return dnatRuleSpec(r.vmIP, PortMapping{HostPort: r.hostPort, GuestPort: r.guestPort, Protocol: r.protocol})
+}
+
+func (r dnatRule) String() string {
+	if r.lastHostPort > 0 {
+		return fmt.Sprintf("%d-%d->%s", r.hostPort, r.lastHostPort, r.vmIP)
+	}
+	return fmt.Sprintf("%d->%s:%d", r.hostPort, r.vmIP, r.guestPort)
+}
+
+// dnatRuleSpec returns the iptables rulespec forwarding the host port to the VM.
+func dnatRuleSpec(vmIP string, mapping PortMapping) []string {
+	return []string{
+		"-p", mapping.Protocol,
+		"--dport", strconv.Itoa(mapping.HostPort),
+		"-j", "DNAT",
+		"--to-destination", fmt.Sprintf("%s:%d", vmIP, mapping.GuestPort),
+	}
+}
+
+// parseDNATRule parses a rule as listed by iptables -S, e.g.
+// "-A PREROUTING -p udp -m udp --dport 40000 -j DNAT --to-destination 172.16.0.2:53"
+// or of a port range "-A PREROUTING -p tcp -m tcp --dport 40000:40009 -j DNAT --to-destination 172.16.0.2".
+// Only DNAT rules with a destination inside subnet are reported as walkio rules.
+func parseDNATRule(rule string, subnet *net.IPNet) (dnatRule, bool) {
+	var parsed dnatRule
+	var target, destination string
+	fields := strings.Fields(rule)
+	for i := 0; i < len(fields)-1; i++ {
+		switch fields[i] {
+		case "-p":
+			parsed.protocol = fields[i+1]
+		case "--dport":
+			first, last, isRange := strings.Cut(fields[i+1], ":")
+			parsed.hostPort, _ = strconv.Atoi(first)
+			if isRange {
+				parsed.lastHostPort, _ = strconv.Atoi(last)
+				if parsed.lastHostPort == 0 {
+					return dnatRule{}, false
+				}
+			}
+		case "-j":
+			target = fields[i+1]
+		case "--to-destination":
+			destination = fields[i+1]
+		}
+	}
+
+	if target != "DNAT" || parsed.hostPort == 0 || len(parsed.protocol) == 0 {
+		return dnatRule{}, false
+	}
+
+	// a range rule keeps the destination port of each packet
+	host := destination
+	if parsed.lastHostPort == 0 {
+		var port string
+		var err error
+		host, port, err = net.SplitHostPort(destination)
+		if err != nil {
+			return dnatRule{}, false
+		}
+		parsed.guestPort, err = strconv.Atoi(port)
+		if err != nil {
+			return dnatRule{}, false
+		}
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !subnet.Contains(ip) {
+		return dnatRule{}, false
+	}
+	parsed.vmIP = ip.String()
+
+	return parsed, true
+}
+
+// resolvConfPaths are searched in order for the host's upstream nameserver.
+// systemd-resolved only lists its loopback stub in /etc/resolv.conf, the real
+// upstreams are in its own copy. Overridden in tests.
+var resolvConfPaths = []string{"/etc/resolv.conf", "/run/systemd/resolve/resolv.conf"}
+
+// SetupDNSRedirect redirects DNS queries (udp and tcp) the VMs send to the bridge IP
+// to the first nameserver of the host, so DefaultDNS works without a resolver
+// running on the bridge. Redirects to a previous upstream are replaced.
+func SetupDNSRedirect(opts Options) error {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return err
+	}
+
+	upstream, err := hostNameserver(resolvConfPaths)
+	if err != nil {
+		return err
+	}
+
+	ipt, err := newIPTables()
 	if err != nil {
 		return fmt.Errorf("failed to initialize iptables: %w", err)
 	}
 
-	// For now, simple approach: let VMs use the bridge IP as DNS
-	// and the host will handle forwarding
-	// This requires dnsmasq or similar to be running on the bridge IP
-	// For POC, we'll skip this and rely on VMs using 8.8.8.8 directly via NAT
+	if err := removeDNSRedirects(ipt, opts.BridgeIP, upstream); err != nil {
+		return err
+	}
 
-	// Future: Add DNS forwarding rules here
-	// iptables -t nat -A PREROUTING -d 172.16.0.1 -p udp --dport 53 -j DNAT --to-destination {hostDNS}
-	// iptables -t nat -A PREROUTING -d 172.16.0.1 -p tcp --dport 53 -j DNAT --to-destination {hostDNS}
+	for _, protocol := range []string{"udp", "tcp"} {
+		// iptables -t nat -A PREROUTING -d 172.16.0.1/32 -p {udp|tcp} --dport 53 -j DNAT --to-destination {upstream}:53
+		err = ipt.AppendUnique("nat", "PREROUTING", dnsRedirectSpec(opts.BridgeIP, protocol, upstream)...)
+		if err != nil {
+			return fmt.Errorf("%w: failed to add DNS redirect: %v", ErrNATSetupFailed, err)
+		}
+	}
 
-	_ = ipt // Suppress unused variable warning for now
+	return nil
+}
+
+// TeardownDNSRedirect removes the DNS redirects of SetupDNSRedirect, whatever upstream they point to.
+func TeardownDNSRedirect(opts Options) error {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return err
+	}
+
+	ipt, err := newIPTables()
+	if err != nil {
+		return fmt.Errorf("failed to initialize iptables: %w", err)
+	}
+
+	return removeDNSRedirects(ipt, opts.BridgeIP, "")
+}
+
+// removeDNSRedirects deletes all DNS redirects of bridgeIP except the ones to keepUpstream
+func removeDNSRedirects(ipt iptablesRunner, bridgeIP, keepUpstream string) error {
+	rules, err := ipt.List("nat", "PREROUTING")
+	if err != nil {
+		return fmt.Errorf("failed to list nat rules: %w", err)
+	}
+
+	for _, rule := range rules {
+		protocol, upstream, ok := parseDNSRedirect(rule, bridgeIP)
+		if !ok || upstream == keepUpstream {
+			continue
+		}
+
+		if err := ipt.Delete("nat", "PREROUTING", dnsRedirectSpec(bridgeIP, protocol, upstream)...); err != nil {
+			return fmt.Errorf("failed to remove DNS redirect to %s: %w", upstream, err)
+		}
+	}
 
 	return nil
 }
 
+func dnsRedirectSpec(bridgeIP, protocol, upstream string) []string {
+	return []string{
+		"-d", bridgeIP + "/32",
+		"-p", protocol,
+		"--dport", "53",
+		"-j", "DNAT",
+		"--to-destination", upstream + ":53",
+	}
+}
+
+// parseDNSRedirect parses a rule as listed by iptables -S, e.g.
+// "-A PREROUTING -d 172.16.0.1/32 -p udp -m udp --dport 53 -j DNAT --to-destination 1.1.1.1:53"
+// and returns its protocol and upstream if it is a DNS redirect of bridgeIP.
+func parseDNSRedirect(rule, bridgeIP string) (string, string, bool) {
+	var destination, protocol, dport, target, toDestination string
+	fields := strings.Fields(rule)
+	for i := 0; i < len(fields)-1; i++ {
+		switch fields[i] {
+		case "-d":
+			destination = fields[i+1]
+		case "-p":
+			protocol = fields[i+1]
+		case "--dport":
+			dport = fields[i+1]
+		case "-j":
+			target = fields[i+1]
+		case "--to-destination":
+			toDestination = fields[i+1]
+		}
+	}
+
+	if destination != bridgeIP+"/32" || dport != "53" || target != "DNAT" || len(protocol) == 0 {
+		return "", "", false
+	}
+
+	upstream, port, err := net.SplitHostPort(toDestination)
+	if err != nil || port != "53" {
+		return "", "", false
+	}
+
+	return protocol, upstream, true
+}
+
+// hostNameserver returns the first IPv4 nameserver in the resolv.conf files that
+// is reachable from the bridge, loopback resolvers are skipped.
+func hostNameserver(paths []string) (string, error) {
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		for line := range strings.Lines(string(data)) {
+			fields := strings.Fields(line)
+			if len(fields) < 2 || fields[0] != "nameserver" {
+				continue
+			}
+
+			ip := net.ParseIP(fields[1]).To4()
+			if ip != nil && !ip.IsLoopback() {
+				return ip.String(), nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("%w in %s", ErrNoUpstreamDNS, strings.Join(paths, ", "))
+}
+
+// ipForwardPath is the IPv4 forwarding sysctl, overridden in tests
+var ipForwardPath = "/proc/sys/net/ipv4/ip_forward"
+
 // enableIPForwarding enables IPv4 forwarding in the kernel.
 func enableIPForwarding() error {
-	const ipForwardPath = "/proc/sys/net/ipv4/ip_forward"
-
 	// Check current value
 	data, err := os.ReadFile(ipForwardPath)
 	if err != nil {
@@ -0,0 +1,404 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var protocolMatch = regexp.MustCompile(` -m (tcp|udp)`)
+
+// fakeIPTables keeps rules in memory in iptables -S format
+type fakeIPTables struct {
+	rules map[string][]string // "table/chain" -> rules
+}
+
+func newFakeIPTables(t *testing.T) *fakeIPTables {
+	t.Helper()
+
+	fake := &fakeIPTables{rules: make(map[string][]string)}
+	original := newIPTables
+	newIPTables = func() (iptablesRunner, error) { return fake, nil }
+	t.Cleanup(func() { newIPTables = original })
+
+	return fake
+}
+
+func (f *fakeIPTables) ruleString(chain string, rulespec []string) string {
+	return "-A " + chain + " " + strings.Join(rulespec, " ")
+}
+
+func (f *fakeIPTables) List(table, chain string) ([]string, error) {
+	return append([]string{"-P " + chain + " ACCEPT"}, f.rules[table+"/"+chain]...), nil
+}
+
+func (f *fakeIPTables) AppendUnique(table, chain string, rulespec ...string) error {
+	rule := f.ruleString(chain, rulespec)
+	if !slices.Contains(f.rules[table+"/"+chain], rule) {
+		f.rules[table+"/"+chain] = append(f.rules[table+"/"+chain], rule)
+	}
+	return nil
+}
+
+func (f *fakeIPTables) Delete(table, chain string, rulespec ...string) error {
+	rule := f.ruleString(chain, rulespec)
+	f.rules[table+"/"+chain] = slices.DeleteFunc(f.rules[table+"/"+chain], func(r string) bool {
+		// iptables -S lists the implicit protocol match module, -D matches without it
+		return protocolMatch.ReplaceAllString(r, "") == rule
+	})
+	return nil
+}
+
+func TestReconcilePortMappingsAddsMissing(t *testing.T) {
+	fake := newFakeIPTables(t)
+
+	live := map[string][]PortMapping{
+		"172.16.0.2": {{HostPort: 40000, GuestPort: 80, Protocol: "tcp"}},
+		"172.16.0.3": {{HostPort: 40001, GuestPort: 8080, Protocol: "tcp"}},
+	}
+	if err := AddPortMappings("172.16.0.2", live["172.16.0.2"]); err != nil {
+		t.Fatalf("AddPortMappings failed: %v", err)
+	}
+
+	if err := ReconcilePortMappings(DefaultOptions(), live, nil); err != nil {
+		t.Fatalf("ReconcilePortMappings failed: %v", err)
+	}
+
+	got := fake.rules["nat/PREROUTING"]
+	want := []string{
+		"-A PREROUTING -p tcp --dport 40000 -j DNAT --to-destination 172.16.0.2:80",
+		"-A PREROUTING -p tcp --dport 40001 -j DNAT --to-destination 172.16.0.3:8080",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("rules = %v, want %v", got, want)
+	}
+}
+
+func TestReconcilePortMappingsRemovesStale(t *testing.T) {
+	fake := newFakeIPTables(t)
+	fake.rules["nat/PREROUTING"] = []string{
+		"-A PREROUTING -p tcp -m tcp --dport 40000 -j DNAT --to-destination 172.16.0.2:80",
+		"-A PREROUTING -p tcp -m tcp --dport 40005 -j DNAT --to-destination 172.16.0.9:22",
+		// not a walkio rule, destination outside the bridge network
+		"-A PREROUTING -p tcp -m tcp --dport 8443 -j DNAT --to-destination 10.0.0.5:443",
+	}
+
+	live := map[string][]PortMapping{
+		"172.16.0.2": {{HostPort: 40000, GuestPort: 80, Protocol: "tcp"}},
+	}
+
+	if err := ReconcilePortMappings(DefaultOptions(), live, nil); err != nil {
+		t.Fatalf("ReconcilePortMappings failed: %v", err)
+	}
+
+	got := fake.rules["nat/PREROUTING"]
+	want := []string{
+		"-A PREROUTING -p tcp -m tcp --dport 40000 -j DNAT --to-destination 172.16.0.2:80",
+		"-A PREROUTING -p tcp -m tcp --dport 8443 -j DNAT --to-destination 10.0.0.5:443",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("rules = %v, want %v", got, want)
+	}
+}
+
+func TestReconcilePortMappingsCustomSubnet(t *testing.T) {
+	fake := newFakeIPTables(t)
+	fake.rules["nat/PREROUTING"] = []string{
+		"-A PREROUTING -p tcp -m tcp --dport 40005 -j DNAT --to-destination 10.10.0.9:22",
+		// inside the default subnet, not walkio's with the custom one
+		"-A PREROUTING -p tcp -m tcp --dport 40006 -j DNAT --to-destination 172.16.0.2:22",
+	}
+
+	live := map[string][]PortMapping{
+		"10.10.0.2": {{HostPort: 40000, GuestPort: 80, Protocol: "tcp"}},
+	}
+	if err := ReconcilePortMappings(Options{BridgeCIDR: "10.10.0.0/16"}, live, nil); err != nil {
+		t.Fatalf("ReconcilePortMappings failed: %v", err)
+	}
+
+	got := fake.rules["nat/PREROUTING"]
+	want := []string{
+		"-A PREROUTING -p tcp -m tcp --dport 40006 -j DNAT --to-destination 172.16.0.2:22",
+		"-A PREROUTING -p tcp --dport 40000 -j DNAT --to-destination 10.10.0.2:80",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("rules = %v, want %v", got, want)
+	}
+}
+
+func TestParseDNATRule(t *testing.T) {
+	tests := []struct {
+		name   string
+		rule   string
+		want   dnatRule
+		wantOk bool
+	}{
+		{
+			name:   "walkio rule with match module",
+			rule:   "-A PREROUTING -p tcp -m tcp --dport 40000 -j DNAT --to-destination 172.16.0.2:80",
+			want:   dnatRule{protocol: "tcp", hostPort: 40000, vmIP: "172.16.0.2", guestPort: 80},
+			wantOk: true,
+		},
+		{
+			name:   "udp rule",
+			rule:   "-A PREROUTING -p udp -m udp --dport 40001 -j DNAT --to-destination 172.16.0.3:53",
+			want:   dnatRule{protocol: "udp", hostPort: 40001, vmIP: "172.16.0.3", guestPort: 53},
+			wantOk: true,
+		},
+		{
+			name:   "port range rule",
+			rule:   "-A PREROUTING -p tcp -m tcp --dport 40000:40009 -j DNAT --to-destination 172.16.0.2",
+			want:   dnatRule{protocol: "tcp", hostPort: 40000, lastHostPort: 40009, vmIP: "172.16.0.2"},
+			wantOk: true,
+		},
+		{
+			name: "port range rule with a destination port",
+			rule: "-A PREROUTING -p tcp --dport 40000:40009 -j DNAT --to-destination 172.16.0.2:80",
+		},
+		{
+			name: "destination outside bridge network",
+			rule: "-A PREROUTING -p tcp --dport 40000 -j DNAT --to-destination 10.0.0.2:80",
+		},
+		{
+			name: "not a DNAT rule",
+			rule: "-A PREROUTING -p tcp --dport 40000 -j ACCEPT",
+		},
+		{
+			name: "chain policy",
+			rule: "-P PREROUTING ACCEPT",
+		},
+	}
+
+	_, subnet, _ := net.ParseCIDR(BridgeCIDR)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseDNATRule(tt.rule, subnet)
+			if ok != tt.wantOk {
+				t.Fatalf("parseDNATRule() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if got != tt.want {
+				t.Errorf("parseDNATRule() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPortMappingsMixedProtocols(t *testing.T) {
+	fake := newFakeIPTables(t)
+
+	mappings := []PortMapping{
+		{HostPort: 40000, GuestPort: 80, Protocol: "tcp"},
+		{HostPort: 40001, GuestPort: 53, Protocol: "udp"},
+	}
+	if err := AddPortMappings("172.16.0.2", mappings); err != nil {
+		t.Fatalf("AddPortMappings failed: %v", err)
+	}
+
+	want := []string{
+		"-A PREROUTING -p tcp --dport 40000 -j DNAT --to-destination 172.16.0.2:80",
+		"-A PREROUTING -p udp --dport 40001 -j DNAT --to-destination 172.16.0.2:53",
+	}
+	if got := fake.rules["nat/PREROUTING"]; !slices.Equal(got, want) {
+		t.Errorf("rules = %v, want %v", got, want)
+	}
+
+	if err := RemovePortMappings("172.16.0.2", mappings); err != nil {
+		t.Fatalf("RemovePortMappings failed: %v", err)
+	}
+	if got := fake.rules["nat/PREROUTING"]; len(got) != 0 {
+		t.Errorf("rules left after removal: %v", got)
+	}
+}
+
+func TestPortMappingsRejectUnknownProtocol(t *testing.T) {
+	fake := newFakeIPTables(t)
+
+	mappings := []PortMapping{
+		{HostPort: 40000, GuestPort: 80, Protocol: "tcp"},
+		{HostPort: 40001, GuestPort: 132, Protocol: "sctp"},
+	}
+
+	if err := AddPortMappings("172.16.0.2", mappings); !errors.Is(err, ErrInvalidProtocol) {
+		t.Errorf("AddPortMappings error = %v, want %v", err, ErrInvalidProtocol)
+	}
+	if got := fake.rules["nat/PREROUTING"]; len(got) != 0 {
+		t.Errorf("rules added for rejected batch: %v", got)
+	}
+
+	if err := RemovePortMappings("172.16.0.2", mappings); !errors.Is(err, ErrInvalidProtocol) {
+		t.Errorf("RemovePortMappings error = %v, want %v", err, ErrInvalidProtocol)
+	}
+	if err := ReconcilePortMappings(DefaultOptions(), map[string][]PortMapping{"172.16.0.2": mappings}, nil); !errors.Is(err, ErrInvalidProtocol) {
+		t.Errorf("ReconcilePortMappings error = %v, want %v", err, ErrInvalidProtocol)
+	}
+}
+
+func writeResolvConf(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write resolv.conf: %v", err)
+	}
+	return path
+}
+
+// stubResolvConf points hostNameserver to a resolv.conf with nameserver
+func stubResolvConf(t *testing.T, nameserver string) {
+	t.Helper()
+
+	original := resolvConfPaths
+	t.Cleanup(func() { resolvConfPaths = original })
+	resolvConfPaths = []string{writeResolvConf(t, "nameserver "+nameserver+"\n")}
+}
+
+func TestHostNameserver(t *testing.T) {
+	stub := writeResolvConf(t, "# systemd-resolved stub\nnameserver 127.0.0.53\noptions edns0\n")
+	upstream := writeResolvConf(t, "search example.com\nnameserver 2606:4700:4700::1111\nnameserver 9.9.9.9\nnameserver 1.1.1.1\n")
+
+	tests := []struct {
+		name    string
+		paths   []string
+		want    string
+		wantErr bool
+	}{
+		{name: "first ipv4 nameserver", paths: []string{upstream}, want: "9.9.9.9"},
+		{name: "loopback stub falls through", paths: []string{stub, upstream}, want: "9.9.9.9"},
+		{name: "missing file falls through", paths: []string{"/does/not/exist", upstream}, want: "9.9.9.9"},
+		{name: "only loopback", paths: []string{stub}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := hostNameserver(tt.paths)
+			if tt.wantErr {
+				if !errors.Is(err, ErrNoUpstreamDNS) {
+					t.Errorf("hostNameserver() error = %v, want %v", err, ErrNoUpstreamDNS)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("hostNameserver() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDNSRedirect(t *testing.T) {
+	fake := newFakeIPTables(t)
+	original := resolvConfPaths
+	t.Cleanup(func() { resolvConfPaths = original })
+
+	portMapping := []PortMapping{{HostPort: 40000, GuestPort: 53, Protocol: "udp"}}
+	if err := AddPortMappings("172.16.0.2", portMapping); err != nil {
+		t.Fatalf("AddPortMappings failed: %v", err)
+	}
+	mappingRule := "-A PREROUTING -p udp --dport 40000 -j DNAT --to-destination 172.16.0.2:53"
+
+	resolvConfPaths = []string{writeResolvConf(t, "nameserver 9.9.9.9\n")}
+	if err := SetupDNSRedirect(DefaultOptions()); err != nil {
+		t.Fatalf("SetupDNSRedirect failed: %v", err)
+	}
+
+	// a changed upstream replaces the redirects
+	resolvConfPaths = []string{writeResolvConf(t, "nameserver 1.1.1.1\n")}
+	if err := SetupDNSRedirect(DefaultOptions()); err != nil {
+		t.Fatalf("SetupDNSRedirect failed: %v", err)
+	}
+
+	want := []string{
+		mappingRule,
+		"-A PREROUTING -d 172.16.0.1/32 -p udp --dport 53 -j DNAT --to-destination 1.1.1.1:53",
+		"-A PREROUTING -d 172.16.0.1/32 -p tcp --dport 53 -j DNAT --to-destination 1.1.1.1:53",
+	}
+	if got := fake.rules["nat/PREROUTING"]; !slices.Equal(got, want) {
+		t.Errorf("rules = %v, want %v", got, want)
+	}
+
+	// port mapping reconciliation leaves the redirects alone
+	if err := ReconcilePortMappings(DefaultOptions(), map[string][]PortMapping{"172.16.0.2": portMapping}, nil); err != nil {
+		t.Fatalf("ReconcilePortMappings failed: %v", err)
+	}
+	if got := fake.rules["nat/PREROUTING"]; !slices.Equal(got, want) {
+		t.Errorf("rules after reconcile = %v, want %v", got, want)
+	}
+
+	if err := TeardownDNSRedirect(DefaultOptions()); err != nil {
+		t.Fatalf("TeardownDNSRedirect failed: %v", err)
+	}
+	if got := fake.rules["nat/PREROUTING"]; !slices.Equal(got, []string{mappingRule}) {
+		t.Errorf("rules after teardown = %v, want only the port mapping", got)
+	}
+}
+
+func TestRangePortMapping(t *testing.T) {
+	fake := newFakeIPTables(t)
+
+	portRange := PortRange{First: 40000, Last: 40009, Protocol: "tcp"}
+	if err := AddRangePortMapping("172.16.0.2", portRange); err != nil {
+		t.Fatalf("AddRangePortMapping failed: %v", err)
+	}
+	want := []string{"-A PREROUTING -p tcp --dport 40000:40009 -j DNAT --to-destination 172.16.0.2"}
+	if got := fake.rules["nat/PREROUTING"]; !slices.Equal(got, want) {
+		t.Errorf("rules = %v, want %v", got, want)
+	}
+
+	if err := RemoveRangePortMapping("172.16.0.2", portRange); err != nil {
+		t.Fatalf("RemoveRangePortMapping failed: %v", err)
+	}
+	if got := fake.rules["nat/PREROUTING"]; len(got) != 0 {
+		t.Errorf("rules after removal = %v", got)
+	}
+
+	invalid := []struct {
+		first, last int
+		protocol    string
+		want        error
+	}{
+		{40009, 40000, "tcp", ErrInvalidPort},
+		{0, 10, "tcp", ErrInvalidPort},
+		{65535, 65536, "udp", ErrInvalidPort},
+		{40000, 40009, "icmp", ErrInvalidProtocol},
+	}
+	for _, tt := range invalid {
+		if err := AddRangePortMapping("172.16.0.2", PortRange{First: tt.first, Last: tt.last, Protocol: tt.protocol}); !errors.Is(err, tt.want) {
+			t.Errorf("AddRangePortMapping(%d, %d, %s) error = %v, want %v", tt.first, tt.last, tt.protocol, err, tt.want)
+		}
+	}
+}
+
+func TestReconcilePortMappingsRanges(t *testing.T) {
+	fake := newFakeIPTables(t)
+	fake.rules["nat/PREROUTING"] = []string{
+		// stale range of a VM that is gone
+		"-A PREROUTING -p udp -m udp --dport 41000:41009 -j DNAT --to-destination 172.16.0.3",
+		// range of another service
+		"-A PREROUTING -p tcp -m tcp --dport 50000:50009 -j DNAT --to-destination 192.168.1.10",
+	}
+
+	liveRanges := map[string][]PortRange{"172.16.0.2": {{First: 40000, Last: 40009, Protocol: "tcp"}}}
+	if err := ReconcilePortMappings(DefaultOptions(), nil, liveRanges); err != nil {
+		t.Fatalf("ReconcilePortMappings failed: %v", err)
+	}
+
+	want := []string{
+		"-A PREROUTING -p tcp -m tcp --dport 50000:50009 -j DNAT --to-destination 192.168.1.10",
+		"-A PREROUTING -p tcp --dport 40000:40009 -j DNAT --to-destination 172.16.0.2",
+	}
+	if got := fake.rules["nat/PREROUTING"]; !slices.Equal(got, want) {
+		t.Errorf("rules = %v, want %v", got, want)
+	}
+
+	// a converged range is kept
+	if err := ReconcilePortMappings(DefaultOptions(), nil, liveRanges); err != nil {
+		t.Fatalf("ReconcilePortMappings failed: %v", err)
+	}
+	if got := fake.rules["nat/PREROUTING"]; !slices.Equal(got, want) {
+		t.Errorf("rules after second reconcile = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,110 @@
+package network
+
+import (
+	"fmt"
+	"net"
+)
+
+// Options overrides the network defaults of types.go, e.g. to run two walkio
+// instances on one host or to move off a subnet the LAN already uses.
+// Empty fields keep their default. If only BridgeCIDR is set, the bridge gets
+// the first host address of the subnet and the pool the remaining ones.
+type Options struct {
+	BridgeName    string // default BridgeName
+	BridgeCIDR    string // subnet of the bridge, default BridgeCIDR
+	BridgeIP      string // default first host address of BridgeCIDR
+	IPPoolStart   string // default the address after BridgeIP
+	IPPoolEnd     string // default the last host address of BridgeCIDR
+	HostPortStart int    // default HostPortPoolStart
+	HostPortEnd   int    // default HostPortPoolEnd
+}
+
+// DefaultOptions are the options of the constants in types.go
+func DefaultOptions() Options {
+	return Options{
+		BridgeName:    BridgeName,
+		BridgeCIDR:    BridgeCIDR,
+		BridgeIP:      BridgeIP,
+		IPPoolStart:   IPPoolStart,
+		IPPoolEnd:     IPPoolEnd,
+		HostPortStart: HostPortPoolStart,
+		HostPortEnd:   HostPortPoolEnd,
+	}
+}
+
+// withDefaults fills the empty fields and validates that bridge IP and pool are inside the subnet
+func (o Options) withDefaults() (Options, error) {
+	if len(o.BridgeName) == 0 {
+		o.BridgeName = BridgeName
+	}
+	if len(o.BridgeCIDR) == 0 {
+		o.BridgeCIDR = BridgeCIDR
+	}
+	if o.HostPortStart == 0 {
+		o.HostPortStart = HostPortPoolStart
+	}
+	if o.HostPortEnd == 0 {
+		o.HostPortEnd = HostPortPoolEnd
+	}
+
+	subnet, err := o.subnet()
+	if err != nil {
+		return o, err
+	}
+	ones, bits := subnet.Mask.Size()
+	if bits != 32 || ones > 30 {
+		return o, fmt.Errorf("bridge subnet %s must be IPv4 with room for the bridge and a VM", o.BridgeCIDR)
+	}
+
+	// first and last address are network and broadcast
+	first := ipToUint32(subnet.IP) + 1
+	last := ipToUint32(subnet.IP) | ^ipToUint32(net.IP(subnet.Mask)) - 1
+	if len(o.BridgeIP) == 0 {
+		o.BridgeIP = uint32ToIP(first).String()
+	}
+	if len(o.IPPoolStart) == 0 {
+		o.IPPoolStart = uint32ToIP(ipToUint32(net.ParseIP(o.BridgeIP)) + 1).String()
+	}
+	if len(o.IPPoolEnd) == 0 {
+		o.IPPoolEnd = uint32ToIP(last).String()
+	}
+
+	for _, ip := range []string{o.BridgeIP, o.IPPoolStart, o.IPPoolEnd} {
+		parsed := net.ParseIP(ip)
+		if parsed == nil || parsed.To4() == nil || !subnet.Contains(parsed) {
+			return o, fmt.Errorf("address %s is not inside the bridge subnet %s", ip, o.BridgeCIDR)
+		}
+	}
+
+	return o, nil
+}
+
+func (o Options) subnet() (*net.IPNet, error) {
+	_, subnet, err := net.ParseCIDR(o.BridgeCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bridge subnet: %w", err)
+	}
+
+	return subnet, nil
+}
+
+// bridgeAddr is the bridge IP with the prefix length of the subnet, e.g. 172.16.0.1/24
+func (o Options) bridgeAddr() string {
+	subnet, err := o.subnet()
+	if err != nil {
+		return o.BridgeIP
+	}
+
+	ones, _ := subnet.Mask.Size()
+	return fmt.Sprintf("%s/%d", o.BridgeIP, ones)
+}
+
+// SubnetMask returns the dotted netmask of the bridge subnet, e.g. 255.255.255.0
+func (o Options) SubnetMask() string {
+	subnet, err := o.subnet()
+	if err != nil {
+		return SubnetMask
+	}
+
+	return net.IP(subnet.Mask).String()
+}
@@ -0,0 +1,122 @@
+package network
+
+import (
+	"testing"
+)
+
+func TestOptionsWithDefaults(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		want Options
+	}{
+		{
+			name: "defaults",
+			opts: Options{},
+			want: DefaultOptions(),
+		},
+		{
+			name: "derived from subnet",
+			opts: Options{BridgeCIDR: "10.10.0.0/16"},
+			want: Options{
+				BridgeName:    BridgeName,
+				BridgeCIDR:    "10.10.0.0/16",
+				BridgeIP:      "10.10.0.1",
+				IPPoolStart:   "10.10.0.2",
+				IPPoolEnd:     "10.10.255.254",
+				HostPortStart: HostPortPoolStart,
+				HostPortEnd:   HostPortPoolEnd,
+			},
+		},
+		{
+			name: "explicit pool inside subnet",
+			opts: Options{
+				BridgeName:    "walkio-br1",
+				BridgeCIDR:    "192.168.50.0/24",
+				BridgeIP:      "192.168.50.254",
+				IPPoolStart:   "192.168.50.100",
+				IPPoolEnd:     "192.168.50.199",
+				HostPortStart: 20000,
+				HostPortEnd:   20100,
+			},
+			want: Options{
+				BridgeName:    "walkio-br1",
+				BridgeCIDR:    "192.168.50.0/24",
+				BridgeIP:      "192.168.50.254",
+				IPPoolStart:   "192.168.50.100",
+				IPPoolEnd:     "192.168.50.199",
+				HostPortStart: 20000,
+				HostPortEnd:   20100,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.opts.withDefaults()
+			if err != nil {
+				t.Fatalf("withDefaults() failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("withDefaults() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOptionsWithDefaultsInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{name: "malformed subnet", opts: Options{BridgeCIDR: "172.16.0.0"}},
+		{name: "IPv6 subnet", opts: Options{BridgeCIDR: "fd00::/64"}},
+		{name: "subnet too small", opts: Options{BridgeCIDR: "172.16.0.0/31"}},
+		{name: "bridge IP outside subnet", opts: Options{BridgeCIDR: "10.10.0.0/24", BridgeIP: "172.16.0.1"}},
+		{name: "pool end outside subnet", opts: Options{BridgeCIDR: "10.10.0.0/24", IPPoolEnd: "10.10.1.10"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.opts.withDefaults(); err == nil {
+				t.Errorf("withDefaults() succeeded for %+v", tt.opts)
+			}
+		})
+	}
+}
+
+func TestOptionsAddresses(t *testing.T) {
+	opts, err := Options{BridgeCIDR: "10.10.0.0/16"}.withDefaults()
+	if err != nil {
+		t.Fatalf("withDefaults() failed: %v", err)
+	}
+
+	if got := opts.bridgeAddr(); got != "10.10.0.1/16" {
+		t.Errorf("bridgeAddr() = %q, want %q", got, "10.10.0.1/16")
+	}
+	if got := opts.SubnetMask(); got != "255.255.0.0" {
+		t.Errorf("SubnetMask() = %q, want %q", got, "255.255.0.0")
+	}
+	if got := DefaultOptions().SubnetMask(); got != SubnetMask {
+		t.Errorf("default SubnetMask() = %q, want %q", got, SubnetMask)
+	}
+}
+
+func TestNewNetworkManagerOptions(t *testing.T) {
+	manager, err := NewNetworkManager(Options{BridgeCIDR: "10.10.0.0/30"})
+	if err != nil {
+		t.Fatalf("NewNetworkManager failed: %v", err)
+	}
+
+	ip, err := manager.ipPool.AllocateIP("vm-1")
+	if err != nil {
+		t.Fatalf("AllocateIP failed: %v", err)
+	}
+	if ip.String() != "10.10.0.2" {
+		t.Errorf("AllocateIP() = %s, want 10.10.0.2", ip)
+	}
+
+	if _, err := NewNetworkManager(Options{HostPortStart: 50000, HostPortEnd: 40000}); err == nil {
+		t.Error("NewNetworkManager succeeded with an empty port range")
+	}
+}
@@ -1,11 +1,19 @@
 package network
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/vishvananda/netlink"
 )
 
+// link operations of ReconcileTAPs, overridden in tests
+var (
+	listLinks  = netlink.LinkList
+	deleteLink = netlink.LinkDel
+)
+
 // GenerateTAPName creates a TAP device name from VM ID (UUID v7).
 // Format: walkio-{last4timestamp}{last4uuid}
 //
@@ -35,9 +43,16 @@ func GenerateTAPName(vmID string) string {
 	return TAPPrefix + last4Timestamp + last4UUID
 }
 
-// CreateTAP creates a TAP device and attaches it to the bridge.
-// Returns the TAP device name.
-func CreateTAP(vmID string) (string, error) {
+// TAPOwner is the user and group allowed to open a TAP device besides root,
+// e.g. the unprivileged user of a jailed VMM. The zero value leaves it to root.
+type TAPOwner struct {
+	UID int
+	GID int
+}
+
+// CreateTAP creates a TAP device owned by owner and attaches it to the bridge
+// bridgeName. Returns the TAP device name.
+func CreateTAP(vmID, bridgeName string, owner TAPOwner) (string, error) {
 	tapName := GenerateTAPName(vmID)
 
 	// Check if TAP already exists
@@ -51,6 +66,8 @@ func CreateTAP(vmID string) (string, error) {
 	tap := &netlink.Tuntap{
 		LinkAttrs: la,
 		Mode:      netlink.TUNTAP_MODE_TAP,
+		Owner:     uint32(owner.UID),
+		Group:     uint32(owner.GID),
 	}
 
 	if err := netlink.LinkAdd(tap); err != nil {
@@ -58,7 +75,7 @@ func CreateTAP(vmID string) (string, error) {
 	}
 
 	// Get the bridge
-	bridge, err := netlink.LinkByName(BridgeName)
+	bridge, err := netlink.LinkByName(bridgeName)
 	if err != nil {
 		// Cleanup TAP device if we can't find bridge
 		_ = netlink.LinkDel(tap)
@@ -112,3 +129,45 @@ func TAPExists(name string) bool {
 	_, ok := link.(*netlink.Tuntap)
 	return ok
 }
+
+// ReconcileTAPs removes walkio TAP devices (TAPPrefix) attached to the bridge of
+// the manager whose name is not in live, e.g. left behind by VMs that crashed or
+// were never stopped. TAPs of other bridges, e.g. of another walkio instance, and
+// other links are left untouched. Returns the removed TAPs.
+func (m *NetworkManager) ReconcileTAPs(live map[string]bool) ([]string, error) {
+	links, err := listLinks()
+	if err != nil {
+		return nil, fmt.Errorf("list links: %w", err)
+	}
+
+	bridgeIndex := 0
+	for _, link := range links {
+		if _, ok := link.(*netlink.Bridge); ok && link.Attrs().Name == m.opts.BridgeName {
+			bridgeIndex = link.Attrs().Index
+		}
+	}
+	// without the bridge no TAP is ours
+	if bridgeIndex == 0 {
+		return nil, nil
+	}
+
+	var removed []string
+	var errs []error
+	for _, link := range links {
+		name := link.Attrs().Name
+		if _, ok := link.(*netlink.Tuntap); !ok || !strings.HasPrefix(name, TAPPrefix) || live[name] {
+			continue
+		}
+		if link.Attrs().MasterIndex != bridgeIndex {
+			continue
+		}
+
+		if err := deleteLink(link); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete TAP device %s: %w", name, err))
+			continue
+		}
+		removed = append(removed, name)
+	}
+
+	return removed, errors.Join(errs...)
+}
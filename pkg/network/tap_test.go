@@ -0,0 +1,83 @@
+package network
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func fakeLinks(t *testing.T, links ...netlink.Link) *[]string {
+	t.Helper()
+
+	var deleted []string
+	originalList, originalDelete := listLinks, deleteLink
+	listLinks = func() ([]netlink.Link, error) { return links, nil }
+	deleteLink = func(link netlink.Link) error {
+		if link.Attrs().Name == "walkio-busy0000" {
+			return errors.New("device or resource busy")
+		}
+		deleted = append(deleted, link.Attrs().Name)
+		return nil
+	}
+	t.Cleanup(func() { listLinks, deleteLink = originalList, originalDelete })
+
+	return &deleted
+}
+
+// bridgeIndex is the link index of the manager's bridge in the fake link list
+const bridgeIndex = 7
+
+func tap(name string, masterIndex int) netlink.Link {
+	return &netlink.Tuntap{LinkAttrs: netlink.LinkAttrs{Name: name, MasterIndex: masterIndex}, Mode: netlink.TUNTAP_MODE_TAP}
+}
+
+func bridge(name string, index int) netlink.Link {
+	return &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name, Index: index}}
+}
+
+func TestReconcileTAPs(t *testing.T) {
+	deleted := fakeLinks(t,
+		tap("walkio-live0001", bridgeIndex),
+		tap("walkio-dead0002", bridgeIndex),
+		tap("walkio-othr0003", bridgeIndex+1),
+		tap("walkio-free0004", 0),
+		tap("tap0", bridgeIndex),
+		bridge(BridgeName, bridgeIndex),
+		bridge("other-br0", bridgeIndex+1),
+		&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth0"}},
+	)
+
+	removed, err := newTestManager(t).ReconcileTAPs(map[string]bool{"walkio-live0001": true})
+	if err != nil {
+		t.Fatalf("ReconcileTAPs failed: %v", err)
+	}
+
+	// TAPs of another bridge or of none belong to someone else
+	want := []string{"walkio-dead0002"}
+	if !slices.Equal(removed, want) || !slices.Equal(*deleted, want) {
+		t.Errorf("removed = %v, deleted = %v, want %v", removed, *deleted, want)
+	}
+}
+
+func TestReconcileTAPsWithoutBridge(t *testing.T) {
+	deleted := fakeLinks(t, tap("walkio-dead0002", bridgeIndex+1), bridge("other-br0", bridgeIndex+1))
+
+	removed, err := newTestManager(t).ReconcileTAPs(nil)
+	if err != nil || len(removed) > 0 || len(*deleted) > 0 {
+		t.Errorf("ReconcileTAPs() = %v, %v, deleted %v, want nothing removed", removed, err, *deleted)
+	}
+}
+
+func TestReconcileTAPsContinuesOnError(t *testing.T) {
+	deleted := fakeLinks(t, tap("walkio-busy0000", bridgeIndex), tap("walkio-dead0002", bridgeIndex), bridge(BridgeName, bridgeIndex))
+
+	removed, err := newTestManager(t).ReconcileTAPs(nil)
+	if err == nil {
+		t.Error("ReconcileTAPs ignored a failed delete")
+	}
+	if want := []string{"walkio-dead0002"}; !slices.Equal(removed, want) || !slices.Equal(*deleted, want) {
+		t.Errorf("removed = %v, deleted = %v, want %v", removed, *deleted, want)
+	}
+}
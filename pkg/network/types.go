@@ -37,12 +37,21 @@ type NetworkConfig struct {
 	IPAddress   string // Assigned IP address (e.g., "172.16.0.2")
 	MACAddress  string // Generated MAC address (e.g., "AA:FC:00:A1:B2:C3")
 	Gateway     string // Gateway IP (typically BridgeIP)
+	Netmask     string // Netmask of the bridge subnet, SubnetMask if empty
 	DNS         string // DNS server IP (typically BridgeIP)
 }
 
-// PortMapping represents a TCP port forward from host to VM.
+// PortMapping represents a port forward from host to VM.
 type PortMapping struct {
 	HostPort  int
 	GuestPort int
-	Protocol  string
+	Protocol  string // "tcp" or "udp", other protocols are rejected with ErrInvalidProtocol
+}
+
+// PortRange forwards the host ports First to Last to the same guest ports
+// with a single rule, see AddRangePortMapping.
+type PortRange struct {
+	First    int
+	Last     int
+	Protocol string // "tcp" or "udp"
 }
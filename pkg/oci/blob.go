@@ -0,0 +1,136 @@
+package oci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/opencontainers/go-digest"
+)
+
+// maxBlobResumes bounds how often a single blob download is resumed
+const maxBlobResumes = 5
+
+// blobFetcher downloads blobs of one repository. Its transport exchanges and
+// refreshes bearer tokens on 401, so every resumed request re-authenticates.
+type blobFetcher struct {
+	client *http.Client
+	repo   name.Repository
+}
+
+func newBlobFetcher(ctx context.Context, repo name.Repository, base http.RoundTripper) (*blobFetcher, error) {
+	rt, err := transport.NewWithContext(ctx, repo.Registry, authn.Anonymous, base, []string{repo.Scope(transport.PullScope)})
+	if err != nil {
+		return nil, fmt.Errorf("registry transport: %w", err)
+	}
+
+	return &blobFetcher{client: &http.Client{Transport: rt}, repo: repo}, nil
+}
+
+// open requests the blob starting at offset
+func (f *blobFetcher) open(ctx context.Context, dgst digest.Digest, offset int64) (io.ReadCloser, error) {
+	url := fmt.Sprintf("%s://%s/v2/%s/blobs/%s", f.repo.Registry.Scheme(), f.repo.RegistryStr(), f.repo.RepositoryStr(), dgst)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("get blob %s: %w", dgst, err)
+	}
+
+	switch {
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		return resp.Body, nil
+	case resp.StatusCode == http.StatusOK:
+		// the registry ignored the range, skip what was already read
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("get blob %s: skip to offset %d: %w", dgst, offset, err)
+		}
+		return resp.Body, nil
+	default:
+		defer resp.Body.Close()
+		// a *transport.Error carries the status, so retries can tell 5xx from 404
+		return nil, fmt.Errorf("get blob %s: %w", dgst, transport.CheckError(resp, http.StatusOK, http.StatusPartialContent))
+	}
+}
+
+// resumableBlobReader resumes an interrupted blob download from the last offset,
+// e.g. when the connection breaks because the token expired mid-pull.
+// The content is verified against the digest once fully read.
+type resumableBlobReader struct {
+	ctx      context.Context
+	fetcher  *blobFetcher
+	digest   digest.Digest
+	size     int64
+	body     io.ReadCloser
+	offset   int64
+	resumes  int
+	verifier digest.Verifier
+}
+
+func newResumableBlobReader(ctx context.Context, fetcher *blobFetcher, dgst digest.Digest, size int64) (*resumableBlobReader, error) {
+	body, err := fetcher.open(ctx, dgst, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &resumableBlobReader{
+		ctx:      ctx,
+		fetcher:  fetcher,
+		digest:   dgst,
+		size:     size,
+		body:     body,
+		verifier: dgst.Verifier(),
+	}, nil
+}
+
+func (r *resumableBlobReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.body.Read(p)
+		r.offset += int64(n)
+		_, _ = r.verifier.Write(p[:n])
+
+		complete := errors.Is(err, io.EOF) && (r.size <= 0 || r.offset >= r.size)
+		switch {
+		case err == nil:
+			return n, nil
+		case complete:
+			if !r.verifier.Verified() {
+				return n, fmt.Errorf("blob %s: digest mismatch", r.digest)
+			}
+			return n, io.EOF
+		case r.ctx.Err() != nil:
+			return n, r.ctx.Err()
+		case r.resumes >= maxBlobResumes:
+			return n, fmt.Errorf("blob %s: giving up after %d resumes: %w", r.digest, r.resumes, err)
+		}
+
+		r.resumes++
+		_ = r.body.Close()
+		body, openErr := r.fetcher.open(r.ctx, r.digest, r.offset)
+		if openErr != nil {
+			return n, fmt.Errorf("blob %s: resume at %d: %w", r.digest, r.offset, openErr)
+		}
+		r.body = body
+
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (r *resumableBlobReader) Close() error {
+	return r.body.Close()
+}
@@ -0,0 +1,153 @@
+package oci
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/opencontainers/go-digest"
+)
+
+// fakeTokenRegistry serves a single blob behind bearer auth. The first full
+// download is cut off halfway and invalidates the token, like a token expiring mid-pull.
+type fakeTokenRegistry struct {
+	mu            sync.Mutex
+	blob          []byte
+	digest        digest.Digest
+	token         string
+	tokensIssued  int
+	rangeRequests int
+	cutOff        bool
+}
+
+func (f *fakeTokenRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/token" {
+		f.tokensIssued++
+		f.token = fmt.Sprintf("token-%d", f.tokensIssued)
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": f.token})
+		return
+	}
+
+	if len(f.token) == 0 || r.Header.Get("Authorization") != "Bearer "+f.token {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="fake"`, r.Host))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/v2/":
+		w.WriteHeader(http.StatusOK)
+
+	case "/v2/test/app/blobs/" + f.digest.String():
+		if start, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes="); ok {
+			offset, _ := strconv.Atoi(strings.TrimSuffix(start, "-"))
+			f.rangeRequests++
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(f.blob[offset:])
+			return
+		}
+
+		if f.cutOff {
+			_, _ = w.Write(f.blob)
+			return
+		}
+
+		f.cutOff = true
+		f.token = ""
+		w.Header().Set("Content-Length", strconv.Itoa(len(f.blob)))
+		_, _ = w.Write(f.blob[:len(f.blob)/2])
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestResumableBlobReaderReauthenticates(t *testing.T) {
+	blob := make([]byte, 256*1024)
+	if _, err := rand.Read(blob); err != nil {
+		t.Fatal(err)
+	}
+	registry := &fakeTokenRegistry{blob: blob, digest: digest.FromBytes(blob)}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	repo, err := name.NewRepository(strings.TrimPrefix(server.URL, "http://")+"/test/app", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	fetcher, err := newBlobFetcher(ctx, repo, remote.DefaultTransport)
+	if err != nil {
+		t.Fatalf("newBlobFetcher failed: %v", err)
+	}
+
+	reader, err := newResumableBlobReader(ctx, fetcher, registry.digest, int64(len(blob)))
+	if err != nil {
+		t.Fatalf("open blob failed: %v", err)
+	}
+	defer reader.Close()
+
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	if digest.FromBytes(got) != registry.digest {
+		t.Errorf("downloaded %d bytes with wrong content", len(got))
+	}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if registry.tokensIssued < 2 {
+		t.Errorf("tokens issued = %d, want a refresh", registry.tokensIssued)
+	}
+	if registry.rangeRequests != 1 {
+		t.Errorf("range requests = %d, want 1", registry.rangeRequests)
+	}
+}
+
+func TestResumableBlobReaderDetectsDigestMismatch(t *testing.T) {
+	blob := []byte("layer content")
+	registry := &fakeTokenRegistry{blob: blob, digest: digest.FromString("other content"), cutOff: true}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	repo, err := name.NewRepository(strings.TrimPrefix(server.URL, "http://")+"/test/app", name.Insecure)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	fetcher, err := newBlobFetcher(ctx, repo, remote.DefaultTransport)
+	if err != nil {
+		t.Fatalf("newBlobFetcher failed: %v", err)
+	}
+
+	reader, err := newResumableBlobReader(ctx, fetcher, registry.digest, int64(len(blob)))
+	if err != nil {
+		t.Fatalf("open blob failed: %v", err)
+	}
+	defer reader.Close()
+
+	if _, err := io.ReadAll(reader); err == nil {
+		t.Error("download with wrong digest succeeded")
+	}
+}
@@ -0,0 +1,221 @@
+package oci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// DefaultLayerCacheDir holds the cached layer blobs, one file per layer digest
+const DefaultLayerCacheDir = "/var/lib/walkio/cache/layers"
+
+// partialPrefix marks blobs still being downloaded, they are never served
+const partialPrefix = ".partial-"
+
+// partialMaxAge is how long a partial blob may go unwritten before it counts as
+// left behind by a crashed download and is pruned
+const partialMaxAge = time.Hour
+
+// LayerCache keeps compressed layer blobs on disk, so images sharing base layers
+// download them once. Blobs are stored under {dir}/{digest} after their digest
+// was verified. Serving a blob marks it as recently used, the least recently
+// used blobs are evicted once the cache grows beyond maxBytes.
+type LayerCache struct {
+	dir      string
+	maxBytes int64 // 0 is unbounded
+
+	// serializes eviction, concurrent downloads of one blob are harmless
+	mu sync.Mutex
+}
+
+// NewLayerCache creates the cache dir and removes stale partial blobs of
+// crashed downloads, maxBytes 0 disables eviction
+func NewLayerCache(dir string, maxBytes int64) (*LayerCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("layer cache: %w", err)
+	}
+
+	cache := &LayerCache{dir: dir, maxBytes: maxBytes}
+	if err := cache.PruneCache(math.MaxInt64); err != nil {
+		return nil, err
+	}
+
+	return cache, nil
+}
+
+// WrapLayers returns the layers with Compressed served from the cache
+func (c *LayerCache) WrapLayers(layers []Layer) []Layer {
+	wrapped := make([]Layer, len(layers))
+	for i, layer := range layers {
+		wrapped[i] = &cachedLayer{Layer: layer, cache: c}
+	}
+
+	return wrapped
+}
+
+// PruneCache removes the least recently used blobs until the cache holds at most
+// maxBytes and partial blobs not written for partialMaxAge
+func (c *LayerCache) PruneCache(maxBytes int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("prune layer cache: %w", err)
+	}
+
+	type blob struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var blobs []blob
+	var total int64
+	now := time.Now()
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		// downloads in progress keep writing, so only abandoned ones are old
+		if strings.HasPrefix(entry.Name(), partialPrefix) {
+			if now.Sub(info.ModTime()) < partialMaxAge {
+				continue
+			}
+			err := os.Remove(filepath.Join(c.dir, entry.Name()))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("prune layer cache: %w", err)
+			}
+			continue
+		}
+		blobs = append(blobs, blob{path: filepath.Join(c.dir, entry.Name()), size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+	}
+
+	slices.SortFunc(blobs, func(a, b blob) int { return a.modTime.Compare(b.modTime) })
+	for _, blob := range blobs {
+		if total <= maxBytes {
+			break
+		}
+		if err := os.Remove(blob.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("prune layer cache: %w", err)
+		}
+		total -= blob.size
+	}
+
+	return nil
+}
+
+func (c *LayerCache) blobPath(dgst digest.Digest) string {
+	return filepath.Join(c.dir, dgst.String())
+}
+
+// store moves a verified download into the cache and evicts down to maxBytes
+func (c *LayerCache) store(partialPath string, dgst digest.Digest) error {
+	if err := os.Rename(partialPath, c.blobPath(dgst)); err != nil {
+		return err
+	}
+	if c.maxBytes > 0 {
+		return c.PruneCache(c.maxBytes)
+	}
+
+	return nil
+}
+
+// cachedLayer serves Compressed from the cache and fills it on a miss
+type cachedLayer struct {
+	Layer
+	cache *LayerCache
+}
+
+// Compressed opens the cached blob. On a miss the upstream blob is written to
+// the cache while it is read, it is kept only if it was read completely and
+// matches the layer digest.
+func (l *cachedLayer) Compressed(ctx context.Context) (io.ReadCloser, error) {
+	dgst := l.Digest()
+	// nothing to key the blob with
+	if dgst.Validate() != nil {
+		return l.Layer.Compressed(ctx)
+	}
+
+	blobPath := l.cache.blobPath(dgst)
+	if blob, err := os.Open(blobPath); err == nil {
+		now := time.Now()
+		_ = os.Chtimes(blobPath, now, now)
+		return blob, nil
+	}
+
+	upstream, err := l.Layer.Compressed(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	partial, err := os.CreateTemp(l.cache.dir, partialPrefix+dgst.Encoded()+"-*")
+	if err != nil {
+		// a cache that can't be written is no reason to fail the build
+		return upstream, nil
+	}
+
+	return &cachingReader{
+		upstream: upstream,
+		partial:  partial,
+		verifier: dgst.Verifier(),
+		digest:   dgst,
+		cache:    l.cache,
+	}, nil
+}
+
+// cachingReader copies what is read from upstream into a partial blob
+type cachingReader struct {
+	upstream io.ReadCloser
+	partial  *os.File
+	verifier digest.Verifier
+	digest   digest.Digest
+	cache    *LayerCache
+	complete bool
+	failed   bool // the partial blob could not be written
+}
+
+func (r *cachingReader) Read(p []byte) (int, error) {
+	n, err := r.upstream.Read(p)
+	if n > 0 && !r.failed {
+		if _, writeErr := r.partial.Write(p[:n]); writeErr != nil {
+			r.failed = true
+		}
+		_, _ = r.verifier.Write(p[:n])
+	}
+	if errors.Is(err, io.EOF) {
+		r.complete = true
+	}
+
+	return n, err
+}
+
+// Close closes upstream and moves the blob into the cache if it is complete and verified
+func (r *cachingReader) Close() error {
+	err := r.upstream.Close()
+	closeErr := r.partial.Close()
+
+	if r.complete && !r.failed && closeErr == nil && r.verifier.Verified() {
+		// the download itself succeeded, a failed store only costs a later re-download
+		if r.cache.store(r.partial.Name(), r.digest) == nil {
+			return err
+		}
+	}
+
+	_ = os.Remove(r.partial.Name())
+	return err
+}
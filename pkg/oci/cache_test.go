@@ -0,0 +1,153 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// countingLayer serves data as its blob and counts how often it was opened
+type countingLayer struct {
+	digest digest.Digest
+	data   []byte
+	opened int
+}
+
+func newCountingLayer(content string) *countingLayer {
+	return &countingLayer{digest: digest.FromString(content), data: []byte(content)}
+}
+
+func (l *countingLayer) Digest() digest.Digest { return l.digest }
+func (l *countingLayer) Size() int64           { return int64(len(l.data)) }
+func (l *countingLayer) MediaType() string     { return "application/vnd.oci.image.layer.v1.tar" }
+
+func (l *countingLayer) Compressed(ctx context.Context) (io.ReadCloser, error) {
+	l.opened++
+	return io.NopCloser(bytes.NewReader(l.data)), nil
+}
+
+func readLayer(t *testing.T, layer Layer) []byte {
+	t.Helper()
+
+	reader, err := layer.Compressed(context.Background())
+	if err != nil {
+		t.Fatalf("Compressed failed: %v", err)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	return data
+}
+
+func TestLayerCacheMissThenHit(t *testing.T) {
+	cache, err := NewLayerCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := newCountingLayer("layer content")
+	for i := range 2 {
+		layer := cache.WrapLayers([]Layer{upstream})[0]
+		if got := readLayer(t, layer); string(got) != "layer content" {
+			t.Errorf("read %d = %q, want %q", i, got, "layer content")
+		}
+	}
+
+	if upstream.opened != 1 {
+		t.Errorf("upstream opened %d times, want 1", upstream.opened)
+	}
+	if _, err := os.Stat(cache.blobPath(upstream.digest)); err != nil {
+		t.Errorf("blob not cached: %v", err)
+	}
+}
+
+func TestLayerCacheSkipsBadDownloads(t *testing.T) {
+	cache, err := NewLayerCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt := newCountingLayer("layer content")
+	corrupt.data = []byte("tampered")
+	readLayer(t, cache.WrapLayers([]Layer{corrupt})[0])
+
+	partial := newCountingLayer("partially read")
+	reader, err := cache.WrapLayers([]Layer{partial})[0].Compressed(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.Read(make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	reader.Close()
+
+	entries, err := os.ReadDir(cache.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("cache holds %s after a corrupt and a partial download", entry.Name())
+	}
+}
+
+func TestLayerCachePruneOldest(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewLayerCache(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old, recent := newCountingLayer("old blob"), newCountingLayer("recent blob")
+	for _, layer := range cache.WrapLayers([]Layer{old, recent}) {
+		readLayer(t, layer)
+	}
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(cache.blobPath(old.digest), past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.PruneCache(recent.Size()); err != nil {
+		t.Fatalf("PruneCache failed: %v", err)
+	}
+	if _, err := os.Stat(cache.blobPath(old.digest)); !os.IsNotExist(err) {
+		t.Errorf("least recently used blob kept, stat error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, recent.digest.String())); err != nil {
+		t.Errorf("recent blob evicted: %v", err)
+	}
+}
+
+func TestLayerCachePrunesStalePartials(t *testing.T) {
+	dir := t.TempDir()
+	stale, fresh := filepath.Join(dir, partialPrefix+"stale-1"), filepath.Join(dir, partialPrefix+"fresh-2")
+	for _, path := range []string{stale, fresh} {
+		if err := os.WriteFile(path, []byte("partial"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// left behind by a download that crashed
+	past := time.Now().Add(-2 * partialMaxAge)
+	if err := os.Chtimes(stale, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewLayerCache(dir, 0); err != nil {
+		t.Fatalf("NewLayerCache failed: %v", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale partial blob kept, stat error = %v", err)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("partial blob of a running download removed: %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package oci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ChainProvider tries its sources in order (e.g. local cache, mirror, upstream registry)
+// and returns the image of the first one that succeeds.
+type ChainProvider struct {
+	sources []OciImageSource
+}
+
+func NewChainProvider(sources ...OciImageSource) *ChainProvider {
+	return &ChainProvider{sources: sources}
+}
+
+func (p *ChainProvider) Info() string {
+	infos := make([]string, len(p.sources))
+	for i, source := range p.sources {
+		infos[i] = source.Info()
+	}
+
+	return "chain(" + strings.Join(infos, " -> ") + ")"
+}
+
+// GetImage returns the image of the first source that provides it.
+// If all sources fail the errors of every source are joined.
+func (p *ChainProvider) GetImage(ctx context.Context) (*Image, error) {
+	if len(p.sources) == 0 {
+		return nil, errors.New("image source chain is empty")
+	}
+
+	var errs []error
+	for _, source := range p.sources {
+		image, err := source.GetImage(ctx)
+		if err == nil {
+			return image, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", source.Info(), err))
+
+		// the remaining sources would fail the same way
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, fmt.Errorf("no image source succeeded: %w", errors.Join(errs...))
+}
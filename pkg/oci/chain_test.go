@@ -0,0 +1,90 @@
+package oci
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type fakeImageSource struct {
+	info  string
+	err   error
+	calls int
+}
+
+func (s *fakeImageSource) Info() string {
+	return s.info
+}
+
+func (s *fakeImageSource) GetImage(ctx context.Context) (*Image, error) {
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	return NewNoOpImageProvider().GetImage(ctx)
+}
+
+func TestChainProviderFallsBack(t *testing.T) {
+	errCacheMiss := errors.New("not in cache")
+	cache := &fakeImageSource{info: "cache", err: errCacheMiss}
+	mirror := &fakeImageSource{info: "mirror"}
+	upstream := &fakeImageSource{info: "upstream"}
+
+	chain := NewChainProvider(cache, mirror, upstream)
+	image, err := chain.GetImage(context.Background())
+	if err != nil {
+		t.Fatalf("GetImage failed: %v", err)
+	}
+	if image == nil {
+		t.Fatal("GetImage returned no image")
+	}
+
+	if cache.calls != 1 || mirror.calls != 1 || upstream.calls != 0 {
+		t.Errorf("calls cache=%d mirror=%d upstream=%d, want 1 1 0", cache.calls, mirror.calls, upstream.calls)
+	}
+	if got, want := chain.Info(), "chain(cache -> mirror -> upstream)"; got != want {
+		t.Errorf("Info() = %q, want %q", got, want)
+	}
+}
+
+func TestChainProviderAllFail(t *testing.T) {
+	errCacheMiss := errors.New("not in cache")
+	errUnauthorized := errors.New("unauthorized")
+	chain := NewChainProvider(
+		&fakeImageSource{info: "cache", err: errCacheMiss},
+		&fakeImageSource{info: "upstream", err: errUnauthorized},
+	)
+
+	_, err := chain.GetImage(context.Background())
+	if err == nil {
+		t.Fatal("GetImage succeeded, want error")
+	}
+	for _, want := range []error{errCacheMiss, errUnauthorized} {
+		if !errors.Is(err, want) {
+			t.Errorf("error %v does not wrap %v", err, want)
+		}
+	}
+}
+
+func TestChainProviderStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	first := &fakeImageSource{info: "cache", err: context.Canceled}
+	second := &fakeImageSource{info: "upstream"}
+
+	_, err := NewChainProvider(first, second).GetImage(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("GetImage error = %v, want %v", err, context.Canceled)
+	}
+	if second.calls != 0 {
+		t.Errorf("source after cancellation called %d times", second.calls)
+	}
+}
+
+func TestChainProviderEmpty(t *testing.T) {
+	if _, err := NewChainProvider().GetImage(context.Background()); err == nil {
+		t.Error("GetImage on empty chain succeeded")
+	}
+}
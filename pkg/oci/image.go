@@ -1,6 +1,9 @@
 package oci
 
 import (
+	"fmt"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/opencontainers/go-digest"
 )
 
@@ -10,6 +13,16 @@ type Image struct {
 	Config   *ImageConfig
 	Layers   []Layer
 	Manifest *Manifest
+	Scratch  bool // the image is meant to have no layers, e.g. a test image
+}
+
+// String describes the image in one line for logs, e.g. "sha256:abc... (3 layers, linux/amd64)"
+func (i *Image) String() string {
+	if i.Config == nil || len(i.Config.Platform.OS) == 0 {
+		return fmt.Sprintf("%s (%d layers)", i.Digest, len(i.Layers))
+	}
+
+	return fmt.Sprintf("%s (%d layers, %s)", i.Digest, len(i.Layers), i.Config.Platform)
 }
 
 // ImageConfig contains OCI runtime configuration
@@ -19,7 +32,9 @@ type ImageConfig struct {
 	Env          []string
 	WorkingDir   string
 	User         string
-	ExposedPorts []string // OCI format: "80/tcp", "443/tcp", "53/udp"
+	ExposedPorts []string          // OCI format: "80/tcp", "443/tcp", "53/udp", sorted
+	Labels       map[string]string // image labels, e.g. org.opencontainers.image.source
+	Platform     Platform          // os/arch/variant the image config declares
 }
 
 // Manifest represents the OCI manifest
@@ -27,3 +42,49 @@ type Manifest struct {
 	MediaType string
 	Size      int64
 }
+
+// newImage reads digest, manifest and config of img, wrap turns its layers into
+// Layers with the access method of the provider
+func newImage(img v1.Image, wrap func(v1.Layer) Layer) (*Image, error) {
+	// Get the image digest (for cache key)
+	dgst, err := img.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("get image digest: %w", err)
+	}
+
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, fmt.Errorf("get manifest: %w", err)
+	}
+
+	config, err := parseImageConfig(img)
+	if err != nil {
+		return nil, fmt.Errorf("parse image config: %w", err)
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("get layers: %w", err)
+	}
+
+	wrappedLayers := make([]Layer, len(layers))
+	for i, layer := range layers {
+		wrappedLayers[i] = wrap(layer)
+	}
+
+	// Calculate manifest size from config descriptor
+	manifestSize := manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		manifestSize += layer.Size
+	}
+
+	return &Image{
+		Digest: digest.Digest(dgst.String()),
+		Config: config,
+		Layers: wrappedLayers,
+		Manifest: &Manifest{
+			MediaType: string(manifest.MediaType),
+			Size:      manifestSize,
+		},
+	}, nil
+}
@@ -0,0 +1,25 @@
+package oci
+
+import (
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestImageString(t *testing.T) {
+	dgst := digest.FromString("image")
+	image := &Image{
+		Digest: dgst,
+		Config: &ImageConfig{Platform: Platform{OS: "linux", Architecture: "arm64"}},
+		Layers: make([]Layer, 3),
+	}
+
+	if got, want := image.String(), dgst.String()+" (3 layers, linux/arm64)"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	image.Config = nil
+	if got, want := image.String(), dgst.String()+" (3 layers)"; got != want {
+		t.Errorf("String() without config = %q, want %q", got, want)
+	}
+}
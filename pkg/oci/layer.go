@@ -12,7 +12,7 @@ type Layer interface {
 	Digest() digest.Digest
 	Size() int64
 	MediaType() string
-	// Compressed returns a reader for the compressed (tar.gz) layer data
+	// Compressed returns a reader for the compressed layer data (tar, tar+gzip or tar+zstd per MediaType)
 	// The caller must close the reader when done
 	Compressed(ctx context.Context) (io.ReadCloser, error)
 }
@@ -0,0 +1,192 @@
+package oci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/opencontainers/go-digest"
+)
+
+// ErrRefNotFound is returned if an OCI layout has no manifest for the requested ref
+var ErrRefNotFound = errors.New("ref not found in OCI layout")
+
+const (
+	refNameAnnotation        = "org.opencontainers.image.ref.name"
+	containerdNameAnnotation = "io.containerd.image.name"
+)
+
+// TarballProvider reads an image from a tarball written by `docker save`,
+// for builds without registry access. The tarball has to hold a single image.
+type TarballProvider struct {
+	path string
+}
+
+func NewTarballProvider(path string) *TarballProvider {
+	return &TarballProvider{path: path}
+}
+
+func (p *TarballProvider) Info() string {
+	return "tarball:" + p.path
+}
+
+// GetImage reads manifest and config from the tarball, layers are read on Compressed()
+func (p *TarballProvider) GetImage(ctx context.Context) (*Image, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	img, err := tarball.ImageFromPath(p.path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("open tarball %s: %w", p.path, err)
+	}
+
+	return newImage(img, newLocalLayer)
+}
+
+// OCILayoutProvider reads an image from an OCI image layout directory, e.g.
+// written by `skopeo copy` or `docker buildx --output type=oci,tar=false`
+type OCILayoutProvider struct {
+	dir      string
+	ref      string   // ref name, full image name or digest of the manifest in index.json
+	platform Platform // platform selected if ref points to a manifest index
+}
+
+// NewOCILayoutProvider creates a provider for the manifest ref in dir. ref may
+// be empty if the layout holds a single manifest.
+func NewOCILayoutProvider(dir, ref string) *OCILayoutProvider {
+	return &OCILayoutProvider{dir: dir, ref: ref, platform: DefaultPlatform()}
+}
+
+func (p *OCILayoutProvider) Info() string {
+	if len(p.ref) == 0 {
+		return "oci:" + p.dir
+	}
+	return "oci:" + p.dir + ":" + p.ref
+}
+
+// GetImage resolves ref in the layout index, layers are read on Compressed()
+func (p *OCILayoutProvider) GetImage(ctx context.Context) (*Image, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	img, err := p.resolveImage()
+	if err != nil {
+		return nil, fmt.Errorf("open OCI layout %s: %w", p.dir, err)
+	}
+
+	return newImage(img, newLocalLayer)
+}
+
+func (p *OCILayoutProvider) resolveImage() (v1.Image, error) {
+	path, err := layout.FromPath(p.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := path.ImageIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("get index manifest: %w", err)
+	}
+
+	desc, err := p.findManifest(indexManifest.Manifests)
+	if err != nil {
+		return nil, err
+	}
+
+	if !desc.MediaType.IsIndex() {
+		return index.Image(desc.Digest)
+	}
+
+	// multi-arch image, pick the manifest for the platform like the registry provider
+	child, err := index.ImageIndex(desc.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("get image index: %w", err)
+	}
+
+	childManifest, err := child.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("get index manifest: %w", err)
+	}
+
+	match, err := selectPlatformManifest(childManifest.Manifests, p.platform)
+	if err != nil {
+		return nil, err
+	}
+
+	return child.Image(match.Digest)
+}
+
+func (p *OCILayoutProvider) findManifest(manifests []v1.Descriptor) (v1.Descriptor, error) {
+	if len(p.ref) == 0 {
+		if len(manifests) != 1 {
+			return v1.Descriptor{}, fmt.Errorf("layout holds %d manifests, a ref is required", len(manifests))
+		}
+		return manifests[0], nil
+	}
+
+	for _, desc := range manifests {
+		if desc.Digest.String() == p.ref ||
+			desc.Annotations[refNameAnnotation] == p.ref ||
+			desc.Annotations[containerdNameAnnotation] == p.ref {
+			return desc, nil
+		}
+	}
+
+	return v1.Descriptor{}, fmt.Errorf("%w: %s", ErrRefNotFound, p.ref)
+}
+
+// localLayer wraps a layer of a tarball or layout, the content is read from disk
+type localLayer struct {
+	layer v1.Layer
+}
+
+func newLocalLayer(layer v1.Layer) Layer {
+	return &localLayer{layer: layer}
+}
+
+func (l *localLayer) Digest() digest.Digest {
+	dgst, err := l.layer.Digest()
+	if err != nil {
+		return digest.Digest("")
+	}
+	return digest.Digest(dgst.String())
+}
+
+func (l *localLayer) Size() int64 {
+	size, err := l.layer.Size()
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
+func (l *localLayer) MediaType() string {
+	mediaType, err := l.layer.MediaType()
+	if err != nil {
+		return ""
+	}
+	return string(mediaType)
+}
+
+func (l *localLayer) Compressed(ctx context.Context) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	reader, err := l.layer.Compressed()
+	if err != nil {
+		return nil, fmt.Errorf("get compressed layer: %w", err)
+	}
+	return reader, nil
+}
@@ -0,0 +1,137 @@
+package oci
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+func randomImage(t *testing.T) v1.Image {
+	t.Helper()
+
+	img, err := random.Image(512, 2)
+	if err != nil {
+		t.Fatalf("random.Image failed: %v", err)
+	}
+	img, err = mutate.Config(img, v1.Config{Entrypoint: []string{"/app"}, User: "1000"})
+	if err != nil {
+		t.Fatalf("mutate.Config failed: %v", err)
+	}
+	return img
+}
+
+// checkImage compares the digest and config with want and reads every layer
+func checkImage(t *testing.T, got *Image, want v1.Image) {
+	t.Helper()
+
+	wantDigest, err := want.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Digest.String() != wantDigest.String() {
+		t.Errorf("Digest = %s, want %s", got.Digest, wantDigest)
+	}
+	if got.Config.User != "1000" || len(got.Config.Entrypoint) != 1 {
+		t.Errorf("Config = %+v, want the random image config", got.Config)
+	}
+	if len(got.Layers) != 2 {
+		t.Fatalf("got %d layers, want 2", len(got.Layers))
+	}
+
+	for _, layer := range got.Layers {
+		reader, err := layer.Compressed(context.Background())
+		if err != nil {
+			t.Fatalf("Compressed(%s) failed: %v", layer.Digest(), err)
+		}
+		n, err := io.Copy(io.Discard, reader)
+		reader.Close()
+		if err != nil || n != layer.Size() {
+			t.Errorf("read %d of %d bytes of %s: %v", n, layer.Size(), layer.Digest(), err)
+		}
+	}
+}
+
+func TestTarballProvider(t *testing.T) {
+	img := randomImage(t)
+	path := filepath.Join(t.TempDir(), "image.tar")
+	tag, err := name.NewTag("walkio/test:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tarball.WriteToFile(path, tag, img); err != nil {
+		t.Fatalf("WriteToFile failed: %v", err)
+	}
+
+	got, err := NewTarballProvider(path).GetImage(context.Background())
+	if err != nil {
+		t.Fatalf("GetImage failed: %v", err)
+	}
+	checkImage(t, got, img)
+
+	if _, err := NewTarballProvider(filepath.Join(t.TempDir(), "missing.tar")).GetImage(context.Background()); err == nil {
+		t.Error("GetImage of a missing tarball succeeded")
+	}
+}
+
+func TestOCILayoutProvider(t *testing.T) {
+	img := randomImage(t)
+	multiArch := randomImage(t)
+	dir := t.TempDir()
+
+	path, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatalf("layout.Write failed: %v", err)
+	}
+	if err := path.AppendImage(img, layout.WithAnnotations(map[string]string{refNameAnnotation: "v1"})); err != nil {
+		t.Fatalf("AppendImage failed: %v", err)
+	}
+	platform := DefaultPlatform().toV1()
+	index := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{
+		Add:        multiArch,
+		Descriptor: v1.Descriptor{Platform: &platform},
+	})
+	if err := path.AppendIndex(index, layout.WithAnnotations(map[string]string{containerdNameAnnotation: "docker.io/walkio/test:v2"})); err != nil {
+		t.Fatalf("AppendIndex failed: %v", err)
+	}
+	imgDigest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		ref  string
+		want v1.Image
+	}{
+		{name: "ref name", ref: "v1", want: img},
+		{name: "digest", ref: imgDigest.String(), want: img},
+		{name: "multi-arch by image name", ref: "docker.io/walkio/test:v2", want: multiArch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewOCILayoutProvider(dir, tt.ref).GetImage(context.Background())
+			if err != nil {
+				t.Fatalf("GetImage failed: %v", err)
+			}
+			checkImage(t, got, tt.want)
+		})
+	}
+
+	if _, err := NewOCILayoutProvider(dir, "v3").GetImage(context.Background()); !errors.Is(err, ErrRefNotFound) {
+		t.Errorf("GetImage of an unknown ref error = %v, want %v", err, ErrRefNotFound)
+	}
+	if _, err := NewOCILayoutProvider(dir, "").GetImage(context.Background()); err == nil {
+		t.Error("GetImage without ref succeeded for a layout with two manifests")
+	}
+}
@@ -0,0 +1,134 @@
+package oci
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+var ErrPlatformNotFound = errors.New("no manifest matches the requested platform")
+
+// Platform identifies the os/arch(/variant) an image is built for, e.g. linux/arm64/v8
+type Platform struct {
+	OS           string
+	Architecture string
+	Variant      string // optional (e.g. "v7" for arm, "v8" for arm64)
+}
+
+// DefaultPlatform returns linux with the architecture and, for arm, the variant
+// of the running host, so arm/v6 hosts don't pull arm/v7 images
+func DefaultPlatform() Platform {
+	return hostPlatform(runtime.GOARCH, buildSetting("GOARM"))
+}
+
+// hostPlatform builds the platform of a binary built for goarch and goarm
+func hostPlatform(goarch, goarm string) Platform {
+	return Platform{
+		OS:           "linux",
+		Architecture: goarch,
+		Variant:      defaultVariant(goarch, goarm),
+	}
+}
+
+// defaultVariant returns the variant of arch, goarm is the arm version like "7"
+// or "6,softfloat", Go builds arm for v7 if it is unset
+func defaultVariant(arch, goarm string) string {
+	switch arch {
+	case "arm64":
+		return "v8"
+	case "arm":
+		version, _, _ := strings.Cut(goarm, ",")
+		if len(version) == 0 {
+			version = "7"
+		}
+		return "v" + version
+	default:
+		return ""
+	}
+}
+
+// buildSetting returns a setting like GOARM the running binary was built with
+func buildSetting(key string) string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+
+	for _, setting := range info.Settings {
+		if setting.Key == key {
+			return setting.Value
+		}
+	}
+	return ""
+}
+
+// ParsePlatform parses a platform string in the form os/arch[/variant]
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return Platform{}, fmt.Errorf("invalid platform %q: expected os/arch[/variant]", s)
+	}
+
+	for _, part := range parts {
+		if len(part) == 0 {
+			return Platform{}, fmt.Errorf("invalid platform %q: empty component", s)
+		}
+	}
+
+	platform := Platform{
+		OS:           parts[0],
+		Architecture: parts[1],
+	}
+	if len(parts) == 3 {
+		platform.Variant = parts[2]
+	}
+
+	return platform, nil
+}
+
+func (p Platform) String() string {
+	if len(p.Variant) > 0 {
+		return p.OS + "/" + p.Architecture + "/" + p.Variant
+	}
+	return p.OS + "/" + p.Architecture
+}
+
+func (p Platform) toV1() v1.Platform {
+	return v1.Platform{
+		OS:           p.OS,
+		Architecture: p.Architecture,
+		Variant:      p.Variant,
+	}
+}
+
+// withDefaultVariant fills the variant an index may leave out, arm64 images
+// are v8 and arm images v7 unless they say otherwise
+func withDefaultVariant(p v1.Platform) v1.Platform {
+	if len(p.Variant) == 0 {
+		p.Variant = defaultVariant(p.Architecture, "")
+	}
+	return p
+}
+
+// selectPlatformManifest picks the descriptor of a manifest index matching the wanted platform.
+// A wanted variant has to match, entries without variant count as the default
+// variant of their architecture. If none matches the error lists all platforms the index provides.
+func selectPlatformManifest(manifests []v1.Descriptor, want Platform) (v1.Descriptor, error) {
+	available := make([]string, 0, len(manifests))
+	for _, desc := range manifests {
+		if desc.Platform == nil {
+			continue
+		}
+
+		if withDefaultVariant(*desc.Platform).Satisfies(want.toV1()) {
+			return desc, nil
+		}
+		available = append(available, desc.Platform.String())
+	}
+
+	return v1.Descriptor{}, fmt.Errorf("%w: wanted %s, available: [%s]", ErrPlatformNotFound, want, strings.Join(available, ", "))
+}
@@ -0,0 +1,196 @@
+package oci
+
+import (
+	"errors"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestParsePlatform(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    Platform
+		wantErr bool
+	}{
+		{
+			name:  "os and arch",
+			input: "linux/amd64",
+			want:  Platform{OS: "linux", Architecture: "amd64"},
+		},
+		{
+			name:  "with variant",
+			input: "linux/arm64/v8",
+			want:  Platform{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		},
+		{
+			name:    "missing arch",
+			input:   "linux",
+			wantErr: true,
+		},
+		{
+			name:    "empty component",
+			input:   "linux//v8",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePlatform(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePlatform() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if got != tt.want {
+				t.Errorf("ParsePlatform() = %+v, want %+v", got, tt.want)
+			}
+			if got.String() != tt.input {
+				t.Errorf("String() = %q, want %q", got.String(), tt.input)
+			}
+		})
+	}
+}
+
+func TestSelectPlatformManifest(t *testing.T) {
+	manifests := []v1.Descriptor{
+		{Digest: v1.Hash{Algorithm: "sha256", Hex: "amd64"}, Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}},
+		{Digest: v1.Hash{Algorithm: "sha256", Hex: "armv7"}, Platform: &v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+		{Digest: v1.Hash{Algorithm: "sha256", Hex: "arm64"}, Platform: &v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+		{Digest: v1.Hash{Algorithm: "sha256", Hex: "noplatform"}},
+	}
+
+	tests := []struct {
+		name    string
+		want    Platform
+		wantHex string
+		wantErr bool
+	}{
+		{
+			name:    "exact match",
+			want:    Platform{OS: "linux", Architecture: "amd64"},
+			wantHex: "amd64",
+		},
+		{
+			name:    "variant not requested matches any variant",
+			want:    Platform{OS: "linux", Architecture: "arm64"},
+			wantHex: "arm64",
+		},
+		{
+			name:    "variant requested",
+			want:    Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
+			wantHex: "armv7",
+		},
+		{
+			name:    "no match",
+			want:    Platform{OS: "linux", Architecture: "s390x"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selectPlatformManifest(manifests, tt.want)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectPlatformManifest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !errors.Is(err, ErrPlatformNotFound) {
+					t.Errorf("error = %v, want ErrPlatformNotFound", err)
+				}
+				if !contains(err.Error(), "linux/arm64/v8") {
+					t.Errorf("error %q should list available platforms", err)
+				}
+				return
+			}
+
+			if got.Digest.Hex != tt.wantHex {
+				t.Errorf("selected %s, want %s", got.Digest.Hex, tt.wantHex)
+			}
+		})
+	}
+}
+
+func TestWithPlatform(t *testing.T) {
+	want := Platform{OS: "linux", Architecture: "amd64"}
+	provider, err := NewRegistryProvider("nginx", WithPlatform(want))
+	if err != nil {
+		t.Fatalf("NewRegistryProvider failed: %v", err)
+	}
+
+	got := provider.(*RegistryProvider).platform
+	if got != want {
+		t.Errorf("platform = %+v, want %+v", got, want)
+	}
+}
+
+func TestHostPlatform(t *testing.T) {
+	tests := []struct {
+		goarch string
+		goarm  string
+		want   string
+	}{
+		{goarch: "amd64", want: "linux/amd64"},
+		{goarch: "arm64", want: "linux/arm64/v8"},
+		{goarch: "arm", goarm: "7", want: "linux/arm/v7"},
+		{goarch: "arm", goarm: "6,softfloat", want: "linux/arm/v6"},
+		{goarch: "arm", want: "linux/arm/v7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := hostPlatform(tt.goarch, tt.goarm).String(); got != tt.want {
+				t.Errorf("hostPlatform(%q, %q) = %s, want %s", tt.goarch, tt.goarm, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectPlatformManifestDefaultVariant(t *testing.T) {
+	// indexes often leave out the default variants arm/v7 and arm64/v8
+	manifests := []v1.Descriptor{
+		{Digest: v1.Hash{Algorithm: "sha256", Hex: "armv6"}, Platform: &v1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}},
+		{Digest: v1.Hash{Algorithm: "sha256", Hex: "armv7"}, Platform: &v1.Platform{OS: "linux", Architecture: "arm"}},
+		{Digest: v1.Hash{Algorithm: "sha256", Hex: "arm64"}, Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}},
+	}
+
+	tests := []struct {
+		want    Platform
+		wantHex string
+	}{
+		{want: Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, wantHex: "armv6"},
+		{want: Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, wantHex: "armv7"},
+		{want: Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, wantHex: "arm64"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want.String(), func(t *testing.T) {
+			got, err := selectPlatformManifest(manifests, tt.want)
+			if err != nil {
+				t.Fatalf("selectPlatformManifest() failed: %v", err)
+			}
+			if got.Digest.Hex != tt.wantHex {
+				t.Errorf("selected %s, want %s", got.Digest.Hex, tt.wantHex)
+			}
+		})
+	}
+
+	if _, err := selectPlatformManifest(manifests, Platform{OS: "linux", Architecture: "arm", Variant: "v5"}); !errors.Is(err, ErrPlatformNotFound) {
+		t.Errorf("arm/v5 error = %v, want ErrPlatformNotFound", err)
+	}
+}
+
+func TestWithVariant(t *testing.T) {
+	provider, err := NewRegistryProvider("nginx", WithPlatform(Platform{OS: "linux", Architecture: "arm"}), WithVariant("v6"))
+	if err != nil {
+		t.Fatalf("NewRegistryProvider failed: %v", err)
+	}
+
+	if got := provider.(*RegistryProvider).platform.String(); got != "linux/arm/v6" {
+		t.Errorf("platform = %s, want linux/arm/v6", got)
+	}
+}
@@ -2,10 +2,14 @@ package oci
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"runtime"
+	"net/http"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
@@ -13,6 +17,9 @@ import (
 	"github.com/opencontainers/go-digest"
 )
 
+// ErrDigestMismatch is returned if a reference pinned to a digest resolved to a different image
+var ErrDigestMismatch = errors.New("image digest does not match the pinned digest")
+
 // RegistryProvider fetches OCI images from a container registry using go-containerregistry.
 // It implements the ImageProvider interface.
 //
@@ -22,6 +29,48 @@ import (
 // from the registry. The actual layer content is not downloaded until Extract() is called.
 type RegistryProvider struct {
 	imageRef name.Reference // e.g., "nginx:latest" or "docker.io/nginx:latest"
+	platform Platform       // platform to select from multi-arch images (default linux/GOARCH)
+	retry    retryPolicy    // retries of transient errors of GetImage and layer downloads
+	insecure bool           // allow plain HTTP and unverified TLS
+	pinned   digest.Digest  // digest of a repo@sha256:... reference the fetched manifest must match
+	tag      string         // tag of a repo:tag@sha256:... reference, only shown by Info
+}
+
+// RegistryOption configures optional settings of a RegistryProvider
+type RegistryOption func(*RegistryProvider)
+
+// WithPlatform overrides the platform selected from multi-arch images,
+// e.g. to build a linux/amd64 app on an arm64 host.
+func WithPlatform(platform Platform) RegistryOption {
+	return func(p *RegistryProvider) {
+		p.platform = platform
+	}
+}
+
+// WithVariant overrides only the variant of the selected platform, e.g. "v6"
+// to pull arm/v6 images for a Raspberry Pi Zero
+func WithVariant(variant string) RegistryOption {
+	return func(p *RegistryProvider) {
+		p.platform.Variant = variant
+	}
+}
+
+// WithRetry sets how often GetImage and layer downloads are tried on transient
+// errors like timeouts or 5xx responses, and the backoff before the first retry.
+// The backoff doubles with each retry. attempts 1 disables retries.
+func WithRetry(attempts int, baseDelay time.Duration) RegistryOption {
+	return func(p *RegistryProvider) {
+		p.retry = retryPolicy{attempts: max(attempts, 1), baseDelay: baseDelay}
+	}
+}
+
+// WithInsecure allows pulling over plain HTTP and from registries with
+// self-signed certificates, e.g. a registry:2 container in CI. TLS with
+// verified certificates stays the default.
+func WithInsecure(insecure bool) RegistryOption {
+	return func(p *RegistryProvider) {
+		p.insecure = insecure
+	}
 }
 
 // NewRegistryProvider creates a new provider for the given image reference
@@ -30,7 +79,9 @@ type RegistryProvider struct {
 //   - "docker.io/nginx:latest"
 //   - "ghcr.io/owner/repo:tag"
 //   - "localhost:5000/image:tag"
-func NewRegistryProvider(imageRef string) (OciImageSource, error) {
+//   - "ghcr.io/owner/repo@sha256:..." (pinned, for reproducible builds)
+//   - "ghcr.io/owner/repo:tag@sha256:..." (fetched by the digest, the tag is ignored)
+func NewRegistryProvider(imageRef string, opts ...RegistryOption) (OciImageSource, error) {
 	// Add docker.io default if no registry specified
 	normalizedRef := imageRef
 	if !strings.Contains(imageRef, "/") {
@@ -40,79 +91,144 @@ func NewRegistryProvider(imageRef string) (OciImageSource, error) {
 		normalizedRef = "docker.io/" + imageRef
 	}
 
-	ref, err := name.ParseReference(normalizedRef)
+	provider := &RegistryProvider{
+		platform: DefaultPlatform(),
+		retry:    defaultRetryPolicy(),
+	}
+	for _, opt := range opts {
+		opt(provider)
+	}
+
+	var nameOpts []name.Option
+	if provider.insecure {
+		nameOpts = append(nameOpts, name.Insecure)
+	}
+	ref, pinned, tag, err := parseReference(normalizedRef, nameOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("invalid image reference: %w", err)
 	}
+	provider.imageRef = ref
+	provider.pinned = pinned
+	provider.tag = tag
 
-	return &RegistryProvider{
-		imageRef: ref,
-	}, nil
+	return provider, nil
+}
+
+// parseReference parses ref and returns the digest it is pinned to. References
+// with a digest are fetched by the digest, like docker does, the tag of a
+// "repo:tag@digest" reference is only returned for Info.
+func parseReference(ref string, opts ...name.Option) (name.Reference, digest.Digest, string, error) {
+	base, pinned, ok := strings.Cut(ref, "@")
+	if !ok {
+		parsed, err := name.ParseReference(ref, opts...)
+		return parsed, "", "", err
+	}
+
+	dgst, err := digest.Parse(pinned)
+	if err != nil {
+		return nil, "", "", err
+	}
+	// strict validation fails for a base without explicit tag
+	if tag, err := name.NewTag(base, append(opts, name.StrictValidation)...); err == nil {
+		return tag.Context().Digest(dgst.String()), dgst, tag.TagStr(), nil
+	}
+
+	parsed, err := name.NewDigest(ref, opts...)
+	return parsed, dgst, "", err
 }
 
 func (p *RegistryProvider) Info() string {
+	if len(p.tag) > 0 {
+		return p.imageRef.Context().Tag(p.tag).String() + "@" + p.pinned.String()
+	}
 	return p.imageRef.String()
 }
 
-// GetImage fetches the image from the registry and returns an Image with all layers
+// GetImage fetches the image from the registry and returns an Image with all layers.
+// Transient errors are retried as configured by WithRetry.
 func (p *RegistryProvider) GetImage(ctx context.Context) (*Image, error) {
-	platformStr := fmt.Sprintf("linux/%s", runtime.GOARCH)
-	platform, err := v1.ParsePlatform(platformStr)
-	if err != nil {
-		return nil, fmt.Errorf("could not parse platform: %w", err)
-	}
+	var image *Image
+	err := p.retry.do(ctx, func() error {
+		var err error
+		image, err = p.getImage(ctx)
+		return err
+	})
+
+	return image, err
+}
 
+func (p *RegistryProvider) getImage(ctx context.Context) (*Image, error) {
 	// Fetch the image from the registry
-	img, err := remote.Image(p.imageRef, remote.WithContext(ctx), remote.WithPlatform(*platform))
+	img, resolved, err := p.fetchImage(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("fetch image: %w", err)
 	}
+	// the digest of the index for multi-arch images, the one a pin refers to
+	if len(p.pinned) > 0 && resolved.String() != p.pinned.String() {
+		return nil, fmt.Errorf("%w: %s resolved to %s, pinned %s", ErrDigestMismatch, p.imageRef, resolved, p.pinned)
+	}
 
-	// Get the image digest (for cache key)
-	dgst, err := img.Digest()
+	// layer downloads bypass go-containerregistry to resume them with a fresh token
+	fetcher, err := newBlobFetcher(ctx, p.imageRef.Context(), p.transport())
 	if err != nil {
-		return nil, fmt.Errorf("get image digest: %w", err)
+		return nil, err
 	}
 
-	// Get the manifest
-	manifest, err := img.Manifest()
+	return newImage(img, func(layer v1.Layer) Layer {
+		return &registryLayer{layer: layer, fetcher: fetcher, retry: p.retry}
+	})
+}
+
+// fetchImage resolves the reference to a single image and returns it with the
+// digest the reference resolved to. If the reference points to a manifest index
+// the manifest matching the provider platform is selected.
+func (p *RegistryProvider) fetchImage(ctx context.Context) (v1.Image, v1.Hash, error) {
+	// retries are left to p.retry, so WithRetry is the only knob
+	noRetries := remote.WithRetryPredicate(func(error) bool { return false })
+	desc, err := remote.Get(p.imageRef,
+		remote.WithContext(ctx),
+		remote.WithPlatform(p.platform.toV1()),
+		remote.WithTransport(p.transport()),
+		noRetries,
+	)
 	if err != nil {
-		return nil, fmt.Errorf("get manifest: %w", err)
+		return nil, v1.Hash{}, err
 	}
 
-	// Parse the image config
-	config, err := parseImageConfig(img)
+	if !desc.MediaType.IsIndex() {
+		img, err := desc.Image()
+		return img, desc.Digest, err
+	}
+
+	index, err := desc.ImageIndex()
 	if err != nil {
-		return nil, fmt.Errorf("parse image config: %w", err)
+		return nil, v1.Hash{}, fmt.Errorf("get image index: %w", err)
 	}
 
-	// Get the layers
-	layers, err := img.Layers()
+	indexManifest, err := index.IndexManifest()
 	if err != nil {
-		return nil, fmt.Errorf("get layers: %w", err)
+		return nil, v1.Hash{}, fmt.Errorf("get index manifest: %w", err)
 	}
 
-	// Wrap layers with our Layer interface
-	wrappedLayers := make([]Layer, len(layers))
-	for i, layer := range layers {
-		wrappedLayers[i] = &registryLayer{layer: layer}
+	match, err := selectPlatformManifest(indexManifest.Manifests, p.platform)
+	if err != nil {
+		return nil, v1.Hash{}, err
 	}
 
-	// Calculate manifest size from config descriptor
-	manifestSize := manifest.Config.Size
-	for _, layer := range manifest.Layers {
-		manifestSize += layer.Size
+	img, err := index.Image(match.Digest)
+	return img, desc.Digest, err
+}
+
+// transport is remote.DefaultTransport, skipping certificate verification if insecure.
+// Plain HTTP is allowed by the insecure reference, its registry falls back to http.
+func (p *RegistryProvider) transport() http.RoundTripper {
+	if !p.insecure {
+		return remote.DefaultTransport
 	}
 
-	return &Image{
-		Digest: digest.Digest(dgst.String()),
-		Config: config,
-		Layers: wrappedLayers,
-		Manifest: &Manifest{
-			MediaType: string(manifest.MediaType),
-			Size:      manifestSize,
-		},
-	}, nil
+	insecure := remote.DefaultTransport.(*http.Transport).Clone()
+	insecure.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	return insecure
 }
 
 // parseImageConfig extracts the OCI config from the image
@@ -128,19 +244,35 @@ func parseImageConfig(img v1.Image) (*ImageConfig, error) {
 
 	cfg := cfgFile.Config
 
+	// the config holds a set, sorted they are stable across pulls
+	var exposedPorts []string
+	for port := range cfg.ExposedPorts {
+		exposedPorts = append(exposedPorts, port)
+	}
+	slices.Sort(exposedPorts)
+
 	return &ImageConfig{
-		Entrypoint: cfg.Entrypoint,
-		Cmd:        cfg.Cmd,
-		Env:        cfg.Env,
-		WorkingDir: cfg.WorkingDir,
-		User:       cfg.User,
+		Entrypoint:   cfg.Entrypoint,
+		Cmd:          cfg.Cmd,
+		Env:          cfg.Env,
+		WorkingDir:   cfg.WorkingDir,
+		User:         cfg.User,
+		ExposedPorts: exposedPorts,
+		Labels:       cfg.Labels,
+		Platform: Platform{
+			OS:           cfgFile.OS,
+			Architecture: cfgFile.Architecture,
+			Variant:      cfgFile.Variant,
+		},
 	}, nil
 }
 
 // registryLayer wraps a go-containerregistry layer to implement the Layer interface.
 // It provides lazy access to layer content - data is only downloaded when Extract() is called.
 type registryLayer struct {
-	layer v1.Layer
+	layer   v1.Layer
+	fetcher *blobFetcher
+	retry   retryPolicy
 }
 
 func (l *registryLayer) Digest() digest.Digest {
@@ -168,9 +300,16 @@ func (l *registryLayer) MediaType() string {
 	return string(mediaType)
 }
 
-// Compressed returns a reader for the compressed (tar.gz) layer data
+// Compressed returns a reader for the compressed layer data as stored in the registry.
+// Interrupted downloads are resumed, re-authenticating if the token expired.
+// Opening the download is retried on transient errors.
 func (l *registryLayer) Compressed(ctx context.Context) (io.ReadCloser, error) {
-	reader, err := l.layer.Compressed()
+	var reader *resumableBlobReader
+	err := l.retry.do(ctx, func() error {
+		var err error
+		reader, err = newResumableBlobReader(ctx, l.fetcher, l.Digest(), l.Size())
+		return err
+	})
 	if err != nil {
 		return nil, fmt.Errorf("get compressed layer: %w", err)
 	}
@@ -201,5 +340,6 @@ func (p *NoOpImageProvider) GetImage(ctx context.Context) (*Image, error) {
 		},
 		Layers:   []Layer{},
 		Manifest: &Manifest{MediaType: "application/vnd.oci.image.manifest.v1+json"},
+		Scratch:  true,
 	}, nil
 }
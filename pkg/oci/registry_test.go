@@ -2,7 +2,20 @@ package oci
 
 import (
 	"context"
+	"io"
+	"log"
+	"net/http/httptest"
+	"slices"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
 )
 
 func TestNewRegistryProvider(t *testing.T) {
@@ -37,6 +50,21 @@ func TestNewRegistryProvider(t *testing.T) {
 			input: "localhost:5000/myimage:latest",
 			want:  "localhost:5000/myimage:latest",
 		},
+		{
+			name:  "digest reference",
+			input: "nginx@sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+			want:  "docker.io/library/nginx@sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+		},
+		{
+			name:  "tag pinned to a digest",
+			input: "localhost:5000/myimage:v1@sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+			want:  "localhost:5000/myimage:v1@sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa",
+		},
+		{
+			name:    "malformed digest",
+			input:   "nginx@sha256:abc",
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -113,3 +141,151 @@ func contains(haystack, needle string) bool {
 	}
 	return false
 }
+
+func TestParseImageConfigPlatform(t *testing.T) {
+	img, err := mutate.ConfigFile(empty.Image, &v1.ConfigFile{
+		OS:           "linux",
+		Architecture: "arm",
+		Variant:      "v7",
+		Config:       v1.Config{Cmd: []string{"/app"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := parseImageConfig(img)
+	if err != nil {
+		t.Fatalf("parseImageConfig failed: %v", err)
+	}
+	if got := config.Platform.String(); got != "linux/arm/v7" {
+		t.Errorf("Platform = %s, want linux/arm/v7", got)
+	}
+}
+
+func TestParseImageConfigPortsAndLabels(t *testing.T) {
+	img, err := mutate.ConfigFile(empty.Image, &v1.ConfigFile{
+		Config: v1.Config{
+			ExposedPorts: map[string]struct{}{"8080/tcp": {}, "53/udp": {}, "443/tcp": {}},
+			Labels:       map[string]string{"org.opencontainers.image.source": "https://example.com/app"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := parseImageConfig(img)
+	if err != nil {
+		t.Fatalf("parseImageConfig failed: %v", err)
+	}
+	if want := []string{"443/tcp", "53/udp", "8080/tcp"}; !slices.Equal(config.ExposedPorts, want) {
+		t.Errorf("ExposedPorts = %v, want %v", config.ExposedPorts, want)
+	}
+	if got := config.Labels["org.opencontainers.image.source"]; got != "https://example.com/app" {
+		t.Errorf("source label = %q, want https://example.com/app", got)
+	}
+}
+
+func TestRegistryProviderInsecureScheme(t *testing.T) {
+	for _, insecure := range []bool{false, true} {
+		source, err := NewRegistryProvider("registry.ci:5000/app:latest", WithInsecure(insecure))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := "https"
+		if insecure {
+			want = "http"
+		}
+		if got := source.(*RegistryProvider).imageRef.Context().Registry.Scheme(); got != want {
+			t.Errorf("WithInsecure(%v) scheme = %s, want %s", insecure, got, want)
+		}
+	}
+}
+
+func TestRegistryProviderInsecureSelfSigned(t *testing.T) {
+	quiet := log.New(io.Discard, "", 0)
+	server := httptest.NewUnstartedServer(registry.New(registry.Logger(quiet)))
+	// the rejected handshakes are expected
+	server.Config.ErrorLog = quiet
+	server.StartTLS()
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "https://")
+	ref, err := name.ParseReference(host + "/test/app:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := randomImage(t)
+	if err := remote.Write(ref, img, remote.WithTransport(server.Client().Transport)); err != nil {
+		t.Fatalf("push image failed: %v", err)
+	}
+	ctx := context.Background()
+
+	verified, err := NewRegistryProvider(host+"/test/app:latest", WithRetry(1, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verified.GetImage(ctx); err == nil {
+		t.Error("GetImage trusted a self-signed certificate without WithInsecure")
+	}
+
+	insecure, err := NewRegistryProvider(host+"/test/app:latest", WithInsecure(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err := insecure.GetImage(ctx)
+	if err != nil {
+		t.Fatalf("GetImage with WithInsecure failed: %v", err)
+	}
+	checkImage(t, image, img)
+}
+
+func TestRegistryProviderPinnedDigest(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+
+	// localhost is served over plain http
+	repo := strings.Replace(server.URL, "http://127.0.0.1", "localhost", 1) + "/test/app"
+	pushed, other := randomImage(t), randomImage(t)
+	for tag, img := range map[string]v1.Image{"latest": pushed, "other": other} {
+		ref, err := name.ParseReference(repo + ":" + tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := remote.Write(ref, img); err != nil {
+			t.Fatalf("push image failed: %v", err)
+		}
+	}
+	pushedDigest, err := pushed.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherDigest, err := other.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for _, ref := range []string{repo + "@" + pushedDigest.String(), repo + ":latest@" + pushedDigest.String()} {
+		provider, err := NewRegistryProvider(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		image, err := provider.GetImage(ctx)
+		if err != nil {
+			t.Fatalf("GetImage(%s) failed: %v", ref, err)
+		}
+		checkImage(t, image, pushed)
+	}
+
+	// the digest wins over a tag pointing elsewhere, like with docker pull
+	moved, err := NewRegistryProvider(repo + ":latest@" + otherDigest.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err := moved.GetImage(ctx)
+	if err != nil {
+		t.Fatalf("GetImage of a moved tag failed: %v", err)
+	}
+	checkImage(t, image, other)
+}
@@ -0,0 +1,79 @@
+package oci
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// defaults of the registry retries, a pull is tried 4 times over about 3.5s
+const (
+	DefaultRetryAttempts  = 4
+	DefaultRetryBaseDelay = 500 * time.Millisecond
+)
+
+// maxRetryDelay caps the exponential backoff, overridden in tests
+var maxRetryDelay = 30 * time.Second
+
+// retryPolicy retries transient registry errors with exponential backoff
+type retryPolicy struct {
+	attempts  int           // total tries, 1 disables retries
+	baseDelay time.Duration // wait before the first retry, doubled for each further one
+}
+
+func defaultRetryPolicy() retryPolicy {
+	return retryPolicy{attempts: DefaultRetryAttempts, baseDelay: DefaultRetryBaseDelay}
+}
+
+// do runs fn until it succeeds, fails with a permanent error or the attempts
+// are used up. Waiting between attempts ends early when ctx is done.
+func (p retryPolicy) do(ctx context.Context, fn func() error) error {
+	delay := p.baseDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.attempts || !isTransient(err) {
+			return err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Join(err, ctx.Err())
+		case <-timer.C:
+		}
+
+		delay = min(2*delay, maxRetryDelay)
+	}
+}
+
+// isTransient reports errors worth another try: timeouts, broken connections
+// and registry responses 408, 429 and 5xx. Everything else, like 401, 404 or
+// an unparsable manifest, fails right away.
+func isTransient(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var transportErr *transport.Error
+	if errors.As(err, &transportErr) {
+		status := transportErr.StatusCode
+		return status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,159 @@
+package oci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "503", err: &transport.Error{StatusCode: http.StatusServiceUnavailable}, want: true},
+		{name: "429", err: fmt.Errorf("fetch: %w", &transport.Error{StatusCode: http.StatusTooManyRequests}), want: true},
+		{name: "connection reset", err: fmt.Errorf("read: %w", syscall.ECONNRESET), want: true},
+		{name: "unexpected EOF", err: io.ErrUnexpectedEOF, want: true},
+		{name: "401", err: &transport.Error{StatusCode: http.StatusUnauthorized}, want: false},
+		{name: "404", err: &transport.Error{StatusCode: http.StatusNotFound}, want: false},
+		{name: "cancelled", err: context.Canceled, want: false},
+		{name: "parse error", err: errors.New("invalid character in manifest"), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransient(tt.err); got != tt.want {
+				t.Errorf("isTransient(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	transient := &transport.Error{StatusCode: http.StatusBadGateway}
+	policy := retryPolicy{attempts: 3, baseDelay: time.Millisecond}
+
+	calls := 0
+	err := policy.do(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return transient
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("do() = %v after %d calls, want success after 3", err, calls)
+	}
+
+	calls = 0
+	err = policy.do(context.Background(), func() error { calls++; return transient })
+	if !errors.Is(err, transient) || calls != 3 {
+		t.Errorf("do() = %v after %d calls, want the transient error after 3", err, calls)
+	}
+
+	calls = 0
+	permanent := &transport.Error{StatusCode: http.StatusNotFound}
+	err = policy.do(context.Background(), func() error { calls++; return permanent })
+	if !errors.Is(err, permanent) || calls != 1 {
+		t.Errorf("do() = %v after %d calls, want the permanent error after 1", err, calls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls = 0
+	slow := retryPolicy{attempts: 3, baseDelay: time.Hour}
+	err = slow.do(ctx, func() error { calls++; return transient })
+	if !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Errorf("do() = %v after %d calls, want to stop waiting on a done ctx", err, calls)
+	}
+}
+
+// flakyRegistry fails the first failures requests to paths containing match with 503
+type flakyRegistry struct {
+	next     http.Handler
+	match    string
+	mu       sync.Mutex
+	failures int
+	requests int
+}
+
+func (f *flakyRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.Contains(r.URL.Path, f.match) && r.Method == http.MethodGet {
+		f.mu.Lock()
+		f.requests++
+		fail := f.failures > 0
+		f.failures--
+		f.mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}
+	f.next.ServeHTTP(w, r)
+}
+
+func TestRegistryProviderRetries(t *testing.T) {
+	flaky := &flakyRegistry{next: registry.New(registry.Logger(log.New(io.Discard, "", 0)))}
+	server := httptest.NewServer(flaky)
+	defer server.Close()
+
+	// localhost is served over plain http
+	host := strings.Replace(server.URL, "http://127.0.0.1", "localhost", 1)
+	ref, err := name.ParseReference(host + "/test/app:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(ref, randomImage(t)); err != nil {
+		t.Fatalf("push image failed: %v", err)
+	}
+
+	provider, err := NewRegistryProvider(host+"/test/app:latest", WithRetry(3, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	flaky.match, flaky.failures = "/manifests/", 2
+	image, err := provider.GetImage(ctx)
+	if err != nil {
+		t.Fatalf("GetImage with 2 failing manifest requests failed: %v", err)
+	}
+
+	flaky.match, flaky.failures = "/blobs/", 1
+	reader, err := image.Layers[0].Compressed(ctx)
+	if err != nil {
+		t.Fatalf("Compressed with a failing blob request failed: %v", err)
+	}
+	if _, err := io.Copy(io.Discard, reader); err != nil {
+		t.Errorf("read layer failed: %v", err)
+	}
+	reader.Close()
+
+	missing, err := NewRegistryProvider(host+"/test/app:missing", WithRetry(3, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	flaky.match, flaky.failures, flaky.requests = "/manifests/", 0, 0
+	if _, err := missing.GetImage(ctx); err == nil {
+		t.Fatal("GetImage of a missing tag succeeded")
+	}
+	if flaky.requests != 1 {
+		t.Errorf("missing tag was requested %d times, want 1", flaky.requests)
+	}
+}
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidSize = errors.New("invalid size")
+
+// Bytes is a size in bytes. Units are binary, so MB matches the MiB of the VMMs.
+type Bytes int64
+
+const (
+	B  Bytes = 1
+	KB       = 1024 * B
+	MB       = 1024 * KB
+	GB       = 1024 * MB
+	TB       = 1024 * GB
+)
+
+// MB returns the size in whole MB, rounded down
+func (b Bytes) MB() int64 {
+	return int64(b / MB)
+}
+
+// GB returns the size in whole GB, rounded down
+func (b Bytes) GB() int64 {
+	return int64(b / GB)
+}
+
+// String formats the size in the largest unit that represents it exactly, e.g. "256M"
+func (b Bytes) String() string {
+	for _, unit := range []struct {
+		size   Bytes
+		suffix string
+	}{{TB, "T"}, {GB, "G"}, {MB, "M"}, {KB, "K"}} {
+		if b != 0 && b%unit.size == 0 {
+			return strconv.FormatInt(int64(b/unit.size), 10) + unit.suffix
+		}
+	}
+
+	return strconv.FormatInt(int64(b), 10)
+}
+
+// ParseBytes parses a size like "512", "256M", "2G" or "2GiB".
+// Units are binary and case insensitive, a trailing "B" or "iB" is optional.
+func ParseBytes(s string) (Bytes, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	value = strings.TrimSuffix(value, "IB")
+	value = strings.TrimSuffix(value, "B")
+
+	unit := B
+	if len(value) > 0 {
+		switch value[len(value)-1] {
+		case 'K':
+			unit = KB
+		case 'M':
+			unit = MB
+		case 'G':
+			unit = GB
+		case 'T':
+			unit = TB
+		}
+		if unit != B {
+			value = value[:len(value)-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidSize, s)
+	}
+	if n > math.MaxInt64/int64(unit) {
+		return 0, fmt.Errorf("%w: %q overflows", ErrInvalidSize, s)
+	}
+
+	return Bytes(n) * unit, nil
+}
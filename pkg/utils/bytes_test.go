@@ -0,0 +1,82 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Bytes
+	}{
+		{input: "0", want: 0},
+		{input: "512", want: 512},
+		{input: "512B", want: 512},
+		{input: "4k", want: 4 * KB},
+		{input: "256M", want: 256 * MB},
+		{input: "256MB", want: 256 * MB},
+		{input: "256MiB", want: 256 * MB},
+		{input: " 2G ", want: 2 * GB},
+		{input: "2gib", want: 2 * GB},
+		{input: "1T", want: TB},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseBytes(tt.input)
+			if err != nil {
+				t.Fatalf("ParseBytes(%q) failed: %v", tt.input, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseBytes(%q) = %d, want %d", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseBytesInvalid(t *testing.T) {
+	for _, input := range []string{"", "M", "-1M", "1.5G", "12X", "9999999999T"} {
+		if _, err := ParseBytes(input); !errors.Is(err, ErrInvalidSize) {
+			t.Errorf("ParseBytes(%q) error = %v, want %v", input, err, ErrInvalidSize)
+		}
+	}
+}
+
+func TestBytesRoundTrip(t *testing.T) {
+	for _, size := range []Bytes{0, 1, 1000, KB, 1536 * KB, 256 * MB, 1536 * MB, 2 * GB, 3 * TB} {
+		parsed, err := ParseBytes(size.String())
+		if err != nil {
+			t.Fatalf("ParseBytes(%q) failed: %v", size.String(), err)
+		}
+		if parsed != size {
+			t.Errorf("ParseBytes(%q) = %d, want %d", size.String(), parsed, size)
+		}
+	}
+}
+
+func TestBytesConversion(t *testing.T) {
+	tests := []struct {
+		size   Bytes
+		wantMB int64
+		wantGB int64
+		wantS  string
+	}{
+		{size: 512 * KB, wantMB: 0, wantGB: 0, wantS: "512K"},
+		{size: 256 * MB, wantMB: 256, wantGB: 0, wantS: "256M"},
+		{size: 1536 * MB, wantMB: 1536, wantGB: 1, wantS: "1536M"},
+		{size: 2 * GB, wantMB: 2048, wantGB: 2, wantS: "2G"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.size.MB(); got != tt.wantMB {
+			t.Errorf("%d.MB() = %d, want %d", tt.size, got, tt.wantMB)
+		}
+		if got := tt.size.GB(); got != tt.wantGB {
+			t.Errorf("%d.GB() = %d, want %d", tt.size, got, tt.wantGB)
+		}
+		if got := tt.size.String(); got != tt.wantS {
+			t.Errorf("String() = %q, want %q", got, tt.wantS)
+		}
+	}
+}
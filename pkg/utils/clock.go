@@ -0,0 +1,27 @@
+package utils
+
+import "time"
+
+// Clock tells the time. Code that stamps builds takes a Clock, so tests can
+// freeze time and reproducible builds can use a fixed one.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the wall clock
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// FixedClock always returns T, e.g. time.Unix(0, 0) for reproducible builds
+type FixedClock struct {
+	T time.Time
+}
+
+func (c FixedClock) Now() time.Time {
+	return c.T
+}
@@ -1,6 +1,14 @@
 package utils
 
-import "github.com/google/uuid"
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+)
 
 func NewUUID7() (string, error) {
 	id, err := uuid.NewV7()
@@ -10,3 +18,26 @@ func NewUUID7() (string, error) {
 
 	return id.String(), nil
 }
+
+// NewUUID7At returns a version 7 UUID for the millisecond of now with its
+// random bits read from entropy (crypto/rand if nil). A fixed time and entropy
+// give the same ID every time.
+func NewUUID7At(now time.Time, entropy io.Reader) (string, error) {
+	if entropy == nil {
+		entropy = rand.Reader
+	}
+
+	var id uuid.UUID
+	if _, err := io.ReadFull(entropy, id[6:]); err != nil {
+		return "", fmt.Errorf("uuid entropy: %w", err)
+	}
+
+	// 48 bit unix milliseconds, then version and variant bits
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(now.UnixMilli()))
+	copy(id[:6], ms[2:])
+	id[6] = id[6]&0x0f | 0x70
+	id[8] = id[8]&0x3f | 0x80
+
+	return id.String(), nil
+}
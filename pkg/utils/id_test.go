@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestNewUUID7At(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	entropy := bytes.Repeat([]byte{0xab}, 20)
+
+	first, err := NewUUID7At(now, bytes.NewReader(entropy))
+	if err != nil {
+		t.Fatalf("NewUUID7At failed: %v", err)
+	}
+	second, err := NewUUID7At(now, bytes.NewReader(entropy))
+	if err != nil {
+		t.Fatalf("NewUUID7At failed: %v", err)
+	}
+	if first != second {
+		t.Errorf("same time and entropy gave %s and %s", first, second)
+	}
+
+	id, err := uuid.Parse(first)
+	if err != nil {
+		t.Fatalf("%s is no UUID: %v", first, err)
+	}
+	if id.Version() != 7 || id.Variant() != uuid.RFC4122 {
+		t.Errorf("%s has version %d and variant %s, want 7 and RFC4122", first, id.Version(), id.Variant())
+	}
+
+	later, err := NewUUID7At(now.Add(time.Millisecond), nil)
+	if err != nil {
+		t.Fatalf("NewUUID7At failed: %v", err)
+	}
+	if later <= first {
+		t.Errorf("ID of a later time %s does not sort after %s", later, first)
+	}
+
+	if _, err := NewUUID7At(now, bytes.NewReader(nil)); err == nil {
+		t.Error("NewUUID7At succeeded without entropy")
+	}
+}
+
+func TestFixedClock(t *testing.T) {
+	fixed := time.Unix(0, 0)
+	clock := FixedClock{T: fixed}
+	if !clock.Now().Equal(fixed) || !clock.Now().Equal(clock.Now()) {
+		t.Errorf("FixedClock.Now() = %v, want %v", clock.Now(), fixed)
+	}
+}
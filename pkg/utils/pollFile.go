@@ -2,13 +2,21 @@ package utils
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"io"
 	"os"
 	"time"
 )
 
-func TailPollUntilIdle(path string, out io.Writer, idle, pollEvery time.Duration) (err error) {
+// TailPollUntilIdle copies the lines of the file at path to out as they are
+// written, until nothing was written for idle. The file is polled every pollEvery.
+func TailPollUntilIdle(path string, out io.Writer, idle, pollEvery time.Duration) error {
+	return TailPollUntilIdleContext(context.Background(), path, out, idle, pollEvery)
+}
+
+// TailPollUntilIdleContext is TailPollUntilIdle that also stops with ctx.Err() once ctx is done
+func TailPollUntilIdleContext(ctx context.Context, path string, out io.Writer, idle, pollEvery time.Duration) (err error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return err
@@ -34,7 +42,11 @@ func TailPollUntilIdle(path string, out io.Writer, idle, pollEvery time.Duration
 				return nil
 			}
 
-			time.Sleep(pollEvery)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(pollEvery):
+			}
 			continue
 		}
 
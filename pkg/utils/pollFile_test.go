@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTailPollUntilIdleFollowsWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "console.log")
+	if err := os.WriteFile(path, []byte("boot\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		_, _ = f.WriteString("init started\n")
+	}()
+
+	var out bytes.Buffer
+	if err := TailPollUntilIdle(path, &out, 300*time.Millisecond, 10*time.Millisecond); err != nil {
+		t.Fatalf("TailPollUntilIdle failed: %v", err)
+	}
+	if got, want := out.String(), "boot\ninit started\n"; got != want {
+		t.Errorf("tailed %q, want %q", got, want)
+	}
+}
+
+func TestTailPollUntilIdleContextCancel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "console.log")
+	if err := os.WriteFile(path, []byte("boot\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	var out bytes.Buffer
+	err := TailPollUntilIdleContext(ctx, path, &out, time.Minute, 10*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("TailPollUntilIdleContext error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("cancelled tail took %v", time.Since(start))
+	}
+	if out.String() != "boot\n" {
+		t.Errorf("tailed %q, want %q", out.String(), "boot\n")
+	}
+}